@@ -0,0 +1,248 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	schemeHTTP  = "http"
+	schemeHTTPS = "https"
+)
+
+const (
+	ipVersionAuto = "auto"
+	ipVersion4    = "4"
+	ipVersion6    = "6"
+)
+
+// parseIPAddress returns the IP of addresses like '10.0.0.2',
+// '10.0.0.2:9000', 'fe80::1%en0' and '[fe80::1%en0]:9000'. It returns nil
+// if the address doesn't contain an IP.
+func parseIPAddress(address string) net.IP {
+	host := address
+	if h, _, err := net.SplitHostPort(address); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		host = host[:i]
+	}
+	return net.ParseIP(host)
+}
+
+// stripScheme returns the host and port of a device URL. Addresses without
+// a scheme are returned as they are.
+func stripScheme(address string) string {
+	if i := strings.Index(address, "://"); i >= 0 {
+		address = strings.TrimSuffix(address[i+len("://"):], "/")
+	}
+	return address
+}
+
+// addressPort returns the port of an address or device URL, or the empty
+// string if it doesn't have one.
+func addressPort(address string) string {
+	if _, port, err := net.SplitHostPort(stripScheme(address)); err == nil {
+		return port
+	}
+	return ""
+}
+
+// hostWithPort adds the HTTP port of Jaguar to an address without a port.
+// IPv6 literals are put in brackets, so 'fe80::1%en0' becomes
+// '[fe80::1%en0]:9000'.
+func hostWithPort(address string) string {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+	return net.JoinHostPort(host, fmt.Sprint(scanHttpPort))
+}
+
+// deviceURL returns the base URL of the device at the given address. The
+// address may already be a URL, like the addresses reported by devices.
+func deviceURL(address string) string {
+	if strings.HasPrefix(address, schemeHTTP+"://") || strings.HasPrefix(address, schemeHTTPS+"://") {
+		return address
+	}
+	u := url.URL{
+		Scheme: schemeHTTP,
+		Host:   hostWithPort(address),
+	}
+	return u.String()
+}
+
+// withScheme replaces the scheme of a device URL. An empty scheme leaves
+// the URL as it is.
+func withScheme(address string, scheme string) string {
+	if scheme == "" {
+		return address
+	}
+	u, err := url.Parse(address)
+	if err != nil || u.Host == "" {
+		return address
+	}
+	u.Scheme = scheme
+	return u.String()
+}
+
+// isRoutableAddress returns false if a device URL is empty or has a host
+// that other machines can't reach the device on, like '0.0.0.0' or a
+// loopback address.
+func isRoutableAddress(address string) bool {
+	u, err := url.Parse(deviceURL(address))
+	if err != nil || u.Hostname() == "" {
+		return false
+	}
+	ip := parseIPAddress(u.Hostname())
+	if ip == nil {
+		// Host names are resolved later.
+		return true
+	}
+	return !ip.IsUnspecified() && !ip.IsLoopback()
+}
+
+// withPort returns the base URL of the device at the given address with
+// the port replaced. Addresses without a host are returned as they are.
+func withPort(address string, port int) string {
+	u, err := url.Parse(deviceURL(address))
+	if err != nil || u.Hostname() == "" {
+		return address
+	}
+	u.Host = net.JoinHostPort(u.Hostname(), fmt.Sprint(port))
+	return u.String()
+}
+
+// sourceURL returns the device URL with the host replaced by the IP of
+// the source of a broadcast. The port of the address is kept if it has
+// one. Otherwise the port the device reported is used, if it isn't 0.
+func sourceURL(address string, reportedPort int, source *net.UDPAddr) string {
+	port := fmt.Sprint(scanHttpPort)
+	if reportedPort != 0 {
+		port = fmt.Sprint(reportedPort)
+	}
+	scheme := schemeHTTP
+	if u, err := url.Parse(address); err == nil && u.Host != "" {
+		if p := u.Port(); p != "" {
+			port = p
+		}
+		scheme = u.Scheme
+	}
+	u := url.URL{
+		Scheme: scheme,
+		Host:   net.JoinHostPort(source.IP.String(), port),
+	}
+	return u.String()
+}
+
+// interfaceNetworks returns the network interface with the given name and
+// the networks of its addresses.
+func interfaceNetworks(name string) (*net.Interface, []*net.IPNet, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("no network interface called '%s' (see 'jag scan --list-interfaces')", name)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, nil, err
+	}
+	var networks []*net.IPNet
+	for _, addr := range addrs {
+		if network, ok := addr.(*net.IPNet); ok {
+			networks = append(networks, network)
+		}
+	}
+	if len(networks) == 0 {
+		return nil, nil, fmt.Errorf("network interface '%s' has no addresses", name)
+	}
+	return iface, networks, nil
+}
+
+// withZone adds the zone of the source to a link-local IPv6 device address.
+// Without the zone, the address can't be dialed later.
+func withZone(address string, source *net.UDPAddr) string {
+	if source.Zone == "" {
+		return address
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return address
+	}
+	// Addresses that already have a zone don't parse as an IP.
+	ip := net.ParseIP(u.Hostname())
+	if ip == nil || ip.To4() != nil || !ip.IsLinkLocalUnicast() {
+		return address
+	}
+	host := u.Hostname() + "%" + source.Zone
+	if port := u.Port(); port != "" {
+		u.Host = net.JoinHostPort(host, port)
+	} else {
+		u.Host = "[" + host + "]"
+	}
+	return u.String()
+}
+
+// joinURLPath appends the path to the base URL with exactly one slash
+// between them.
+func joinURLPath(base string, path string) string {
+	return strings.TrimRight(base, "/") + "/" + strings.TrimLeft(path, "/")
+}
+
+// isHTTPMethod returns true if the method is one of the standard HTTP
+// methods.
+func isHTTPMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// broadcastAddress returns the broadcast address of an IPv4 network, or nil
+// for other networks.
+func broadcastAddress(network *net.IPNet) net.IP {
+	ip := network.IP.To4()
+	if ip == nil || len(network.Mask) != net.IPv4len {
+		return nil
+	}
+	res := make(net.IP, net.IPv4len)
+	for i := range ip {
+		res[i] = ip[i] | ^network.Mask[i]
+	}
+	return res
+}
+
+// ipv4Interfaces returns the names of the network interfaces that are up,
+// have an IPv4 address and aren't loopback interfaces.
+func ipv4Interfaces() ([]string, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if network, ok := addr.(*net.IPNet); ok && network.IP.To4() != nil {
+				res = append(res, iface.Name)
+				break
+			}
+		}
+	}
+	return res, nil
+}
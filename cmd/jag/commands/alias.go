@@ -0,0 +1,230 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/toitlang/jaguar/cmd/jag/directory"
+)
+
+// aliasesCfgKey holds the device aliases in the device config, e.g.
+// 'aliases.<alias>: <id>'. The config keys aren't case sensitive, so the
+// aliases are stored in lowercase.
+const aliasesCfgKey = "aliases"
+
+func AliasCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "alias",
+		Short: "Manage aliases for Jaguar devices",
+		Long: "Manage aliases for Jaguar devices.\n" +
+			"An alias can be used instead of the name or ID of the device when\n" +
+			"selecting it, e.g. 'jag scan <alias>' or 'jag run -d <alias>'.",
+	}
+
+	cmd.AddCommand(
+		AliasSetCmd(),
+		AliasListCmd(),
+		AliasRemoveCmd(),
+	)
+	return cmd
+}
+
+func AliasSetCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "set <alias> <id>",
+		Short:        "Make the alias refer to the device with the given ID",
+		Args:         cobra.ExactArgs(2),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := directory.GetDeviceConfig()
+			if err != nil {
+				return err
+			}
+
+			alias, id := strings.ToLower(args[0]), args[1]
+			if err := setAlias(cfg, alias, id); err != nil {
+				return err
+			}
+			if err := cfg.WriteConfig(); err != nil {
+				return err
+			}
+			fmt.Printf("Alias '%s' now refers to device '%s'\n", alias, id)
+			return nil
+		},
+	}
+	return cmd
+}
+
+func AliasRemoveCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "rm <alias>",
+		Short:        "Remove an alias",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := directory.GetDeviceConfig()
+			if err != nil {
+				return err
+			}
+
+			alias := strings.ToLower(args[0])
+			aliases, ok := cfg.Get(aliasesCfgKey).(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("no such alias: '%s'", alias)
+			}
+			if _, ok := aliases[alias]; !ok {
+				return fmt.Errorf("no such alias: '%s'", alias)
+			}
+			delete(aliases, alias)
+			return cfg.WriteConfig()
+		},
+	}
+	return cmd
+}
+
+func AliasListCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the aliases",
+		Long: "List the aliases and the devices they refer to.\n" +
+			"With '--scan', scan for devices and show which of the aliased\n" +
+			"devices are reachable.",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := directory.GetDeviceConfig()
+			if err != nil {
+				return err
+			}
+
+			scan, err := cmd.Flags().GetBool("scan")
+			if err != nil {
+				return err
+			}
+
+			aliases := getAliases(cfg)
+			if len(aliases) == 0 {
+				fmt.Println("No aliases, use 'jag alias set' to add one")
+				return nil
+			}
+
+			names := map[string]string{}
+			known, err := getKnownDevices(cfg)
+			if err != nil {
+				return err
+			}
+			for _, d := range known {
+				names[d.ID] = d.Name
+			}
+
+			var reachable map[string]bool
+			if scan {
+				devices, err := scanDevices(cmd.Context(), nil, defaultScanOptions())
+				if err != nil {
+					return err
+				}
+				reachable = map[string]bool{}
+				for _, d := range devices {
+					reachable[d.ID] = true
+					names[d.ID] = d.Name
+				}
+			}
+
+			var sorted []string
+			aliasLength := len("ALIAS")
+			idLength := len("ID")
+			nameLength := len("NAME")
+			for alias, id := range aliases {
+				sorted = append(sorted, alias)
+				aliasLength = max(aliasLength, len(alias))
+				idLength = max(idLength, len(id))
+				nameLength = max(nameLength, len(names[id]))
+			}
+			sort.Strings(sorted)
+
+			header := padded("ALIAS", aliasLength) + padded("ID", idLength)
+			if scan {
+				header += padded("NAME", nameLength) + "STATUS"
+			} else {
+				header += "NAME"
+			}
+			fmt.Println(header)
+			for _, alias := range sorted {
+				id := aliases[alias]
+				line := padded(alias, aliasLength) + padded(id, idLength)
+				if scan {
+					status := "unreachable"
+					if reachable[id] {
+						status = "reachable"
+					}
+					line += padded(names[id], nameLength) + status
+				} else {
+					line += names[id]
+				}
+				fmt.Println(line)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().Bool("scan", false, "if set, scan for devices and show which aliased devices are reachable")
+	return cmd
+}
+
+// setAlias makes the alias refer to the device with the given ID. The
+// caller writes the config.
+func setAlias(cfg *viper.Viper, alias string, id string) error {
+	if alias == "" || strings.ContainsAny(alias, ". ") {
+		return fmt.Errorf("the alias '%s' must be non-empty and can't contain dots or spaces", alias)
+	}
+	if _, ok := parseDeviceSelection(id).(deviceIDSelect); !ok {
+		return fmt.Errorf("'%s' is not a valid device ID", id)
+	}
+	cfg.Set(aliasesCfgKey+"."+alias, id)
+	return nil
+}
+
+// aliasOf returns the alias of the device with the given ID, or the empty
+// string if it has none. If the device has several aliases, the first in
+// alphabetical order is used.
+func aliasOf(aliases map[string]string, id string) string {
+	res := ""
+	for alias, aliasID := range aliases {
+		if aliasID == id && (res == "" || alias < res) {
+			res = alias
+		}
+	}
+	return res
+}
+
+// applyAliases sets the alias of the devices that have one.
+func applyAliases(aliases map[string]string, devices []Device) {
+	for i := range devices {
+		devices[i].Alias = aliasOf(aliases, devices[i].ID)
+	}
+}
+
+// getAliases returns the aliases and the IDs of the devices they refer to.
+func getAliases(cfg *viper.Viper) map[string]string {
+	return cfg.GetStringMapString(aliasesCfgKey)
+}
+
+// resolveAlias turns a selection by name into a selection by ID if the
+// name is an alias.
+func resolveAlias(aliases map[string]string, ds deviceSelect) deviceSelect {
+	name, ok := ds.(deviceNameSelect)
+	if !ok {
+		return ds
+	}
+	if id, ok := aliases[strings.ToLower(string(name))]; ok {
+		return deviceIDSelect(id)
+	}
+	return ds
+}
@@ -0,0 +1,182 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/toitlang/jaguar/cmd/jag/directory"
+)
+
+// newSecret returns a random shared secret for a device.
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+var (
+	requestCounterMutex sync.Mutex
+	lastRequestCounter  int64
+)
+
+// nextRequestCounter returns the counter for the next signed request. The
+// counters increase with the clock, so they keep increasing when jag is
+// run again, and they are always after the given counter.
+func nextRequestCounter(after int64) int64 {
+	requestCounterMutex.Lock()
+	defer requestCounterMutex.Unlock()
+	counter := time.Now().UnixNano()
+	if counter <= lastRequestCounter {
+		counter = lastRequestCounter + 1
+	}
+	if counter <= after {
+		counter = after + 1
+	}
+	lastRequestCounter = counter
+	return counter
+}
+
+// staleRequestCounter returns the last counter accepted by the device, if
+// it rejected the request because its counter wasn't after that one.
+func staleRequestCounter(res *http.Response, counter int64) (int64, bool) {
+	if res.StatusCode != http.StatusUnauthorized {
+		return 0, false
+	}
+	last, err := strconv.ParseInt(res.Header.Get(JaguarRequestCounterHeader), 10, 64)
+	if err != nil || counter > last {
+		return 0, false
+	}
+	return last, true
+}
+
+// signRequest signs the request and its body with the shared secret of the
+// device. The request must have all its other headers. The signature covers
+// the method, the path and all the X-Jaguar-* headers, which include a
+// timestamp, the counter and the SHA-256 of the body, so the device can
+// check that the request came from someone who knows the secret and wasn't
+// changed on the way. The device only accepts a counter that is after the
+// ones it has seen, so the request can't be sent again, even if the device
+// doesn't know what time it is. The device does the same computation in
+// src/auth.toit.
+func signRequest(req *http.Request, secret string, body []byte, counter int64) {
+	digest := sha256.Sum256(body)
+	req.Header.Set(JaguarTimestampHeader, strconv.FormatInt(time.Now().Unix(), 10))
+	req.Header.Set(JaguarRequestCounterHeader, strconv.FormatInt(counter, 10))
+	req.Header.Set(JaguarContentSHA256Header, hex.EncodeToString(digest[:]))
+	req.Header.Del(JaguarRequestSignatureHeader)
+
+	message := req.Method + "\n" +
+		req.URL.Path + "\n" +
+		signedHeaders(req.Header)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(message))
+	req.Header.Set(JaguarRequestSignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// doSigned signs the request with the secret and sends it with the client.
+func doSigned(client *http.Client, req *http.Request, secret string, body []byte) (*http.Response, error) {
+	counter := nextRequestCounter(0)
+	signRequest(req, secret, body, counter)
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	last, ok := staleRequestCounter(res, counter)
+	if !ok {
+		return res, nil
+	}
+
+	// The device has accepted a later counter, for instance from a
+	// machine with a clock that is ahead of ours. Sign the request again
+	// with a counter after that one.
+	io.ReadAll(res.Body)
+	res.Body.Close()
+	// The body of the first request has been read, so the retry gets a
+	// new one. Requests with a reader that can't be rewound, like the
+	// progress readers of the firmware updates, are sent the signed body.
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	} else if req.Body != nil && req.Body != http.NoBody {
+		retry.Body = io.NopCloser(bytes.NewReader(body))
+		retry.ContentLength = int64(len(body))
+	}
+	signRequest(retry, secret, body, nextRequestCounter(last))
+	return client.Do(retry)
+}
+
+// signedHeaders returns the X-Jaguar-* headers, except for the signature,
+// in the canonical form they are signed in: a 'name:value' line per
+// header, with the name in lower case, sorted by name. Multiple values of
+// a header are joined with commas.
+func signedHeaders(header http.Header) string {
+	values := map[string]string{}
+	var names []string
+	for name, v := range header {
+		lower := strings.ToLower(name)
+		if !strings.HasPrefix(lower, "x-jaguar-") || lower == strings.ToLower(JaguarRequestSignatureHeader) {
+			continue
+		}
+		values[lower] = strings.Join(v, ",")
+		names = append(names, lower)
+	}
+	sort.Strings(names)
+	lines := make([]string, len(names))
+	for i, name := range names {
+		lines[i] = name + ":" + values[name]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// storeSecret remembers the shared secret of the device with the given ID.
+// The caller must write the config.
+func storeSecret(cfg *viper.Viper, id string, secret string) {
+	cfg.Set(secretsCfgKey+"."+id, secret)
+}
+
+// forgetSecret removes the shared secret of the device with the given ID.
+// The caller must write the config.
+func forgetSecret(cfg *viper.Viper, id string) {
+	if secrets, ok := cfg.Get(secretsCfgKey).(map[string]interface{}); ok {
+		delete(secrets, id)
+	}
+}
+
+// storeFlashedSecrets remembers the secrets of the devices that were
+// flashed with one.
+func storeFlashedSecrets(devices []DeviceOptions) error {
+	cfg, err := directory.GetDeviceConfig()
+	if err != nil {
+		return err
+	}
+	stored := false
+	for _, d := range devices {
+		if d.Secret != "" {
+			storeSecret(cfg, d.Id, d.Secret)
+			stored = true
+		}
+	}
+	if !stored {
+		return nil
+	}
+	return cfg.WriteConfig()
+}
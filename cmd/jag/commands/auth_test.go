@@ -0,0 +1,55 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDoSignedRetry(t *testing.T) {
+	body := bytes.Repeat([]byte("firmware"), 1024)
+	ahead := time.Now().Add(time.Hour).UnixNano()
+	var bodies [][]byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, b)
+		counter, _ := strconv.ParseInt(r.Header.Get(JaguarRequestCounterHeader), 10, 64)
+		if counter <= ahead {
+			// The device has seen a later counter.
+			w.Header().Set(JaguarRequestCounterHeader, strconv.FormatInt(ahead, 10))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}))
+	defer server.Close()
+
+	// A progress reader can't be rewound, so the request has no GetBody.
+	var progress bytes.Buffer
+	req, err := http.NewRequest("PUT", server.URL+"/firmware", NewProgressReader(&progress, body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ContentLength = int64(len(body))
+	res, err := doSigned(server.Client(), req, "secret", body)
+	if err != nil {
+		t.Fatalf("doSigned() error = %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	if len(bodies) != 2 {
+		t.Fatalf("got %d requests, want 2", len(bodies))
+	}
+	if !bytes.Equal(bodies[1], body) {
+		t.Errorf("the retry sent %d bytes, want %d", len(bodies[1]), len(body))
+	}
+}
@@ -0,0 +1,17 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import "syscall"
+
+// bindToDevice makes the socket only receive the packets that arrive on the
+// network interface with the given name. Older kernels only allow it with
+// CAP_NET_RAW; without it, the packets are still filtered by the networks
+// of the interface.
+func bindToDevice(c syscall.RawConn, name string) {
+	c.Control(func(fd uintptr) {
+		syscall.BindToDevice(int(fd), name)
+	})
+}
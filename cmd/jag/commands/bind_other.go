@@ -0,0 +1,15 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package commands
+
+import "syscall"
+
+// bindToDevice does nothing on platforms that can't bind a socket to a
+// network interface. The packets are filtered by the networks of the
+// interface instead.
+func bindToDevice(c syscall.RawConn, name string) {}
@@ -9,6 +9,7 @@ import (
 	"os"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 	"github.com/toitlang/jaguar/cmd/jag/directory"
 )
 
@@ -16,19 +17,35 @@ const (
 	WifiCfgKey         = "wifi"
 	WifiSSIDCfgKey     = "ssid"
 	WifiPasswordCfgKey = "password"
+
+	PinnedCfgKey        = "pinned"
+	PinnedAddressCfgKey = "address"
+
+	// The defaults for 'jag scan' that are used unless the flags are given.
+	ScanCfgKey            = "scan"
+	ScanOutputCfgKey      = "output"
+	ScanTimeoutCfgKey     = "timeout"
+	ScanValidateCmdCfgKey = "validateCmd"
 )
 
 func ConfigCmd(info Info) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "config",
 		Short: "Configure Jaguar",
-		Long:  "Configure the Jaguar command line tool.",
+		Long: "Configure the Jaguar command line tool.\n" +
+			"Use 'jag config list' to see the settings that can be read and changed\n" +
+			"with 'jag config get', 'set' and 'unset'.",
 	}
 
 	cmd.AddCommand(
+		ConfigGetCmd(),
+		ConfigSetCmd(),
+		ConfigUnsetCmd(),
+		ConfigListCmd(),
 		ConfigAnalyticsCmd(),
 		ConfigUpToDateCmd(info),
 		ConfigWifiCmd(),
+		ConfigDeviceCmd(),
 	)
 	return cmd
 }
@@ -146,6 +163,66 @@ credentials whenever necessary.`,
 	return cmd
 }
 
+func ConfigDeviceCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "device",
+		Short: "Pin the Jaguar device to a fixed address",
+		Long: `Pins the Jaguar device to a fixed address.
+
+When a device is pinned, Jaguar asks the device at the pinned address to
+identify itself instead of scanning for devices. If the device doesn't
+respond, Jaguar falls back to scanning.
+
+Without any flags, the pinned address is printed.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			cfg, err := directory.GetDeviceConfig()
+			if err != nil {
+				return err
+			}
+
+			unpin, err := cmd.Flags().GetBool("clear")
+			if err != nil {
+				return err
+			}
+			if unpin {
+				if cfg.IsSet(PinnedCfgKey + "." + PinnedAddressCfgKey) {
+					delete(cfg.Get(PinnedCfgKey).(map[string]interface{}), PinnedAddressCfgKey)
+				}
+				return directory.WriteConfig(cfg)
+			}
+
+			if !cmd.Flags().Changed("address") {
+				if address := pinnedAddress(cfg); address != "" {
+					fmt.Println(address)
+				} else {
+					fmt.Println("No device is pinned")
+				}
+				return nil
+			}
+
+			address, err := cmd.Flags().GetString("address")
+			if err != nil {
+				return err
+			}
+			if address == "" {
+				return fmt.Errorf("the address can't be empty, use --clear to unpin the device")
+			}
+			cfg.Set(PinnedCfgKey+"."+PinnedAddressCfgKey, address)
+			return directory.WriteConfig(cfg)
+		},
+	}
+	cmd.Flags().String("address", "", "address of the device, like 10.0.0.5:9000")
+	cmd.Flags().Bool("clear", false, "if set, unpin the device")
+	return cmd
+}
+
+// pinnedAddress returns the address the device is pinned to, or the empty
+// string if no device is pinned.
+func pinnedAddress(cfg *viper.Viper) string {
+	return cfg.GetString(PinnedCfgKey + "." + PinnedAddressCfgKey)
+}
+
 func configAnalytics(disable bool) func(*cobra.Command, []string) error {
 	return func(_ *cobra.Command, _ []string) error {
 		cfg, err := directory.GetUserConfig()
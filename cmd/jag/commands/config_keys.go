@@ -0,0 +1,299 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/toitlang/jaguar/cmd/jag/directory"
+	"gopkg.in/yaml.v2"
+)
+
+// configKey is a setting that can be managed with 'jag config get', 'set',
+// 'unset' and 'list'.
+type configKey struct {
+	key string
+	// device is true for the keys of the device config, and false for the
+	// keys of the user config.
+	device      bool
+	description string
+	// parse validates the value given to 'jag config set' and returns
+	// what is stored.
+	parse func(value string) (interface{}, error)
+	// secret values aren't shown by 'jag config list'.
+	secret bool
+}
+
+var configKeys = []configKey{
+	{key: WifiCfgKey + "." + WifiSSIDCfgKey, description: "default WiFi network name", parse: parseConfigString},
+	{key: WifiCfgKey + "." + WifiPasswordCfgKey, description: "default WiFi password", parse: parseConfigString, secret: true},
+	{key: "analytics.disabled", description: "disable anonymous usage statistics and crash reports", parse: parseConfigBool},
+	{key: UpToDateKey + ".disabled", description: "disable the periodic up-to-date checks", parse: parseConfigBool},
+	{key: directory.SDKVersionCfgKey, description: "Toit SDK version to use instead of the one from 'jag setup' (see 'jag sdk')", parse: parseConfigString},
+	{key: "port", device: true, description: "serial port used by 'jag flash' and 'jag monitor'", parse: parseConfigString},
+	{key: PinnedCfgKey + "." + PinnedAddressCfgKey, device: true, description: "address the device is pinned to", parse: parseConfigString},
+	{key: scanOutputCfgKey, device: true, description: "default output format of 'jag scan --list'", parse: parseConfigScanOutput},
+	{key: scanTimeoutCfgKey, device: true, description: "default timeout of 'jag scan'", parse: parseConfigDuration},
+	{key: scanValidateCmdCfgKey, device: true, description: "command run on the device selected by 'jag scan' and the other commands", parse: parseConfigString},
+}
+
+func findConfigKey(key string) (configKey, error) {
+	for _, k := range configKeys {
+		if strings.EqualFold(k.key, key) {
+			return k, nil
+		}
+	}
+	return configKey{}, fmt.Errorf("unknown config key '%s' (see 'jag config list')", key)
+}
+
+func (k configKey) config() (*viper.Viper, error) {
+	if k.device {
+		return directory.GetDeviceConfig()
+	}
+	return directory.GetUserConfig()
+}
+
+func (k configKey) file() string {
+	if k.device {
+		return "device"
+	}
+	return "user"
+}
+
+func parseConfigString(value string) (interface{}, error) {
+	if value == "" {
+		return nil, fmt.Errorf("the value can't be empty, use 'jag config unset' to remove it")
+	}
+	return value, nil
+}
+
+func parseConfigBool(value string) (interface{}, error) {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, fmt.Errorf("'%s' is not a boolean, must be either true or false", value)
+	}
+	return b, nil
+}
+
+func parseConfigDuration(value string) (interface{}, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return nil, fmt.Errorf("'%s' is not a positive duration like 2s", value)
+	}
+	return d.String(), nil
+}
+
+func parseConfigScanOutput(value string) (interface{}, error) {
+	return parseOutputFormat(value, deviceOutputFormats)
+}
+
+func ConfigGetCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "get <key>",
+		Short:        "Print the value of a setting",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			output, err := parseConfigOutput(cmd)
+			if err != nil {
+				return err
+			}
+			key, err := findConfigKey(args[0])
+			if err != nil {
+				return err
+			}
+			cfg, err := key.config()
+			if err != nil {
+				return err
+			}
+			if !cfg.IsSet(key.key) {
+				return fmt.Errorf("'%s' is not set", key.key)
+			}
+			return printConfigValue(cmd.OutOrStdout(), output, cfg.Get(key.key))
+		},
+	}
+	cmd.Flags().StringP("output", "o", "short", "set output format to json, yaml or short")
+	return cmd
+}
+
+func ConfigSetCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "set <key> <value>",
+		Short:        "Change a setting",
+		Args:         cobra.ExactArgs(2),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			key, err := findConfigKey(args[0])
+			if err != nil {
+				return err
+			}
+			value, err := key.parse(args[1])
+			if err != nil {
+				return fmt.Errorf("invalid value for '%s': %w", key.key, err)
+			}
+			cfg, err := key.config()
+			if err != nil {
+				return err
+			}
+			cfg.Set(key.key, value)
+			return directory.WriteConfig(cfg)
+		},
+	}
+	return cmd
+}
+
+func ConfigUnsetCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "unset <key>",
+		Short:        "Remove a setting, so the default is used",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			key, err := findConfigKey(args[0])
+			if err != nil {
+				return err
+			}
+			cfg, err := key.config()
+			if err != nil {
+				return err
+			}
+			return unsetConfig(cfg, key.key)
+		},
+	}
+	return cmd
+}
+
+// unsetConfig removes the setting from the config and writes it, unless
+// the setting isn't there.
+func unsetConfig(cfg *viper.Viper, key string) error {
+	if !cfg.IsSet(key) {
+		return nil
+	}
+
+	// Viper can't remove keys, so the remaining settings are written to
+	// the file by a new config.
+	settings := cfg.AllSettings()
+	removeSetting(settings, strings.Split(strings.ToLower(key), "."))
+	res := viper.New()
+	res.SetConfigType("yaml")
+	res.SetConfigFile(cfg.ConfigFileUsed())
+	if err := res.MergeConfigMap(settings); err != nil {
+		return err
+	}
+	return directory.WriteConfig(res)
+}
+
+// removeSetting removes the setting at the path from the nested settings.
+// Sections that end up empty are removed as well.
+func removeSetting(settings map[string]interface{}, path []string) {
+	if len(path) == 1 {
+		delete(settings, path[0])
+		return
+	}
+	section, ok := settings[path[0]].(map[string]interface{})
+	if !ok {
+		return
+	}
+	removeSetting(section, path[1:])
+	if len(section) == 0 {
+		delete(settings, path[0])
+	}
+}
+
+func ConfigListCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the settings",
+		Long: "List the settings that can be changed with 'jag config set', with their\n" +
+			"values. Secret values, like the WiFi password, are masked.",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			output, err := parseConfigOutput(cmd)
+			if err != nil {
+				return err
+			}
+			userCfg, err := directory.GetUserConfig()
+			if err != nil {
+				return err
+			}
+			deviceCfg, err := directory.GetDeviceConfig()
+			if err != nil {
+				return err
+			}
+
+			values := map[string]interface{}{}
+			for _, key := range configKeys {
+				cfg := userCfg
+				if key.device {
+					cfg = deviceCfg
+				}
+				if !cfg.IsSet(key.key) {
+					continue
+				}
+				var value interface{} = cfg.Get(key.key)
+				if key.secret {
+					value = "********"
+				}
+				values[key.key] = value
+			}
+
+			w := cmd.OutOrStdout()
+			switch output {
+			case "json":
+				return json.NewEncoder(w).Encode(values)
+			case "yaml":
+				return yaml.NewEncoder(w).Encode(values)
+			}
+
+			keyLength := len("KEY")
+			fileLength := len("CONFIG")
+			valueLength := len("VALUE")
+			for _, key := range configKeys {
+				keyLength = max(keyLength, len(key.key))
+				if value, ok := values[key.key]; ok {
+					valueLength = max(valueLength, len(fmt.Sprint(value)))
+				}
+			}
+			sorted := append([]configKey(nil), configKeys...)
+			sort.Slice(sorted, func(i, j int) bool { return sorted[i].key < sorted[j].key })
+
+			fmt.Fprintln(w, padded("KEY", keyLength)+padded("CONFIG", fileLength)+padded("VALUE", valueLength)+"DESCRIPTION")
+			for _, key := range sorted {
+				value := ""
+				if v, ok := values[key.key]; ok {
+					value = fmt.Sprint(v)
+				}
+				fmt.Fprintln(w, padded(key.key, keyLength)+padded(key.file(), fileLength)+padded(value, valueLength)+key.description)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringP("output", "o", "short", "set output format to json, yaml or short")
+	return cmd
+}
+
+func parseConfigOutput(cmd *cobra.Command) (string, error) {
+	return parseOutputFormatFlag(cmd, resultOutputFormats)
+}
+
+func printConfigValue(w io.Writer, output string, value interface{}) error {
+	switch output {
+	case "json":
+		return json.NewEncoder(w).Encode(value)
+	case "yaml":
+		return yaml.NewEncoder(w).Encode(value)
+	}
+	_, err := fmt.Fprintln(w, value)
+	return err
+}
@@ -7,6 +7,7 @@ package commands
 import (
 	"fmt"
 	"os"
+	"sort"
 	"strings"
 
 	"github.com/spf13/cobra"
@@ -33,49 +34,75 @@ func ContainerListCmd() *cobra.Command {
 		Use:  "list",
 		Args: cobra.ExactArgs(0),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			cfg, err := directory.GetDeviceConfig()
+			out, err := parseCommandOutput(cmd)
 			if err != nil {
 				return err
 			}
+			result := &containerListResult{}
+			return out.print(result, listContainers(cmd, out, result))
+		},
+	}
 
-			deviceSelect, err := parseDeviceFlag(cmd)
-			if err != nil {
-				return err
-			}
+	cmd.Flags().StringP("device", "d", "", "use device with a given name, id, or address")
+	addOutputFlag(cmd)
+	return cmd
+}
 
-			ctx := cmd.Context()
-			sdk, err := GetSDK(ctx)
-			if err != nil {
-				return err
-			}
+// containerListResult is the result of 'jag container list' printed with
+// --output.
+type containerListResult struct {
+	commandStatus `yaml:",inline"`
+	Device        *deviceResult        `mapstructure:"device" yaml:"device,omitempty" json:"device,omitempty"`
+	Containers    []InstalledContainer `mapstructure:"containers" yaml:"containers" json:"containers"`
+}
 
-			device, err := GetDevice(ctx, cfg, sdk, false, deviceSelect)
-			if err != nil {
-				return err
-			}
+func listContainers(cmd *cobra.Command, out *commandOutput, result *containerListResult) error {
+	cfg, err := directory.GetDeviceConfig()
+	if err != nil {
+		return err
+	}
 
-			containers, err := device.ContainerList(ctx, sdk)
-			if err != nil {
-				return err
-			}
+	deviceSelect, err := parseDeviceFlag(cmd)
+	if err != nil {
+		return err
+	}
 
-			// Compute the column lengths for all columns except for the last.
-			deviceNameLength := max(len("DEVICE"), len(device.Name))
-			idLength := len("IMAGE")
-			for id := range containers {
-				idLength = max(idLength, len(id))
-			}
+	ctx := cmd.Context()
+	sdk, err := GetSDK(ctx)
+	if err != nil {
+		return err
+	}
 
-			fmt.Println(padded("DEVICE", deviceNameLength) + padded("IMAGE", idLength) + "NAME")
-			for id, name := range containers {
-				fmt.Println(padded(device.Name, deviceNameLength) + padded(id, idLength) + name)
-			}
-			return nil
-		},
+	device, err := GetDevice(ctx, cfg, sdk, false, deviceSelect)
+	if err != nil {
+		return err
 	}
 
-	cmd.Flags().StringP("device", "d", "", "use device with a given name, id, or address")
-	return cmd
+	containers, err := device.Containers(ctx, sdk)
+	if err != nil {
+		return err
+	}
+	sort.Slice(containers, func(i, j int) bool { return containers[i].Name < containers[j].Name })
+	result.Device = newDeviceResult(device)
+	result.Containers = containers
+	if out.structured() {
+		return nil
+	}
+
+	// Compute the column lengths for all columns except for the last.
+	deviceNameLength := max(len("DEVICE"), len(device.Name))
+	idLength := len("IMAGE")
+	nameLength := len("NAME")
+	for _, c := range containers {
+		idLength = max(idLength, len(c.ID))
+		nameLength = max(nameLength, len(c.Name))
+	}
+
+	fmt.Fprintln(out.stdout, padded("DEVICE", deviceNameLength)+padded("IMAGE", idLength)+padded("NAME", nameLength)+"VERSION")
+	for _, c := range containers {
+		fmt.Fprintln(out.stdout, padded(device.Name, deviceNameLength)+padded(c.ID, idLength)+padded(c.Name, nameLength)+c.Version())
+	}
+	return nil
 }
 
 func ContainerInstallCmd() *cobra.Command {
@@ -89,6 +116,9 @@ func ContainerInstallCmd() *cobra.Command {
 			if err != nil {
 				return err
 			}
+			if deviceSelect != nil && cmd.Flags().Changed("group") {
+				return fmt.Errorf("--device and --group are exclusive")
+			}
 
 			cfg, err := directory.GetDeviceConfig()
 			if err != nil {
@@ -123,13 +153,37 @@ func ContainerInstallCmd() *cobra.Command {
 				return err
 			}
 
-			device, err := GetDevice(ctx, cfg, sdk, true, deviceSelect)
+			name := args[0]
+			defines, err := parseDefineFlags(cmd, "define")
 			if err != nil {
 				return err
 			}
+			if cmd.Flags().Changed("version") {
+				version, err := cmd.Flags().GetString("version")
+				if err != nil {
+					return err
+				}
+				if defines == nil {
+					defines = map[string]interface{}{}
+				}
+				defines["jag.version"] = version
+			}
+
+			if cmd.Flags().Changed("group") {
+				group, err := cmd.Flags().GetString("group")
+				if err != nil {
+					return err
+				}
+				members, err := getGroupDevices(ctx, cfg, group)
+				if err != nil {
+					return err
+				}
+				err = InstallFileOnDevices(cmd, members, sdk, name, entrypoint, defines, programAssetsPath, optimizationLevel)
+				printGroupResults(getStdout(ctx), members)
+				return err
+			}
 
-			name := args[0]
-			defines, err := parseDefineFlags(cmd, "define")
+			device, err := GetDevice(ctx, cfg, sdk, true, deviceSelect)
 			if err != nil {
 				return err
 			}
@@ -139,9 +193,11 @@ func ContainerInstallCmd() *cobra.Command {
 	}
 
 	cmd.Flags().StringP("device", "d", "", "use device with a given name, id, or address")
+	cmd.Flags().String("group", "", "install on all the devices of the given group (see 'jag group')")
 	cmd.Flags().StringArrayP("define", "D", nil, "define settings to control container on device")
 	cmd.Flags().String("assets", "", "attach assets to the container")
 	cmd.Flags().IntP("optimization-level", "O", -1, "optimization level")
+	cmd.Flags().String("version", "", "version of the container, shown by 'jag container list' (same as -D jag.version)")
 	return cmd
 }
 
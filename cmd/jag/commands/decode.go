@@ -38,19 +38,24 @@ func DecodeCmd() *cobra.Command {
 			if err != nil {
 				return err
 			}
-			return serialDecode(cmd, args[0], pretty, plain)
+			chip, err := cmd.Flags().GetString("chip")
+			if err != nil {
+				return err
+			}
+			return serialDecode(cmd, chip, args[0], pretty, plain)
 		},
 	}
 	cmd.Flags().BoolP("force-pretty", "r", false, "force output to use terminal graphics")
 	cmd.Flags().BoolP("force-plain", "l", false, "force output to use plain ASCII text")
+	cmd.Flags().StringP("chip", "c", "esp32", "chip of the device, used to decode crashes in native code")
 	return cmd
 }
 
-func serialDecode(cmd *cobra.Command, message string, forcePretty bool, forcePlain bool) error {
+func serialDecode(cmd *cobra.Command, chip string, message string, forcePretty bool, forcePlain bool) error {
 	if strings.HasPrefix(message, "jag decode ") {
 		return jagDecode(cmd, message[11:], forcePretty, forcePlain)
 	} else if strings.HasPrefix(message, "Backtrace:") {
-		return crashDecode(cmd, message)
+		return crashDecode(cmd, chip, message)
 	} else {
 		return jagDecode(cmd, message, forcePretty, forcePlain)
 	}
@@ -169,14 +174,16 @@ func jagDecode(cmd *cobra.Command, base64Message string, forcePretty bool, force
 	return decodeCommand.Run()
 }
 
-func crashDecode(cmd *cobra.Command, backtrace string) error {
+// crashDecode symbolizes the backtrace of a crash in native code against
+// the firmware ELF of the chip.
+func crashDecode(cmd *cobra.Command, chip string, backtrace string) error {
 	ctx := cmd.Context()
 	sdk, err := GetSDK(ctx)
 	if err != nil {
 		return err
 	}
 
-	envelopePath, err := directory.GetFirmwareEnvelopePath("esp32")
+	envelopePath, err := directory.GetFirmwareEnvelopePath(chip)
 	if err != nil {
 		return err
 	}
@@ -187,9 +194,11 @@ func crashDecode(cmd *cobra.Command, backtrace string) error {
 	}
 	defer firmwareElf.Close()
 
-	objdump, err := exec.LookPath("xtensa-esp32-elf-objdump")
-	if err != nil {
-		objdump, err = exec.LookPath("objdump")
+	var objdump string
+	for _, name := range objdumpNames(chip) {
+		if objdump, err = exec.LookPath(name); err == nil {
+			break
+		}
 	}
 	if err != nil {
 		return err
@@ -205,6 +214,9 @@ func crashDecode(cmd *cobra.Command, backtrace string) error {
 type Decoder struct {
 	scanner *bufio.Scanner
 	cmd     *cobra.Command
+	// chip is the chip of the device, whose firmware is used to decode
+	// crashes in native code.
+	chip string
 }
 
 func (d *Decoder) decode(forcePretty bool, forcePlain bool) {
@@ -235,7 +247,7 @@ func (d *Decoder) decode(forcePretty bool, forcePlain bool) {
 					fmt.Printf("Decoding by `jag`, device has version <%s>\n", Version)
 					fmt.Printf(separator + "\n")
 				}
-				if err := serialDecode(d.cmd, line, forcePretty, forcePlain); err != nil {
+				if err := serialDecode(d.cmd, d.chip, line, forcePretty, forcePlain); err != nil {
 					if len(postponed) != 0 {
 						fmt.Println(strings.Join(postponed, "\n"))
 						postponed = []string{}
@@ -256,3 +268,17 @@ func (d *Decoder) decode(forcePretty bool, forcePlain bool) {
 		}
 	}
 }
+
+// objdumpNames returns the names of the objdump tools that can disassemble
+// the firmware of the chip, the best first.
+func objdumpNames(chip string) []string {
+	// Variants like 'esp32s3-spiram-octo' use the toolchain of their chip.
+	toolchain := strings.SplitN(chip, "-", 2)[0]
+	switch toolchain {
+	case "esp32c3", "esp32c6", "esp32h2":
+		// The RISC-V chips share a single toolchain.
+		return []string{"riscv32-esp-elf-objdump", "objdump"}
+	default:
+		return []string{"xtensa-" + toolchain + "-elf-objdump", "xtensa-esp32-elf-objdump", "objdump"}
+	}
+}
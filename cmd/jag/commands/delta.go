@@ -0,0 +1,200 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/toitlang/jaguar/cmd/jag/directory"
+)
+
+// A firmware patch is a sequence of commands that produce the new firmware
+// in order. All numbers are 32-bit little endian.
+//
+//	1 <length> <offset>  copies length bytes from offset in the current firmware.
+//	2 <length> <data>    copies the length bytes of data from the patch.
+//
+// The device applies it in src/delta.toit.
+const (
+	patchCopy = 1
+	patchData = 2
+
+	// deltaBlockSize is the size of the blocks of the base firmware that
+	// are looked for in the new firmware.
+	deltaBlockSize = 256
+	// deltaMaxCandidates limits how many blocks with the same hash are
+	// compared, so padding that repeats all over the firmware doesn't
+	// make the diff slow.
+	deltaMaxCandidates = 16
+)
+
+// errFirmwareBaselineMismatch is returned when the device doesn't run the
+// firmware a patch was computed against, or doesn't support patches.
+var errFirmwareBaselineMismatch = errors.New("the device doesn't run the firmware the patch is for")
+
+// firmwareDelta computes a patch that turns the base firmware into the
+// target firmware.
+func firmwareDelta(base []byte, target []byte) []byte {
+	blocks := map[uint32][]int{}
+	for offset := 0; offset+deltaBlockSize <= len(base); offset += deltaBlockSize {
+		sum := newRollingHash(base[offset : offset+deltaBlockSize]).sum()
+		blocks[sum] = append(blocks[sum], offset)
+	}
+
+	var patch bytes.Buffer
+	// pending is the start of the target data that isn't covered by the
+	// patch yet.
+	pending := 0
+	i := 0
+	var hash rollingHash
+	if len(target) >= deltaBlockSize {
+		hash = newRollingHash(target[:deltaBlockSize])
+	}
+	for i+deltaBlockSize <= len(target) {
+		from, n := longestMatch(base, target[i:], blocks[hash.sum()])
+		if n == 0 {
+			if i+deltaBlockSize < len(target) {
+				hash.roll(target[i], target[i+deltaBlockSize])
+			}
+			i++
+			continue
+		}
+		// The match may start before the block that was found.
+		for from > 0 && i > pending && base[from-1] == target[i-1] {
+			from--
+			i--
+			n++
+		}
+		writePatchData(&patch, target[pending:i])
+		writePatchCommand(&patch, patchCopy, n)
+		binary.Write(&patch, binary.LittleEndian, uint32(from))
+		i += n
+		pending = i
+		if i+deltaBlockSize <= len(target) {
+			hash = newRollingHash(target[i : i+deltaBlockSize])
+		}
+	}
+	writePatchData(&patch, target[pending:])
+	return patch.Bytes()
+}
+
+// longestMatch returns the offset and length of the longest data in base
+// that starts with one of the candidate blocks and is a prefix of target.
+// The length is zero if none of the candidates match.
+func longestMatch(base []byte, target []byte, candidates []int) (int, int) {
+	if len(candidates) > deltaMaxCandidates {
+		candidates = candidates[:deltaMaxCandidates]
+	}
+	bestFrom, bestLength := 0, 0
+	for _, from := range candidates {
+		if !bytes.Equal(base[from:from+deltaBlockSize], target[:deltaBlockSize]) {
+			continue
+		}
+		n := deltaBlockSize
+		for from+n < len(base) && n < len(target) && base[from+n] == target[n] {
+			n++
+		}
+		if n > bestLength {
+			bestFrom, bestLength = from, n
+		}
+	}
+	return bestFrom, bestLength
+}
+
+func writePatchCommand(patch *bytes.Buffer, command byte, length int) {
+	patch.WriteByte(command)
+	binary.Write(patch, binary.LittleEndian, uint32(length))
+}
+
+func writePatchData(patch *bytes.Buffer, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	writePatchCommand(patch, patchData, len(data))
+	patch.Write(data)
+}
+
+// rollingHash is the weak checksum from rsync. It can be moved along the
+// data one byte at a time.
+type rollingHash struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRollingHash(data []byte) rollingHash {
+	h := rollingHash{n: uint32(len(data))}
+	for i, c := range data {
+		h.a += uint32(c)
+		h.b += uint32(len(data)-i) * uint32(c)
+	}
+	return h
+}
+
+// roll moves the hash one byte along, from out to in.
+func (h *rollingHash) roll(out byte, in byte) {
+	h.a += uint32(in) - uint32(out)
+	h.b += h.a - h.n*uint32(out)
+}
+
+func (h rollingHash) sum() uint32 {
+	return h.a&0xffff | h.b<<16
+}
+
+func firmwareBaselinePath(id string) (string, error) {
+	dir, err := directory.GetFirmwareBaselinesCachePath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, id+".bin"), nil
+}
+
+// loadFirmwareBaseline returns the firmware last installed on the device
+// with the given ID by 'jag firmware update', or nil if it isn't known.
+func loadFirmwareBaseline(id string) []byte {
+	path, err := firmwareBaselinePath(id)
+	if err != nil {
+		return nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// storeFirmwareBaseline remembers the firmware installed on the device
+// with the given ID. The firmware contains the WiFi password, so only the
+// user can read the file.
+func storeFirmwareBaseline(id string, bin []byte) error {
+	path, err := firmwareBaselinePath(id)
+	if err != nil {
+		return err
+	}
+	// Temporary files are only readable by the user, also if the file
+	// they replace wasn't.
+	file, err := os.CreateTemp(filepath.Dir(path), "jag_baseline_*.bin")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(bin); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+func forgetFirmwareBaseline(id string) {
+	if path, err := firmwareBaselinePath(id); err == nil {
+		os.Remove(path)
+	}
+}
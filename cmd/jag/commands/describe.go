@@ -0,0 +1,102 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/spf13/cobra"
+	"github.com/toitlang/jaguar/cmd/jag/directory"
+	"gopkg.in/yaml.v2"
+)
+
+func DescribeCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "describe [device]",
+		Short: "Describe a Jaguar device",
+		Long: "Describe a Jaguar device.\n" +
+			"The device is asked for more than it broadcasts, like its uptime and the\n" +
+			"installed containers. The device is selected like for the other commands.",
+		Args:         cobra.MaximumNArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := directory.GetDeviceConfig()
+			if err != nil {
+				return err
+			}
+
+			deviceSelect, err := parseDeviceFlag(cmd)
+			if err != nil {
+				return err
+			}
+			if len(args) == 1 {
+				if deviceSelect != nil {
+					return fmt.Errorf("a device argument and --device are exclusive")
+				}
+				deviceSelect = parseDeviceSelection(args[0])
+			}
+
+			timeout, err := cmd.Flags().GetDuration("timeout")
+			if err != nil {
+				return err
+			}
+
+			output, err := parseOutputFormatFlag(cmd, resultOutputFormats)
+			if err != nil {
+				return err
+			}
+
+			ctx := cmd.Context()
+			sdk, err := GetSDK(ctx)
+			if err != nil {
+				return err
+			}
+
+			device, err := GetDevice(ctx, cfg, sdk, true, deviceSelect)
+			if err != nil {
+				return err
+			}
+
+			describeCtx, cancel := context.WithTimeout(ctx, device.probeTimeoutFor(ctx, timeout))
+			defer cancel()
+			description, err := device.Describe(describeCtx, sdk)
+			if err != nil {
+				return fmt.Errorf("couldn't describe '%s': %w", device.Name, err)
+			}
+			return printDescription(os.Stdout, description, output)
+		},
+	}
+
+	cmd.Flags().StringP("device", "d", "", "use device with a given name, id, or address")
+	cmd.Flags().DurationP("timeout", "t", connectTimeout, "how long to wait for the device to describe itself")
+	cmd.Flags().StringP("output", "o", "short", "set output format to json, yaml or short")
+	return cmd
+}
+
+// printDescription writes the description in the given output format. The
+// short format has a line per field, sorted by name.
+func printDescription(w io.Writer, d DeviceDescription, output string) error {
+	switch output {
+	case "json":
+		return json.NewEncoder(w).Encode(d)
+	case "yaml":
+		return yaml.NewEncoder(w).Encode(d)
+	}
+
+	var keys []string
+	for key := range d {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s: %v\n", key, d[key])
+	}
+	return nil
+}
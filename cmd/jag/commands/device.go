@@ -7,11 +7,16 @@ package commands
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 	"unicode/utf8"
 
@@ -20,15 +25,50 @@ import (
 )
 
 const (
-	JaguarDeviceIDHeader         = "X-Jaguar-Device-ID"
-	JaguarSDKVersionHeader       = "X-Jaguar-SDK-Version"
-	JaguarDisabledHeader         = "X-Jaguar-Disabled"
-	JaguarContainerNameHeader    = "X-Jaguar-Container-Name"
-	JaguarContainerTimeoutHeader = "X-Jaguar-Container-Timeout"
+	JaguarDeviceIDHeader           = "X-Jaguar-Device-ID"
+	JaguarSDKVersionHeader         = "X-Jaguar-SDK-Version"
+	JaguarDisabledHeader           = "X-Jaguar-Disabled"
+	JaguarContainerNameHeader      = "X-Jaguar-Container-Name"
+	JaguarContainerTimeoutHeader   = "X-Jaguar-Container-Timeout"
+	JaguarContainerVersionHeader   = "X-Jaguar-Container-Version"
+	JaguarContainerArgumentsHeader = "X-Jaguar-Container-Arguments"
+	JaguarOutputSequenceHeader     = "X-Jaguar-Output-Sequence"
+	JaguarTimestampHeader          = "X-Jaguar-Timestamp"
+	JaguarContentSHA256Header      = "X-Jaguar-Content-SHA256"
+	JaguarRequestSignatureHeader   = "X-Jaguar-Request-Signature"
+	JaguarRequestCounterHeader     = "X-Jaguar-Request-Counter"
+	JaguarFirmwareSizeHeader       = "X-Jaguar-Firmware-Size"
+	JaguarFirmwareSHA256Header     = "X-Jaguar-Firmware-SHA256"
+	JaguarFirmwareBaseSizeHeader   = "X-Jaguar-Firmware-Base-Size"
+	JaguarFirmwareBaseSHA256Header = "X-Jaguar-Firmware-Base-SHA256"
 )
 
 type Devices struct {
 	Devices []Device `mapstructure:"devices" yaml:"devices" json:"devices"`
+	// Conflicts are the device IDs that were reported from more than one
+	// address, which happens when boards are flashed with a cloned image.
+	Conflicts []DeviceConflict `mapstructure:"conflicts" yaml:"conflicts,omitempty" json:"conflicts,omitempty"`
+	// Stats are the packet statistics of the scan, if asked for with
+	// --stats.
+	Stats *ScanStats `mapstructure:"stats" yaml:"stats,omitempty" json:"stats,omitempty"`
+}
+
+type DeviceConflict struct {
+	ID        string   `mapstructure:"id" yaml:"id" json:"id"`
+	Addresses []string `mapstructure:"addresses" yaml:"addresses" json:"addresses"`
+}
+
+// newDevices returns the list of the devices with the IDs that are used by
+// more than one of them. The list is never nil, so an empty scan is listed
+// as an empty collection.
+func newDevices(devices []Device) Devices {
+	if devices == nil {
+		devices = []Device{}
+	}
+	return Devices{
+		Devices:   devices,
+		Conflicts: findConflicts(devices),
+	}
 }
 
 func (d Devices) Elements() []Short {
@@ -39,13 +79,145 @@ func (d Devices) Elements() []Short {
 	return res
 }
 
+// Columns returns the summary and versions of the devices for the short
+// output, followed by the health of the devices that aren't healthy.
+func (d Devices) Columns() [][]string {
+	var res [][]string
+	for _, d := range d.Devices {
+		row := []string{d.Summary(), d.SDKVersion, d.FirmwareVersion}
+		if d.Health != "" {
+			row = append(row, d.Health)
+		}
+		res = append(res, row)
+	}
+	return res
+}
+
 type Device struct {
 	ID         string `mapstructure:"id" yaml:"id" json:"id"`
 	Name       string `mapstructure:"name" yaml:"name" json:"name"`
 	Chip       string `mapstructure:"chip" yaml:"chip" json:"chip"`
 	Address    string `mapstructure:"address" yaml:"address" json:"address"`
 	SDKVersion string `mapstructure:"sdkVersion" yaml:"sdkVersion" json:"sdkVersion"`
-	WordSize   int    `mapstructure:"wordSize" yaml:"wordSize" json:"wordSize"`
+	// Port is the HTTP port the device reported, if it doesn't use the
+	// default port. It is already part of the address.
+	Port int `mapstructure:"port" yaml:"port,omitempty" json:"port,omitempty"`
+	// FirmwareVersion is the version of Jaguar the firmware was built by.
+	// It is empty for devices that don't report it.
+	FirmwareVersion string `mapstructure:"firmwareVersion" yaml:"firmwareVersion" json:"firmwareVersion"`
+	WordSize        int    `mapstructure:"wordSize" yaml:"wordSize" json:"wordSize"`
+	// The location of the device, if the device reports it.
+	Latitude  *float64 `mapstructure:"latitude" yaml:"latitude,omitempty" json:"latitude,omitempty"`
+	Longitude *float64 `mapstructure:"longitude" yaml:"longitude,omitempty" json:"longitude,omitempty"`
+	// Writable is false for devices that are locked and don't accept
+	// code or firmware updates. Devices that don't report it are writable.
+	Writable *bool `mapstructure:"writable" yaml:"writable,omitempty" json:"writable,omitempty"`
+	// Addresses are all the addresses the device was seen on during a
+	// scan. Address is the most recently seen one.
+	Addresses []string `mapstructure:"addresses" yaml:"addresses,omitempty" json:"addresses,omitempty"`
+	// ReportedAddress is the address a device announced in its broadcast,
+	// and SourceAddress is the address the broadcast was sent from. They
+	// differ for devices that don't know their own address, like devices
+	// behind a NAT. Address is the source address if the reported one is
+	// empty or can't be reached.
+	ReportedAddress string `mapstructure:"reportedAddress" yaml:"reportedAddress,omitempty" json:"reportedAddress,omitempty"`
+	SourceAddress   string `mapstructure:"sourceAddress" yaml:"sourceAddress,omitempty" json:"sourceAddress,omitempty"`
+	// Scheme is 'https' for devices that are reached through a proxy that
+	// terminates TLS. It is empty for devices reached over plain http.
+	// Insecure is set if the certificate of the device isn't verified.
+	Scheme   string `mapstructure:"scheme" yaml:"scheme,omitempty" json:"scheme,omitempty"`
+	Insecure bool   `mapstructure:"insecure" yaml:"insecure,omitempty" json:"insecure,omitempty"`
+	// Health is 'flaky' for devices that recently failed to answer and
+	// 'unhealthy' for devices that are skipped because they failed too
+	// often. It is only set when listing devices.
+	Health string `mapstructure:"health" yaml:"health,omitempty" json:"health,omitempty"`
+	// Alias is the local alias of the device (see 'jag alias'). It is
+	// looked up in the aliases when the device is listed, picked or
+	// selected, and never stored with the device.
+	Alias string `mapstructure:"alias" yaml:"alias,omitempty" json:"alias,omitempty"`
+
+	// probeTimeout overrides the default timeout when probing the device.
+	// It is set from the device config and never stored with the device.
+	probeTimeout time.Duration
+	// token is the bearer token for devices that require authentication.
+	// Like probeTimeout, it is kept in its own section of the device config
+	// so it doesn't show up when devices are listed.
+	token string
+	// secret is the shared secret provisioned by 'jag flash --auth'. It is
+	// used to sign the requests to the device.
+	secret string
+}
+
+// client returns the HTTP client to talk to the device with.
+func (d Device) client() *http.Client {
+	if d.Insecure {
+		return insecureDeviceClient
+	}
+	return deviceClient
+}
+
+// do sends the request with the given body to the device, authenticating
+// it if the device has a token and signing it if it has a secret.
+func (d Device) do(req *http.Request, body []byte) (*http.Response, error) {
+	authorize(req, d.token)
+	if d.secret == "" {
+		return d.client().Do(req)
+	}
+	return doSigned(d.client(), req, d.secret, body)
+}
+
+// authorize adds the bearer token to the request, unless it is empty.
+func authorize(req *http.Request, token string) {
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// responseError returns the error for a non-OK response from a device. The
+// body of the response, if any, is added to the error, as devices explain
+// what went wrong there.
+func responseError(res *http.Response, body []byte) error {
+	status := res.Status
+	if detail := strings.TrimSpace(string(body)); detail != "" {
+		status += ": " + detail
+	}
+	if res.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("device requires authentication, use --token to give a token or make sure the device config has its secret from 'jag flash --auth': %s", status)
+	}
+	return fmt.Errorf("got non-OK from device: %s", status)
+}
+
+// IsWritable returns true unless the device reported that it is locked.
+func (d Device) IsWritable() bool {
+	return d.Writable == nil || *d.Writable
+}
+
+// HasLocation returns true if the device reported its coordinates.
+func (d Device) HasLocation() bool {
+	return d.Latitude != nil && d.Longitude != nil
+}
+
+// identity returns the fields that identify a physical device. Fields
+// like the name and the address may change without the device changing.
+func (d Device) identity() []string {
+	return []string{d.ID, d.Chip}
+}
+
+// Equal returns true if the two devices are the same physical device.
+func (d Device) Equal(other Device) bool {
+	a, b := d.identity(), other.identity()
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Fingerprint returns a stable hash of the fields that identify the device.
+func (d Device) Fingerprint() string {
+	hash := sha256.Sum256([]byte(strings.Join(d.identity(), "\x00")))
+	return hex.EncodeToString(hash[:8])
 }
 
 func (d Device) String() string {
@@ -53,15 +225,44 @@ func (d Device) String() string {
 }
 
 func (d Device) Short() string {
-	return d.Name
+	return d.Summary()
+}
+
+// Summary returns the name, ID and address of the device, preceded by
+// its alias if it has one. It is how devices are referred to in prompts,
+// messages and the short output, so they look the same everywhere.
+func (d Device) Summary() string {
+	if d.Alias != "" {
+		return fmt.Sprintf("%s (%s, %s, %s)", d.Alias, d.Name, d.ID, d.Address)
+	}
+	return fmt.Sprintf("%s (%s, %s)", d.Name, d.ID, d.Address)
 }
 
 const (
 	pingTimeout = 400 * time.Millisecond
+	// The device waits up to 10 seconds for new output before it answers,
+	// so polling for output must be allowed to take longer than that.
+	outputPollTimeout = 20 * time.Second
+	outputRetryDelay  = 2 * time.Second
 )
 
+// probeTimeoutFor returns the timeout to use when probing the device. The
+// fallback is used unless the device has an override in the device config.
+func (d Device) probeTimeoutFor(ctx context.Context, fallback time.Duration) time.Duration {
+	timeout := fallback
+	source := "default"
+	if d.probeTimeout != 0 {
+		timeout = d.probeTimeout
+		source = "override for " + d.ID
+	}
+	if isVerbose(ctx) {
+		fmt.Fprintf(os.Stderr, "Probing '%s' with a timeout of %s (%s)\n", d.Name, timeout, source)
+	}
+	return timeout
+}
+
 func (d Device) Ping(ctx context.Context, sdk *SDK) bool {
-	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	ctx, cancel := context.WithTimeout(ctx, d.probeTimeoutFor(ctx, pingTimeout))
 	defer cancel()
 	req, err := http.NewRequestWithContext(ctx, "GET", d.Address+"/ping", nil)
 	if err != nil {
@@ -69,7 +270,7 @@ func (d Device) Ping(ctx context.Context, sdk *SDK) bool {
 	}
 	req.Header.Set(JaguarDeviceIDHeader, d.ID)
 	req.Header.Set(JaguarSDKVersionHeader, sdk.Version)
-	res, err := http.DefaultClient.Do(req)
+	res, err := d.do(req, nil)
 	if err != nil {
 		return false
 	}
@@ -86,16 +287,20 @@ func (d Device) SendCode(ctx context.Context, sdk *SDK, request string, b []byte
 	req.Header.Set(JaguarDeviceIDHeader, d.ID)
 	req.Header.Set(JaguarSDKVersionHeader, sdk.Version)
 	for key, value := range headersMap {
-		req.Header.Set(key, value)
+		// Headers without a value are left out, as they are signed and
+		// the device has to see the same headers as we do.
+		if value != "" {
+			req.Header.Set(key, value)
+		}
 	}
-	res, err := http.DefaultClient.Do(req)
+	res, err := d.do(req, b)
 	if err != nil {
 		return err
 	}
 
-	io.ReadAll(res.Body) // Avoid closing connection prematurely.
+	reply, _ := io.ReadAll(res.Body) // Avoid closing connection prematurely.
 	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("got non-OK from device: %s", res.Status)
+		return responseError(res, reply)
 	}
 
 	return nil
@@ -108,7 +313,7 @@ func (d Device) ContainerList(ctx context.Context, sdk *SDK) (map[string]string,
 	}
 	req.Header.Set(JaguarDeviceIDHeader, d.ID)
 	req.Header.Set(JaguarSDKVersionHeader, sdk.Version)
-	res, err := http.DefaultClient.Do(req)
+	res, err := d.do(req, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -118,7 +323,7 @@ func (d Device) ContainerList(ctx context.Context, sdk *SDK) (map[string]string,
 		return nil, err
 	}
 	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("got non-OK from device: %s", res.Status)
+		return nil, responseError(res, body)
 	}
 
 	var unmarshalled map[string]string
@@ -131,6 +336,182 @@ func (d Device) ContainerList(ctx context.Context, sdk *SDK) (map[string]string,
 	return unmarshalled, nil
 }
 
+// InstalledContainer is a named container installed on a device.
+type InstalledContainer struct {
+	ID      string                 `json:"id" yaml:"id"`
+	Name    string                 `json:"name" yaml:"name"`
+	Defines map[string]interface{} `json:"defines,omitempty" yaml:"defines,omitempty"`
+}
+
+// Version returns the version the container was installed with, or the
+// empty string if it wasn't given one.
+func (c InstalledContainer) Version() string {
+	if version, ok := c.Defines["jag.version"].(string); ok {
+		return version
+	}
+	return ""
+}
+
+// Containers returns the containers installed on the device with their
+// details. Devices with older firmware only know the names of their
+// containers, so for them the details are left out.
+func (d Device) Containers(ctx context.Context, sdk *SDK) ([]InstalledContainer, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", d.Address+"/containers", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(JaguarDeviceIDHeader, d.ID)
+	req.Header.Set(JaguarSDKVersionHeader, sdk.Version)
+	res, err := d.do(req, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		containers, err := d.ContainerList(ctx, sdk)
+		if err != nil {
+			return nil, err
+		}
+		var res []InstalledContainer
+		for id, name := range containers {
+			res = append(res, InstalledContainer{ID: id, Name: name})
+		}
+		return res, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, responseError(res, body)
+	}
+
+	var unmarshalled []InstalledContainer
+	if err = ubjson.Unmarshal(body, &unmarshalled); err != nil {
+		if err = json.Unmarshal(body, &unmarshalled); err != nil {
+			return nil, err
+		}
+	}
+	return unmarshalled, nil
+}
+
+// DeviceOutput is a chunk of the output printed by the programs on a
+// device. Next is the sequence number of the line after the last one in
+// Lines, and Dropped is the number of lines that were lost because the
+// device had to make room for newer ones.
+type DeviceOutput struct {
+	Next    int      `json:"next"`
+	Lines   []string `json:"lines"`
+	Dropped int      `json:"dropped"`
+}
+
+// Output returns the lines of output from the line with the given sequence
+// number on. The device waits a while for new output if there isn't any
+// yet. If the sequence number is negative, the device answers right away
+// with no lines, to tell where its output currently ends.
+func (d Device) Output(ctx context.Context, sdk *SDK, from int) (*DeviceOutput, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", d.Address+"/output", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(JaguarDeviceIDHeader, d.ID)
+	req.Header.Set(JaguarSDKVersionHeader, sdk.Version)
+	req.Header.Set(JaguarOutputSequenceHeader, strconv.Itoa(from))
+	res, err := d.do(req, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("'%s' can't stream its output, its firmware may be too old: %s", d.Name, res.Status)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, responseError(res, body)
+	}
+
+	var unmarshalled DeviceOutput
+	if err = ubjson.Unmarshal(body, &unmarshalled); err != nil {
+		if err = json.Unmarshal(body, &unmarshalled); err != nil {
+			return nil, err
+		}
+	}
+	return &unmarshalled, nil
+}
+
+// Metrics returns the health and resource usage of the device.
+func (d Device) Metrics(ctx context.Context, sdk *SDK) (*DeviceMetrics, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", d.Address+"/metrics", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(JaguarDeviceIDHeader, d.ID)
+	req.Header.Set(JaguarSDKVersionHeader, sdk.Version)
+	res, err := d.do(req, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("'%s' can't report its metrics, its firmware may be too old: %s", d.Name, res.Status)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, responseError(res, body)
+	}
+
+	var unmarshalled DeviceMetrics
+	if err = ubjson.Unmarshal(body, &unmarshalled); err != nil {
+		if err = json.Unmarshal(body, &unmarshalled); err != nil {
+			return nil, err
+		}
+	}
+	return &unmarshalled, nil
+}
+
+// DeviceDescription is what a device tells about itself when asked to
+// describe itself, like its uptime and installed containers. Devices may
+// add fields, so they are kept as they are.
+type DeviceDescription map[string]interface{}
+
+func (d Device) Describe(ctx context.Context, sdk *SDK) (DeviceDescription, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", d.Address+"/describe", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(JaguarDeviceIDHeader, d.ID)
+	req.Header.Set(JaguarSDKVersionHeader, sdk.Version)
+	res, err := d.do(req, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("'%s' can't describe itself, its firmware may be too old: %s", d.Name, res.Status)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, responseError(res, body)
+	}
+
+	var unmarshalled DeviceDescription
+	if err = ubjson.Unmarshal(body, &unmarshalled); err != nil {
+		if err = json.Unmarshal(body, &unmarshalled); err != nil {
+			return nil, err
+		}
+	}
+	return unmarshalled, nil
+}
+
 func (d Device) ContainerUninstall(ctx context.Context, sdk *SDK, name string) error {
 	req, err := http.NewRequestWithContext(ctx, "PUT", d.Address+"/uninstall", nil)
 	if err != nil {
@@ -139,30 +520,31 @@ func (d Device) ContainerUninstall(ctx context.Context, sdk *SDK, name string) e
 	req.Header.Set(JaguarDeviceIDHeader, d.ID)
 	req.Header.Set(JaguarSDKVersionHeader, sdk.Version)
 	req.Header.Set(JaguarContainerNameHeader, name)
-	res, err := http.DefaultClient.Do(req)
+	res, err := d.do(req, nil)
 	if err != nil {
 		return err
 	}
 
-	io.ReadAll(res.Body) // Avoid closing connection prematurely.
+	reply, _ := io.ReadAll(res.Body) // Avoid closing connection prematurely.
 	if err != nil {
 		return err
 	}
 	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("got non-OK from device: %s", res.Status)
+		return responseError(res, reply)
 	}
 	return nil
 }
 
-// A Reader based on a byte array that prints a progress bar.
+// A Reader based on a byte array that prints a progress bar to w.
 type ProgressReader struct {
+	w         io.Writer
 	b         []byte
 	index     int
 	spinState int
 }
 
-func NewProgressReader(b []byte) *ProgressReader {
-	return &ProgressReader{b, 0, 0}
+func NewProgressReader(w io.Writer, b []byte) *ProgressReader {
+	return &ProgressReader{w, b, 0, 0}
 }
 
 func (p *ProgressReader) Read(buffer []byte) (n int, err error) {
@@ -172,7 +554,7 @@ func (p *ProgressReader) Read(buffer []byte) (n int, err error) {
 	copied := copy(buffer, p.b[p.index:])
 	p.index += copied
 	percent := (p.index * 100) / len(p.b)
-	fmt.Print("\r")
+	fmt.Fprint(p.w, "\r")
 	// The strings must contain characters with the same UTF-8 length so that
 	// they can be chopped up.  The emoji generally are 4-byte characters.
 	// Braille are 3-byte characters, and or course ASCII is 1-byte characters.
@@ -200,63 +582,280 @@ func (p *ProgressReader) Read(buffer []byte) (n int, err error) {
 		p.spinState = 0
 	}
 	spinChar := spin[p.spinState : p.spinState+spinBytesPerPart]
-	fmt.Printf("   %3d%%  %4dk  %s  [", percent, p.index>>10, spinChar)
-	fmt.Print(done[len(done)-pos*doneBytesPerPart:])
-	fmt.Print(todo[:len(todo)-pos*todoBytesPerPart])
-	fmt.Print("] ")
+	fmt.Fprintf(p.w, "   %3d%%  %4dk  %s  [", percent, p.index>>10, spinChar)
+	fmt.Fprint(p.w, done[len(done)-pos*doneBytesPerPart:])
+	fmt.Fprint(p.w, todo[:len(todo)-pos*todoBytesPerPart])
+	fmt.Fprint(p.w, "] ")
 	return copied, nil
 }
 
 func (d Device) UpdateFirmware(ctx context.Context, sdk *SDK, b []byte) error {
-	var reader = NewProgressReader(b)
+	var reader = NewProgressReader(getStdout(ctx), b)
 	req, err := http.NewRequestWithContext(ctx, "PUT", d.Address+"/firmware", reader)
 	if err != nil {
 		return err
 	}
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(NewProgressReader(getStdout(ctx), b)), nil
+	}
 	req.ContentLength = int64(len(b))
 	req.Header.Set(JaguarDeviceIDHeader, d.ID)
 	req.Header.Set(JaguarSDKVersionHeader, sdk.Version)
-	defer fmt.Print("\n\n")
-	res, err := http.DefaultClient.Do(req)
+	defer fmt.Fprint(getStdout(ctx), "\n\n")
+	res, err := d.do(req, b)
 	if err != nil {
 		return err
 	}
 
-	io.ReadAll(res.Body) // Avoid closing connection prematurely.
+	reply, _ := io.ReadAll(res.Body) // Avoid closing connection prematurely.
 	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("got non-OK from device: %s", res.Status)
+		return responseError(res, reply)
 	}
 
 	return nil
 }
 
+// UpdateFirmwareDelta updates the firmware on the device from a patch
+// against the base firmware, which the device must be running. It returns
+// errFirmwareBaselineMismatch if the device doesn't run the base firmware,
+// or if its firmware is too old to apply patches.
+func (d Device) UpdateFirmwareDelta(ctx context.Context, sdk *SDK, base []byte, b []byte, patch []byte) error {
+	var reader = NewProgressReader(getStdout(ctx), patch)
+	req, err := http.NewRequestWithContext(ctx, "PUT", d.Address+"/firmware/delta", reader)
+	if err != nil {
+		return err
+	}
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(NewProgressReader(getStdout(ctx), patch)), nil
+	}
+	baseSum := sha256.Sum256(base)
+	sum := sha256.Sum256(b)
+	req.ContentLength = int64(len(patch))
+	req.Header.Set(JaguarDeviceIDHeader, d.ID)
+	req.Header.Set(JaguarSDKVersionHeader, sdk.Version)
+	req.Header.Set(JaguarFirmwareSizeHeader, strconv.Itoa(len(b)))
+	req.Header.Set(JaguarFirmwareSHA256Header, hex.EncodeToString(sum[:]))
+	req.Header.Set(JaguarFirmwareBaseSizeHeader, strconv.Itoa(len(base)))
+	req.Header.Set(JaguarFirmwareBaseSHA256Header, hex.EncodeToString(baseSum[:]))
+	defer fmt.Fprint(getStdout(ctx), "\n\n")
+	res, err := d.do(req, patch)
+	if err != nil {
+		return err
+	}
+
+	reply, _ := io.ReadAll(res.Body) // Avoid closing connection prematurely.
+	if res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusConflict {
+		return errFirmwareBaselineMismatch
+	}
+	if res.StatusCode != http.StatusOK {
+		return responseError(res, reply)
+	}
+
+	return nil
+}
+
+const (
+	deviceCfgKey  = "device"
+	devicesCfgKey = "devices"
+	// probeTimeoutsCfgKey holds the per-device probe timeouts, e.g.
+	// 'probeTimeouts.<id>: 2s'.
+	probeTimeoutsCfgKey = "probeTimeouts"
+	// tokensCfgKey holds the bearer tokens of the devices that require
+	// authentication, e.g. 'tokens.<id>: secret'.
+	tokensCfgKey = "tokens"
+	// secretsCfgKey holds the shared secrets of the devices flashed with
+	// 'jag flash --auth', e.g. 'secrets.<id>: <hex>'.
+	secretsCfgKey = "secrets"
+)
+
+// storeDevice makes the device the currently selected device and adds it
+// to the devices known by Jaguar. The caller must write the config.
+func storeDevice(cfg *viper.Viper, d Device) {
+	d = storedDevice(d)
+	cfg.Set(deviceCfgKey, d)
+	cfg.Set(devicesCfgKey+"."+d.ID, d)
+}
+
+// storedDevice returns the device without the information that is only
+// computed for listing it, so it doesn't end up in the device config.
+func storedDevice(d Device) Device {
+	d.Alias = ""
+	d.Health = ""
+	return d
+}
+
+// lastDeviceID returns the ID of the currently selected device, or the
+// empty string if there is none.
+func lastDeviceID(cfg *viper.Viper) (string, error) {
+	if !cfg.IsSet(deviceCfgKey) {
+		return "", nil
+	}
+	var d Device
+	if err := cfg.UnmarshalKey(deviceCfgKey, &d); err != nil {
+		return "", err
+	}
+	return d.ID, nil
+}
+
+// updateKnownDevice replaces the stored information about a known device.
+// If it is the currently selected device, the selection is updated too.
+// The caller must write the config.
+func updateKnownDevice(cfg *viper.Viper, d Device) error {
+	d = storedDevice(d)
+	cfg.Set(devicesCfgKey+"."+d.ID, d)
+	if !cfg.IsSet(deviceCfgKey) {
+		return nil
+	}
+	var current Device
+	if err := cfg.UnmarshalKey(deviceCfgKey, &current); err != nil {
+		return err
+	}
+	if current.ID == d.ID {
+		cfg.Set(deviceCfgKey, d)
+	}
+	return nil
+}
+
+// applyProbeTimeout sets the probe timeout of the device from the
+// 'probeTimeouts' section of the device config, which is keyed by device
+// ID.
+func applyProbeTimeout(cfg *viper.Viper, d *Device) error {
+	key := probeTimeoutsCfgKey + "." + d.ID
+	if !cfg.IsSet(key) {
+		return nil
+	}
+	timeout, err := time.ParseDuration(cfg.GetString(key))
+	if err != nil {
+		return fmt.Errorf("cannot parse %s ('%s') as a duration", key, cfg.GetString(key))
+	}
+	d.probeTimeout = timeout
+	return nil
+}
+
+// applyCredentials sets the bearer token and the shared secret of the
+// device from the 'tokens' and 'secrets' sections of the device config,
+// which are keyed by device ID.
+func applyCredentials(cfg *viper.Viper, d *Device) {
+	d.token = cfg.GetString(tokensCfgKey + "." + d.ID)
+	d.secret = cfg.GetString(secretsCfgKey + "." + d.ID)
+}
+
+// storeToken remembers the bearer token of the device with the given ID.
+// An empty token is ignored, so a token is kept until it is replaced. The
+// caller must write the config.
+func storeToken(cfg *viper.Viper, id string, token string) {
+	if token != "" {
+		cfg.Set(tokensCfgKey+"."+id, token)
+	}
+}
+
+// forgetDevice removes the device with the given ID from the devices known
+// by Jaguar. The caller must write the config.
+func forgetDevice(cfg *viper.Viper, id string) {
+	if devices, ok := cfg.Get(devicesCfgKey).(map[string]interface{}); ok {
+		delete(devices, id)
+	}
+}
+
+// getKnownDevices returns the devices known by Jaguar sorted by name.
+func getKnownDevices(cfg *viper.Viper) ([]Device, error) {
+	if !cfg.IsSet(devicesCfgKey) {
+		return nil, nil
+	}
+	var known map[string]Device
+	if err := cfg.UnmarshalKey(devicesCfgKey, &known); err != nil {
+		return nil, err
+	}
+	var res []Device
+	for _, d := range known {
+		if err := applyProbeTimeout(cfg, &d); err != nil {
+			return nil, err
+		}
+		applyCredentials(cfg, &d)
+		res = append(res, d)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res, nil
+}
+
+// validateConfiguredDevice runs the validation command from the config, if
+// there is one, for the device.
+func validateConfiguredDevice(ctx context.Context, cfg *viper.Viper, d *Device) error {
+	validateCmd := cfg.GetString(scanValidateCmdCfgKey)
+	if validateCmd == "" {
+		return nil
+	}
+	return validateDevice(ctx, validateCmd, d)
+}
+
 func GetDevice(ctx context.Context, cfg *viper.Viper, sdk *SDK, checkPing bool, deviceSelect deviceSelect) (*Device, error) {
 	manualPick := deviceSelect != nil
-	if cfg.IsSet("device") && !manualPick {
+	var scheme string
+	var insecure bool
+	if cfg.IsSet(deviceCfgKey) && !manualPick {
 		var d Device
-		if err := cfg.UnmarshalKey("device", &d); err != nil {
+		if err := cfg.UnmarshalKey(deviceCfgKey, &d); err != nil {
 			return nil, err
 		}
+		// If we have to scan for the device, reach it the same way.
+		scheme, insecure = d.Scheme, d.Insecure
+		if err := applyProbeTimeout(cfg, &d); err != nil {
+			return nil, err
+		}
+		applyCredentials(cfg, &d)
+		d.Alias = aliasOf(getAliases(cfg), d.ID)
 		if checkPing {
+			if err := checkDeviceHealth(ctx, d); err != nil {
+				return nil, err
+			}
 			if d.Ping(ctx, sdk) {
+				recordProbes(ctx, map[string]bool{d.ID: true})
+				if err := validateConfiguredDevice(ctx, cfg, &d); err != nil {
+					return nil, err
+				}
 				return &d, nil
 			}
+			recordProbes(ctx, map[string]bool{d.ID: false})
 			deviceSelect = deviceIDSelect(d.ID)
-			fmt.Printf("Failed to ping '%s'.\n", d.Name)
+			getLogger(ctx).Infof("Failed to ping '%s'.", d.Name)
 		} else {
+			if err := validateConfiguredDevice(ctx, cfg, &d); err != nil {
+				return nil, err
+			}
 			return &d, nil
 		}
 	}
 
-	d, autoSelected, err := scanAndPickDevice(ctx, scanTimeout, scanPort, deviceSelect, manualPick)
+	lastID, err := lastDeviceID(cfg)
 	if err != nil {
 		return nil, err
 	}
+	opts := defaultScanOptions()
+	opts.lastDeviceID = lastID
+	opts.aliases = getAliases(cfg)
+	opts.pinnedAddress = pinnedAddress(cfg)
+	opts.scheme = scheme
+	opts.insecure = insecure
+	// The device picked by the scan is validated like the one picked by
+	// 'jag scan'.
+	opts.validateCmd = cfg.GetString(scanValidateCmdCfgKey)
+	if opts.known, err = getKnownDevices(cfg); err != nil {
+		return nil, err
+	}
+	d, autoSelected, err := scanAndPickDevice(ctx, opts, deviceSelect, manualPick)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyProbeTimeout(cfg, d); err != nil {
+		return nil, err
+	}
+	applyCredentials(cfg, d)
+	d.Alias = aliasOf(opts.aliases, d.ID)
 	if !manualPick {
 		if autoSelected {
-			fmt.Printf("Found device '%s' again\n", d.Name)
+			getLogger(ctx).Infof("Found device '%s' again", d.Name)
 		}
-		cfg.Set("device", d)
+		storeDevice(cfg, *d)
 		if err := cfg.WriteConfig(); err != nil {
 			return nil, err
 		}
@@ -0,0 +1,140 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/toitlang/jaguar/cmd/jag/directory"
+)
+
+const (
+	// healthFailureThreshold is the number of probes in a row a device
+	// may fail before it is marked unhealthy.
+	healthFailureThreshold = 3
+	// healthCooldown is how long an unhealthy device is skipped before it
+	// is probed again.
+	healthCooldown = time.Minute
+
+	healthFlaky     = "flaky"
+	healthUnhealthy = "unhealthy"
+)
+
+// deviceHealth holds the recent failures to reach a device. Devices
+// without failures have no entry. The failures are kept in a file, so
+// they carry over from one command to the next.
+type deviceHealth struct {
+	Failures       int       `json:"failures"`
+	UnhealthyUntil time.Time `json:"unhealthyUntil"`
+}
+
+// state returns the health of the device as shown by 'jag scan --list'.
+// It is empty for healthy devices.
+func (h deviceHealth) state() string {
+	if h.Failures == 0 {
+		return ""
+	}
+	if time.Now().Before(h.UnhealthyUntil) {
+		return healthUnhealthy
+	}
+	return healthFlaky
+}
+
+func readDeviceHealthFile(path string) (map[string]deviceHealth, error) {
+	entries := map[string]deviceHealth{}
+	if err := readJSONMap(path, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// readDeviceHealth returns the health of the devices, keyed by device ID.
+// If the health file can't be read, all devices are considered healthy.
+func readDeviceHealth() map[string]deviceHealth {
+	path, err := directory.GetDeviceHealthPath()
+	if err != nil {
+		return map[string]deviceHealth{}
+	}
+	entries, err := readDeviceHealthFile(path)
+	if err != nil {
+		return map[string]deviceHealth{}
+	}
+	return entries
+}
+
+// recordProbes updates the health of the devices with the results of
+// probing them, keyed by device ID. A device that answers has its failures
+// forgotten. A device that fails healthFailureThreshold times in a row is
+// marked unhealthy for healthCooldown.
+func recordProbes(ctx context.Context, results map[string]bool) {
+	path, err := directory.GetDeviceHealthPath()
+	if err != nil {
+		return
+	}
+	entries, err := readDeviceHealthFile(path)
+	if err != nil {
+		// A broken health file is replaced.
+		entries = map[string]deviceHealth{}
+	}
+	changed := false
+	for id, ok := range results {
+		h, known := entries[id]
+		if ok {
+			if known {
+				delete(entries, id)
+				changed = true
+			}
+			continue
+		}
+		h.Failures++
+		if h.Failures >= healthFailureThreshold {
+			h.UnhealthyUntil = time.Now().Add(healthCooldown)
+		}
+		entries[id] = h
+		changed = true
+	}
+	if !changed {
+		return
+	}
+	if err := writeJSONMap(path, entries); err != nil {
+		getLogger(ctx).Warnf("Failed to update device health: %s", err)
+	}
+}
+
+// checkDeviceHealth returns an error if the device is marked unhealthy,
+// so we don't wait for it to time out again. Once the cooldown is over,
+// the device must identify itself before it is used again.
+func checkDeviceHealth(ctx context.Context, d Device) error {
+	h := readDeviceHealth()[d.ID]
+	if h.Failures < healthFailureThreshold {
+		return nil
+	}
+	if remaining := time.Until(h.UnhealthyUntil); remaining > 0 {
+		return fmt.Errorf("device '%s' marked unhealthy after %d failed connections, skipping it for %s", d.Name, h.Failures, remaining.Round(time.Second))
+	}
+
+	probeCtx, cancel := context.WithTimeout(ctx, d.probeTimeoutFor(ctx, pingTimeout))
+	defer cancel()
+	identified, err := identifyDevice(probeCtx, d)
+	if err == nil && identified.ID != d.ID {
+		err = fmt.Errorf("address is used by another device with ID '%s'", identified.ID)
+	}
+	recordProbes(ctx, map[string]bool{d.ID: err == nil})
+	if err != nil {
+		return fmt.Errorf("device '%s' marked unhealthy, skipping it: %w", d.Name, err)
+	}
+	return nil
+}
+
+// applyHealth sets the health of the devices from the recent failures to
+// reach them.
+func applyHealth(devices []Device) {
+	health := readDeviceHealth()
+	for i := range devices {
+		devices[i].Health = health[devices[i].ID].state()
+	}
+}
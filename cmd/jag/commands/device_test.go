@@ -0,0 +1,114 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestDeviceSummary(t *testing.T) {
+	tests := []struct {
+		name   string
+		device Device
+		want   string
+	}{
+		{
+			"device",
+			Device{ID: "8bfa6a6c-7a40-4f8e-9a43-3b0e8c7f6a10", Name: "sensor", Address: "http://192.168.1.10:9000"},
+			"sensor (8bfa6a6c-7a40-4f8e-9a43-3b0e8c7f6a10, http://192.168.1.10:9000)",
+		},
+		{
+			"alias",
+			Device{ID: "8bfa6a6c-7a40-4f8e-9a43-3b0e8c7f6a10", Name: "sensor", Address: "http://192.168.1.10:9000", Alias: "kitchen"},
+			"kitchen (sensor, 8bfa6a6c-7a40-4f8e-9a43-3b0e8c7f6a10, http://192.168.1.10:9000)",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.device.Summary(); got != test.want {
+				t.Errorf("Summary() = %q, want %q", got, test.want)
+			}
+			if got := test.device.Short(); got != test.want {
+				t.Errorf("Short() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestStoredDevice(t *testing.T) {
+	d := Device{ID: "8bfa6a6c-7a40-4f8e-9a43-3b0e8c7f6a10", Name: "sensor", Alias: "kitchen", Health: "flaky"}
+	stored := storedDevice(d)
+	if stored.Alias != "" || stored.Health != "" {
+		t.Errorf("storedDevice() = %+v, want no alias and health", stored)
+	}
+	if stored.ID != d.ID || stored.Name != d.Name {
+		t.Errorf("storedDevice() = %+v, want the ID and name of %+v", stored, d)
+	}
+}
+
+func TestDevicesShortOutput(t *testing.T) {
+	devices := Devices{Devices: []Device{
+		{ID: "1", Name: "sensor", Address: "http://192.168.1.10:9000", SDKVersion: "v2.0.0-alpha.74", FirmwareVersion: "v1.9.0"},
+		{ID: "2", Name: "gateway", Address: "http://192.168.1.11:9000", SDKVersion: "v2.0.0-alpha.74", Alias: "hall", Health: "unreachable"},
+	}}
+	var buf bytes.Buffer
+	if err := newShortEncoder(&buf).Encode(devices); err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	want := "sensor (1, http://192.168.1.10:9000)          v2.0.0-alpha.74   v1.9.0\n" +
+		"hall (gateway, 2, http://192.168.1.11:9000)   v2.0.0-alpha.74            unreachable\n"
+	if got := buf.String(); got != want {
+		t.Errorf("short output =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestEmptyDevices(t *testing.T) {
+	for _, devices := range [][]Device{nil, {}} {
+		data, err := json.Marshal(newDevices(devices))
+		if err != nil {
+			t.Fatalf("Marshal() error = %v", err)
+		}
+		if got, want := string(data), `{"devices":[]}`; got != want {
+			t.Errorf("newDevices(%#v) = %s, want %s", devices, got, want)
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{newScanError(ErrNoDevicesFound, "didn't find any Jaguar devices"), noDevicesExitCode},
+		{fmt.Errorf("scan failed: %w", newScanError(ErrNoDevicesFound, "couldn't find the device")), noDevicesExitCode},
+		{newScanError(ErrDeviceUnreachable, "couldn't reach the device"), unreachableExitCode},
+		{newScanError(ErrAmbiguousSelection, "found 2 devices"), ambiguousExitCode},
+		{errors.New("failed"), 1},
+	}
+	for _, test := range tests {
+		if got := ExitCode(test.err); got != test.want {
+			t.Errorf("ExitCode(%v) = %d, want %d", test.err, got, test.want)
+		}
+	}
+}
+
+func TestProgressReader(t *testing.T) {
+	var progress bytes.Buffer
+	data := bytes.Repeat([]byte{42}, 4096)
+	var read bytes.Buffer
+	if _, err := read.ReadFrom(NewProgressReader(&progress, data)); err != nil {
+		t.Fatalf("ReadFrom() error = %v", err)
+	}
+	if !bytes.Equal(read.Bytes(), data) {
+		t.Errorf("read %d bytes, want %d", read.Len(), len(data))
+	}
+	if !bytes.Contains(progress.Bytes(), []byte("100%")) {
+		t.Errorf("progress %q doesn't reach 100%%", progress.String())
+	}
+}
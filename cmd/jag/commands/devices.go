@@ -0,0 +1,398 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/toitlang/jaguar/cmd/jag/directory"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	devicesPingTimeout = 2 * time.Second
+)
+
+// knownDeviceOutputFormats are the output formats of the commands on the
+// known devices.
+var knownDeviceOutputFormats = []string{"json", "yaml", "canonical", "short"}
+
+func DevicesCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "devices",
+		Aliases: []string{"device"},
+		Short:   "Manage the Jaguar devices you have used",
+		Long: "Manage the Jaguar devices you have used.\n" +
+			"Jaguar remembers the devices you select through 'jag scan' or by\n" +
+			"running commands on them.",
+	}
+
+	cmd.AddCommand(DevicesPingCmd())
+	cmd.AddCommand(DevicesFingerprintCmd())
+	cmd.AddCommand(DevicesRefreshCmd())
+	cmd.AddCommand(DevicesRenameCmd())
+	return cmd
+}
+
+const (
+	refreshRelocated = "relocated"
+	refreshUnchanged = "unchanged"
+	refreshNotFound  = "not found"
+)
+
+type DeviceRefresh struct {
+	ID         string `mapstructure:"id" yaml:"id" json:"id"`
+	Name       string `mapstructure:"name" yaml:"name" json:"name"`
+	Status     string `mapstructure:"status" yaml:"status" json:"status"`
+	Address    string `mapstructure:"address" yaml:"address" json:"address"`
+	OldAddress string `mapstructure:"oldAddress" yaml:"oldAddress,omitempty" json:"oldAddress,omitempty"`
+}
+
+type DeviceRefreshes struct {
+	Devices []DeviceRefresh `mapstructure:"devices" yaml:"devices" json:"devices"`
+}
+
+func DevicesRefreshCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "refresh",
+		Short: "Update the addresses of the known devices",
+		Long: "Update the addresses of the known devices.\n" +
+			"Scans for devices and matches them to the known devices by ID. The\n" +
+			"stored information of the devices that are found is updated, so devices\n" +
+			"that got a new address are found again after a change of the network.",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := directory.GetDeviceConfig()
+			if err != nil {
+				return err
+			}
+
+			timeout, err := cmd.Flags().GetDuration("timeout")
+			if err != nil {
+				return err
+			}
+
+			output, err := parseOutputFormatFlag(cmd, knownDeviceOutputFormats)
+			if err != nil {
+				return err
+			}
+
+			known, err := getKnownDevices(cfg)
+			if err != nil {
+				return err
+			}
+			if len(known) == 0 {
+				return fmt.Errorf("no known devices, use 'jag scan' to select a device")
+			}
+
+			opts := defaultScanOptions()
+			opts.timeout = timeout
+			scanned, err := scanDevices(cmd.Context(), nil, opts)
+			if err != nil {
+				return err
+			}
+			found := map[string]Device{}
+			for _, d := range scanned {
+				found[d.ID] = d
+			}
+
+			var refreshes DeviceRefreshes
+			for _, d := range known {
+				refresh := DeviceRefresh{
+					ID:      d.ID,
+					Name:    d.Name,
+					Address: d.Address,
+				}
+				fresh, ok := found[d.ID]
+				if !ok {
+					refresh.Status = refreshNotFound
+				} else {
+					if fresh.Address == d.Address {
+						refresh.Status = refreshUnchanged
+					} else {
+						refresh.Status = refreshRelocated
+						refresh.OldAddress = d.Address
+						refresh.Address = fresh.Address
+					}
+					refresh.Name = fresh.Name
+					if err := updateKnownDevice(cfg, fresh); err != nil {
+						return err
+					}
+				}
+				refreshes.Devices = append(refreshes.Devices, refresh)
+			}
+			if err := cfg.WriteConfig(); err != nil {
+				return err
+			}
+
+			switch output {
+			case "json":
+				return json.NewEncoder(os.Stdout).Encode(refreshes)
+			case "yaml":
+				return yaml.NewEncoder(os.Stdout).Encode(refreshes)
+			case "canonical":
+				return newCanonicalEncoder(os.Stdout).Encode(refreshes)
+			default:
+				printDeviceRefreshes(refreshes)
+				return nil
+			}
+		},
+	}
+
+	cmd.Flags().DurationP("timeout", "t", scanTimeout, "how long to scan")
+	cmd.Flags().StringP("output", "o", "short", "set output format to json, yaml, canonical or short")
+	return cmd
+}
+
+func printDeviceRefreshes(refreshes DeviceRefreshes) {
+	nameLength := len("DEVICE")
+	statusLength := len("STATUS")
+	for _, r := range refreshes.Devices {
+		nameLength = max(nameLength, len(r.Name))
+		statusLength = max(statusLength, len(r.Status))
+	}
+
+	fmt.Println(padded("DEVICE", nameLength) + padded("STATUS", statusLength) + "ADDRESS")
+	for _, r := range refreshes.Devices {
+		address := r.Address
+		if r.Status == refreshRelocated {
+			address = r.OldAddress + " -> " + r.Address
+		}
+		fmt.Println(padded(r.Name, nameLength) + padded(r.Status, statusLength) + address)
+	}
+}
+
+func DevicesFingerprintCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "fingerprint <id>",
+		Short: "Print the fingerprint of a device",
+		Long: "Print the fingerprint of a device. The fingerprint is a stable hash of\n" +
+			"the fields that identify the physical device. Use it with\n" +
+			"'jag scan --fingerprint' to make sure you always target the same board.",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := directory.GetDeviceConfig()
+			if err != nil {
+				return err
+			}
+
+			id := args[0]
+			devices, err := getKnownDevices(cfg)
+			if err != nil {
+				return err
+			}
+			for _, d := range devices {
+				if d.ID == id {
+					fmt.Println(d.Fingerprint())
+					return nil
+				}
+			}
+
+			device, _, err := scanAndPickDevice(cmd.Context(), defaultScanOptions(), deviceIDSelect(id), true)
+			if err != nil {
+				return err
+			}
+			fmt.Println(device.Fingerprint())
+			return nil
+		},
+	}
+	return cmd
+}
+
+func DevicesRenameCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rename <id> <alias>",
+		Short: "Give a device a local alias",
+		Long: "Give a device a local alias, replacing any alias it already has.\n" +
+			"The alias is only stored on this machine and is shown by 'jag scan'.\n" +
+			"It can be used instead of the device name, e.g. 'jag run -d <alias>'.",
+		Args:         cobra.ExactArgs(2),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := directory.GetDeviceConfig()
+			if err != nil {
+				return err
+			}
+
+			id, alias := args[0], strings.ToLower(args[1])
+			if aliases, ok := cfg.Get(aliasesCfgKey).(map[string]interface{}); ok {
+				for a, aliasID := range aliases {
+					if aliasID == id && a != alias {
+						delete(aliases, a)
+					}
+				}
+			}
+			if err := setAlias(cfg, alias, id); err != nil {
+				return err
+			}
+			if err := cfg.WriteConfig(); err != nil {
+				return err
+			}
+			fmt.Printf("Device '%s' is now known as '%s'\n", id, alias)
+			return nil
+		},
+	}
+	return cmd
+}
+
+type DevicePing struct {
+	ID        string  `mapstructure:"id" yaml:"id" json:"id"`
+	Name      string  `mapstructure:"name" yaml:"name" json:"name"`
+	Address   string  `mapstructure:"address" yaml:"address" json:"address"`
+	Up        bool    `mapstructure:"up" yaml:"up" json:"up"`
+	LatencyMs float64 `mapstructure:"latencyMs" yaml:"latencyMs" json:"latencyMs"`
+	Error     string  `mapstructure:"error" yaml:"error,omitempty" json:"error,omitempty"`
+}
+
+type DevicePings struct {
+	Devices []DevicePing `mapstructure:"devices" yaml:"devices" json:"devices"`
+}
+
+func DevicesPingCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "ping",
+		Short: "Check which of the known devices are reachable",
+		Long: "Check which of the known devices are reachable by asking all of them\n" +
+			"to identify themselves. Exits with a non-zero exit code if any of the\n" +
+			"devices are down, unless '--ignore-down' is given.",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := directory.GetDeviceConfig()
+			if err != nil {
+				return err
+			}
+
+			timeout, err := cmd.Flags().GetDuration("timeout")
+			if err != nil {
+				return err
+			}
+
+			ignoreDown, err := cmd.Flags().GetBool("ignore-down")
+			if err != nil {
+				return err
+			}
+
+			output, err := parseOutputFormatFlag(cmd, knownDeviceOutputFormats)
+			if err != nil {
+				return err
+			}
+
+			devices, err := getKnownDevices(cfg)
+			if err != nil {
+				return err
+			}
+			if len(devices) == 0 {
+				return fmt.Errorf("no known devices, use 'jag scan' to select a device")
+			}
+
+			pings := pingDevices(cmd.Context(), devices, timeout)
+
+			switch output {
+			case "json":
+				err = json.NewEncoder(os.Stdout).Encode(pings)
+			case "yaml":
+				err = yaml.NewEncoder(os.Stdout).Encode(pings)
+			case "canonical":
+				err = newCanonicalEncoder(os.Stdout).Encode(pings)
+			case "short":
+				printDevicePings(pings)
+			}
+			if err != nil {
+				return err
+			}
+
+			down := 0
+			for _, p := range pings.Devices {
+				if !p.Up {
+					down++
+				}
+			}
+			if down > 0 && !ignoreDown {
+				return fmt.Errorf("%d of %d devices are down", down, len(pings.Devices))
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().DurationP("timeout", "t", devicesPingTimeout, "how long to wait for each device to reply")
+	cmd.Flags().StringP("output", "o", "short", "set output format to json, yaml, canonical or short")
+	cmd.Flags().Bool("ignore-down", false, "if set, don't fail when some devices are down")
+	return cmd
+}
+
+// pingDevices asks all the devices to identify themselves concurrently. A
+// device is only considered up if it still has the ID we know it by.
+func pingDevices(ctx context.Context, devices []Device, timeout time.Duration) DevicePings {
+	res := DevicePings{
+		Devices: make([]DevicePing, len(devices)),
+	}
+
+	var wg sync.WaitGroup
+	for i, d := range devices {
+		wg.Add(1)
+		go func(i int, d Device) {
+			defer wg.Done()
+			ping := DevicePing{
+				ID:      d.ID,
+				Name:    d.Name,
+				Address: d.Address,
+			}
+
+			pingCtx, cancel := context.WithTimeout(ctx, d.probeTimeoutFor(ctx, timeout))
+			defer cancel()
+			start := time.Now()
+			identified, err := identifyDevice(pingCtx, d)
+			latency := time.Since(start)
+			if err != nil {
+				ping.Error = err.Error()
+			} else if identified.ID != d.ID {
+				ping.Error = fmt.Sprintf("address is used by another device with ID '%s'", identified.ID)
+			} else {
+				ping.Up = true
+				ping.LatencyMs = float64(latency.Microseconds()) / 1000
+			}
+			res.Devices[i] = ping
+		}(i, d)
+	}
+	wg.Wait()
+
+	// The pings are the health checks of the devices.
+	results := map[string]bool{}
+	for _, p := range res.Devices {
+		results[p.ID] = p.Up
+	}
+	recordProbes(ctx, results)
+	return res
+}
+
+func printDevicePings(pings DevicePings) {
+	nameLength := len("DEVICE")
+	addressLength := len("ADDRESS")
+	statusLength := len("STATUS")
+	for _, p := range pings.Devices {
+		nameLength = max(nameLength, len(p.Name))
+		addressLength = max(addressLength, len(p.Address))
+	}
+
+	fmt.Println(padded("DEVICE", nameLength) + padded("ADDRESS", addressLength) + padded("STATUS", statusLength) + "LATENCY")
+	for _, p := range pings.Devices {
+		if p.Up {
+			latency := time.Duration(p.LatencyMs * float64(time.Millisecond)).Round(time.Millisecond)
+			fmt.Println(padded(p.Name, nameLength) + padded(p.Address, addressLength) + padded("up", statusLength) + latency.String())
+		} else {
+			fmt.Println(padded(p.Name, nameLength) + padded(p.Address, addressLength) + padded("down", statusLength) + p.Error)
+		}
+	}
+}
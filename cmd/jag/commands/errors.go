@@ -0,0 +1,67 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The reasons for a failed device discovery. Use errors.Is to check for
+// them; each has its own exit code.
+var (
+	ErrNoDevicesFound     = errors.New("no devices found")
+	ErrDeviceUnreachable  = errors.New("device unreachable")
+	ErrAmbiguousSelection = errors.New("ambiguous device selection")
+)
+
+// The exit codes of the commands. Scripts can rely on them to tell why a
+// command failed. Other errors exit with 1.
+const (
+	noDevicesExitCode   = 2
+	unreachableExitCode = 3
+	ambiguousExitCode   = 4
+)
+
+// scanError is an error with its own message that is one of the reasons
+// above for errors.Is.
+type scanError struct {
+	reason error
+	err    error
+}
+
+// newScanError returns an error for the reason with a message formatted
+// like fmt.Errorf.
+func newScanError(reason error, format string, args ...interface{}) error {
+	return &scanError{
+		reason: reason,
+		err:    fmt.Errorf(format, args...),
+	}
+}
+
+func (e *scanError) Error() string {
+	return e.err.Error()
+}
+
+func (e *scanError) Unwrap() error {
+	return e.err
+}
+
+func (e *scanError) Is(target error) bool {
+	return target == e.reason
+}
+
+// ExitCode returns the exit code for an error returned by a command.
+func ExitCode(err error) int {
+	switch {
+	case errors.Is(err, ErrNoDevicesFound):
+		return noDevicesExitCode
+	case errors.Is(err, ErrDeviceUnreachable):
+		return unreachableExitCode
+	case errors.Is(err, ErrAmbiguousSelection):
+		return ambiguousExitCode
+	}
+	return 1
+}
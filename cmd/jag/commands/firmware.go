@@ -28,153 +28,243 @@ func FirmwareCmd() *cobra.Command {
 		Args:         cobra.NoArgs,
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			cfg, err := directory.GetDeviceConfig()
+			out, err := parseCommandOutput(cmd)
 			if err != nil {
 				return err
 			}
-
-			ctx := cmd.Context()
-			deviceSelect, err := parseDeviceFlag(cmd)
-			if err != nil {
-				return err
-			}
-
-			sdk, err := GetSDK(ctx)
-			if err != nil {
-				return err
-			}
-
-			device, err := GetDevice(ctx, cfg, sdk, true, deviceSelect)
-			if err != nil {
-				return err
-			}
-
-			fmt.Printf("Device '%s' is running Toit SDK %s\n", device.Name, device.SDKVersion)
-			return nil
+			result := &firmwareResult{}
+			return out.print(result, showFirmware(cmd, result))
 		},
 	}
 	cmd.AddCommand(FirmwareUpdateCmd())
 	cmd.Flags().StringP("device", "d", "", "use device with a given name, id, or address")
+	addOutputFlag(cmd)
 	return cmd
 }
 
+// firmwareResult is the result of 'jag firmware' printed with --output.
+type firmwareResult struct {
+	commandStatus   `yaml:",inline"`
+	Device          *deviceResult `mapstructure:"device" yaml:"device,omitempty" json:"device,omitempty"`
+	SDKVersion      string        `mapstructure:"sdkVersion" yaml:"sdkVersion,omitempty" json:"sdkVersion,omitempty"`
+	FirmwareVersion string        `mapstructure:"firmwareVersion" yaml:"firmwareVersion,omitempty" json:"firmwareVersion,omitempty"`
+}
+
+func showFirmware(cmd *cobra.Command, result *firmwareResult) error {
+	cfg, err := directory.GetDeviceConfig()
+	if err != nil {
+		return err
+	}
+
+	ctx := cmd.Context()
+	deviceSelect, err := parseDeviceFlag(cmd)
+	if err != nil {
+		return err
+	}
+
+	sdk, err := GetSDK(ctx)
+	if err != nil {
+		return err
+	}
+
+	device, err := GetDevice(ctx, cfg, sdk, true, deviceSelect)
+	if err != nil {
+		return err
+	}
+
+	result.Device = newDeviceResult(device)
+	result.SDKVersion = device.SDKVersion
+	result.FirmwareVersion = device.FirmwareVersion
+	fmt.Fprintf(getStdout(ctx), "Device '%s' is running Toit SDK %s\n", device.Name, device.SDKVersion)
+	return nil
+}
+
 func FirmwareUpdateCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "update [envelope]",
 		Short: "Update the firmware on a Jaguar device",
 		Long: "Update the firmware on a Jaguar device via WiFi. The device name and\n" +
-			"id are preserved across the operation.",
+			"id are preserved across the operation.\n\n" +
+			"Jaguar remembers the firmware it installed on a device, and the next update\n" +
+			"of that device only uploads a patch against it. The device checks that it\n" +
+			"runs the firmware the patch is for, and the full firmware is uploaded if it\n" +
+			"doesn't, or if the device was flashed over serial. Use '--full' to always\n" +
+			"upload the full firmware.",
 		Args:         cobra.MaximumNArgs(1),
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			cfg, err := directory.GetDeviceConfig()
+			out, err := parseCommandOutput(cmd)
 			if err != nil {
 				return err
 			}
+			result := &firmwareUpdateResult{}
+			return out.print(result, updateFirmwareCmd(cmd, args, result))
+		},
+	}
 
-			ctx := cmd.Context()
-			deviceSelect, err := parseDeviceFlag(cmd)
-			if err != nil {
-				return err
-			}
+	cmd.Flags().StringP("chip", "c", "esp32", "chip of the target device")
+	cmd.Flags().String("wifi-ssid", "", "default WiFi network name")
+	cmd.Flags().String("wifi-password", "", "default WiFi password")
+	cmd.Flags().StringP("device", "d", "", "use device with a given name, id, or address")
+	cmd.Flags().Bool("exclude-jaguar", false, "don't install the Jaguar service")
+	cmd.Flags().Bool("full", false, "upload the full firmware, even if a patch against the current firmware can be used")
+	addOutputFlag(cmd)
+	return cmd
+}
 
-			sdk, err := GetSDK(ctx)
-			if err != nil {
-				return err
-			}
+// firmwareUpdateResult is the result of 'jag firmware update' printed with
+// --output. The device has the ID it got with the new firmware.
+type firmwareUpdateResult struct {
+	commandStatus `yaml:",inline"`
+	Device        *deviceResult `mapstructure:"device" yaml:"device,omitempty" json:"device,omitempty"`
+	SDKVersion    string        `mapstructure:"sdkVersion" yaml:"sdkVersion,omitempty" json:"sdkVersion,omitempty"`
+	// Patch is set if only a patch against the current firmware was
+	// uploaded.
+	Patch         bool `mapstructure:"patch" yaml:"patch" json:"patch"`
+	UploadedBytes int  `mapstructure:"uploadedBytes" yaml:"uploadedBytes" json:"uploadedBytes"`
+}
 
-			// We need to generate a new ID for the device, so entries in
-			// the device flash stored by an older version are invalidated.
-			newID := uuid.New().String()
+func updateFirmwareCmd(cmd *cobra.Command, args []string, result *firmwareUpdateResult) error {
+	cfg, err := directory.GetDeviceConfig()
+	if err != nil {
+		return err
+	}
 
-			device, err := GetDevice(ctx, cfg, sdk, true, deviceSelect)
-			if err != nil {
-				return err
-			}
+	ctx := cmd.Context()
+	deviceSelect, err := parseDeviceFlag(cmd)
+	if err != nil {
+		return err
+	}
 
-			chip, err := cmd.Flags().GetString("chip")
-			if err != nil {
-				return err
-			}
+	sdk, err := GetSDK(ctx)
+	if err != nil {
+		return err
+	}
 
-			// TODO(kasper): Make 'auto' the default.
-			if chip == "auto" {
-				chip = device.Chip
-			}
+	// We need to generate a new ID for the device, so entries in
+	// the device flash stored by an older version are invalidated.
+	newID := uuid.New().String()
 
-			wifiSSID, wifiPassword, err := getWifiCredentials(cmd)
-			if err != nil {
-				return err
-			}
+	device, err := GetDevice(ctx, cfg, sdk, true, deviceSelect)
+	if err != nil {
+		return err
+	}
 
-			deviceOptions := DeviceOptions{
-				Id:           newID,
-				Name:         device.Name,
-				Chip:         chip,
-				WifiSsid:     wifiSSID,
-				WifiPassword: wifiPassword,
-			}
+	chip, err := cmd.Flags().GetString("chip")
+	if err != nil {
+		return err
+	}
 
-			var envelopePath string
-			if len(args) == 1 {
-				envelopePath = args[0]
-			} else {
-				envelopePath, err = directory.GetFirmwareEnvelopePath(chip)
-				if err != nil {
-					return err
-				}
-			}
+	// TODO(kasper): Make 'auto' the default.
+	if chip == "auto" {
+		chip = device.Chip
+	}
 
-			excludeJaguar, err := cmd.Flags().GetBool("exclude-jaguar")
-			if err != nil {
-				return err
-			}
+	wifiSSID, wifiPassword, err := getWifiCredentials(cmd)
+	if err != nil {
+		return err
+	}
 
-			envelopeOptions := EnvelopeOptions{
-				Path:          envelopePath,
-				ExcludeJaguar: excludeJaguar,
-			}
+	deviceOptions := DeviceOptions{
+		Id:           newID,
+		Name:         device.Name,
+		Chip:         chip,
+		WifiSsid:     wifiSSID,
+		WifiPassword: wifiPassword,
+		// Keep requiring the secret the device was flashed with. The
+		// device already has it, so it isn't sent along in the firmware.
+		KeepSecret: device.secret != "",
+	}
 
-			envelopeFile, err := BuildFirmwareEnvelope(ctx, envelopeOptions, deviceOptions)
-			if err != nil {
-				return err
-			}
-			defer os.Remove(envelopeFile.Name())
+	var envelopePath string
+	if len(args) == 1 {
+		envelopePath = args[0]
+	} else {
+		envelopePath, err = directory.GetFirmwareEnvelopePath(chip)
+		if err != nil {
+			return err
+		}
+	}
 
-			config := deviceOptions.GetConfig()
-			firmwareBin, err := ExtractFirmwareBin(ctx, sdk, envelopeFile.Name(), config)
-			if err != nil {
-				return err
-			}
-			defer os.Remove(firmwareBin.Name())
+	excludeJaguar, err := cmd.Flags().GetBool("exclude-jaguar")
+	if err != nil {
+		return err
+	}
 
-			bin, err := ioutil.ReadFile(firmwareBin.Name())
-			if err != nil {
-				return err
-			}
+	envelopeOptions := EnvelopeOptions{
+		Path:          envelopePath,
+		ExcludeJaguar: excludeJaguar,
+	}
 
-			fmt.Printf("Updating firmware on '%s' to Toit SDK %s\n\n", device.Name, sdk.Version)
-			if err := device.UpdateFirmware(ctx, sdk, bin); err != nil {
-				return err
-			}
+	envelopeFile, err := BuildFirmwareEnvelope(ctx, envelopeOptions, deviceOptions)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(envelopeFile.Name())
 
-			// Update the device ID and the SDK version and store them back, so users don't
-			// have to scan and ping before they can use the device after the firmware update.
-			// If the update failed or if the device got a new IP address after rebooting, we
-			// will have to ping again.
-			device.ID = newID
-			device.SDKVersion = sdk.Version
-			cfg.Set("device", device)
-			return cfg.WriteConfig()
-		},
+	config := deviceOptions.GetConfig()
+	firmwareBin, err := ExtractFirmwareBin(ctx, sdk, envelopeFile.Name(), config)
+	if err != nil {
+		return err
 	}
+	defer os.Remove(firmwareBin.Name())
 
-	cmd.Flags().StringP("chip", "c", "esp32", "chip of the target device")
-	cmd.Flags().String("wifi-ssid", "", "default WiFi network name")
-	cmd.Flags().String("wifi-password", "", "default WiFi password")
-	cmd.Flags().StringP("device", "d", "", "use device with a given name, id, or address")
-	cmd.Flags().Bool("exclude-jaguar", false, "don't install the Jaguar service")
-	return cmd
+	bin, err := ioutil.ReadFile(firmwareBin.Name())
+	if err != nil {
+		return err
+	}
+
+	full, err := cmd.Flags().GetBool("full")
+	if err != nil {
+		return err
+	}
+
+	patched, uploaded, err := updateFirmware(ctx, sdk, *device, bin, full)
+	result.Patch = patched
+	result.UploadedBytes = uploaded
+	if err != nil {
+		return err
+	}
+
+	// Update the device ID and the SDK version and store them back, so users don't
+	// have to scan and ping before they can use the device after the firmware update.
+	// If the update failed or if the device got a new IP address after rebooting, we
+	// will have to ping again.
+	forgetDevice(cfg, device.ID)
+	if device.secret != "" {
+		forgetSecret(cfg, device.ID)
+		storeSecret(cfg, newID, device.secret)
+	}
+	forgetFirmwareBaseline(device.ID)
+	if err := storeFirmwareBaseline(newID, bin); err != nil {
+		getLogger(ctx).Warnf("Failed to remember the firmware of '%s', the next update uploads it in full: %s", device.Name, err)
+	}
+	device.ID = newID
+	device.SDKVersion = sdk.Version
+	result.Device = newDeviceResult(device)
+	result.SDKVersion = sdk.Version
+	storeDevice(cfg, *device)
+	return cfg.WriteConfig()
+}
+
+// updateFirmware uploads the firmware to the device. If the firmware the
+// device runs is known and not full, only a patch against it is uploaded,
+// unless the patch is hardly smaller than the firmware. It returns whether
+// a patch was used and how many bytes were uploaded.
+func updateFirmware(ctx context.Context, sdk *SDK, device Device, bin []byte, full bool) (bool, int, error) {
+	if base := loadFirmwareBaseline(device.ID); base != nil && !full {
+		patch := firmwareDelta(base, bin)
+		if len(patch) < len(bin)*3/4 {
+			fmt.Fprintf(getStdout(ctx), "Updating firmware on '%s' to Toit SDK %s with a %dk patch\n\n", device.Name, sdk.Version, len(patch)>>10)
+			err := device.UpdateFirmwareDelta(ctx, sdk, base, bin, patch)
+			if err != errFirmwareBaselineMismatch {
+				return true, len(patch), err
+			}
+			fmt.Fprintf(getStdout(ctx), "The device '%s' doesn't run the firmware the patch is for\n", device.Name)
+		}
+	}
+	fmt.Fprintf(getStdout(ctx), "Updating firmware on '%s' to Toit SDK %s\n\n", device.Name, sdk.Version)
+	return false, len(bin), device.UpdateFirmware(ctx, sdk, bin)
 }
 
 type DeviceOptions struct {
@@ -183,6 +273,12 @@ type DeviceOptions struct {
 	Chip         string
 	WifiSsid     string
 	WifiPassword string
+	// Secret is the shared secret the device requires requests to be
+	// signed with. Devices without a secret accept unsigned requests.
+	// KeepSecret makes the device keep requiring the secret it has, so
+	// firmware updates over the network don't contain the secret.
+	Secret     string
+	KeepSecret bool
 }
 
 type EnvelopeOptions struct {
@@ -228,9 +324,15 @@ func BuildFirmwareEnvelope(ctx context.Context, envelope EnvelopeOptions, device
 		}
 
 		configAssetMap := map[string]interface{}{
-			"id":   device.Id,
-			"name": device.Name,
-			"chip": device.Chip,
+			"id":      device.Id,
+			"name":    device.Name,
+			"chip":    device.Chip,
+			"version": GetInfo(ctx).Version,
+		}
+		if device.Secret != "" {
+			configAssetMap["secret"] = device.Secret
+		} else if device.KeepSecret {
+			configAssetMap["keep-secret"] = true
 		}
 		configAssetJson, err := json.Marshal(configAssetMap)
 		if err != nil {
@@ -317,6 +419,13 @@ func setFirmwareProperty(ctx context.Context, sdk *SDK, envelope *os.File, key s
 }
 
 func runFirmwareToolWithConfig(ctx context.Context, sdk *SDK, envelopePath string, config map[string]interface{}, args ...string) error {
+	return runFirmwareToolWithConfigTo(ctx, sdk, nil, envelopePath, config, args...)
+}
+
+// runFirmwareToolWithConfigTo is like runFirmwareToolWithConfig, but writes
+// all the output of the tool to w. If w is nil, stdout and stderr are
+// used.
+func runFirmwareToolWithConfigTo(ctx context.Context, sdk *SDK, w io.Writer, envelopePath string, config map[string]interface{}, args ...string) error {
 	configFile, err := os.CreateTemp("", "*.json.config")
 	if err != nil {
 		return err
@@ -333,14 +442,23 @@ func runFirmwareToolWithConfig(ctx context.Context, sdk *SDK, envelopePath strin
 	}
 
 	args = append(args, "--config", configFile.Name())
-	return runFirmwareTool(ctx, sdk, envelopePath, args...)
+	return runFirmwareToolTo(ctx, sdk, w, envelopePath, args...)
 }
 
 func runFirmwareTool(ctx context.Context, sdk *SDK, envelopePath string, args ...string) error {
+	return runFirmwareToolTo(ctx, sdk, nil, envelopePath, args...)
+}
+
+func runFirmwareToolTo(ctx context.Context, sdk *SDK, w io.Writer, envelopePath string, args ...string) error {
 	args = append([]string{"-e", envelopePath}, args...)
 	cmd := sdk.FirmwareTool(ctx, args...)
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
+	if w != nil {
+		cmd.Stderr = w
+		cmd.Stdout = w
+	} else {
+		cmd.Stderr = os.Stderr
+		cmd.Stdout = getStdout(ctx)
+	}
 	return cmd.Run()
 }
 
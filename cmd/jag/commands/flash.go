@@ -20,111 +20,197 @@ func FlashCmd() *cobra.Command {
 		Short: "Flash an ESP32 with the Jaguar firmware",
 		Long: "Flash an ESP32 with the Jaguar firmware. The initial flashing is\n" +
 			"done over a serial connection and it is used to give the ESP32 its initial\n" +
-			"firmware and the necessary WiFi credentials.",
+			"firmware and the necessary WiFi credentials.\n\n" +
+			"To flash several devices at once, give '--port' a comma-separated list of\n" +
+			"ports or globs, like '--port /dev/ttyUSB*'. The devices are flashed in\n" +
+			"parallel, each with its own ID and name, and a summary is printed at the end.\n\n" +
+			"With '--auth', the device is given a random shared secret and only accepts\n" +
+			"requests signed with it. The secret is stored in the device config, so\n" +
+			"only this machine can run code on the device.",
 		Args:         cobra.MaximumNArgs(1),
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			ctx := cmd.Context()
-			sdk, err := GetSDK(ctx)
+			out, err := parseCommandOutput(cmd)
 			if err != nil {
 				return err
 			}
+			result := &flashCommandResult{}
+			return out.print(result, flash(cmd, args, result))
+		},
+	}
 
-			port, err := cmd.Flags().GetString("port")
-			if err != nil {
-				return err
-			}
-			if port, err = CheckPort(port); err != nil {
-				return err
-			}
+	cmd.Flags().StringP("port", "p", ConfiguredPort(), "serial port to flash via, or a comma-separated list of ports or globs like '/dev/ttyUSB*' to flash several devices in parallel")
+	cmd.Flags().Uint("baud", 921600, "baud rate used for the serial flashing")
+	cmd.Flags().StringP("chip", "c", "esp32", "chip of the target device")
+	cmd.Flags().String("wifi-ssid", "", "default WiFi network name")
+	cmd.Flags().String("wifi-password", "", "default WiFi password")
+	cmd.Flags().String("name", "", "name for the device, if not set a name will be auto generated")
+	cmd.Flags().Bool("exclude-jaguar", false, "don't install the Jaguar service")
+	cmd.Flags().Bool("auth", false, "provision a shared secret that the device requires all requests to be signed with")
+	addOutputFlag(cmd)
+	return cmd
+}
 
-			baud, err := cmd.Flags().GetUint("baud")
-			if err != nil {
-				return err
-			}
+// flashCommandResult is the result of 'jag flash' printed with --output.
+type flashCommandResult struct {
+	commandStatus `yaml:",inline"`
+	// Devices are the flashed devices, with the error for each of them
+	// flashing failed for.
+	Devices []flashedDevice `mapstructure:"devices" yaml:"devices" json:"devices"`
+}
 
-			chip, err := cmd.Flags().GetString("chip")
-			if err != nil {
-				return err
-			}
+type flashedDevice struct {
+	Port  string `mapstructure:"port" yaml:"port" json:"port"`
+	ID    string `mapstructure:"id" yaml:"id" json:"id"`
+	Name  string `mapstructure:"name" yaml:"name" json:"name"`
+	Chip  string `mapstructure:"chip" yaml:"chip" json:"chip"`
+	Error string `mapstructure:"error" yaml:"error,omitempty" json:"error,omitempty"`
+}
 
-			if chip == "auto" {
-				return fmt.Errorf("auto-detecting chip type isn't supported yet")
-			}
+func (r *flashCommandResult) add(port string, device DeviceOptions, err error) {
+	d := flashedDevice{
+		Port: port,
+		ID:   device.Id,
+		Name: device.Name,
+		Chip: device.Chip,
+	}
+	if err != nil {
+		d.Error = err.Error()
+	}
+	r.Devices = append(r.Devices, d)
+}
 
-			id := uuid.New()
-			var name string
-			if cmd.Flags().Changed("name") {
-				name, err = cmd.Flags().GetString("name")
-				if err != nil {
-					return err
-				}
-			} else {
-				name = GetRandomName(id[:])
-			}
+func flash(cmd *cobra.Command, args []string, result *flashCommandResult) error {
+	ctx := cmd.Context()
+	sdk, err := GetSDK(ctx)
+	if err != nil {
+		return err
+	}
 
-			wifiSSID, wifiPassword, err := getWifiCredentials(cmd)
-			if err != nil {
-				return err
-			}
+	port, err := cmd.Flags().GetString("port")
+	if err != nil {
+		return err
+	}
+	var ports []string
+	if isPortList(port) {
+		if ports, err = expandPorts(port); err != nil {
+			return err
+		}
+		if cmd.Flags().Changed("name") && len(ports) > 1 {
+			return fmt.Errorf("--name can't be used when flashing several devices, as their names must differ")
+		}
+	} else if port, err = CheckPort(port); err != nil {
+		return err
+	}
 
-			deviceOptions := DeviceOptions{
-				Id:           id.String(),
-				Name:         name,
-				Chip:         chip,
-				WifiSsid:     wifiSSID,
-				WifiPassword: wifiPassword,
-			}
+	baud, err := cmd.Flags().GetUint("baud")
+	if err != nil {
+		return err
+	}
 
-			var envelopePath string
-			if len(args) == 1 {
-				envelopePath = args[0]
-			} else {
-				envelopePath, err = directory.GetFirmwareEnvelopePath(chip)
-				if err != nil {
-					return err
-				}
-			}
+	chip, err := cmd.Flags().GetString("chip")
+	if err != nil {
+		return err
+	}
 
-			excludeJaguar, err := cmd.Flags().GetBool("exclude-jaguar")
-			if err != nil {
-				return err
-			}
+	if chip == "auto" {
+		return fmt.Errorf("auto-detecting chip type isn't supported yet")
+	}
 
-			envelopeOptions := EnvelopeOptions{
-				Path:          envelopePath,
-				ExcludeJaguar: excludeJaguar,
-			}
+	var name string
+	if cmd.Flags().Changed("name") {
+		name, err = cmd.Flags().GetString("name")
+		if err != nil {
+			return err
+		}
+	}
 
-			envelopeFile, err := BuildFirmwareEnvelope(ctx, envelopeOptions, deviceOptions)
-			if err != nil {
-				return err
-			}
-			defer os.Remove(envelopeFile.Name())
+	wifiSSID, wifiPassword, err := getWifiCredentials(cmd)
+	if err != nil {
+		return err
+	}
 
-			if chip == "esp32s3-spiram-octo" {
-				chip = "esp32s3"
-			}
+	var envelopePath string
+	if len(args) == 1 {
+		envelopePath = args[0]
+	} else {
+		envelopePath, err = directory.GetFirmwareEnvelopePath(chip)
+		if err != nil {
+			return err
+		}
+	}
+
+	excludeJaguar, err := cmd.Flags().GetBool("exclude-jaguar")
+	if err != nil {
+		return err
+	}
+
+	envelopeOptions := EnvelopeOptions{
+		Path:          envelopePath,
+		ExcludeJaguar: excludeJaguar,
+	}
 
-			flashArguments := []string{
-				"flash",
-				"--chip", chip,
-				"--port", port,
-				"--baud", strconv.Itoa(int(baud)),
+	auth, err := cmd.Flags().GetBool("auth")
+	if err != nil {
+		return err
+	}
+
+	// Every device gets its own ID, name and secret.
+	newDeviceOptions := func() (DeviceOptions, error) {
+		id := uuid.New()
+		deviceName := name
+		if deviceName == "" {
+			deviceName = GetRandomName(id[:])
+		}
+		var secret string
+		if auth {
+			if secret, err = newSecret(); err != nil {
+				return DeviceOptions{}, err
 			}
+		}
+		return DeviceOptions{
+			Id:           id.String(),
+			Name:         deviceName,
+			Chip:         chip,
+			WifiSsid:     wifiSSID,
+			WifiPassword: wifiPassword,
+			Secret:       secret,
+		}, nil
+	}
 
-			fmt.Printf("Flashing device over serial on port '%s' ...\n", port)
-			config := deviceOptions.GetConfig()
-			return runFirmwareToolWithConfig(ctx, sdk, envelopeFile.Name(), config, flashArguments...)
-		},
+	toolChip := chip
+	if toolChip == "esp32s3-spiram-octo" {
+		toolChip = "esp32s3"
+	}
+	flashArguments := func(port string) []string {
+		return []string{
+			"flash",
+			"--chip", toolChip,
+			"--port", port,
+			"--baud", strconv.Itoa(int(baud)),
+		}
 	}
 
-	cmd.Flags().StringP("port", "p", ConfiguredPort(), "serial port to flash via")
-	cmd.Flags().Uint("baud", 921600, "baud rate used for the serial flashing")
-	cmd.Flags().StringP("chip", "c", "esp32", "chip of the target device")
-	cmd.Flags().String("wifi-ssid", "", "default WiFi network name")
-	cmd.Flags().String("wifi-password", "", "default WiFi password")
-	cmd.Flags().String("name", "", "name for the device, if not set a name will be auto generated")
-	cmd.Flags().Bool("exclude-jaguar", false, "don't install the Jaguar service")
-	return cmd
+	if ports != nil {
+		return flashPorts(ctx, sdk, ports, envelopeOptions, newDeviceOptions, flashArguments, result)
+	}
+
+	deviceOptions, err := newDeviceOptions()
+	if err != nil {
+		return err
+	}
+	envelopeFile, err := BuildFirmwareEnvelope(ctx, envelopeOptions, deviceOptions)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(envelopeFile.Name())
+
+	fmt.Fprintf(getStdout(ctx), "Flashing device over serial on port '%s' ...\n", port)
+	config := deviceOptions.GetConfig()
+	err = runFirmwareToolWithConfig(ctx, sdk, envelopeFile.Name(), config, flashArguments(port)...)
+	result.add(port, deviceOptions, err)
+	if err != nil {
+		return err
+	}
+	return storeFlashedSecrets([]DeviceOptions{deviceOptions})
 }
@@ -0,0 +1,207 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cheggaaa/pb/v3"
+)
+
+// isPortList returns true if the --port flag of 'jag flash' names more
+// than a single port, with a comma-separated list or a glob.
+func isPortList(port string) bool {
+	return strings.Contains(port, ",") || isGlob(port)
+}
+
+// expandPorts returns the serial ports given by a comma-separated list of
+// ports and globs. The globs are matched against all the serial ports of
+// the machine, so they also work for ports like 'COM*' that aren't files.
+func expandPorts(list string) ([]string, error) {
+	available, err := getPorts(true)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []string
+	seen := map[string]bool{}
+	for _, pattern := range strings.Split(list, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		matched := false
+		for _, p := range available.Ports {
+			port := string(p)
+			ok, err := filepath.Match(pattern, port)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port pattern '%s': %w", pattern, err)
+			}
+			if !ok {
+				continue
+			}
+			matched = true
+			if !seen[port] {
+				seen[port] = true
+				res = append(res, port)
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("no serial port matches '%s'", pattern)
+		}
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("no serial ports given")
+	}
+	return res, nil
+}
+
+// flashResult is the outcome of flashing the device on a port. The output
+// of the firmware tool is kept, so it can be shown if the flashing fails.
+type flashResult struct {
+	port   string
+	device DeviceOptions
+	output bytes.Buffer
+	err    error
+}
+
+// flashPorts flashes a device on each of the ports in parallel. Each port
+// gets a progress bar, and a summary of how it went for each of them is
+// printed at the end and added to the result.
+func flashPorts(
+	ctx context.Context,
+	sdk *SDK,
+	ports []string,
+	envelope EnvelopeOptions,
+	newDevice func() (DeviceOptions, error),
+	flashArguments func(port string) []string,
+	result *flashCommandResult) error {
+
+	results := make([]*flashResult, len(ports))
+	bars := make([]*pb.ProgressBar, len(ports))
+	for i, port := range ports {
+		device, err := newDevice()
+		if err != nil {
+			return err
+		}
+		results[i] = &flashResult{
+			port:   port,
+			device: device,
+		}
+		bars[i] = pb.New(100).
+			SetTemplateString(`{{string . "prefix"}}{{bar . }} {{percent . }}`).
+			Set("prefix", fmt.Sprintf("%s (%s) ", port, results[i].device.Name))
+	}
+
+	fmt.Fprintf(getStdout(ctx), "Flashing %d devices over serial ...\n", len(ports))
+	pool, err := pb.StartPool(bars...)
+	if err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	for i := range ports {
+		wg.Add(1)
+		go func(r *flashResult, bar *pb.ProgressBar) {
+			defer wg.Done()
+			r.err = flashPort(ctx, sdk, r, envelope, flashArguments(r.port), bar)
+			if r.err == nil {
+				bar.SetCurrent(100)
+			}
+			bar.Finish()
+		}(results[i], bars[i])
+	}
+	wg.Wait()
+	pool.Stop()
+
+	printFlashSummary(getStdout(ctx), results)
+	failed := 0
+	var flashed []DeviceOptions
+	for _, r := range results {
+		result.add(r.port, r.device, r.err)
+		if r.err != nil {
+			failed++
+		} else {
+			flashed = append(flashed, r.device)
+		}
+	}
+	if err := storeFlashedSecrets(flashed); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to flash %d of %d devices", failed, len(ports))
+	}
+	return nil
+}
+
+func flashPort(ctx context.Context, sdk *SDK, r *flashResult, envelope EnvelopeOptions, args []string, bar *pb.ProgressBar) error {
+	envelopeFile, err := BuildFirmwareEnvelope(ctx, envelope, r.device)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(envelopeFile.Name())
+
+	w := &flashProgressWriter{
+		output: &r.output,
+		bar:    bar,
+	}
+	return runFirmwareToolWithConfigTo(ctx, sdk, w, envelopeFile.Name(), r.device.GetConfig(), args...)
+}
+
+// flashProgress matches the percentages the flashing tool prints, like
+// 'Writing at 0x00010000... (3 %)'.
+var flashProgress = regexp.MustCompile(`\((\d+) ?%\)`)
+
+// flashProgressWriter keeps the output of the firmware tool and moves the
+// progress bar along with the percentages in it.
+type flashProgressWriter struct {
+	output *bytes.Buffer
+	bar    *pb.ProgressBar
+}
+
+func (w *flashProgressWriter) Write(b []byte) (int, error) {
+	w.output.Write(b)
+	matches := flashProgress.FindAllSubmatch(b, -1)
+	if len(matches) > 0 {
+		if percent, err := strconv.Atoi(string(matches[len(matches)-1][1])); err == nil {
+			w.bar.SetCurrent(int64(percent))
+		}
+	}
+	return len(b), nil
+}
+
+func printFlashSummary(w io.Writer, results []*flashResult) {
+	portLength := len("PORT")
+	nameLength := len("NAME")
+	idLength := len("ID")
+	for _, r := range results {
+		portLength = max(portLength, len(r.port))
+		nameLength = max(nameLength, len(r.device.Name))
+		idLength = max(idLength, len(r.device.Id))
+	}
+
+	fmt.Fprintln(w, padded("PORT", portLength)+padded("NAME", nameLength)+padded("ID", idLength)+"STATUS")
+	for _, r := range results {
+		status := "flashed"
+		if r.err != nil {
+			status = "failed: " + r.err.Error()
+		}
+		fmt.Fprintln(w, padded(r.port, portLength)+padded(r.device.Name, nameLength)+padded(r.device.Id, idLength)+status)
+	}
+
+	for _, r := range results {
+		if r.err != nil && r.output.Len() > 0 {
+			fmt.Fprintf(w, "\nOutput of flashing '%s':\n%s", r.port, r.output.String())
+		}
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/toitlang/jaguar/cmd/jag/directory"
+)
+
+// groupsCfgKey holds the device groups in the device config, e.g.
+// 'groups.<group>: [<id or name>, ...]'. Like the aliases, the group
+// names are stored in lowercase.
+const groupsCfgKey = "groups"
+
+func GroupCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "group",
+		Short: "Manage named groups of Jaguar devices",
+		Long: "Manage named groups of Jaguar devices.\n" +
+			"A group can be given to 'jag run' and 'jag container install' with\n" +
+			"'--group <group>' to do the same thing on all of its devices at once.",
+	}
+
+	cmd.AddCommand(
+		GroupAddCmd(),
+		GroupListCmd(),
+		GroupRemoveCmd(),
+	)
+	return cmd
+}
+
+func GroupAddCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "add <group> <device>...",
+		Short:        "Add devices to a group, creating it if needed",
+		Long:         "Add devices to a group, creating it if needed. The devices are given by ID or name.",
+		Args:         cobra.MinimumNArgs(2),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := directory.GetDeviceConfig()
+			if err != nil {
+				return err
+			}
+
+			group := strings.ToLower(args[0])
+			if group == "" || strings.ContainsAny(group, ". ") {
+				return fmt.Errorf("the group '%s' must be non-empty and can't contain dots or spaces", args[0])
+			}
+
+			members := getGroups(cfg)[group]
+			for _, member := range args[1:] {
+				switch parseDeviceSelection(member).(type) {
+				case deviceIDSelect, deviceNameSelect:
+				default:
+					return fmt.Errorf("'%s' is not a device ID or name", member)
+				}
+				if !containsString(members, member) {
+					members = append(members, member)
+				}
+			}
+
+			cfg.Set(groupsCfgKey+"."+group, members)
+			if err := cfg.WriteConfig(); err != nil {
+				return err
+			}
+			fmt.Printf("Group '%s' now has %d devices\n", group, len(members))
+			return nil
+		},
+	}
+	return cmd
+}
+
+func GroupRemoveCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "rm <group> [<device>...]",
+		Short:        "Remove devices from a group, or the whole group",
+		Args:         cobra.MinimumNArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := directory.GetDeviceConfig()
+			if err != nil {
+				return err
+			}
+
+			group := strings.ToLower(args[0])
+			groups, ok := cfg.Get(groupsCfgKey).(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("no such group: '%s'", group)
+			}
+			if _, ok := groups[group]; !ok {
+				return fmt.Errorf("no such group: '%s'", group)
+			}
+			if len(args) == 1 {
+				delete(groups, group)
+				return cfg.WriteConfig()
+			}
+
+			var members []string
+			for _, member := range getGroups(cfg)[group] {
+				if !containsString(args[1:], member) {
+					members = append(members, member)
+				}
+			}
+			groups[group] = members
+			return cfg.WriteConfig()
+		},
+	}
+	return cmd
+}
+
+func GroupListCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "list",
+		Short:        "List the groups and their devices",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := directory.GetDeviceConfig()
+			if err != nil {
+				return err
+			}
+
+			groups := getGroups(cfg)
+			if len(groups) == 0 {
+				fmt.Println("No groups, use 'jag group add' to add one")
+				return nil
+			}
+
+			var sorted []string
+			groupLength := len("GROUP")
+			for group := range groups {
+				sorted = append(sorted, group)
+				groupLength = max(groupLength, len(group))
+			}
+			sort.Strings(sorted)
+
+			fmt.Println(padded("GROUP", groupLength) + "DEVICES")
+			for _, group := range sorted {
+				fmt.Println(padded(group, groupLength) + strings.Join(groups[group], ", "))
+			}
+			return nil
+		},
+	}
+	return cmd
+}
+
+// getGroups returns the groups and the IDs or names of their devices.
+func getGroups(cfg *viper.Viper) map[string][]string {
+	res := map[string][]string{}
+	for group := range cfg.GetStringMap(groupsCfgKey) {
+		res[group] = cfg.GetStringSlice(groupsCfgKey + "." + group)
+	}
+	return res
+}
+
+// groupMember is a device of a group. If the device couldn't be found,
+// err tells why.
+type groupMember struct {
+	name   string
+	device *Device
+	err    error
+}
+
+// getGroupDevices scans for the devices of the group. The members of the
+// group that aren't found are returned with an error, so they can be
+// reported together with the ones that fail later on.
+func getGroupDevices(ctx context.Context, cfg *viper.Viper, group string) ([]groupMember, error) {
+	group = strings.ToLower(group)
+	names, ok := getGroups(cfg)[group]
+	if !ok {
+		return nil, fmt.Errorf("no such group: '%s' (see 'jag group list')", group)
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("the group '%s' has no devices", group)
+	}
+
+	opts := defaultScanOptions()
+	opts.aliases = getAliases(cfg)
+	fmt.Fprintf(getStdout(ctx), "Scanning for the %d devices of group '%s' ...\n", len(names), group)
+	devices, err := scanDevices(ctx, nil, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []groupMember
+	for _, name := range names {
+		ds := resolveAlias(opts.aliases, parseDeviceSelection(name))
+		member := groupMember{
+			name: name,
+			err:  fmt.Errorf("device not found"),
+		}
+		for _, d := range devices {
+			if !ds.Match(d) {
+				continue
+			}
+			d := d
+			if err := applyProbeTimeout(cfg, &d); err != nil {
+				return nil, err
+			}
+			applyCredentials(cfg, &d)
+			member.device = &d
+			member.err = nil
+			break
+		}
+		res = append(res, member)
+	}
+	return res, nil
+}
+
+// forEachGroupDevice calls fn for all the found devices of the group
+// concurrently, and records how it went in the members. It returns an
+// error if it failed for any of the devices.
+func forEachGroupDevice(members []groupMember, fn func(d *Device) error) error {
+	var wg sync.WaitGroup
+	for i := range members {
+		if members[i].err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(m *groupMember) {
+			defer wg.Done()
+			m.err = fn(m.device)
+		}(&members[i])
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, m := range members {
+		if m.err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed on %d of %d devices", failed, len(members))
+	}
+	return nil
+}
+
+// printGroupResults prints how it went for each of the members.
+func printGroupResults(w io.Writer, members []groupMember) {
+	fmt.Fprintln(w, "Results:")
+	for _, m := range members {
+		if m.err != nil {
+			fmt.Fprintf(w, "  %s: failed: %s\n", m.name, m.err)
+		} else {
+			fmt.Fprintf(w, "  %s: success\n", m.device.Name)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestForEachGroupDevice(t *testing.T) {
+	members := []groupMember{
+		{name: "sensor", device: &Device{Name: "sensor"}},
+		{name: "gateway", device: &Device{Name: "gateway"}},
+		{name: "hall", err: errors.New("device not found")},
+	}
+	err := forEachGroupDevice(members, func(d *Device) error {
+		if d.Name == "gateway" {
+			return errors.New("unreachable")
+		}
+		return nil
+	})
+	if err == nil || err.Error() != "failed on 2 of 3 devices" {
+		t.Errorf("forEachGroupDevice() error = %v", err)
+	}
+
+	var buf bytes.Buffer
+	printGroupResults(&buf, members)
+	want := strings.Join([]string{
+		"Results:",
+		"  sensor: success",
+		"  gateway: failed: unreachable",
+		"  hall: failed: device not found",
+		"",
+	}, "\n")
+	if got := buf.String(); got != want {
+		t.Errorf("printGroupResults() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+)
+
+// inventory is the format of the files written by 'jag scan --export'.
+// The devices are kept as raw messages when reading, so a malformed
+// device doesn't make us drop the rest.
+type inventory struct {
+	Devices []json.RawMessage `json:"devices"`
+}
+
+// writeInventory stores all the fields of the given devices in a JSON
+// file that can be read back with readInventory.
+func writeInventory(path string, devices []Device) error {
+	if devices == nil {
+		devices = []Device{}
+	}
+	b, err := json.MarshalIndent(Devices{Devices: devices}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0666)
+}
+
+// readInventory returns the devices stored in an inventory file. Devices
+// that can't be parsed or lack the fields we need to talk to them are
+// skipped with a warning.
+func readInventory(ctx context.Context, path string) ([]Device, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var inv inventory
+	if err := json.Unmarshal(b, &inv); err != nil {
+		return nil, fmt.Errorf("failed to parse inventory '%s': %w", path, err)
+	}
+
+	var devices []Device
+	for i, raw := range inv.Devices {
+		var d Device
+		if err := json.Unmarshal(raw, &d); err != nil {
+			getLogger(ctx).Warnf("Skipped device %d in '%s': %s", i, path, err)
+			continue
+		}
+		if err := validateInventoryDevice(d); err != nil {
+			getLogger(ctx).Warnf("Skipped device %d in '%s': %s", i, path, err)
+			continue
+		}
+		devices = append(devices, d)
+	}
+	sortDevices(devices)
+	return devices, nil
+}
+
+// validateInventoryDevice checks that the device has the fields we get
+// from a device that identifies itself, and a valid address.
+func validateInventoryDevice(d Device) error {
+	if err := validateIdentify(d); err != nil {
+		return err
+	}
+	if d.Address == "" {
+		return fmt.Errorf("the field 'address' is missing or empty")
+	}
+	if u, err := url.Parse(deviceURL(d.Address)); err != nil || u.Hostname() == "" {
+		return fmt.Errorf("invalid address '%s'", d.Address)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateInventoryDevice(t *testing.T) {
+	tests := []struct {
+		name    string
+		device  Device
+		wantErr string
+	}{
+		{"valid", Device{ID: "1", Name: "sensor", Address: "http://192.168.1.10:9000"}, ""},
+		{"missing id", Device{Name: "sensor", Address: "http://192.168.1.10:9000"}, "'id'"},
+		{"invalid port", Device{ID: "1", Name: "sensor", Address: "http://192.168.1.10:9000", Port: 70000}, "'port'"},
+		{"missing address", Device{ID: "1", Name: "sensor"}, "'address'"},
+		{"invalid address", Device{ID: "1", Name: "sensor", Address: "http://"}, "invalid address"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateInventoryDevice(test.device)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateInventoryDevice() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("validateInventoryDevice() error = %v, want an error with %q", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -27,7 +27,12 @@ type ctxKey string
 
 const (
 	ctxKeyInfo          ctxKey = "info"
+	ctxKeyVerbose       ctxKey = "verbose"
+	ctxKeyLogger        ctxKey = "logger"
+	ctxKeyStdout        ctxKey = "stdout"
 	noAnalyticsFlagName string = "no-analytics"
+	verboseFlagName     string = "verbose"
+	quietFlagName       string = "quiet"
 )
 
 type Info struct {
@@ -44,6 +49,17 @@ func GetInfo(ctx context.Context) Info {
 	return ctx.Value(ctxKeyInfo).(Info)
 }
 
+func setVerbose(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxKeyVerbose, true)
+}
+
+// isVerbose returns true if jag was asked to print more details about
+// what it is doing.
+func isVerbose(ctx context.Context) bool {
+	verbose, _ := ctx.Value(ctxKeyVerbose).(bool)
+	return verbose
+}
+
 func JagCmd(info Info, isReleaseBuild bool) *cobra.Command {
 	var analyticsClient analytics.Client
 	configCmd := ConfigCmd(info)
@@ -56,14 +72,53 @@ func JagCmd(info Info, isReleaseBuild bool) *cobra.Command {
 			"ESP32 applications written in Toit over WiFi. Change your Toit code in your editor, update\n" +
 			"the application on your device, and restart it all within seconds. No need to flash over\n" +
 			"serial, reboot your device, or wait for it to reconnect to your network.",
-		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := applyProjectConfig(cmd); err != nil {
+				return err
+			}
+
+			verbose, err := cmd.Flags().GetBool(verboseFlagName)
+			if err != nil {
+				return err
+			}
+			quiet, err := cmd.Flags().GetBool(quietFlagName)
+			if err != nil {
+				return err
+			}
+			if verbose && quiet {
+				return fmt.Errorf("--%s and --%s are exclusive", verboseFlagName, quietFlagName)
+			}
+			level := logLevelNormal
+			if verbose {
+				cmd.SetContext(setVerbose(cmd.Context()))
+				level = logLevelVerbose
+			} else if quiet {
+				level = logLevelQuiet
+			}
+			cmd.SetContext(setLogger(cmd.Context(), &logger{
+				w:     os.Stderr,
+				level: level,
+			}))
+
+			proxy, err := cmd.Flags().GetString(proxyFlagName)
+			if err != nil {
+				return err
+			}
+			noProxy, err := cmd.Flags().GetBool(noProxyFlagName)
+			if err != nil {
+				return err
+			}
+			if err := setDeviceProxy(proxy, noProxy); err != nil {
+				return err
+			}
+
 			noAnalytics, err := cmd.Flags().GetBool(noAnalyticsFlagName)
 			if err != nil || noAnalytics {
-				return
+				return nil
 			}
 
 			if isLikelyRunningOnBuildbot() {
-				return
+				return nil
 			}
 
 			// Avoid running the analytics and up-to-date check code when
@@ -71,7 +126,7 @@ func JagCmd(info Info, isReleaseBuild bool) *cobra.Command {
 			current := cmd
 			for current.HasParent() {
 				if current == configCmd {
-					return
+					return nil
 				}
 				current = current.Parent()
 			}
@@ -81,12 +136,13 @@ func JagCmd(info Info, isReleaseBuild bool) *cobra.Command {
 			var analyticsErr error
 			analyticsClient, analyticsErr = analytics.GetClient()
 			if analyticsErr != nil {
-				return
+				return nil
 			}
 
 			command := (*cobra.Command)(cmd).UseLine()
 			enqueueAnalytics(analyticsClient, isReleaseBuild, info, command)
 			CheckUpToDate(info)
+			return nil
 		},
 		// The "post run" function on the 'jag' command needs to run also
 		// when the program exits with an error from main(). The cobra
@@ -101,14 +157,21 @@ func JagCmd(info Info, isReleaseBuild bool) *cobra.Command {
 
 	cmd.AddCommand(
 		ScanCmd(),
+		DevicesCmd(),
+		AliasCmd(),
+		GroupCmd(),
 		ContainerCmd(),
 		PingCmd(),
+		DescribeCmd(),
+		StatsCmd(),
 		RunCmd(),
 		CompileCmd(),
 		SimulateCmd(),
 		DecodeCmd(),
 		SetupCmd(info),
+		SdkCmd(info),
 		FlashCmd(),
+		ProvisionCmd(),
 		FirmwareCmd(),
 		MonitorCmd(),
 		WatchCmd(),
@@ -119,6 +182,10 @@ func JagCmd(info Info, isReleaseBuild bool) *cobra.Command {
 		VersionCmd(info, isReleaseBuild),
 	)
 
+	cmd.PersistentFlags().Bool(verboseFlagName, false, "print more details about what jag is doing")
+	cmd.PersistentFlags().Bool(quietFlagName, false, "only print warnings and errors besides the output")
+	cmd.PersistentFlags().String(proxyFlagName, "", "proxy to reach the devices through, instead of the one from HTTP_PROXY and HTTPS_PROXY")
+	cmd.PersistentFlags().Bool(noProxyFlagName, false, "if set, reach the devices directly, ignoring HTTP_PROXY and HTTPS_PROXY")
 	cmd.PersistentFlags().Bool(noAnalyticsFlagName, false, "do not send analytics")
 	cmd.PersistentFlags().MarkHidden(noAnalyticsFlagName)
 	return cmd
@@ -0,0 +1,82 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+)
+
+type logLevel int
+
+const (
+	// logLevelQuiet only shows warnings.
+	logLevelQuiet logLevel = iota
+	// logLevelNormal also shows progress messages like "Scanning ...".
+	logLevelNormal
+	// logLevelVerbose also shows the details asked for with --verbose.
+	logLevelVerbose
+)
+
+// logger prints human readable messages on stderr, so they don't mix with
+// the machine readable output on stdout.
+type logger struct {
+	w     io.Writer
+	level logLevel
+}
+
+var defaultLogger = &logger{
+	w:     os.Stderr,
+	level: logLevelNormal,
+}
+
+func setLogger(ctx context.Context, l *logger) context.Context {
+	return context.WithValue(ctx, ctxKeyLogger, l)
+}
+
+// getLogger returns the logger of the command. Without one, messages are
+// printed on stderr at the normal level.
+func getLogger(ctx context.Context) *logger {
+	if l, ok := ctx.Value(ctxKeyLogger).(*logger); ok {
+		return l
+	}
+	return defaultLogger
+}
+
+// quiet returns a logger that only shows warnings, unless the logger is
+// verbose.
+func (l *logger) quiet() *logger {
+	if l.level != logLevelNormal {
+		return l
+	}
+	return &logger{
+		w:     l.w,
+		level: logLevelQuiet,
+	}
+}
+
+func (l *logger) logf(level logLevel, format string, args ...interface{}) {
+	if l.level < level {
+		return
+	}
+	fmt.Fprintf(l.w, format+"\n", args...)
+}
+
+// Warnf prints a message that is shown even with --quiet.
+func (l *logger) Warnf(format string, args ...interface{}) {
+	l.logf(logLevelQuiet, format, args...)
+}
+
+// Infof prints a progress message that is hidden by --quiet.
+func (l *logger) Infof(format string, args ...interface{}) {
+	l.logf(logLevelNormal, format, args...)
+}
+
+// Debugf prints a message that is only shown with --verbose.
+func (l *logger) Debugf(format string, args ...interface{}) {
+	l.logf(logLevelVerbose, format, args...)
+}
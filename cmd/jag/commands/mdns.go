@@ -0,0 +1,201 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// mdnsService is the DNS-SD service that Jaguar devices advertise.
+	mdnsService = "_jaguar._tcp.local."
+	mdnsAddress = "224.0.0.251:5353"
+	// mdnsQueryInterval is how often the query is repeated while we
+	// listen, as a single multicast packet is easily lost on busy
+	// wireless networks.
+	mdnsQueryInterval = time.Second
+)
+
+// mdnsRecords collects the records of the responses to our query. They
+// may be spread over several responses, so a device is only asked to
+// identify itself once we know both its port and its address.
+type mdnsRecords struct {
+	// instances are the names of the advertised service instances.
+	instances map[string]bool
+	// targets are the host names and ports of the instances.
+	targets map[string]mdnsTarget
+	// hosts are the IPv4 addresses of the host names.
+	hosts map[string]net.IP
+}
+
+type mdnsTarget struct {
+	host string
+	port uint16
+}
+
+func newMDNSRecords() *mdnsRecords {
+	return &mdnsRecords{
+		instances: map[string]bool{},
+		targets:   map[string]mdnsTarget{},
+		hosts:     map[string]net.IP{},
+	}
+}
+
+// add adds the records of a response.
+func (r *mdnsRecords) add(resources []dnsmessage.Resource) {
+	for _, res := range resources {
+		name := strings.ToLower(res.Header.Name.String())
+		switch body := res.Body.(type) {
+		case *dnsmessage.PTRResource:
+			if name == mdnsService {
+				r.instances[strings.ToLower(body.PTR.String())] = true
+			}
+		case *dnsmessage.SRVResource:
+			r.targets[name] = mdnsTarget{
+				host: strings.ToLower(body.Target.String()),
+				port: body.Port,
+			}
+		case *dnsmessage.AResource:
+			r.hosts[name] = net.IP(body.A[:])
+		}
+	}
+}
+
+// addresses returns the addresses of the instances we have all the records
+// for.
+func (r *mdnsRecords) addresses() []string {
+	var res []string
+	for instance := range r.instances {
+		target, ok := r.targets[instance]
+		if !ok {
+			continue
+		}
+		ip, ok := r.hosts[target.host]
+		if !ok {
+			continue
+		}
+		res = append(res, net.JoinHostPort(ip.String(), fmt.Sprint(target.port)))
+	}
+	return res
+}
+
+// mdnsQuery returns the query for the instances of the Jaguar service.
+func mdnsQuery() ([]byte, error) {
+	name, err := dnsmessage.NewName(mdnsService)
+	if err != nil {
+		return nil, err
+	}
+	msg := dnsmessage.Message{
+		Questions: []dnsmessage.Question{
+			{
+				Name:  name,
+				Type:  dnsmessage.TypePTR,
+				Class: dnsmessage.ClassINET,
+			},
+		},
+	}
+	return msg.Pack()
+}
+
+// browseMDNS looks for the devices that advertise the Jaguar service with
+// mDNS for the duration of the scan, and asks each of them to identify
+// itself like we do for the hosts of a range. The query is sent from an
+// ephemeral port, so the devices answer us directly and we don't compete
+// with the mDNS responder of the host for port 5353.
+func browseMDNS(ctx context.Context, opts scanOptions) []Device {
+	log := getLogger(ctx)
+	query, err := mdnsQuery()
+	if err != nil {
+		log.Warnf("Failed to build the mDNS query: %s", err)
+		return nil
+	}
+	dst, err := net.ResolveUDPAddr("udp4", mdnsAddress)
+	if err != nil {
+		log.Warnf("Failed to resolve the mDNS address: %s", err)
+		return nil
+	}
+
+	listenCtx, cancel := context.WithTimeout(ctx, opts.timeout)
+	defer cancel()
+	pc, err := opts.packetSource().ListenPacket(listenCtx, "udp4", ":0")
+	if err != nil {
+		log.Warnf("Failed to open a socket for mDNS: %s", err)
+		return nil
+	}
+	defer pc.Close()
+
+	// Closing the connection makes a blocked read return when we are done
+	// listening. The query is repeated until then.
+	go func() {
+		ticker := time.NewTicker(mdnsQueryInterval)
+		defer ticker.Stop()
+		for {
+			if _, err := pc.WriteTo(query, dst); err != nil {
+				log.Debugf("Failed to send the mDNS query: %s", err)
+			}
+			select {
+			case <-listenCtx.Done():
+				pc.Close()
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	devices := map[string]Device{}
+	asked := map[string]bool{}
+	records := newMDNSRecords()
+	buf := make([]byte, scanBufferSize)
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(buf[:n]); err != nil {
+			log.Debugf("Skipped a malformed mDNS response: %s", err)
+			continue
+		}
+		if !msg.Header.Response {
+			continue
+		}
+		records.add(msg.Answers)
+		records.add(msg.Additionals)
+		for _, address := range records.addresses() {
+			if asked[address] {
+				continue
+			}
+			asked[address] = true
+			wg.Add(1)
+			go func(address string) {
+				defer wg.Done()
+				dev, err := opts.identify(ctx, opts.deviceURL(address))
+				if err != nil {
+					log.Debugf("Skipped '%s' found with mDNS: %s", address, err)
+					return
+				}
+				mutex.Lock()
+				opts.addDevice(devices, *dev)
+				mutex.Unlock()
+			}(address)
+		}
+	}
+	wg.Wait()
+
+	var res []Device
+	for _, d := range devices {
+		res = append(res, d)
+	}
+	return res
+}
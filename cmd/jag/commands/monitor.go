@@ -17,8 +17,12 @@ import (
 
 func MonitorCmd() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:          "monitor",
-		Short:        "Monitor the serial output of an ESP32",
+		Use:   "monitor",
+		Short: "Monitor the serial output of an ESP32",
+		Long: "Monitor the serial output of an ESP32.\n" +
+			"Toit stack traces and backtraces of crashes in native code are decoded\n" +
+			"into readable stack traces, using the Jaguar firmware for the given chip.\n" +
+			"Use '--decode=false' to see the raw output.",
 		Args:         cobra.NoArgs,
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
@@ -52,6 +56,16 @@ func MonitorCmd() *cobra.Command {
 				return err
 			}
 
+			decode, err := cmd.Flags().GetBool("decode")
+			if err != nil {
+				return err
+			}
+
+			chip, err := cmd.Flags().GetString("chip")
+			if err != nil {
+				return err
+			}
+
 			fmt.Printf("Starting serial monitor of port '%s' ...\n", port)
 			dev, err := serialOpen(port, &serial.Mode{
 				BaudRate: int(baud),
@@ -64,12 +78,28 @@ func MonitorCmd() *cobra.Command {
 				dev.Reboot()
 			}
 
-			scanner := bufio.NewScanner(dev)
+			// Close the port when we're interrupted, so the blocking reads
+			// return and we can exit.
+			ctx := cmd.Context()
+			go func() {
+				<-ctx.Done()
+				dev.Close()
+			}()
 
-			decoder := Decoder{scanner, cmd}
+			scanner := bufio.NewScanner(dev)
 
-			decoder.decode(pretty, plain)
+			if decode {
+				decoder := Decoder{scanner, cmd, chip}
+				decoder.decode(pretty, plain)
+			} else {
+				for scanner.Scan() {
+					fmt.Println(scanner.Text())
+				}
+			}
 
+			if ctx.Err() != nil {
+				return nil
+			}
 			return scanner.Err()
 		},
 	}
@@ -79,6 +109,8 @@ func MonitorCmd() *cobra.Command {
 	cmd.Flags().BoolP("force-pretty", "r", false, "force output to use terminal graphics")
 	cmd.Flags().BoolP("force-plain", "l", false, "force output to use plain ASCII text")
 	cmd.Flags().Uint("baud", 115200, "the baud rate for serial monitoring")
+	cmd.Flags().Bool("decode", true, "decode Toit stack traces and crash backtraces in the output")
+	cmd.Flags().StringP("chip", "c", "esp32", "chip of the device, used to decode crashes in native code")
 	return cmd
 }
 
@@ -5,49 +5,249 @@
 package commands
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/toitlang/jaguar/cmd/jag/directory"
 )
 
+const (
+	pingInterval = time.Second
+)
+
 func PingCmd() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:          "ping",
-		Short:        "Ping a Jaguar device to see if it is active",
+		Use:   "ping [device]",
+		Short: "Ping a Jaguar device to see if it is active",
+		Long: "Ping a Jaguar device to see if it is active.\n" +
+			"The device is asked to identify itself, and the round-trip time is printed\n" +
+			"for every reply. With more than one ping, the pings continue when a reply\n" +
+			"is lost, and the minimum, average and maximum round-trip times and the loss\n" +
+			"are printed at the end, also when interrupted. Use '--count 0' to keep\n" +
+			"pinging a flaky device until interrupted.\n" +
+			"Exits with a non-zero exit code if any reply is lost, or right away if the\n" +
+			"device replies with another ID than expected.\n" +
+			"With '--output json' or '--output yaml', the replies and the statistics are\n" +
+			"printed as a single result when done.",
+		Args:         cobra.MaximumNArgs(1),
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			cfg, err := directory.GetDeviceConfig()
+			out, err := parseCommandOutput(cmd)
 			if err != nil {
 				return err
 			}
+			result := &pingResult{}
+			return out.print(result, ping(cmd, args, result))
+		},
+	}
 
-			deviceSelect, err := parseDeviceFlag(cmd)
-			if err != nil {
-				return err
-			}
+	cmd.Flags().StringP("device", "d", "", "use device with a given name, id, or address")
+	cmd.Flags().DurationP("timeout", "t", pingTimeout, "how long to wait for a reply")
+	cmd.Flags().IntP("count", "c", 1, "number of pings to send, 0 to keep pinging until interrupted")
+	cmd.Flags().Duration("interval", pingInterval, "how long to wait between pings")
+	addOutputFlag(cmd)
+	return cmd
+}
 
-			ctx := cmd.Context()
-			sdk, err := GetSDK(ctx)
-			if err != nil {
-				return err
-			}
+// pingResult is the result of 'jag ping' printed with --output.
+type pingResult struct {
+	commandStatus `yaml:",inline"`
+	Device        *deviceResult `mapstructure:"device" yaml:"device,omitempty" json:"device,omitempty"`
+	Sent          int           `mapstructure:"sent" yaml:"sent" json:"sent"`
+	Received      int           `mapstructure:"received" yaml:"received" json:"received"`
+	// The round-trip times in milliseconds, if any replies were received.
+	MinMs   float64     `mapstructure:"minMs" yaml:"minMs,omitempty" json:"minMs,omitempty"`
+	AvgMs   float64     `mapstructure:"avgMs" yaml:"avgMs,omitempty" json:"avgMs,omitempty"`
+	MaxMs   float64     `mapstructure:"maxMs" yaml:"maxMs,omitempty" json:"maxMs,omitempty"`
+	Replies []pingReply `mapstructure:"replies" yaml:"replies" json:"replies"`
+}
 
-			device, err := GetDevice(ctx, cfg, sdk, false, deviceSelect)
-			if err != nil {
-				return err
-			}
-			if !device.Ping(ctx, sdk) {
-				cmd.SilenceUsage = true
-				return fmt.Errorf("couldn't ping the device")
+type pingReply struct {
+	Seq    int     `mapstructure:"seq" yaml:"seq" json:"seq"`
+	TimeMs float64 `mapstructure:"timeMs" yaml:"timeMs,omitempty" json:"timeMs,omitempty"`
+	Error  string  `mapstructure:"error" yaml:"error,omitempty" json:"error,omitempty"`
+}
+
+func ping(cmd *cobra.Command, args []string, result *pingResult) error {
+	cfg, err := directory.GetDeviceConfig()
+	if err != nil {
+		return err
+	}
+
+	deviceSelect, err := parseDeviceFlag(cmd)
+	if err != nil {
+		return err
+	}
+	if len(args) == 1 {
+		if deviceSelect != nil {
+			return fmt.Errorf("a device argument and --device are exclusive")
+		}
+		deviceSelect = parseDeviceSelection(args[0])
+	}
+
+	timeout, err := cmd.Flags().GetDuration("timeout")
+	if err != nil {
+		return err
+	}
+
+	count, err := cmd.Flags().GetInt("count")
+	if err != nil {
+		return err
+	}
+
+	interval, err := cmd.Flags().GetDuration("interval")
+	if err != nil {
+		return err
+	}
+
+	ctx := cmd.Context()
+	sdk, err := GetSDK(ctx)
+	if err != nil {
+		return err
+	}
+
+	device, err := GetDevice(ctx, cfg, sdk, false, deviceSelect)
+	if err != nil {
+		return err
+	}
+	result.Device = newDeviceResult(device)
+
+	var stats pingStats
+	defer stats.fill(result)
+	if count == 1 {
+		latency, err := pingIdentify(ctx, *device, device.probeTimeoutFor(ctx, timeout))
+		stats.add(latency, err)
+		if err != nil {
+			return fmt.Errorf("couldn't ping '%s': %w", device.Name, err)
+		}
+		fmt.Fprintf(getStdout(ctx), "Reply from %s: time=%s\n", device.Summary(), latency.Round(100*time.Microsecond))
+		return nil
+	}
+
+loop:
+	for i := 0; count == 0 || i < count; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+				break loop
 			}
+		}
+		latency, err := pingIdentify(ctx, *device, device.probeTimeoutFor(ctx, timeout))
+		if ctx.Err() != nil {
+			// Interrupted while waiting for the reply.
+			break
+		}
+		if errors.Is(err, errOtherDevice) {
+			return fmt.Errorf("couldn't ping '%s': %w", device.Name, err)
+		}
+		stats.add(latency, err)
+		if err != nil {
+			fmt.Fprintf(getStdout(ctx), "No reply from %s: %s\n", device.Summary(), err)
+		} else {
+			fmt.Fprintf(getStdout(ctx), "Reply from %s: seq=%d time=%s\n", device.Summary(), i, latency.Round(100*time.Microsecond))
+		}
+	}
 
-			fmt.Println("Got ping from the device")
-			return nil
-		},
+	stats.print(getStdout(ctx), device.Name)
+	if stats.lost() > 0 {
+		return newScanError(ErrDeviceUnreachable, "%d of %d pings to '%s' got no reply", stats.lost(), stats.sent, device.Name)
 	}
+	return nil
+}
 
-	cmd.Flags().StringP("device", "d", "", "use device with a given name, id, or address")
-	cmd.Flags().DurationP("timeout", "t", pingTimeout, "how long to wait for a reply")
-	return cmd
+// pingIdentify asks the device to identify itself through the single
+// address path of the scan and checks that it still has the expected ID.
+func pingIdentify(ctx context.Context, device Device, timeout time.Duration) (time.Duration, error) {
+	opts := defaultScanOptions()
+	opts.retries = 0
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	devices, err := scan(ctx, deviceAddressSelect(device.Address), opts)
+	latency := time.Since(start)
+	if err != nil {
+		return 0, err
+	}
+	if len(devices) != 1 {
+		return 0, fmt.Errorf("no reply from %s", device.Address)
+	}
+	if devices[0].ID != device.ID {
+		return 0, fmt.Errorf("%w with ID '%s'", errOtherDevice, devices[0].ID)
+	}
+	return latency, nil
+}
+
+// errOtherDevice is returned by pingIdentify if another device answers
+// on the address. Pinging again won't help with that.
+var errOtherDevice = errors.New("the address is used by another device")
+
+// pingStats are the round-trip times of a series of pings.
+type pingStats struct {
+	sent     int
+	received int
+	min      time.Duration
+	max      time.Duration
+	total    time.Duration
+	replies  []pingReply
+}
+
+// add records a ping with the given latency, or a lost one if err isn't
+// nil.
+func (s *pingStats) add(latency time.Duration, err error) {
+	reply := pingReply{Seq: s.sent}
+	s.sent++
+	if err != nil {
+		reply.Error = err.Error()
+		s.replies = append(s.replies, reply)
+		return
+	}
+	reply.TimeMs = milliseconds(latency)
+	s.replies = append(s.replies, reply)
+	if s.received == 0 || latency < s.min {
+		s.min = latency
+	}
+	if latency > s.max {
+		s.max = latency
+	}
+	s.total += latency
+	s.received++
+}
+
+func (s *pingStats) lost() int {
+	return s.sent - s.received
+}
+
+// fill sets the statistics of the result.
+func (s *pingStats) fill(result *pingResult) {
+	result.Sent = s.sent
+	result.Received = s.received
+	result.Replies = s.replies
+	if s.received > 0 {
+		result.MinMs = milliseconds(s.min)
+		result.AvgMs = milliseconds(s.total / time.Duration(s.received))
+		result.MaxMs = milliseconds(s.max)
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Round(time.Microsecond)) / float64(time.Millisecond)
+}
+
+func (s *pingStats) print(w io.Writer, name string) {
+	if s.sent == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\n--- '%s' ping statistics ---\n", name)
+	fmt.Fprintf(w, "%d pings sent, %d replies received, %.1f%% loss\n", s.sent, s.received, 100*float64(s.lost())/float64(s.sent))
+	if s.received > 0 {
+		round := func(d time.Duration) time.Duration { return d.Round(100 * time.Microsecond) }
+		avg := s.total / time.Duration(s.received)
+		fmt.Fprintf(w, "round-trip min/avg/max = %s/%s/%s\n", round(s.min), round(avg), round(s.max))
+	}
 }
@@ -20,7 +20,7 @@ func PkgCmd(info Info) *cobra.Command {
 		return nil
 	}
 
-	s := store.NewViper("", info.SDKVersion, false, false)
+	s := store.NewViper("", activeSDKVersion(info), false, false)
 	pkg, err := commands.Pkg(commands.DefaultRunWrapper, track, s, nil)
 	if err != nil {
 		panic(err)
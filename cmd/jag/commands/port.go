@@ -28,7 +28,7 @@ func PortCmd() *cobra.Command {
 				return err
 			}
 
-			outputter, err := parseOutputFlag(cmd)
+			outputter, err := parseOutputFlag(cmd, nil, "")
 			if err != nil {
 				return err
 			}
@@ -55,8 +55,10 @@ func PortCmd() *cobra.Command {
 	}
 
 	cmd.AddCommand(PortSetCmd())
+	cmd.AddCommand(PortListCmd())
+	cmd.AddCommand(PortTestCmd())
 	cmd.Flags().BoolP("list", "l", false, "if set, list the ports")
-	cmd.Flags().StringP("output", "o", "short", "set output format to json, yaml or short (works only with '--list')")
+	cmd.Flags().StringP("output", "o", "short", "set output format to json, yaml, canonical or short (works only with '--list')")
 	cmd.Flags().Bool("all", false, "if set, will show all available ports")
 	return cmd
 }
@@ -92,6 +94,49 @@ func PortSetCmd() *cobra.Command {
 	return cmd
 }
 
+func PortListCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the serial ports with a description of what they are connected to",
+		Long: "List the serial ports with a description of what they are connected to.\n" +
+			"Ports connected to the USB serial adapters found on ESP32 boards are marked\n" +
+			"as such, and USB ports show their vendor and product ID.",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			all, err := cmd.Flags().GetBool("all")
+			if err != nil {
+				return err
+			}
+
+			output, err := parseOutputFormatFlag(cmd, resultOutputFormats)
+			if err != nil {
+				return err
+			}
+
+			ports, err := getDetailedPorts(all)
+			if err != nil {
+				return err
+			}
+
+			w := cmd.OutOrStdout()
+			if output == "short" && len(ports.Ports) == 0 {
+				fmt.Fprintln(w, "No serial ports detected")
+				return nil
+			}
+			outputter, err := newOutputEncoder(w, output)
+			if err != nil {
+				return err
+			}
+			return outputter.Encode(ports)
+		},
+	}
+
+	cmd.Flags().StringP("output", "o", "short", "set output format to json, yaml or short")
+	cmd.Flags().Bool("all", false, "if set, will show all available ports")
+	return cmd
+}
+
 func PortExists(port string) (bool, error) {
 	ports, err := serial.GetPortsList()
 	if err != nil {
@@ -130,7 +175,32 @@ func CheckPort(port string) (string, error) {
 	return GetPort(cfg, false, true)
 }
 
+// pickPort picks the serial port to use. Unless all ports are wanted, the
+// ports connected to ESP32 boards are detected by their USB IDs: a single
+// one is picked right away, and the user chooses between several. If none
+// are detected, the user chooses from the ports that look like serial
+// ports to USB devices.
 func pickPort(all bool) (string, error) {
+	if !all {
+		detected, err := detectESP32Ports()
+		if err == nil && len(detected) == 1 {
+			fmt.Printf("Using serial port %s\n", detected[0])
+			return detected[0].name, nil
+		} else if err == nil && len(detected) > 1 {
+			prompt := promptui.Select{
+				Label:     "Found several ESP32 boards, choose what serial port you want to use",
+				Items:     detected,
+				Templates: &promptui.SelectTemplates{},
+			}
+			i, _, err := prompt.Run()
+			if err != nil {
+				fmt.Println("Error", err)
+				return "", fmt.Errorf("you didn't select anything")
+			}
+			return detected[i].name, nil
+		}
+	}
+
 	ports, err := getPorts(all)
 	if err != nil || ports.Len() == 0 {
 		if runtime.GOOS == "linux" {
@@ -0,0 +1,193 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/toitlang/jaguar/cmd/jag/directory"
+	"go.bug.st/serial"
+	"go.bug.st/serial/enumerator"
+)
+
+const (
+	bootloaderSyncAttempts = 5
+	bootloaderReadTimeout  = 100 * time.Millisecond
+	bootLogTimeout         = 500 * time.Millisecond
+)
+
+// bootloaderSyncCommand is the SYNC command of the serial protocol of the
+// ESP32 ROM bootloader, framed by SLIP like esptool does.
+var bootloaderSyncCommand = func() []byte {
+	b := []byte{0xc0, 0x00, 0x08, 0x24, 0x00, 0x00, 0x00, 0x00, 0x00, 0x07, 0x07, 0x12, 0x20}
+	b = append(b, bytes.Repeat([]byte{0x55}, 32)...)
+	return append(b, 0xc0)
+}()
+
+// bootloaderSyncResponse is the start of the response to the SYNC command.
+var bootloaderSyncResponse = []byte{0xc0, 0x01, 0x08}
+
+func PortTestCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "test [<port>]",
+		Short: "Check that the bootloader of an ESP32 responds on a serial port",
+		Long: "Check that the bootloader of an ESP32 responds on a serial port.\n" +
+			"The port is opened and the board is reset into its bootloader by toggling\n" +
+			"the DTR and RTS lines, like it is when flashing. The board is reset again\n" +
+			"when done, so it runs its firmware as before.\n" +
+			"Use it to find problems with cables, drivers and permissions before\n" +
+			"flashing. Without a port, the configured port is tested.",
+		Args:         cobra.MaximumNArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			baud, err := cmd.Flags().GetUint("baud")
+			if err != nil {
+				return err
+			}
+
+			var port string
+			if len(args) == 1 {
+				port = args[0]
+			} else {
+				cfg, err := directory.GetDeviceConfig()
+				if err != nil {
+					return err
+				}
+				if port, err = GetPort(cfg, false, false); err != nil {
+					return err
+				}
+			}
+
+			fmt.Printf("Opening serial port '%s' ...\n", port)
+			dev, err := serialOpen(port, &serial.Mode{BaudRate: int(baud)})
+			if err != nil {
+				if os.IsPermission(err) && runtime.GOOS == "linux" {
+					return fmt.Errorf("couldn't open serial port '%s': %w\nIs your user in the 'dialout' group?", port, err)
+				}
+				return fmt.Errorf("couldn't open serial port '%s': %w", port, err)
+			}
+			defer dev.Close()
+
+			fmt.Println("Resetting the board into its bootloader ...")
+			bootLog, synced, err := probeBootloader(dev.Port, isUSBSerialJTAG(port))
+			// Leave the bootloader again, so the board runs its firmware.
+			dev.Reboot()
+			if err != nil {
+				return err
+			}
+
+			if synced {
+				fmt.Printf("The ESP32 bootloader responded on '%s', so the board is ready to be flashed\n", port)
+				return nil
+			}
+			if len(bootLog) == 0 {
+				fmt.Println("Nothing was received from the board. Check that it is powered, that the")
+				fmt.Println("USB cable carries data and not only power, and that the driver for the USB")
+				fmt.Println("serial adapter of the board is installed.")
+			} else {
+				fmt.Printf("The board printed:\n\n%s\n\n", strings.TrimSpace(string(bootLog)))
+				fmt.Println("The board is alive, but didn't enter its bootloader. Try holding the BOOT")
+				fmt.Printf("button of the board down while testing, or check that %d is the baud rate\n", baud)
+				fmt.Println("of the board.")
+			}
+			return fmt.Errorf("no ESP32 bootloader responded on '%s'", port)
+		},
+	}
+
+	cmd.Flags().Uint("baud", 115200, "the baud rate of the bootloader")
+	return cmd
+}
+
+// probeBootloader resets the board into its bootloader and sends it the
+// SYNC command. It returns what the board printed while booting, and
+// whether the bootloader responded.
+func probeBootloader(port serial.Port, usbSerialJTAG bool) ([]byte, bool, error) {
+	if err := port.SetReadTimeout(bootloaderReadTimeout); err != nil {
+		return nil, false, err
+	}
+	port.ResetInputBuffer()
+
+	if usbSerialJTAG {
+		// The native USB of the newer chips drives the reset and boot
+		// pins with another sequence, see esptool.
+		port.SetRTS(false)
+		port.SetDTR(false)
+		time.Sleep(100 * time.Millisecond)
+		port.SetDTR(true)
+		port.SetRTS(false)
+		time.Sleep(100 * time.Millisecond)
+		port.SetRTS(true)
+		port.SetDTR(false)
+		port.SetRTS(true)
+		time.Sleep(100 * time.Millisecond)
+		port.SetRTS(false)
+		port.SetDTR(false)
+	} else {
+		// Hold the board in reset, then release it while the boot pin
+		// is pulled low.
+		port.SetDTR(false)
+		port.SetRTS(true)
+		time.Sleep(100 * time.Millisecond)
+		port.SetDTR(true)
+		port.SetRTS(false)
+		time.Sleep(50 * time.Millisecond)
+		port.SetDTR(false)
+	}
+
+	bootLog, err := readSerialFor(port, bootLogTimeout)
+	if err != nil {
+		return nil, false, err
+	}
+
+	for i := 0; i < bootloaderSyncAttempts; i++ {
+		if _, err := port.Write(bootloaderSyncCommand); err != nil {
+			return bootLog, false, err
+		}
+		response, err := readSerialFor(port, bootloaderReadTimeout)
+		if err != nil {
+			return bootLog, false, err
+		}
+		if bytes.Contains(response, bootloaderSyncResponse) {
+			return bootLog, true, nil
+		}
+	}
+	return bootLog, false, nil
+}
+
+// readSerialFor returns what is received on the port within the duration.
+func readSerialFor(port serial.Port, d time.Duration) ([]byte, error) {
+	var res []byte
+	buf := make([]byte, 1024)
+	deadline := time.Now().Add(d)
+	for time.Now().Before(deadline) {
+		n, err := port.Read(buf)
+		if err != nil {
+			return res, err
+		}
+		res = append(res, buf[:n]...)
+	}
+	return res, nil
+}
+
+// isUSBSerialJTAG returns whether the port is the native USB of an ESP32
+// chip, like the ESP32-C3 and ESP32-S3 have.
+func isUSBSerialJTAG(port string) bool {
+	details, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return false
+	}
+	for _, d := range details {
+		if d.Name == port && d.IsUSB {
+			return strings.ToUpper(d.VID) == "303A" && strings.ToUpper(d.PID) == "1001"
+		}
+	}
+	return false
+}
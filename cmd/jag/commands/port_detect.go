@@ -0,0 +1,144 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"fmt"
+	"strings"
+
+	"go.bug.st/serial"
+	"go.bug.st/serial/enumerator"
+)
+
+// usbID is the USB vendor and product ID of a serial adapter.
+type usbID struct {
+	vid string
+	pid string
+}
+
+// esp32USBIDs are the USB serial adapters found on ESP32 boards, and the
+// native USB of the chips that have one.
+var esp32USBIDs = map[usbID]string{
+	{"10C4", "EA60"}: "CP210x",
+	{"1A86", "7523"}: "CH340",
+	{"1A86", "7522"}: "CH340K",
+	{"1A86", "55D4"}: "CH9102",
+	{"0403", "6001"}: "FT232R",
+	{"0403", "6010"}: "FT2232",
+	{"0403", "6014"}: "FT232H",
+	{"0403", "6015"}: "FT-X",
+	{"303A", "1001"}: "ESP32 native USB",
+	{"303A", "0002"}: "ESP32-S2 native USB",
+}
+
+// detectedPort is a serial port that looks like it is connected to an
+// ESP32, with the USB adapter it goes through.
+type detectedPort struct {
+	name    string
+	adapter string
+}
+
+func (p detectedPort) String() string {
+	return fmt.Sprintf("%s (%s)", p.name, p.adapter)
+}
+
+// detectESP32Ports returns the serial ports whose USB vendor and product
+// IDs are those of the adapters on ESP32 boards.
+func detectESP32Ports() ([]detectedPort, error) {
+	details, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return nil, err
+	}
+	var res []detectedPort
+	for _, d := range details {
+		if !d.IsUSB {
+			continue
+		}
+		id := usbID{strings.ToUpper(d.VID), strings.ToUpper(d.PID)}
+		if adapter, ok := esp32USBIDs[id]; ok {
+			res = append(res, detectedPort{name: d.Name, adapter: adapter})
+		}
+	}
+	return res, nil
+}
+
+// SerialPorts are the serial ports listed by 'jag port list'.
+type SerialPorts struct {
+	Ports []SerialPort `mapstructure:"ports" yaml:"ports" json:"ports"`
+}
+
+type SerialPort struct {
+	Name string `mapstructure:"name" yaml:"name" json:"name"`
+	// Description is the adapter for ports connected to an ESP32 board,
+	// or the product the USB device reports for other USB ports.
+	Description  string `mapstructure:"description" yaml:"description,omitempty" json:"description,omitempty"`
+	VID          string `mapstructure:"vid" yaml:"vid,omitempty" json:"vid,omitempty"`
+	PID          string `mapstructure:"pid" yaml:"pid,omitempty" json:"pid,omitempty"`
+	SerialNumber string `mapstructure:"serialNumber" yaml:"serialNumber,omitempty" json:"serialNumber,omitempty"`
+	ESP32        bool   `mapstructure:"esp32" yaml:"esp32" json:"esp32"`
+}
+
+func (p SerialPorts) Columns() [][]string {
+	var res [][]string
+	for _, p := range p.Ports {
+		description := p.Description
+		if p.ESP32 {
+			description = "ESP32 board via " + description
+		}
+		if p.VID != "" {
+			description = strings.TrimSpace(fmt.Sprintf("%s [%s:%s]", description, p.VID, p.PID))
+		}
+		res = append(res, []string{p.Name, description})
+	}
+	return res
+}
+
+// getDetailedPorts returns the serial ports with the details of the USB
+// devices they are connected to. Unless all ports are wanted, only the
+// ports connected to an ESP32 board and the ports that look like serial
+// ports to USB devices are returned.
+func getDetailedPorts(all bool) (SerialPorts, error) {
+	details, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		// Not all platforms have the details, so we fall back to the
+		// names of the ports.
+		names, err := serial.GetPortsList()
+		if err != nil {
+			return SerialPorts{}, err
+		}
+		details = nil
+		for _, name := range names {
+			details = append(details, &enumerator.PortDetails{Name: name})
+		}
+	}
+
+	var names []string
+	for _, d := range details {
+		names = append(names, d.Name)
+	}
+	likely := map[string]bool{}
+	for _, name := range filterPorts(names) {
+		likely[name] = true
+	}
+
+	var res SerialPorts
+	for _, d := range details {
+		port := SerialPort{Name: d.Name}
+		if d.IsUSB {
+			port.VID = strings.ToUpper(d.VID)
+			port.PID = strings.ToUpper(d.PID)
+			port.SerialNumber = d.SerialNumber
+			port.Description = d.Product
+			if adapter, ok := esp32USBIDs[usbID{port.VID, port.PID}]; ok {
+				port.Description = adapter
+				port.ESP32 = true
+			}
+		}
+		if all || port.ESP32 || likely[d.Name] {
+			res.Ports = append(res.Ports, port)
+		}
+	}
+	return res, nil
+}
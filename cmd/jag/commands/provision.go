@@ -0,0 +1,161 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"go.bug.st/serial"
+)
+
+// The lines sent to and received from the device over the serial console,
+// see src/provision.toit.
+const (
+	provisionWifiCommand = "jag.provision.wifi "
+	provisionWifiDone    = "jag.provision.done"
+	provisionWifiFailed  = "jag.provision.failed "
+
+	// provisionBaudRate is the baud rate the device listens at, see
+	// CONSOLE_BAUD_RATE_ in src/provision.toit.
+	provisionBaudRate = 115200
+
+	provisionTimeout     = 10 * time.Second
+	provisionResendDelay = 2 * time.Second
+)
+
+func ProvisionCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "provision",
+		Short: "Provision settings on a Jaguar device without flashing it",
+		Long: "Provision settings on an already flashed Jaguar device without flashing it\n" +
+			"again.",
+	}
+
+	cmd.AddCommand(ProvisionWifiCmd())
+	return cmd
+}
+
+func ProvisionWifiCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "wifi",
+		Short: "Give a Jaguar device new WiFi credentials over the serial console",
+		Long: "Give a Jaguar device new WiFi credentials over the serial console, so it can\n" +
+			"be moved to another network without flashing it again.\n" +
+			"The device stores the credentials and restarts to join the network. Use\n" +
+			"'jag scan' to find it there. With '--reset', the device forgets the provisioned\n" +
+			"credentials and joins the network it was flashed with again.\n" +
+			"The credentials are received on the UART pins of the console, so boards that\n" +
+			"are connected through the native USB of the chip can't be provisioned this way.",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			port, err := cmd.Flags().GetString("port")
+			if err != nil {
+				return err
+			}
+			if port, err = CheckPort(port); err != nil {
+				return err
+			}
+
+			timeout, err := cmd.Flags().GetDuration("timeout")
+			if err != nil {
+				return err
+			}
+
+			reset, err := cmd.Flags().GetBool("reset")
+			if err != nil {
+				return err
+			}
+
+			credentials := map[string]string{}
+			if !reset {
+				wifiSSID, wifiPassword, err := getWifiCredentials(cmd)
+				if err != nil {
+					return err
+				}
+				if wifiSSID == "" {
+					return fmt.Errorf("the WiFi network (SSID) can't be empty, use '--reset' to go back to the flashed credentials")
+				}
+				credentials["ssid"] = wifiSSID
+				credentials["password"] = wifiPassword
+			}
+			payload, err := json.Marshal(credentials)
+			if err != nil {
+				return err
+			}
+
+			dev, err := serialOpen(port, &serial.Mode{BaudRate: provisionBaudRate})
+			if err != nil {
+				return err
+			}
+			defer dev.Close()
+			// Keep the board running, as some USB serial adapters reset it
+			// when the control lines change.
+			dev.SetDTR(false)
+			dev.SetRTS(false)
+
+			if reset {
+				fmt.Printf("Resetting the WiFi credentials of the device on '%s' ...\n", port)
+			} else {
+				fmt.Printf("Provisioning the device on '%s' to join '%s' ...\n", port, credentials["ssid"])
+			}
+			line := []byte(provisionWifiCommand + string(payload) + "\n")
+			if err := provisionOverSerial(dev.Port, line, timeout); err != nil {
+				return err
+			}
+			fmt.Println("The device is restarting to join the network, use 'jag scan' to find it")
+			return nil
+		},
+	}
+
+	cmd.Flags().StringP("port", "p", ConfiguredPort(), "serial port of the device")
+	cmd.Flags().String("wifi-ssid", "", "WiFi network name")
+	cmd.Flags().String("wifi-password", "", "WiFi password")
+	cmd.Flags().Bool("reset", false, "forget the provisioned credentials and use the ones the device was flashed with")
+	cmd.Flags().DurationP("timeout", "t", provisionTimeout, "how long to wait for the device to reply")
+	return cmd
+}
+
+// provisionOverSerial sends the line to the device until it replies, or
+// until the timeout. The line is sent again every few seconds, in case the
+// device was busy booting when it was sent.
+func provisionOverSerial(port serial.Port, line []byte, timeout time.Duration) error {
+	if err := port.SetReadTimeout(100 * time.Millisecond); err != nil {
+		return err
+	}
+	port.ResetInputBuffer()
+
+	var received []byte
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if _, err := port.Write(line); err != nil {
+			return err
+		}
+		output, err := readSerialFor(port, provisionResendDelay)
+		if err != nil {
+			return err
+		}
+		received = append(received, output...)
+		for _, l := range strings.Split(string(received), "\n") {
+			l = strings.TrimSpace(l)
+			if strings.HasPrefix(l, provisionWifiDone) {
+				return nil
+			}
+			if i := strings.Index(l, provisionWifiFailed); i >= 0 {
+				return fmt.Errorf("the device failed to store the credentials: %s", l[i+len(provisionWifiFailed):])
+			}
+		}
+		// Only keep the last line, which may not be complete yet.
+		if i := bytes.LastIndexByte(received, '\n'); i >= 0 {
+			received = received[i+1:]
+		}
+	}
+	return fmt.Errorf("the device didn't reply within %s. Is it running Jaguar with support for provisioning?", timeout)
+}
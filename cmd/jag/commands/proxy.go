@@ -0,0 +1,72 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+const (
+	proxyFlagName   string = "proxy"
+	noProxyFlagName string = "no-proxy"
+)
+
+// devicesProxy returns the proxy to use for a request to a device. By
+// default it is taken from the HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+// environment variables. It is changed by the --proxy and --no-proxy
+// flags.
+var devicesProxy = http.ProxyFromEnvironment
+
+// deviceProxy is the proxy function of all the transports used to talk
+// to devices. It looks up devicesProxy for every request, so the flags
+// also apply to the clients that are created before they are parsed.
+func deviceProxy(req *http.Request) (*url.URL, error) {
+	return devicesProxy(req)
+}
+
+// setDeviceProxy overrides the proxy from the environment. If noProxy is
+// set, devices are always reached directly, which is useful for devices
+// on the local network.
+func setDeviceProxy(proxy string, noProxy bool) error {
+	if noProxy {
+		if proxy != "" {
+			return fmt.Errorf("--%s and --%s are exclusive", proxyFlagName, noProxyFlagName)
+		}
+		devicesProxy = func(*http.Request) (*url.URL, error) {
+			return nil, nil
+		}
+		return nil
+	}
+	if proxy == "" {
+		return nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("--%s '%s' is not a valid URL", proxyFlagName, proxy)
+	}
+	devicesProxy = http.ProxyURL(u)
+	return nil
+}
+
+// deviceClient is used for the requests to devices. The credentials for
+// an authenticated proxy can be given in the URL of the proxy.
+var deviceClient = newDeviceClient(false)
+
+// insecureDeviceClient is used for devices with self-signed certificates.
+var insecureDeviceClient = newDeviceClient(true)
+
+func newDeviceClient(insecure bool) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: deviceProxy,
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: insecure,
+			},
+		},
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+// commandOutput prints the result of a command in the format given with
+// --output. In the short format, the command prints its progress and its
+// results as it goes. With json or yaml, the command prints a single result
+// object on stdout when it is done, also if it fails, and everything else
+// it prints goes to stderr, so scripts can parse stdout.
+type commandOutput struct {
+	format string
+	w      io.Writer
+	// stdout is where the command and the tools it runs print their
+	// progress and, in the short format, their results.
+	stdout io.Writer
+}
+
+// commandResult is implemented by the results of the commands, by
+// embedding commandStatus.
+type commandResult interface {
+	setError(err *commandError)
+}
+
+// commandStatus is embedded in the results of the commands, so failed
+// commands report their error in the result.
+// It must be embedded with the tag `yaml:",inline"`.
+type commandStatus struct {
+	Error *commandError `mapstructure:"error" yaml:"error,omitempty" json:"error,omitempty"`
+}
+
+func (s *commandStatus) setError(err *commandError) {
+	s.Error = err
+}
+
+// commandError is the error of a failed command and the exit code jag
+// exits with.
+type commandError struct {
+	Message  string `mapstructure:"message" yaml:"message" json:"message"`
+	ExitCode int    `mapstructure:"exitCode" yaml:"exitCode" json:"exitCode"`
+}
+
+// deviceResult identifies the device a command talked to in its result.
+type deviceResult struct {
+	ID      string `mapstructure:"id" yaml:"id" json:"id"`
+	Name    string `mapstructure:"name" yaml:"name" json:"name"`
+	Address string `mapstructure:"address" yaml:"address,omitempty" json:"address,omitempty"`
+}
+
+func newDeviceResult(d *Device) *deviceResult {
+	if d == nil {
+		return nil
+	}
+	return &deviceResult{
+		ID:      d.ID,
+		Name:    d.Name,
+		Address: d.Address,
+	}
+}
+
+func addOutputFlag(cmd *cobra.Command) {
+	cmd.Flags().StringP("output", "o", "short", "set output format to json, yaml or short")
+}
+
+// parseCommandOutput returns the output selected with the flag added by
+// addOutputFlag. With json or yaml, what the command prints goes to stderr,
+// so it doesn't end up in the result. The context of the command carries
+// the writer for the tools it runs, see getStdout.
+func parseCommandOutput(cmd *cobra.Command) (*commandOutput, error) {
+	format, err := parseOutputFormatFlag(cmd, resultOutputFormats)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &commandOutput{
+		format: format,
+		w:      cmd.OutOrStdout(),
+		stdout: cmd.OutOrStdout(),
+	}
+	if o.structured() {
+		o.stdout = cmd.ErrOrStderr()
+	}
+	cmd.SetContext(setStdout(cmd.Context(), o.stdout))
+	return o, nil
+}
+
+func setStdout(ctx context.Context, w io.Writer) context.Context {
+	return context.WithValue(ctx, ctxKeyStdout, w)
+}
+
+// getStdout returns the writer the command prints its progress to. Without
+// one, it is stdout.
+func getStdout(ctx context.Context) io.Writer {
+	if w, ok := ctx.Value(ctxKeyStdout).(io.Writer); ok {
+		return w
+	}
+	return os.Stdout
+}
+
+// structured returns whether the result is printed as json or yaml.
+func (o *commandOutput) structured() bool {
+	return o.format != "short"
+}
+
+// print prints the result with the error of the command, if it failed, and
+// returns the error. In the short format nothing is printed, as the command
+// already printed its results.
+func (o *commandOutput) print(result commandResult, err error) error {
+	if !o.structured() {
+		return err
+	}
+	if err != nil {
+		result.setError(&commandError{
+			Message:  err.Error(),
+			ExitCode: ExitCode(err),
+		})
+	}
+	var encodeErr error
+	if o.format == "json" {
+		encodeErr = json.NewEncoder(o.w).Encode(result)
+	} else {
+		encodeErr = yaml.NewEncoder(o.w).Encode(result)
+	}
+	if err != nil {
+		return err
+	}
+	return encodeErr
+}
@@ -7,6 +7,7 @@ package commands
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -15,8 +16,10 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -58,7 +61,7 @@ func IsSnapshot(filename string) bool {
 func GetUuid(filename string) (uuid.UUID, error) {
 	source, err := os.Open(filename)
 	if err != nil {
-		fmt.Printf("Failed to open '%s'n", filename)
+		fmt.Fprintf(os.Stderr, "Failed to open '%s'n", filename)
 		return uuid.Nil, err
 	}
 	reader := ar.NewReader(source)
@@ -67,9 +70,9 @@ func GetUuid(filename string) (uuid.UUID, error) {
 		header, err := reader.Next()
 		if err != nil {
 			if readAtLeastOneEntry {
-				fmt.Printf("Did not include UUID: '%s'n", filename)
+				fmt.Fprintf(os.Stderr, "Did not include UUID: '%s'n", filename)
 			} else {
-				fmt.Printf("Not a snapshot file: '%s'n", filename)
+				fmt.Fprintf(os.Stderr, "Not a snapshot file: '%s'n", filename)
 			}
 			return uuid.Nil, err
 		}
@@ -77,7 +80,7 @@ func GetUuid(filename string) (uuid.UUID, error) {
 			raw_uuid := make([]byte, 16)
 			_, err = io.ReadAtLeast(reader, raw_uuid, 16)
 			if err != nil {
-				fmt.Printf("UUID in snapshot too short: '%s'n", filename)
+				fmt.Fprintf(os.Stderr, "UUID in snapshot too short: '%s'n", filename)
 				return uuid.Nil, err
 			}
 			return uuid.FromBytes(raw_uuid)
@@ -87,96 +90,259 @@ func GetUuid(filename string) (uuid.UUID, error) {
 
 func RunCmd() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "run <file>",
+		Use:   "run <file> [-- <arguments>...]",
 		Short: "Run Toit code on a Jaguar device",
 		Long: "Run the specified .toit file on a Jaguar device as a new program. If the\n" +
 			"device is already executing another program, that program is stopped before\n" +
 			"the new program is started.\n" +
 			"If you specify the device to be 'host' with the option '-d host', then the\n" +
-			"program runs on the current computer instead.",
+			"program runs on the current computer instead.\n" +
+			"With '--follow', the output printed on the device is shown until you\n" +
+			"press Ctrl-C, so you don't need a serial connection to see it.\n" +
+			"The arguments after '--' are passed to the main function of the program,\n" +
+			"and the variables given with '--env KEY=VALUE' are available to it in the\n" +
+			"'jag.env' asset. On the host, they are set in its environment.",
 		Args:         cobra.MinimumNArgs(0),
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			ctx := cmd.Context()
-
-			deviceSelect, err := parseDeviceFlag(cmd)
+			out, err := parseCommandOutput(cmd)
 			if err != nil {
 				return err
 			}
+			result := &runResult{}
+			return out.print(result, run(cmd, args, out, result))
+		},
+	}
 
-			optimizationLevel := -1
-			if cmd.Flags().Changed("optimization-level") {
-				optimizationLevel, err = cmd.Flags().GetInt("optimization-level")
-				if err != nil {
-					return err
-				}
-			}
+	cmd.Flags().StringP("expression", "s", "", "evaluate immediate Toit expression")
+	cmd.Flags().StringP("device", "d", "", "use device with a given name, id, or address")
+	cmd.Flags().String("group", "", "run on all the devices of the given group (see 'jag group')")
+	cmd.Flags().StringArrayP("define", "D", nil, "define settings to control run on device")
+	cmd.Flags().String("assets", "", "attach assets to the program")
+	cmd.Flags().StringArray("env", nil, "set an environment variable for the program (KEY=VALUE)")
+	cmd.Flags().IntP("optimization-level", "O", -1, "optimization level")
+	cmd.Flags().BoolP("follow", "f", false, "show the output printed on the device until interrupted")
+	addOutputFlag(cmd)
+	return cmd
+}
 
-			if name, ok := deviceSelect.(deviceNameSelect); ok && string(name) == "host" {
-				if cmd.Flags().Changed("define") {
-					return fmt.Errorf("--define/-D is not yet supported when running on host")
-				}
-				return runOnHost(ctx, cmd, args, optimizationLevel)
-			}
+// runResult is the result of 'jag run' printed with --output.
+type runResult struct {
+	commandStatus `yaml:",inline"`
+	Program       string `mapstructure:"program" yaml:"program,omitempty" json:"program,omitempty"`
+	// Devices are the devices the program was sent to, with the error for
+	// each of them it failed for.
+	Devices []runDeviceResult `mapstructure:"devices" yaml:"devices" json:"devices"`
+}
 
-			if cmd.Flags().Changed("expression") {
-				return fmt.Errorf("--expression/-s is not yet supported when running on devices")
-			}
+type runDeviceResult struct {
+	Name  string `mapstructure:"name" yaml:"name" json:"name"`
+	ID    string `mapstructure:"id" yaml:"id,omitempty" json:"id,omitempty"`
+	Error string `mapstructure:"error" yaml:"error,omitempty" json:"error,omitempty"`
+}
 
-			cfg, err := directory.GetDeviceConfig()
-			if err != nil {
-				return err
-			}
+func (r *runResult) add(name string, device *Device, err error) {
+	d := runDeviceResult{Name: name}
+	if device != nil {
+		d.Name = device.Name
+		d.ID = device.ID
+	}
+	if err != nil {
+		d.Error = err.Error()
+	}
+	r.Devices = append(r.Devices, d)
+}
 
-			if len(args) == 0 {
-				return fmt.Errorf("No input file provided")
-			} else if len(args) > 1 {
-				return fmt.Errorf("Passing arguments is only supported with 'jag run -d host'")
-			}
+func run(cmd *cobra.Command, args []string, out *commandOutput, result *runResult) error {
+	ctx := cmd.Context()
 
-			programAssetsPath, err := GetProgramAssetsPath(cmd.Flags(), "assets")
-			if err != nil {
-				return err
-			}
+	deviceSelect, err := parseDeviceFlag(cmd)
+	if err != nil {
+		return err
+	}
+	if deviceSelect != nil && cmd.Flags().Changed("group") {
+		return fmt.Errorf("--device and --group are exclusive")
+	}
 
-			entrypoint := args[0]
-			if stat, err := os.Stat(entrypoint); err != nil {
-				if os.IsNotExist(err) {
-					return fmt.Errorf("no such file or directory: '%s'", entrypoint)
-				}
-				return fmt.Errorf("can't stat file '%s', reason: %w", entrypoint, err)
-			} else if stat.IsDir() {
-				return fmt.Errorf("can't run directory: '%s'", entrypoint)
-			}
+	follow, err := cmd.Flags().GetBool("follow")
+	if err != nil {
+		return err
+	}
+	if follow && cmd.Flags().Changed("group") {
+		return fmt.Errorf("--follow and --group are exclusive")
+	}
+	if follow && out.structured() {
+		return fmt.Errorf("--follow and --output are exclusive")
+	}
 
-			sdk, err := GetSDK(ctx)
-			if err != nil {
-				return err
-			}
+	optimizationLevel := -1
+	if cmd.Flags().Changed("optimization-level") {
+		optimizationLevel, err = cmd.Flags().GetInt("optimization-level")
+		if err != nil {
+			return err
+		}
+	}
 
-			device, err := GetDevice(ctx, cfg, sdk, true, deviceSelect)
-			if err != nil {
-				return err
-			}
+	if name, ok := deviceSelect.(deviceNameSelect); ok && string(name) == "host" {
+		if cmd.Flags().Changed("define") {
+			return fmt.Errorf("--define/-D is not yet supported when running on host")
+		}
+		env, err := parseEnvFlags(cmd, "env")
+		if err != nil {
+			return err
+		}
+		return runOnHost(ctx, cmd, args, env, optimizationLevel)
+	}
 
-			defines, err := parseDefineFlags(cmd, "define")
-			if err != nil {
-				return err
-			}
+	if cmd.Flags().Changed("expression") {
+		return fmt.Errorf("--expression/-s is not yet supported when running on devices")
+	}
 
-			return RunFile(cmd, device, sdk, entrypoint, defines, programAssetsPath, optimizationLevel)
-		},
+	cfg, err := directory.GetDeviceConfig()
+	if err != nil {
+		return err
 	}
 
-	cmd.Flags().StringP("expression", "s", "", "evaluate immediate Toit expression")
-	cmd.Flags().StringP("device", "d", "", "use device with a given name, id, or address")
-	cmd.Flags().StringArrayP("define", "D", nil, "define settings to control run on device")
-	cmd.Flags().String("assets", "", "attach assets to the program")
-	cmd.Flags().IntP("optimization-level", "O", -1, "optimization level")
-	return cmd
+	if len(args) == 0 {
+		return fmt.Errorf("No input file provided")
+	} else if dash := cmd.ArgsLenAtDash(); dash > 1 || (dash == -1 && len(args) > 1) {
+		return fmt.Errorf("only one input file can be run, pass arguments to the program after '--'")
+	}
+
+	programAssetsPath, err := GetProgramAssetsPath(cmd.Flags(), "assets")
+	if err != nil {
+		return err
+	}
+
+	entrypoint := args[0]
+	result.Program = entrypoint
+	if stat, err := os.Stat(entrypoint); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("no such file or directory: '%s'", entrypoint)
+		}
+		return fmt.Errorf("can't stat file '%s', reason: %w", entrypoint, err)
+	} else if stat.IsDir() {
+		return fmt.Errorf("can't run directory: '%s'", entrypoint)
+	}
+
+	sdk, err := GetSDK(ctx)
+	if err != nil {
+		return err
+	}
+
+	defines, err := parseDefineFlags(cmd, "define")
+	if err != nil {
+		return err
+	}
+	if len(args) > 1 {
+		arguments := []interface{}{}
+		for _, arg := range args[1:] {
+			arguments = append(arguments, arg)
+		}
+		defines["jag.arguments"] = arguments
+	}
+	env, err := parseEnvFlags(cmd, "env")
+	if err != nil {
+		return err
+	}
+	if len(env) > 0 {
+		defines["jag.env"] = env
+	}
+
+	if cmd.Flags().Changed("group") {
+		group, err := cmd.Flags().GetString("group")
+		if err != nil {
+			return err
+		}
+		members, err := getGroupDevices(ctx, cfg, group)
+		if err != nil {
+			return err
+		}
+		err = RunFileOnDevices(cmd, members, sdk, entrypoint, defines, programAssetsPath, optimizationLevel)
+		// With --output json or yaml, the results are only in the result
+		// object.
+		if !out.structured() {
+			printGroupResults(getStdout(ctx), members)
+		}
+		for _, m := range members {
+			result.add(m.name, m.device, m.err)
+		}
+		return err
+	}
+
+	device, err := GetDevice(ctx, cfg, sdk, true, deviceSelect)
+	if err != nil {
+		return err
+	}
+
+	if !follow {
+		err := RunFile(cmd, device, sdk, entrypoint, defines, programAssetsPath, optimizationLevel)
+		result.add(device.Name, device, err)
+		return err
+	}
+
+	// Find out where the output of the device ends before running
+	// the program, so none of its output is missed.
+	output, err := device.Output(ctx, sdk, -1)
+	if err != nil {
+		return err
+	}
+	if err := RunFile(cmd, device, sdk, entrypoint, defines, programAssetsPath, optimizationLevel); err != nil {
+		return err
+	}
+	return followOutput(ctx, device, sdk, output.Next)
+}
+
+// followOutput prints the output of the device from the line with the
+// given sequence number on, until the context is cancelled. Failing to get
+// the output, for instance because the device restarts, isn't fatal; we
+// keep trying until the device answers again.
+func followOutput(ctx context.Context, device *Device, sdk *SDK, from int) error {
+	fmt.Fprintf(os.Stderr, "Following the output of '%s', press Ctrl-C to stop ...\n", device.Name)
+	for ctx.Err() == nil {
+		pollCtx, cancel := context.WithTimeout(ctx, outputPollTimeout)
+		output, err := device.Output(pollCtx, sdk, from)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			fmt.Fprintf(os.Stderr, "Failed to get the output of '%s': %s\n", device.Name, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(outputRetryDelay):
+			}
+			continue
+		}
+		if output.Dropped > 0 {
+			fmt.Fprintf(os.Stderr, "[%d lines of output were dropped]\n", output.Dropped)
+		}
+		for _, line := range output.Lines {
+			fmt.Fprintln(getStdout(ctx), line)
+		}
+		from = output.Next
+	}
+	return nil
+}
+
+// parseEnvFlags returns the KEY=VALUE pairs given with the flag as a map.
+func parseEnvFlags(cmd *cobra.Command, flagName string) (map[string]interface{}, error) {
+	pairs, err := cmd.Flags().GetStringArray(flagName)
+	if err != nil {
+		return nil, err
+	}
+	env := make(map[string]interface{})
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid --%s '%s', must be KEY=VALUE", flagName, pair)
+		}
+		env[kv[0]] = kv[1]
+	}
+	return env, nil
 }
 
-func runOnHost(ctx context.Context, cmd *cobra.Command, args []string, optimizationLevel int) error {
+func runOnHost(ctx context.Context, cmd *cobra.Command, args []string, env map[string]interface{}, optimizationLevel int) error {
 	sdk, err := GetSDK(ctx)
 	if err != nil {
 		return err
@@ -197,8 +363,14 @@ func runOnHost(ctx context.Context, cmd *cobra.Command, args []string, optimizat
 		runCmd = sdk.ToitRun(ctx, args...)
 	}
 
+	if len(env) > 0 {
+		runCmd.Env = os.Environ()
+		for key, value := range env {
+			runCmd.Env = append(runCmd.Env, key+"="+fmt.Sprint(value))
+		}
+	}
 	runCmd.Stderr = os.Stderr
-	runCmd.Stdout = os.Stdout
+	runCmd.Stdout = getStdout(ctx)
 	runCmd.Stdin = os.Stdin
 	return runCmd.Run()
 }
@@ -211,7 +383,7 @@ func RunFile(
 	defines map[string]interface{},
 	assetsPath string,
 	optimizationLevel int) error {
-	fmt.Printf("Running '%s' on '%s' ...\n", path, device.Name)
+	announceCode(cmd.Context(), "/run", path, "", device)
 	return sendCodeFromFile(cmd, device, sdk, "/run", path, "", defines, assetsPath, optimizationLevel)
 }
 
@@ -224,10 +396,47 @@ func InstallFile(
 	defines map[string]interface{},
 	assetsPath string,
 	optimizationLevel int) error {
-	fmt.Printf("Installing container '%s' from '%s' on '%s' ...\n", name, path, device.Name)
+	announceCode(cmd.Context(), "/install", path, name, device)
 	return sendCodeFromFile(cmd, device, sdk, "/install", path, name, defines, assetsPath, optimizationLevel)
 }
 
+// RunFileOnDevices runs the program on all the devices concurrently, like
+// RunFile, but compiles it only once. How it went for each of them is
+// recorded in the members, see forEachGroupDevice.
+func RunFileOnDevices(
+	cmd *cobra.Command,
+	members []groupMember,
+	sdk *SDK,
+	path string,
+	defines map[string]interface{},
+	assetsPath string,
+	optimizationLevel int) error {
+	return sendCodeToGroup(cmd, members, sdk, "/run", path, "", defines, assetsPath, optimizationLevel)
+}
+
+// InstallFileOnDevices installs the container on all the devices
+// concurrently, like InstallFile, but compiles it only once.
+func InstallFileOnDevices(
+	cmd *cobra.Command,
+	members []groupMember,
+	sdk *SDK,
+	name string,
+	path string,
+	defines map[string]interface{},
+	assetsPath string,
+	optimizationLevel int) error {
+	return sendCodeToGroup(cmd, members, sdk, "/install", path, name, defines, assetsPath, optimizationLevel)
+}
+
+// announceCode prints what is about to be sent to the device.
+func announceCode(ctx context.Context, request string, path string, name string, device *Device) {
+	if request == "/install" {
+		fmt.Fprintf(getStdout(ctx), "Installing container '%s' from '%s' on '%s' ...\n", name, path, device.Name)
+	} else {
+		fmt.Fprintf(getStdout(ctx), "Running '%s' on '%s' ...\n", path, device.Name)
+	}
+}
+
 func sendCodeFromFile(
 	cmd *cobra.Command,
 	device *Device,
@@ -238,11 +447,88 @@ func sendCodeFromFile(
 	defines map[string]interface{},
 	assetsPath string,
 	optimizationLevel int) error {
+	p, err := prepareProgram(cmd, sdk, path, name, defines, assetsPath, optimizationLevel)
+	if err != nil {
+		return err
+	}
+	defer p.close()
+	if err := p.send(cmd.Context(), device, sdk, request); err != nil {
+		// The tools and send print their errors.
+		// Mark the command as silent to avoid printing the error twice.
+		cmd.SilenceErrors = true
+		return err
+	}
+	return nil
+}
 
+func sendCodeToGroup(
+	cmd *cobra.Command,
+	members []groupMember,
+	sdk *SDK,
+	request string,
+	path string,
+	name string,
+	defines map[string]interface{},
+	assetsPath string,
+	optimizationLevel int) error {
+	p, err := prepareProgram(cmd, sdk, path, name, defines, assetsPath, optimizationLevel)
+	if err != nil {
+		// The program isn't sent to any of the devices.
+		for i := range members {
+			if members[i].err == nil {
+				members[i].err = err
+			}
+		}
+		return err
+	}
+	defer p.close()
+	// The devices are sent the program concurrently, so the command isn't
+	// touched here. The callers report the results.
 	ctx := cmd.Context()
+	return forEachGroupDevice(members, func(device *Device) error {
+		announceCode(ctx, request, path, name, device)
+		return p.send(ctx, device, sdk, request)
+	})
+}
+
+// preparedProgram is a compiled program with its defines, ready to be sent
+// to devices. The image only depends on the word size of the device, so it
+// is built once for every word size.
+type preparedProgram struct {
+	snapshot   string
+	assetsPath string
+	headers    map[string]string
+	cleanup    []func()
+
+	mutex  sync.Mutex
+	images map[int][]byte
+}
+
+// prepareProgram compiles the program at the path, unless it is a snapshot
+// already, and adds the snapshot to the cache. The defines are split into
+// the headers for Jaguar and the assets.
+func prepareProgram(
+	cmd *cobra.Command,
+	sdk *SDK,
+	path string,
+	name string,
+	defines map[string]interface{},
+	assetsPath string,
+	optimizationLevel int) (_ *preparedProgram, err error) {
+
+	ctx := cmd.Context()
+	p := &preparedProgram{
+		images: map[int][]byte{},
+	}
+	defer func() {
+		if err != nil {
+			p.close()
+		}
+	}()
+
 	snapshotsCache, err := directory.GetSnapshotsCachePath()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var snapshot string = ""
@@ -254,13 +540,13 @@ func sendCodeFromFile(
 		// snapshot first.
 		tempdir, err := ioutil.TempDir("", "jag_run")
 		if err != nil {
-			return err
+			return nil, err
 		}
-		defer os.RemoveAll(tempdir)
+		p.cleanup = append(p.cleanup, func() { os.RemoveAll(tempdir) })
 
 		snapshotFile, err := ioutil.TempFile(tempdir, "jag_run_*.snapshot")
 		if err != nil {
-			return err
+			return nil, err
 		}
 		snapshot = snapshotFile.Name()
 		err = sdk.Compile(ctx, snapshot, path, optimizationLevel)
@@ -268,13 +554,13 @@ func sendCodeFromFile(
 			// We assume the error has been printed.
 			// Mark the command as silent to avoid printing the error twice.
 			cmd.SilenceErrors = true
-			return err
+			return nil, err
 		}
 	}
 
 	programId, err := GetUuid(snapshot)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	cacheDestination := filepath.Join(snapshotsCache, programId.String()+".snapshot")
@@ -288,31 +574,31 @@ func sendCodeFromFile(
 	if cacheDestination != snapshot {
 		tempFileInCacheDirectory, err := ioutil.TempFile(snapshotsCache, "jag_run_*.snapshot")
 		if err != nil {
-			fmt.Printf("Failed to write temporary file in '%s'\n", snapshotsCache)
-			return err
+			fmt.Fprintf(getStdout(ctx), "Failed to write temporary file in '%s'\n", snapshotsCache)
+			return nil, err
 		}
 		defer tempFileInCacheDirectory.Close()
 		defer os.Remove(tempFileInCacheDirectory.Name())
 
 		source, err := os.Open(snapshot)
 		if err != nil {
-			fmt.Printf("Failed to read '%s'n", snapshot)
-			return err
+			fmt.Fprintf(getStdout(ctx), "Failed to read '%s'n", snapshot)
+			return nil, err
 		}
 		defer source.Close()
 		defer tempFileInCacheDirectory.Close()
 
 		_, err = io.Copy(tempFileInCacheDirectory, source)
 		if err != nil {
-			fmt.Printf("Failed to write '%s'n", tempFileInCacheDirectory.Name())
-			return err
+			fmt.Fprintf(getStdout(ctx), "Failed to write '%s'n", tempFileInCacheDirectory.Name())
+			return nil, err
 		}
 		tempFileInCacheDirectory.Close()
 
 		// Atomic move so no other process can see a half-written snapshot file.
 		err = os.Rename(tempFileInCacheDirectory.Name(), cacheDestination)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
@@ -321,6 +607,7 @@ func sendCodeFromFile(
 	headersMap := make(map[string]string)
 	headersMap[JaguarContainerNameHeader] = name
 	assetsMap := make(map[string]interface{})
+	var envMap map[string]interface{}
 	for key, value := range defines {
 		if strings.HasPrefix(key, "jag.") {
 			if key == "jag.disabled" {
@@ -330,7 +617,7 @@ func sendCodeFromFile(
 						headersMap[JaguarDisabledHeader] = "true"
 					}
 				default:
-					return fmt.Errorf("jag.disabled must be a bool")
+					return nil, fmt.Errorf("jag.disabled must be a bool")
 				}
 			} else if key == "jag.timeout" {
 				switch converted := value.(type) {
@@ -339,64 +626,110 @@ func sendCodeFromFile(
 				case string:
 					duration, err := time.ParseDuration(converted)
 					if err != nil {
-						return fmt.Errorf("cannot parse jag.timeout ('%s') as a duration", converted)
+						return nil, fmt.Errorf("cannot parse jag.timeout ('%s') as a duration", converted)
 					}
 					headersMap[JaguarContainerTimeoutHeader] = fmt.Sprint(int(math.Ceil(duration.Seconds())))
 				default:
-					return fmt.Errorf("jag.timeout must be a string or an int")
+					return nil, fmt.Errorf("jag.timeout must be a string or an int")
+				}
+			} else if key == "jag.version" {
+				headersMap[JaguarContainerVersionHeader] = fmt.Sprint(value)
+			} else if key == "jag.arguments" {
+				arguments, ok := value.([]interface{})
+				if !ok {
+					return nil, fmt.Errorf("jag.arguments must be a list")
+				}
+				// The arguments are base64 encoded, so they can contain any
+				// character without breaking the header.
+				encoded, err := json.Marshal(arguments)
+				if err != nil {
+					return nil, err
 				}
+				headersMap[JaguarContainerArgumentsHeader] = base64.StdEncoding.EncodeToString(encoded)
+			} else if key == "jag.env" {
+				converted, ok := value.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("jag.env must be a map")
+				}
+				envMap = converted
 			} else {
-				return fmt.Errorf("unsupported Jaguar define: %s", key)
+				return nil, fmt.Errorf("unsupported Jaguar define: %s", key)
 			}
 		} else {
 			assetsMap[key] = value
 		}
 	}
 
+	// The defines and the environment are sent along as TISON assets.
+	jagAssets := make(map[string]interface{})
 	if len(assetsMap) > 0 {
+		jagAssets["jag.defines"] = assetsMap
+	}
+	if len(envMap) > 0 {
+		jagAssets["jag.env"] = envMap
+	}
+	if len(jagAssets) > 0 {
 		temporaryAssetsFile, err := ioutil.TempFile("", "jag_run_*.assets")
 		if err != nil {
-			return err
+			return nil, err
 		}
 		defer temporaryAssetsFile.Close()
-		defer os.Remove(temporaryAssetsFile.Name())
-		buildAssets(ctx, sdk, temporaryAssetsFile, assetsPath, assetsMap)
+		p.cleanup = append(p.cleanup, func() { os.Remove(temporaryAssetsFile.Name()) })
+		if err := buildAssets(ctx, sdk, temporaryAssetsFile, assetsPath, jagAssets); err != nil {
+			return nil, err
+		}
 		assetsPath = temporaryAssetsFile.Name()
 	}
 
-	b, err := sdk.Build(ctx, device, cacheDestination, assetsPath)
-	if err != nil {
-		// We assume the error has been printed.
-		// Mark the command as silent to avoid printing the error twice.
-		cmd.SilenceErrors = true
-		return err
+	p.snapshot = cacheDestination
+	p.assetsPath = assetsPath
+	p.headers = headersMap
+	return p, nil
+}
+
+// close removes the temporary files of the program.
+func (p *preparedProgram) close() {
+	for _, cleanup := range p.cleanup {
+		cleanup()
 	}
+}
 
-	if err := device.SendCode(ctx, sdk, request, b, headersMap); err != nil {
-		fmt.Println("Error:", err)
-		// We just printed the error.
-		// Mark the command as silent to avoid printing the error twice.
-		cmd.SilenceErrors = true
-		return err
+// image returns the image of the program for the word size of the device.
+func (p *preparedProgram) image(ctx context.Context, sdk *SDK, device *Device) ([]byte, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if b, ok := p.images[device.WordSize]; ok {
+		return b, nil
 	}
-	fmt.Printf("Success: Sent %dKB code to '%s'\n", len(b)/1024, device.Name)
-	return nil
+	b, err := sdk.Build(ctx, device, p.snapshot, p.assetsPath)
+	if err != nil {
+		return nil, err
+	}
+	p.images[device.WordSize] = b
+	return b, nil
 }
 
-func buildAssets(ctx context.Context, sdk *SDK, output *os.File, inputPath string, assetsMap map[string]interface{}) error {
-	// Write the defines into a temporary file as JSON.
-	definesJsonFile, err := ioutil.TempFile("", "jag_run_*.defines")
+// send sends the program to the device with the given request. It is
+// called concurrently for the devices of a group. The errors of the tools
+// that build the image are printed by them, and the errors of sending the
+// image are printed here.
+func (p *preparedProgram) send(ctx context.Context, device *Device, sdk *SDK, request string) error {
+	b, err := p.image(ctx, sdk, device)
 	if err != nil {
 		return err
 	}
-	definesJson, err := json.Marshal(assetsMap)
-	if err != nil {
+
+	if err := device.SendCode(ctx, sdk, request, b, p.headers); err != nil {
+		fmt.Fprintln(getStdout(ctx), "Error:", err)
 		return err
 	}
-	os.WriteFile(definesJsonFile.Name(), definesJson, 0777)
-	defer definesJsonFile.Close()
-	defer os.Remove(definesJsonFile.Name())
+	fmt.Fprintf(getStdout(ctx), "Success: Sent %dKB code to '%s'\n", len(b)/1024, device.Name)
+	return nil
+}
 
+// buildAssets writes the assets at the inputPath, if any, to the output
+// with the given values added as TISON assets under their names.
+func buildAssets(ctx context.Context, sdk *SDK, output *os.File, inputPath string, values map[string]interface{}) error {
 	// Create a new assets file or copy the existing one.
 	if inputPath == "" {
 		if err := runAssetsTool(ctx, sdk, output.Name(), "create"); err != nil {
@@ -405,14 +738,40 @@ func buildAssets(ctx context.Context, sdk *SDK, output *os.File, inputPath strin
 		inputPath = output.Name()
 	}
 
-	// Add the defines as a TISON asset under with the name jag.defines.
-	return runAssetsTool(ctx, sdk, inputPath, "add", "-o", output.Name(), "--format=tison", "jag.defines", definesJsonFile.Name())
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		// Write the value into a temporary file as JSON.
+		jsonFile, err := ioutil.TempFile("", "jag_run_*.json")
+		if err != nil {
+			return err
+		}
+		defer jsonFile.Close()
+		defer os.Remove(jsonFile.Name())
+		encoded, err := json.Marshal(values[name])
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(jsonFile.Name(), encoded, 0600); err != nil {
+			return err
+		}
+
+		if err := runAssetsTool(ctx, sdk, inputPath, "add", "-o", output.Name(), "--format=tison", name, jsonFile.Name()); err != nil {
+			return err
+		}
+		// The following assets are added to the output.
+		inputPath = output.Name()
+	}
+	return nil
 }
 
 func runAssetsTool(ctx context.Context, sdk *SDK, assetsPath string, args ...string) error {
 	args = append([]string{"-e", assetsPath}, args...)
 	cmd := sdk.AssetsTool(ctx, args...)
 	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
+	cmd.Stdout = getStdout(ctx)
 	return cmd.Run()
 }
@@ -5,19 +5,32 @@
 package commands
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/rand"
 	"net"
 	"net/http"
 	"os"
+	"os/exec"
+	"path"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/manifoldco/promptui"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 	"github.com/toitlang/jaguar/cmd/jag/directory"
 	"github.com/toitware/ubjson"
 	"gopkg.in/yaml.v2"
@@ -27,273 +40,3016 @@ const (
 	scanTimeout  = 600 * time.Millisecond
 	scanPort     = 1990
 	scanHttpPort = 9000
+
+	// connectTimeout is how long we wait for a single address to identify
+	// itself. Busy networks need longer than the broadcast scan.
+	connectTimeout = 2 * time.Second
+
+	// expectTimeout is how long we keep scanning for the number of devices
+	// given with --expect.
+	expectTimeout = 10 * time.Second
+
+	// identifyRetries and identifyRetryDelay are the defaults for retrying
+	// the identify requests to a single address.
+	identifyRetries     = 2
+	identifyRetryDelay  = 100 * time.Millisecond
+	identifyDialTimeout = 2 * time.Second
+	// identifyPath and identifyMethod are the defaults for the request
+	// that asks a device to identify itself.
+	identifyPath   = "/identify"
+	identifyMethod = http.MethodGet
+
+	scanBufferSize = 1024
+	// maxScanBufferSize is the largest possible UDP payload.
+	maxScanBufferSize = 65507
+	// scanBufferFillLimit is the number of reads that may fill the scan
+	// buffer before it is grown.
+	scanBufferFillLimit = 2
+	// scanParsers is the number of goroutines that parse the broadcasts
+	// received on a port, and scanPacketQueueSize is the number of packets
+	// that may wait for them.
+	scanParsers         = 4
+	scanPacketQueueSize = 256
+
+	// The keys in the device config with the defaults for the --output,
+	// --timeout and --validate-cmd flags.
+	scanOutputCfgKey      = ScanCfgKey + "." + ScanOutputCfgKey
+	scanTimeoutCfgKey     = ScanCfgKey + "." + ScanTimeoutCfgKey
+	scanValidateCmdCfgKey = ScanCfgKey + "." + ScanValidateCmdCfgKey
 )
 
 func ScanCmd() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "scan [device]",
+		Use:   "scan [device | address...]",
 		Short: "Scan for Jaguar devices",
 		Long: "Scan for Jaguar devices.\n" +
 			"Unless 'device' is an address, listen for UDP packets broadcasted by the devices.\n" +
 			"In that case you need to be on the same network as the device.\n" +
 			"If a device selection is given, automatically select that device.\n" +
-			"If the device selection is an address, connect to it using TCP.",
-		Args: cobra.MaximumNArgs(1),
-		RunE: func(cmd *cobra.Command, args []string) error {
+			"If the device selection is an address, connect to it using TCP.\n" +
+			"If several addresses are given, they are all asked to identify themselves at\n" +
+			"the same time. The addresses that don't answer are reported at the end.\n" +
+			"If 'device' is a range like 192.168.1.0/24, ask every host in the range to\n" +
+			"identify itself using TCP. Use this when broadcasts are blocked. The range\n" +
+			"can also be given with '--subnet'. Up to '--concurrency' hosts are asked at\n" +
+			"the same time, each for at most '--connect-timeout'. The whole sweep takes\n" +
+			"at most '--timeout' if it is given.\n\n" +
+			"Devices that announce themselves more than once are only listed once. Use\n" +
+			"'--dedup-by' to control how devices are told apart: by 'id' (the default)\n" +
+			"merges devices that share an ID and uses the most recently seen address, by\n" +
+			"'address' lists a device twice if it changes address during the scan, and by\n" +
+			"'name' merges devices that share a name.\n\n" +
+			"The addresses of the found devices are stored in a seed file. The next scan\n" +
+			"probes these addresses directly, so devices that haven't changed address are\n" +
+			"found right away even if their broadcasts are missed.\n\n" +
+			"Use '--watch' to keep scanning until interrupted. Devices are shown as they come\n" +
+			"online and go offline. With '--output json', every change is printed as a single\n" +
+			"line of JSON.\n\n" +
+			"Use '--interface <name>' to only scan on one network interface, like when a VPN\n" +
+			"or a container bridge is in the way. Devices broadcast to all addresses, so jag\n" +
+			"still listens on all of them, but drops the broadcasts that didn't come from the\n" +
+			"networks of the interface. The '--timeout' is for the whole scan, not for each\n" +
+			"interface or port. Use '--list-interfaces' to see the available interfaces.\n\n" +
+			"Use '--all-interfaces' on a machine that is attached to several networks. jag\n" +
+			"then listens with a socket per IPv4 interface that isn't a loopback interface,\n" +
+			"and merges the devices found on all of them. Interfaces that can't be listened\n" +
+			"on are skipped with a warning.\n\n" +
+			"Use '--expect <n>' when devices are slow to announce themselves. The scan then\n" +
+			"keeps going until n devices are found, for at most '--expect-timeout'.\n\n" +
+			"Use '--await <name>' in scripts to block until the named device shows up.\n" +
+			"The address of the device is then printed on stdout with nothing else and the\n" +
+			"command exits with 0. Diagnostics are printed on stderr.\n\n" +
+			"Use '--dry-run' to check the flags. The ports, interfaces, timeouts, discovery\n" +
+			"method and output format of the scan are printed, and nothing is sent or\n" +
+			"received on the network.",
+		Args: cobra.ArbitraryArgs,
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
 			ctx := cmd.Context()
 			cfg, err := directory.GetDeviceConfig()
 			if err != nil {
 				return err
 			}
 
+			if cmd.Flags().Changed("output-file") {
+				path, err := cmd.Flags().GetString("output-file")
+				if err != nil {
+					return err
+				}
+				out := &outputFile{path: path}
+				cmd.SetOut(out)
+				defer func() {
+					if closeErr := out.close(err == nil); err == nil {
+						err = closeErr
+					}
+				}()
+			}
+
 			var autoSelect deviceSelect = nil
-			if len(args) == 1 {
-				autoSelect = parseDeviceSelection(args[0])
+			var network *net.IPNet
+			var addresses []string
+			if len(args) > 1 {
+				for _, arg := range args {
+					if _, _, err := net.ParseCIDR(arg); err == nil {
+						return fmt.Errorf("a range can't be given together with other addresses")
+					}
+				}
+				addresses = args
+			} else if len(args) == 1 {
+				if _, n, err := net.ParseCIDR(args[0]); err == nil {
+					network = n
+				} else {
+					autoSelect = parseDeviceSelection(args[0])
+				}
+			}
+
+			if cmd.Flags().Changed("subnet") {
+				if len(args) > 0 {
+					return fmt.Errorf("--subnet can't be given together with a device or addresses")
+				}
+				subnet, err := cmd.Flags().GetString("subnet")
+				if err != nil {
+					return err
+				}
+				if _, network, err = net.ParseCIDR(subnet); err != nil {
+					return fmt.Errorf("--subnet '%s' is not a valid range like 192.168.1.0/24", subnet)
+				}
+			}
+
+			if cmd.Flags().Changed("fingerprint") {
+				if autoSelect != nil {
+					return fmt.Errorf("a device selection and --fingerprint are exclusive")
+				}
+				fingerprint, err := cmd.Flags().GetString("fingerprint")
+				if err != nil {
+					return err
+				}
+				autoSelect = deviceFingerprintSelect(strings.ToLower(fingerprint))
+			}
+
+			// A device given with --device or --device-id must be found, so
+			// scripts without a terminal never end up at the prompt.
+			manualPick := false
+			if cmd.Flags().Changed("device") || cmd.Flags().Changed("device-id") {
+				if cmd.Flags().Changed("device") && cmd.Flags().Changed("device-id") {
+					return fmt.Errorf("--device and --device-id are exclusive")
+				}
+				if autoSelect != nil {
+					return fmt.Errorf("a device selection and --device or --device-id are exclusive")
+				}
+				if cmd.Flags().Changed("device") {
+					name, err := cmd.Flags().GetString("device")
+					if err != nil {
+						return err
+					}
+					pattern, err := parseNamePattern(name)
+					if err != nil {
+						return fmt.Errorf("--device '%s' is not a valid pattern: %w", name, err)
+					}
+					if pattern != nil {
+						autoSelect = pattern
+					} else {
+						autoSelect = deviceNameSelect(name)
+					}
+				} else {
+					id, err := cmd.Flags().GetString("device-id")
+					if err != nil {
+						return err
+					}
+					autoSelect = deviceIDSelect(id)
+				}
+				manualPick = true
+			}
+
+			outputter, err := parseOutputFlag(cmd, cfg, scanOutputCfgKey)
+			if err != nil {
+				return err
+			}
+			if cmd.Flags().Changed("template") {
+				if outputter == nil {
+					return fmt.Errorf("--template only works with '--list'")
+				}
+				if cmd.Flags().Changed("output") {
+					return fmt.Errorf("--template and --output are exclusive")
+				}
+				text, err := cmd.Flags().GetString("template")
+				if err != nil {
+					return err
+				}
+				// Parse the template before scanning, so mistakes are found
+				// right away.
+				tmpl, err := template.New("device").Parse(text)
+				if err != nil {
+					return fmt.Errorf("failed to parse --template: %w", err)
+				}
+				outputter = newTemplateEncoder(cmd.OutOrStdout(), tmpl)
+			}
+			if outputter != nil {
+				output, err := stringFlagOrConfig(cmd, "output", cfg, scanOutputCfgKey)
+				if err != nil {
+					return err
+				}
+				// Scripts that parse the output don't want the progress
+				// messages either.
+				if strings.ToLower(output) != "short" {
+					ctx = setLogger(ctx, getLogger(ctx).quiet())
+				}
 			}
 
-			port, err := cmd.Flags().GetUint("port")
+			dryRun, err := cmd.Flags().GetBool("dry-run")
 			if err != nil {
 				return err
 			}
+			if dryRun {
+				for _, flag := range []string{"list-interfaces", "diagnose", "await", "watch", "open"} {
+					if cmd.Flags().Changed(flag) {
+						return fmt.Errorf("--dry-run and --%s are exclusive", flag)
+					}
+				}
+			}
+
+			listInterfaces, err := cmd.Flags().GetBool("list-interfaces")
+			if err != nil {
+				return err
+			}
+			if listInterfaces {
+				for _, iface := range diagnoseInterfaces() {
+					if !iface.Up || iface.Loopback {
+						continue
+					}
+					fmt.Fprintf(cmd.OutOrStdout(), "%s\t%s\n", iface.Name, strings.Join(iface.Addresses, " "))
+				}
+				return nil
+			}
 
-			timeout, err := cmd.Flags().GetDuration("timeout")
+			diagnose, err := cmd.Flags().GetBool("diagnose")
 			if err != nil {
 				return err
 			}
+			if diagnose {
+				var address string
+				if autoSelect != nil {
+					address = autoSelect.Address()
+					if address == "" {
+						return fmt.Errorf("--diagnose only works with an address")
+					}
+				}
+				output, err := stringFlagOrConfig(cmd, "output", cfg, scanOutputCfgKey)
+				if err != nil {
+					return err
+				}
+				opts, err := parseScanOptions(cmd, cfg)
+				if err != nil {
+					return err
+				}
+
+				cmd.SilenceUsage = true
+				return printDiagnosis(cmd.OutOrStdout(), diagnoseScan(ctx, address, opts), output)
+			}
+
+			if cmd.Flags().Changed("await") {
+				if autoSelect != nil || outputter != nil {
+					return fmt.Errorf("--await is exclusive with listing and device-selection")
+				}
+				name, err := cmd.Flags().GetString("await")
+				if err != nil {
+					return err
+				}
+				opts, err := parseScanOptions(cmd, cfg)
+				if err != nil {
+					return err
+				}
+
+				cmd.SilenceUsage = true
+				device, err := awaitDevice(ctx, opts, name)
+				if err != nil {
+					return err
+				}
+				storeDevice(cfg, *device)
+				storeToken(cfg, device.ID, opts.token)
+				if err := cfg.WriteConfig(); err != nil {
+					return err
+				}
+				fmt.Fprintln(cmd.OutOrStdout(), device.Address)
+				return nil
+			}
 
-			outputter, err := parseOutputFlag(cmd)
+			watch, err := cmd.Flags().GetBool("watch")
 			if err != nil {
 				return err
 			}
+			if watch {
+				if autoSelect != nil {
+					return fmt.Errorf("--watch and device-selection are exclusive")
+				}
+				output, err := stringFlagOrConfig(cmd, "output", cfg, scanOutputCfgKey)
+				if err != nil {
+					return err
+				}
+				ttl, err := cmd.Flags().GetDuration("ttl")
+				if err != nil {
+					return err
+				}
+				if ttl <= 0 {
+					return fmt.Errorf("--ttl must be positive")
+				}
+				opts, err := parseScanOptions(cmd, cfg)
+				if err != nil {
+					return err
+				}
+
+				cmd.SilenceUsage = true
+				return runScanWatch(ctx, cmd.OutOrStdout(), opts, ttl, strings.ToLower(output))
+			}
 
 			if outputter != nil && autoSelect != nil {
 				return fmt.Errorf("listing and device-selection are exclusive")
 			}
 
+			opts, err := parseScanOptions(cmd, cfg)
+			if err != nil {
+				return err
+			}
+			opts.network = network
+			if network != nil && opts.hostsFile != "" {
+				return fmt.Errorf("a range and --hosts are exclusive")
+			}
+			opts.addresses = addresses
+			if len(addresses) > 0 && (opts.hostsFile != "" || opts.importFile != "") {
+				return fmt.Errorf("addresses can't be given together with --hosts or --import")
+			}
+
+			try, err := cmd.Flags().GetBool("try")
+			if err != nil {
+				return err
+			}
+			if try && outputter == nil {
+				return fmt.Errorf("--try only works with '--list'")
+			}
+			if try && opts.importFile != "" {
+				return fmt.Errorf("--try and --import are exclusive")
+			}
+
+			envelope, err := cmd.Flags().GetBool("envelope")
+			if err != nil {
+				return err
+			}
+			if _, ok := outputter.(*json.Encoder); envelope && !ok {
+				return fmt.Errorf("--envelope only works with '--list --output json'")
+			}
+
+			if dryRun {
+				var output string
+				if cmd.Flags().Changed("template") {
+					output = "template"
+				} else if outputter != nil {
+					if output, err = stringFlagOrConfig(cmd, "output", cfg, scanOutputCfgKey); err != nil {
+						return err
+					}
+					output = strings.ToLower(output)
+				}
+				plan, err := opts.plan(autoSelect, try, output)
+				if err != nil {
+					return err
+				}
+				return printScanPlan(cmd.OutOrStdout(), plan)
+			}
+
 			cmd.SilenceUsage = true
+			if _, ok := outputter.(*ndjsonEncoder); ok && !try && opts.streams() {
+				return streamDevices(ctx, opts, getAliases(cfg), outputter)
+			}
 			if outputter != nil {
-				scanCtx, cancel := context.WithTimeout(ctx, scanTimeout)
-				devices := []Device{}
-				var err error
-				devices, err = scan(scanCtx, autoSelect, port)
-				cancel()
+				var devices []Device
+				if try {
+					devices, err = tryScan(cfg, opts)
+				} else {
+					devices, err = scanDevices(ctx, autoSelect, opts)
+				}
 				if err != nil {
 					return err
 				}
 
-				return outputter.Encode(Devices{devices})
+				applyHealth(devices)
+				applyAliases(getAliases(cfg), devices)
+				list := newDevices(devices)
+				if opts.report != nil {
+					stats := opts.report.stats()
+					list.Stats = &stats
+				}
+				if envelope {
+					return outputter.Encode(ScanEnvelope{
+						Version:   GetInfo(ctx).Version,
+						Timestamp: time.Now().UTC(),
+						Scan:      opts.parameters(autoSelect, try),
+						Devices:   list,
+					})
+				}
+				return outputter.Encode(list)
 			}
 
-			device, _, err := scanAndPickDevice(ctx, timeout, port, autoSelect, false)
+			if opts.lastDeviceID, err = lastDeviceID(cfg); err != nil {
+				return err
+			}
+			opts.aliases = getAliases(cfg)
+			if opts.importFile == "" && len(opts.addresses) == 0 {
+				// Imported devices are picked from without going online, and
+				// given addresses are picked from instead of the pinned one.
+				opts.pinnedAddress = pinnedAddress(cfg)
+			}
+			device, _, err := scanAndPickDevice(ctx, opts, autoSelect, manualPick)
 			if err != nil {
 				return err
 			}
 
 			if autoSelect != nil {
-				outputter = yaml.NewEncoder(os.Stdout)
+				outputter = yaml.NewEncoder(cmd.OutOrStdout())
 				err = outputter.Encode(device)
 				if err != nil {
 					return err
 				}
 			}
 
-			cfg.Set("device", device)
-			return cfg.WriteConfig()
+			storeDevice(cfg, *device)
+			storeToken(cfg, device.ID, opts.token)
+			if err := cfg.WriteConfig(); err != nil {
+				return err
+			}
+
+			open, err := cmd.Flags().GetBool("open")
+			if err != nil {
+				return err
+			}
+			if open {
+				if err := openBrowser(device.Address + "/"); err != nil {
+					getLogger(ctx).Warnf("Didn't open the web page of '%s': %s", device.Name, err)
+				}
+			}
+			return nil
 		},
 	}
 
 	cmd.Flags().BoolP("list", "l", false, "if set, list the devices")
-	cmd.Flags().StringP("output", "o", "short", "set output format to json, yaml or short (works only with '--list')")
-	cmd.Flags().UintP("port", "p", scanPort, "UDP port to scan for devices on (ignored when an address is given)")
+	cmd.Flags().StringP("output", "o", "short", "set output format to json, yaml, ndjson, csv, geojson, canonical, terraform or short (works only with '--list')")
+	cmd.Flags().Bool("envelope", false, "with '--list --output json', wrap the devices with the version of jag, the time and the scan parameters")
+	cmd.Flags().String("output-file", "", "write the output to the given file instead of stdout")
+	cmd.Flags().Bool("dry-run", false, "if set, print the ports, interfaces, timeouts and output format the scan would use, without scanning")
+	cmd.Flags().String("template", "", "with '--list', print every device with a Go template like '{{.Name}} {{.Address}}'")
+	cmd.Flags().UintSliceP("port", "p", []uint{scanPort}, "UDP port to scan for devices on, can be repeated or comma-separated (ignored when an address is given)")
 	cmd.Flags().DurationP("timeout", "t", scanTimeout, "how long to scan")
+	cmd.Flags().Duration("discovery-timeout", scanTimeout, "how long to listen for broadcasts, same as '--timeout' and can't be combined with it")
+	cmd.Flags().Duration("connect-timeout", connectTimeout, "how long to wait for a given address to identify itself")
+	cmd.Flags().Bool("watch", false, "if set, keep scanning and print the devices as they appear and disappear")
+	cmd.Flags().Duration("ttl", scanWatchTTL, "with '--watch', show devices as offline if they haven't announced themselves for this long")
+	cmd.Flags().Bool("try", false, "if set, list the known devices right away without scanning (works only with '--list')")
+	cmd.Flags().String("await", "", "wait until the device with the given name shows up and print its address")
+	cmd.Flags().Bool("diagnose", false, "if set, report which interfaces and ports are used, what arrives on them, and whether the given address answers")
+	cmd.Flags().String("fingerprint", "", "select the device with the given fingerprint (see 'jag devices fingerprint')")
+	cmd.Flags().String("device", "", "select the device with the given name, failing if it isn't found")
+	cmd.Flags().String("device-id", "", "select the device with the given ID, failing if it isn't found")
+	cmd.Flags().String("validate-cmd", "", "command to run on the selected device, e.g. 'check {{.ID}}'; a non-zero exit aborts (default from 'jag config set scan.validateCmd')")
+	cmd.Flags().String("near", "", "only use devices within a radius of a location, given as 'latitude,longitude,meters'")
+	cmd.Flags().String("filter", "", "only use devices with a name or ID matching a glob like 'lab-*' or starting with the given prefix")
+	cmd.Flags().Bool("writable-only", false, "if set, only use devices that aren't locked")
+	cmd.Flags().Bool("shuffle", false, "if set, order the devices in a pseudo-random but reproducible order")
+	cmd.Flags().Int64("seed", 0, "the seed used for ordering the devices with '--shuffle'")
+	cmd.Flags().Int("retries", identifyRetries, "number of times to retry asking a device at an address to identify itself")
+	cmd.Flags().Duration("retry-delay", identifyRetryDelay, "how long to wait before the first retry, doubled for every following retry")
+	cmd.Flags().String("identify-path", identifyPath, "path that devices identify themselves on, for firmware that doesn't use the default")
+	cmd.Flags().String("identify-method", identifyMethod, "HTTP method of the request that asks devices to identify themselves")
+	cmd.Flags().String("hosts", "", "file with a host name or address per line to ask to identify themselves instead of listening for broadcasts")
+	cmd.Flags().String("subnet", "", "ask every host in the range, like 192.168.1.0/24, to identify itself instead of listening for broadcasts")
+	cmd.Flags().Int("concurrency", scanRangeConcurrency, "number of hosts to probe at the same time when scanning a range or hosts")
+	cmd.Flags().Int("buffer-size", scanBufferSize, "initial size in bytes of the buffer for reading broadcasts, grown if broadcasts don't fit")
+	cmd.Flags().String("ip-version", ipVersionAuto, "IP version to listen for broadcasts on: auto, 4 or 6")
+	cmd.Flags().String("sort", sortByName, "order the devices by name, id or address")
+	cmd.Flags().Bool("reverse", false, "if set, reverse the order of the devices")
+	cmd.Flags().String("dedup-by", dedupByID, "tell devices apart by id, address or name")
+	cmd.Flags().StringArray("trust-source", nil, "only accept broadcasts from sources in the given CIDR (can be repeated)")
+	cmd.Flags().String("interface", "", "only scan for devices on the network interface with the given name")
+	cmd.Flags().Bool("list-interfaces", false, "if set, list the network interfaces that can be given to '--interface'")
+	cmd.Flags().Bool("all-interfaces", false, "if set, listen on every IPv4 network interface that isn't a loopback interface")
+	cmd.Flags().Bool("solicit", false, "if set, ask the devices to identify themselves right away, for firmware that supports it")
+	cmd.Flags().Bool("mdns", false, "if set, also look for devices that advertise themselves with mDNS, for networks that drop broadcasts")
+	cmd.Flags().Bool("include-errors", false, "if set, report the broadcast packets that were dropped")
+	cmd.Flags().Bool("stats", false, "if set, report how long the scan ran and how many packets were received")
+	cmd.Flags().String("seed-file", "", "file with the last-known device addresses to probe before listening for broadcasts (defaults to seeds.yaml in the Jaguar config directory)")
+	cmd.Flags().Duration("cache-ttl", scanCacheTTL, "select from the devices found by an earlier scan if it is less than this old")
+	cmd.Flags().Bool("no-cache", false, "if set, always scan before selecting a device")
+	cmd.Flags().String("export", "", "write all the fields of the found devices to the given JSON file")
+	cmd.Flags().String("import", "", "use the devices in a file written with '--export' instead of scanning")
+	cmd.Flags().Bool("last", false, "if set, select the last used device if it is found")
+	cmd.Flags().Bool("always-prompt", false, "if set, ask which device to use even if only one device is found")
+	cmd.Flags().Bool("first", false, "if set, select the first device when more than one device matches the selection")
+	cmd.Flags().Int("expect", 0, "keep scanning until at least this many devices are found, up to '--expect-timeout'")
+	cmd.Flags().Duration("expect-timeout", expectTimeout, "how long to scan for the devices given with '--expect'")
+	cmd.Flags().Bool("explain-selection", false, "if set, explain on stderr how the device was selected")
+	cmd.Flags().Bool("open", false, "if set, open the web page of the selected device in a browser")
+	cmd.Flags().String("scheme", "", "URL scheme to talk to the devices at the given addresses with, http or https (defaults to http)")
+	cmd.Flags().Bool("insecure", false, "if set, don't verify the certificates of devices reached over https")
+	cmd.Flags().String("token", "", "bearer token for devices that require authentication, remembered for the selected device")
+	cmd.Flags().String("webhook", "", "URL to post the scan results to as JSON")
+	cmd.Flags().String("webhook-secret", "", "secret used to sign the webhook requests with HMAC-SHA256")
 	return cmd
 }
 
-type deviceSelect interface {
-	Match(d Device) bool
-	Address() string
-}
-
-type deviceIDSelect string
-
-func (s deviceIDSelect) Match(d Device) bool {
-	return string(s) == d.ID
-}
+// parseScanOptions returns the scan options given by the flags of the
+// 'jag scan' command.
+func parseScanOptions(cmd *cobra.Command, cfg *viper.Viper) (scanOptions, error) {
+	ports, err := cmd.Flags().GetUintSlice("port")
+	if err != nil {
+		return scanOptions{}, err
+	}
+	if len(ports) == 0 {
+		ports = []uint{scanPort}
+	}
 
-func (s deviceIDSelect) Address() string {
-	return ""
-}
+	timeout, err := durationFlagOrConfig(cmd, "timeout", cfg, scanTimeoutCfgKey)
+	if err != nil {
+		return scanOptions{}, err
+	}
+	if cmd.Flags().Changed("discovery-timeout") {
+		if cmd.Flags().Changed("timeout") {
+			return scanOptions{}, fmt.Errorf("--discovery-timeout and --timeout are exclusive")
+		}
+		if timeout, err = cmd.Flags().GetDuration("discovery-timeout"); err != nil {
+			return scanOptions{}, err
+		}
+	}
 
-func (s deviceIDSelect) String() string {
-	return fmt.Sprintf("device with ID: '%s'", string(s))
-}
+	var sweepTimeout time.Duration
+	if cmd.Flags().Changed("timeout") {
+		sweepTimeout = timeout
+	}
 
-type deviceNameSelect string
+	connectTimeout, err := cmd.Flags().GetDuration("connect-timeout")
+	if err != nil {
+		return scanOptions{}, err
+	}
 
-func (s deviceNameSelect) Match(d Device) bool {
-	return string(s) == d.Name
-}
+	validateCmd, err := stringFlagOrConfig(cmd, "validate-cmd", cfg, scanValidateCmdCfgKey)
+	if err != nil {
+		return scanOptions{}, err
+	}
 
-func (s deviceNameSelect) Address() string {
-	return ""
-}
+	filters, err := parseFilterFlags(cmd)
+	if err != nil {
+		return scanOptions{}, err
+	}
 
-func (s deviceNameSelect) String() string {
-	return fmt.Sprintf("device with name: '%s'", string(s))
-}
+	shuffle, err := cmd.Flags().GetBool("shuffle")
+	if err != nil {
+		return scanOptions{}, err
+	}
 
-type deviceAddressSelect string
+	seed, err := cmd.Flags().GetInt64("seed")
+	if err != nil {
+		return scanOptions{}, err
+	}
 
-func (s deviceAddressSelect) Match(d Device) bool {
-	// The device address contains the 'http://' prefix and a port number.
-	m := string(s)
-	if !strings.HasPrefix(m, "http://") {
-		m = "http://" + m
+	sortBy, err := cmd.Flags().GetString("sort")
+	if err != nil {
+		return scanOptions{}, err
 	}
-	if !strings.Contains(m, ":") {
-		m += ":"
+	sortBy = strings.ToLower(sortBy)
+	if sortBy != sortByName && sortBy != sortByID && sortBy != sortByAddress {
+		return scanOptions{}, fmt.Errorf("--sort flag '%s' was not recognized. Must be either name, id or address.", sortBy)
 	}
-	return strings.HasPrefix(d.Address, m)
-}
-
-func (s deviceAddressSelect) Address() string {
-	return string(s)
-}
-
-func (s deviceAddressSelect) String() string {
-	return fmt.Sprintf("device with address: '%s'", string(s))
-}
 
-func scanAndPickDevice(ctx context.Context, scanTimeout time.Duration, port uint, autoSelect deviceSelect, manualPick bool) (*Device, bool, error) {
-	fmt.Println("Scanning ...")
-	scanCtx, cancel := context.WithTimeout(ctx, scanTimeout)
-	devices, err := scan(scanCtx, autoSelect, port)
-	cancel()
+	reverse, err := cmd.Flags().GetBool("reverse")
 	if err != nil {
-		return nil, false, err
+		return scanOptions{}, err
+	}
+	if shuffle && (cmd.Flags().Changed("sort") || reverse) {
+		return scanOptions{}, fmt.Errorf("--shuffle is exclusive with --sort and --reverse")
 	}
 
-	if len(devices) == 0 {
-		return nil, false, fmt.Errorf("didn't find any Jaguar devices")
+	dedupBy, err := cmd.Flags().GetString("dedup-by")
+	if err != nil {
+		return scanOptions{}, err
 	}
-	if autoSelect != nil {
-		for _, d := range devices {
-			if autoSelect.Match(d) {
-				return &d, true, nil
-			}
-		}
-		if manualPick {
-			return nil, false, fmt.Errorf("couldn't find %s", autoSelect)
-		}
+	dedupBy = strings.ToLower(dedupBy)
+	if dedupBy != dedupByAddress && dedupBy != dedupByID && dedupBy != dedupByName {
+		return scanOptions{}, fmt.Errorf("--dedup-by flag '%s' was not recognized. Must be either id, address or name.", dedupBy)
 	}
 
-	prompt := promptui.Select{
-		Label:     "Choose what Jaguar device you want to use",
-		Items:     devices,
-		Templates: &promptui.SelectTemplates{},
+	webhook, err := cmd.Flags().GetString("webhook")
+	if err != nil {
+		return scanOptions{}, err
 	}
 
-	i, _, err := prompt.Run()
+	webhookSecret, err := cmd.Flags().GetString("webhook-secret")
 	if err != nil {
-		return nil, false, fmt.Errorf("you didn't select anything")
+		return scanOptions{}, err
 	}
 
-	res := devices[i]
-	return &res, false, nil
-}
-
-func scan(ctx context.Context, ds deviceSelect, port uint) ([]Device, error) {
-	if ds != nil && ds.Address() != "" {
-		addr := ds.Address()
-		if !strings.Contains(addr, ":") {
-			addr = addr + ":" + fmt.Sprint(scanHttpPort)
-		}
-		req, err := http.NewRequestWithContext(ctx, "GET", "http://"+addr+"/identify", nil)
-		if err != nil {
-			return nil, err
-		}
-		res, err := http.DefaultClient.Do(req)
+	trustSources, err := cmd.Flags().GetStringArray("trust-source")
+	if err != nil {
+		return scanOptions{}, err
+	}
+	var trusted []*net.IPNet
+	for _, source := range trustSources {
+		network, err := parseTrustedSource(source)
 		if err != nil {
-			return nil, err
+			return scanOptions{}, err
 		}
-		buf, err := io.ReadAll(res.Body)
+		trusted = append(trusted, network)
+	}
+
+	var iface *net.Interface
+	var ifaceNetworks []*net.IPNet
+	if cmd.Flags().Changed("interface") {
+		name, err := cmd.Flags().GetString("interface")
 		if err != nil {
-			return nil, err
-		}
-		if res.StatusCode != http.StatusOK {
-			return nil, fmt.Errorf("got non-OK from device: %s", res.Status)
+			return scanOptions{}, err
 		}
-		dev, err := parseDevice(buf)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse identify. reason %w", err)
-		} else if dev == nil {
-			return nil, fmt.Errorf("invalid identify response")
+		if iface, ifaceNetworks, err = interfaceNetworks(name); err != nil {
+			return scanOptions{}, err
 		}
-		return []Device{*dev}, nil
 	}
 
-	pc, err := net.ListenPacket("udp4", fmt.Sprintf(":%d", port))
+	includeErrors, err := cmd.Flags().GetBool("include-errors")
 	if err != nil {
-		return nil, err
+		return scanOptions{}, err
 	}
-	defer pc.Close()
-	if deadline, ok := ctx.Deadline(); ok {
-		if err := pc.SetDeadline(deadline); err != nil {
-			return nil, err
-		}
+
+	stats, err := cmd.Flags().GetBool("stats")
+	if err != nil {
+		return scanOptions{}, err
+	}
+	var report *scanReport
+	if stats {
+		report = &scanReport{}
 	}
 
-	devices := map[string]Device{}
-looping:
-	for {
-		select {
-		case <-ctx.Done():
-			err := ctx.Err()
-			if err == context.DeadlineExceeded {
-				break looping
-			}
-			return nil, err
-		default:
-		}
+	ipVersion, err := cmd.Flags().GetString("ip-version")
+	if err != nil {
+		return scanOptions{}, err
+	}
+	ipVersion = strings.ToLower(ipVersion)
+	if ipVersion != ipVersionAuto && ipVersion != ipVersion4 && ipVersion != ipVersion6 {
+		return scanOptions{}, fmt.Errorf("--ip-version flag '%s' was not recognized. Must be either auto, 4 or 6.", ipVersion)
+	}
 
-		buf := make([]byte, 1024)
-		n, _, err := pc.ReadFrom(buf)
-		if err != nil {
-			if isTimeoutError(err) {
-				break looping
-			}
-			return nil, err
-		}
+	allInterfaces, err := cmd.Flags().GetBool("all-interfaces")
+	if err != nil {
+		return scanOptions{}, err
+	}
 
-		dev, err := parseDevice(buf[:n])
-		if err != nil {
-			fmt.Println("Failed to parse identify", err)
-		} else if dev != nil {
-			devices[dev.Address] = *dev
-		}
+	solicit, err := cmd.Flags().GetBool("solicit")
+	if err != nil {
+		return scanOptions{}, err
 	}
 
-	var res []Device
-	for _, d := range devices {
+	mdns, err := cmd.Flags().GetBool("mdns")
+	if err != nil {
+		return scanOptions{}, err
+	}
+	if mdns && ipVersion == ipVersion6 {
+		return scanOptions{}, fmt.Errorf("--mdns only queries over IPv4 and can't be used with '--ip-version 6'")
+	}
+	if allInterfaces && iface != nil {
+		return scanOptions{}, fmt.Errorf("--all-interfaces and --interface are exclusive")
+	}
+	if allInterfaces && ipVersion == ipVersion6 {
+		return scanOptions{}, fmt.Errorf("--all-interfaces only listens on IPv4 interfaces and can't be used with '--ip-version 6'")
+	}
+
+	hostsFile, err := cmd.Flags().GetString("hosts")
+	if err != nil {
+		return scanOptions{}, err
+	}
+
+	concurrency, err := cmd.Flags().GetInt("concurrency")
+	if err != nil {
+		return scanOptions{}, err
+	}
+	if concurrency < 1 {
+		return scanOptions{}, fmt.Errorf("--concurrency must be at least 1")
+	}
+
+	bufferSize, err := cmd.Flags().GetInt("buffer-size")
+	if err != nil {
+		return scanOptions{}, err
+	}
+	if bufferSize < 1 || bufferSize > maxScanBufferSize {
+		return scanOptions{}, fmt.Errorf("--buffer-size must be between 1 and %d", maxScanBufferSize)
+	}
+
+	retries, err := cmd.Flags().GetInt("retries")
+	if err != nil {
+		return scanOptions{}, err
+	}
+	if retries < 0 {
+		return scanOptions{}, fmt.Errorf("--retries can't be negative")
+	}
+
+	retryDelay, err := cmd.Flags().GetDuration("retry-delay")
+	if err != nil {
+		return scanOptions{}, err
+	}
+
+	identifyPath, err := cmd.Flags().GetString("identify-path")
+	if err != nil {
+		return scanOptions{}, err
+	}
+	identifyMethod, err := cmd.Flags().GetString("identify-method")
+	if err != nil {
+		return scanOptions{}, err
+	}
+	identifyMethod = strings.ToUpper(identifyMethod)
+	if !isHTTPMethod(identifyMethod) {
+		return scanOptions{}, fmt.Errorf("--identify-method flag '%s' was not recognized. Must be a standard HTTP method like GET or POST.", identifyMethod)
+	}
+
+	useLast, err := cmd.Flags().GetBool("last")
+	if err != nil {
+		return scanOptions{}, err
+	}
+
+	first, err := cmd.Flags().GetBool("first")
+	if err != nil {
+		return scanOptions{}, err
+	}
+
+	alwaysPrompt, err := cmd.Flags().GetBool("always-prompt")
+	if err != nil {
+		return scanOptions{}, err
+	}
+
+	expect, err := cmd.Flags().GetInt("expect")
+	if err != nil {
+		return scanOptions{}, err
+	}
+	if cmd.Flags().Changed("expect") && expect < 1 {
+		return scanOptions{}, fmt.Errorf("--expect must be at least 1")
+	}
+	expectTimeout, err := cmd.Flags().GetDuration("expect-timeout")
+	if err != nil {
+		return scanOptions{}, err
+	}
+
+	explainSelection, err := cmd.Flags().GetBool("explain-selection")
+	if err != nil {
+		return scanOptions{}, err
+	}
+
+	scheme, err := cmd.Flags().GetString("scheme")
+	if err != nil {
+		return scanOptions{}, err
+	}
+	scheme = strings.ToLower(scheme)
+	if scheme != "" && scheme != schemeHTTP && scheme != schemeHTTPS {
+		return scanOptions{}, fmt.Errorf("--scheme flag '%s' was not recognized. Must be either http or https.", scheme)
+	}
+
+	insecure, err := cmd.Flags().GetBool("insecure")
+	if err != nil {
+		return scanOptions{}, err
+	}
+
+	token, err := cmd.Flags().GetString("token")
+	if err != nil {
+		return scanOptions{}, err
+	}
+
+	known, err := getKnownDevices(cfg)
+	if err != nil {
+		return scanOptions{}, err
+	}
+
+	cacheTTL, err := cmd.Flags().GetDuration("cache-ttl")
+	if err != nil {
+		return scanOptions{}, err
+	}
+	noCache, err := cmd.Flags().GetBool("no-cache")
+	if err != nil {
+		return scanOptions{}, err
+	}
+	if noCache {
+		cacheTTL = 0
+	}
+	cacheFile, err := directory.GetScanCachePath()
+	if err != nil {
+		return scanOptions{}, err
+	}
+
+	exportFile, err := cmd.Flags().GetString("export")
+	if err != nil {
+		return scanOptions{}, err
+	}
+
+	importFile, err := cmd.Flags().GetString("import")
+	if err != nil {
+		return scanOptions{}, err
+	}
+
+	seedFile, err := cmd.Flags().GetString("seed-file")
+	if err != nil {
+		return scanOptions{}, err
+	}
+	if seedFile == "" {
+		if seedFile, err = directory.GetSeedFilePath(); err != nil {
+			return scanOptions{}, err
+		}
+	}
+
+	return scanOptions{
+		timeout:          timeout,
+		connectTimeout:   connectTimeout,
+		sweepTimeout:     sweepTimeout,
+		ports:            ports,
+		validateCmd:      validateCmd,
+		filters:          filters,
+		shuffle:          shuffle,
+		seed:             seed,
+		sortBy:           sortBy,
+		reverse:          reverse,
+		dedupBy:          dedupBy,
+		webhook:          webhook,
+		webhookSecret:    webhookSecret,
+		trusted:          trusted,
+		includeErrors:    includeErrors,
+		report:           report,
+		iface:            iface,
+		ifaceNetworks:    ifaceNetworks,
+		allInterfaces:    allInterfaces,
+		solicit:          solicit,
+		mdns:             mdns,
+		seedFile:         seedFile,
+		cacheFile:        cacheFile,
+		cacheTTL:         cacheTTL,
+		exportFile:       exportFile,
+		importFile:       importFile,
+		explainSelection: explainSelection,
+		ipVersion:        ipVersion,
+		useLast:          useLast,
+		first:            first,
+		hasFirst:         true,
+		alwaysPrompt:     alwaysPrompt,
+		expect:           expect,
+		expectTimeout:    expectTimeout,
+		hostsFile:        hostsFile,
+		concurrency:      concurrency,
+		bufferSize:       bufferSize,
+		retries:          retries,
+		retryDelay:       retryDelay,
+		identifyPath:     identifyPath,
+		identifyMethod:   identifyMethod,
+		scheme:           scheme,
+		insecure:         insecure,
+		token:            token,
+		known:            known,
+	}, nil
+}
+
+// parseTrustedSource parses a CIDR like '192.168.1.0/24'. A plain IP
+// address is trusted on its own.
+func parseTrustedSource(source string) (*net.IPNet, error) {
+	if ip := net.ParseIP(source); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+			bits = 8 * net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(source)
+	if err != nil {
+		return nil, fmt.Errorf("--trust-source '%s' is not a valid CIDR", source)
+	}
+	return network, nil
+}
+
+// ScanEnvelope is the output of 'jag scan --list --output json --envelope'.
+// It describes how the devices were found, so stored outputs can be
+// understood later on.
+type ScanEnvelope struct {
+	Version   string         `mapstructure:"version" yaml:"version" json:"version"`
+	Timestamp time.Time      `mapstructure:"timestamp" yaml:"timestamp" json:"timestamp"`
+	Scan      ScanParameters `mapstructure:"scan" yaml:"scan" json:"scan"`
+	Devices
+}
+
+// ScanParameters are the parameters a scan was run with. Method is how the
+// devices were found: 'broadcast', 'mdns' (broadcasts and mDNS), 'address',
+// 'addresses', 'range', 'hosts', 'import' or 'try'. Timeout is how long the
+// scan took at most, or 0s if only the hosts it asked were limited.
+type ScanParameters struct {
+	Method  string `mapstructure:"method" yaml:"method" json:"method"`
+	Ports   []uint `mapstructure:"ports" yaml:"ports" json:"ports"`
+	Timeout string `mapstructure:"timeout" yaml:"timeout" json:"timeout"`
+}
+
+// parameters returns the parameters of a scan with the options.
+func (o scanOptions) parameters(ds deviceSelect, try bool) ScanParameters {
+	method := "broadcast"
+	switch {
+	case try:
+		method = "try"
+	case o.importFile != "":
+		method = "import"
+	case ds != nil && ds.Address() != "":
+		method = "address"
+	case len(o.addresses) > 0:
+		method = "addresses"
+	case o.network != nil:
+		method = "range"
+	case o.hostsFile != "":
+		method = "hosts"
+	case o.mdns:
+		method = "mdns"
+	}
+	var timeout time.Duration
+	if !try && o.importFile == "" {
+		timeout = o.scanTimeout(ds)
+	}
+	return ScanParameters{
+		Method:  method,
+		Ports:   o.ports,
+		Timeout: timeout.String(),
+	}
+}
+
+// scanTimeout returns how long a scan for the selection takes at most. A
+// timeout of zero leaves it to the scan to decide when it is done.
+func (o scanOptions) scanTimeout(ds deviceSelect) time.Duration {
+	switch {
+	case ds != nil && ds.Address() != "":
+		// Asking addresses to identify themselves gets its own budget, so
+		// it doesn't depend on how long we listen for broadcasts.
+		return o.addressesTimeout([]string{ds.Address()})
+	case len(o.addresses) > 0:
+		return o.addressesTimeout(o.addresses)
+	case o.network != nil || o.hostsFile != "":
+		// Every host of a range or hosts file gets its own budget, so
+		// unless the sweep is limited it takes as long as it needs to ask
+		// all of them.
+		return o.sweepTimeout
+	case o.expect > 0 && o.expectTimeout > o.timeout:
+		return o.expectTimeout
+	}
+	return o.timeout
+}
+
+// streams returns true if the devices can be emitted as they are found,
+// which is the case when listening for broadcasts. Seeds and mDNS add
+// devices that are only known once the scan is done, so those scans list
+// the devices at the end.
+func (o scanOptions) streams() bool {
+	return o.network == nil && o.hostsFile == "" && len(o.addresses) == 0 && o.importFile == "" && !o.mdns
+}
+
+// streamDevices listens for broadcasts for the duration given by the scan
+// options and encodes each device the first time it is seen. The devices
+// at the last-known addresses are probed while we listen, and the ones
+// that haven't broadcast yet are encoded once they have answered. The
+// devices are filtered and get their alias and health, but aren't ordered.
+// The outputter writes to stdout or the output file, which aren't
+// buffered, so a consumer sees every device right away. Once the scan is
+// done, the devices are exported, posted and cached like the devices of a
+// scan that isn't streamed.
+func streamDevices(ctx context.Context, opts scanOptions, aliases map[string]string, outputter encoder) error {
+	ctx, cancel := context.WithTimeout(ctx, opts.scanTimeout(nil))
+	defer cancel()
+	health := readDeviceHealth()
+
+	seeded := make(chan []Device, 1)
+	if opts.seedFile == "" {
+		seeded <- nil
+	} else {
+		seeds, err := readSeeds(opts.seedFile)
+		if err != nil {
+			getLogger(ctx).Warnf("Failed to read seed file: %s", err)
+		}
+		go func() { seeded <- probeSeeds(ctx, seeds, opts) }()
+	}
+
+	opts.report.begin()
+	stream, errs := scanStream(ctx, "", opts)
+	all := map[string]Device{}
+	seen := map[string]Device{}
+	addresses := map[string]string{}
+	var encodeErr error
+	emit := func(d Device) {
+		opts.addDevice(all, d)
+		key := opts.deviceKey(d)
+		if _, ok := seen[key]; ok || len(filterDevices([]Device{d}, opts.filters)) == 0 {
+			return
+		}
+		if address, ok := addresses[d.ID]; ok && address != d.Address {
+			getLogger(ctx).Warnf("Warning: the device ID '%s' is used by the addresses %s and %s. Selecting the device by ID may pick the wrong board.",
+				d.ID, address, d.Address)
+		}
+		addresses[d.ID] = d.Address
+		d.Alias = aliasOf(aliases, d.ID)
+		d.Health = health[d.ID].state()
+		seen[key] = d
+		if encodeErr != nil {
+			return
+		}
+		if err := outputter.Encode(Devices{Devices: []Device{d}}); err != nil {
+			// Stop listening, but let the scan end before returning.
+			encodeErr = err
+			cancel()
+			return
+		}
+		if opts.expect > 0 && len(seen) == opts.expect {
+			opts.explain("Found the %d expected devices, stopping the scan", opts.expect)
+			cancel()
+		}
+	}
+
+	// Like in scan, the devices that answered on their last-known address
+	// are only added if they haven't broadcast.
+	broadcasted := map[string]bool{}
+	emitSeeds := func(found []Device) {
+		for _, d := range found {
+			if !broadcasted[d.ID] {
+				broadcasted[d.ID] = true
+				emit(d)
+			}
+		}
+	}
+	for stream != nil {
+		select {
+		case d, ok := <-stream:
+			if !ok {
+				stream = nil
+				break
+			}
+			broadcasted[d.ID] = true
+			emit(d)
+		case found := <-seeded:
+			seeded = nil
+			emitSeeds(found)
+		}
+	}
+	if seeded != nil {
+		emitSeeds(<-seeded)
+	}
+	err := <-errs
+	if encodeErr != nil {
+		return encodeErr
+	}
+	if err != nil {
+		return err
+	}
+	if opts.report != nil {
+		opts.report.end()
+		opts.report.print(os.Stderr)
+	}
+
+	// The cache has all the devices, like the cache of a scan that isn't
+	// streamed, and the filtered devices are published.
+	var found []Device
+	for _, d := range all {
+		found = append(found, d)
+	}
+	sortDevices(found)
+	if opts.seedFile != "" {
+		if err := writeSeeds(opts.seedFile, found); err != nil {
+			getLogger(ctx).Warnf("Failed to update seed file: %s", err)
+		}
+	}
+	if opts.cacheFile != "" {
+		if err := writeScanCache(opts, found); err != nil {
+			getLogger(ctx).Warnf("Failed to update scan cache: %s", err)
+		}
+	}
+	var devices []Device
+	for _, d := range seen {
+		devices = append(devices, d)
+	}
+	sortDevicesBy(devices, opts.sortBy, opts.reverse)
+	return publishDevices(ctx, opts, devices)
+}
+
+// scanDevices scans for devices for the duration given by the scan options
+// and returns the filtered and ordered devices. If the options have an
+// inventory to import, its devices are used instead of scanning.
+func scanDevices(ctx context.Context, ds deviceSelect, opts scanOptions) ([]Device, error) {
+	var devices []Device
+	var err error
+	if opts.importFile != "" {
+		devices, err = readInventory(ctx, opts.importFile)
+	} else {
+		devices, err = scanWithTimeout(ctx, opts.scanTimeout(ds), ds, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	devices = prepareDevices(devices, opts)
+	for _, c := range findConflicts(devices) {
+		getLogger(ctx).Warnf("Warning: the device ID '%s' is used by %d addresses: %s. Selecting the device by ID may pick the wrong board.",
+			c.ID, len(c.Addresses), strings.Join(c.Addresses, ", "))
+	}
+	if err := publishDevices(ctx, opts, devices); err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+// publishDevices warns if fewer devices than expected were found, and
+// exports the devices and posts them to the webhook if the options ask
+// for it.
+func publishDevices(ctx context.Context, opts scanOptions, devices []Device) error {
+	if opts.expect > 0 && len(devices) < opts.expect {
+		getLogger(ctx).Warnf("Expected %d devices, but only found %d", opts.expect, len(devices))
+	}
+	if opts.exportFile != "" {
+		if err := writeInventory(opts.exportFile, devices); err != nil {
+			return fmt.Errorf("failed to export the devices: %w", err)
+		}
+	}
+	if opts.webhook != "" {
+		if err := postWebhook(ctx, opts.webhook, opts.webhookSecret, Devices{Devices: devices}); err != nil {
+			getLogger(ctx).Warnf("Failed to post scan results to webhook: %s", err)
+		}
+	}
+	return nil
+}
+
+// scanWithTimeout scans for at most the given time. A timeout of zero
+// leaves it to the scan to decide when it is done.
+func scanWithTimeout(ctx context.Context, timeout time.Duration, ds deviceSelect, opts scanOptions) ([]Device, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return scan(ctx, ds, opts)
+}
+
+// tryScan returns the known devices without waiting for the network, so
+// a user interface can show them right away and refresh them with a full
+// scan later.
+func tryScan(cfg *viper.Viper, opts scanOptions) ([]Device, error) {
+	devices, err := getKnownDevices(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return prepareDevices(devices, opts), nil
+}
+
+// prepareDevices filters and orders the scanned devices before they are
+// listed or offered for selection.
+func prepareDevices(devices []Device, opts scanOptions) []Device {
+	if opts.explainSelection {
+		explainFilters(devices, opts)
+	}
+	devices = filterDevices(devices, opts.filters)
+	if opts.shuffle {
+		// The devices are sorted when we get them, so shuffling with a
+		// fixed seed gives the same order for the same set of devices.
+		r := rand.New(rand.NewSource(opts.seed))
+		r.Shuffle(len(devices), func(i, j int) {
+			devices[i], devices[j] = devices[j], devices[i]
+		})
+	} else {
+		sortDevicesBy(devices, opts.sortBy, opts.reverse)
+	}
+	return devices
+}
+
+// parseFilterFlags returns the device filters given on the command line.
+// A device must match all the filters to be listed or selected.
+func parseFilterFlags(cmd *cobra.Command) ([]deviceSelect, error) {
+	var filters []deviceSelect
+	if cmd.Flags().Changed("near") {
+		near, err := cmd.Flags().GetString("near")
+		if err != nil {
+			return nil, err
+		}
+		s, err := parseNearSelect(near)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, s)
+	}
+	writableOnly, err := cmd.Flags().GetBool("writable-only")
+	if err != nil {
+		return nil, err
+	}
+	if writableOnly {
+		filters = append(filters, deviceWritableSelect{})
+	}
+	if cmd.Flags().Changed("filter") {
+		pattern, err := cmd.Flags().GetString("filter")
+		if err != nil {
+			return nil, err
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("--filter '%s' is not a valid pattern", pattern)
+		}
+		filters = append(filters, devicePatternSelect(pattern))
+	}
+	return filters, nil
+}
+
+// explainFilters tells which of the scanned devices are removed by which
+// of the filters.
+func explainFilters(devices []Device, opts scanOptions) {
+	opts.explain("Considering %d devices found by the scan", len(devices))
+	for _, d := range devices {
+		kept := true
+		for _, f := range opts.filters {
+			if !f.Match(d) {
+				opts.explain("Filtered out %s, it isn't a %s", d.Summary(), f)
+				kept = false
+			}
+		}
+		if kept {
+			opts.explain("Kept %s", d.Summary())
+		}
+	}
+}
+
+func filterDevices(devices []Device, filters []deviceSelect) []Device {
+	if len(filters) == 0 {
+		return devices
+	}
+	res := []Device{}
+outer:
+	for _, d := range devices {
+		for _, f := range filters {
+			if !f.Match(d) {
+				continue outer
+			}
+		}
+		res = append(res, d)
+	}
+	return res
+}
+
+type scanOptions struct {
+	// timeout is how long we listen for broadcasts. connectTimeout is how
+	// long we wait for a given address to identify itself.
+	timeout        time.Duration
+	connectTimeout time.Duration
+	// sweepTimeout is how long asking the hosts of a range or a hosts file
+	// takes at most.
+	// It is only set if --timeout is given, as every host gets its own
+	// connectTimeout otherwise.
+	sweepTimeout time.Duration
+	// ports are the UDP ports to listen for broadcasts on.
+	ports []uint
+	// validateCmd is an optional command that is run after a device has
+	// been selected. Each argument is expanded as a template with the
+	// selected device, and a non-zero exit code rejects the device.
+	validateCmd string
+	// filters restrict the devices that can be selected.
+	filters []deviceSelect
+	shuffle bool
+	seed    int64
+	// sortBy is the device field the devices are ordered by, unless they
+	// are shuffled. If reverse is set, the order is reversed.
+	sortBy  string
+	reverse bool
+	// dedupBy is the device field used to tell devices apart.
+	dedupBy string
+	// webhook is an optional URL that the scan results are posted to.
+	webhook       string
+	webhookSecret string
+	// trusted restricts the sources we accept broadcasts from. If empty,
+	// broadcasts from all sources are accepted.
+	trusted       []*net.IPNet
+	includeErrors bool
+	// iface is the network interface to scan on, if set. The sockets are
+	// bound to it on Linux, and broadcasts are only accepted if they arrive
+	// from one of the ifaceNetworks.
+	iface         *net.Interface
+	ifaceNetworks []*net.IPNet
+	// allInterfaces makes the scan listen with a socket per IPv4 network
+	// interface instead of a single socket for all of them.
+	allInterfaces bool
+	// solicit makes the scan broadcast an identify request when it starts
+	// listening, so devices that support it don't wait for their next
+	// announcement.
+	solicit bool
+	// mdns makes the scan also look for devices that advertise the Jaguar
+	// service with mDNS, for networks that drop broadcasts.
+	mdns bool
+	// packets opens the sockets for the broadcasts, and transport sends
+	// the identify requests. If nil, the network of the host is used.
+	packets   packetSource
+	transport http.RoundTripper
+	// identifyPath and identifyMethod make up the request that asks a
+	// device to identify itself. If empty, 'GET /identify' is used.
+	identifyPath   string
+	identifyMethod string
+	// seedFile is the file with the last-known device addresses. If
+	// empty, no seeds are probed.
+	seedFile string
+	// exportFile is an optional file that the found devices are written
+	// to. importFile is an optional file written that way, whose devices
+	// are used instead of scanning.
+	exportFile string
+	importFile string
+	// cacheFile stores the devices found by the last scans. Selecting a
+	// device reuses them if they were found less than cacheTTL ago, unless
+	// cacheTTL is zero.
+	cacheFile string
+	cacheTTL  time.Duration
+	// network is a range of addresses to probe over TCP instead of
+	// listening for broadcasts. The probes are done by concurrency workers.
+	network     *net.IPNet
+	concurrency int
+	// hostsFile is a file with host names and addresses to probe over TCP
+	// instead of listening for broadcasts, like a network.
+	hostsFile string
+	// addresses are the addresses given on the command line when there is
+	// more than one. They are probed like the hosts of a hosts file.
+	addresses []string
+	// retries is how many times a failed identify request to a single
+	// address is retried, waiting retryDelay before the first retry.
+	retries    int
+	retryDelay time.Duration
+	// bufferSize is the initial size of the buffer for reading broadcasts.
+	// It grows if the broadcasts don't fit.
+	bufferSize int
+	// report collects the packets that couldn't be parsed and the packet
+	// statistics, if set. It is set with --stats and --verbose.
+	report *scanReport
+	// pinnedAddress is the address of the pinned device. If set, the
+	// device at the address is used without scanning.
+	pinnedAddress string
+	// aliases maps device aliases to device IDs.
+	aliases map[string]string
+	// lastDeviceID is the ID of the last used device. It is preselected
+	// when asking for a device, or picked right away if useLast is set
+	// and the device is found.
+	lastDeviceID string
+	useLast      bool
+	// first makes the selection use the first matching device when more
+	// than one device matches. Otherwise that is an error. hasFirst is set
+	// for the commands with the --first flag, so the error can suggest it.
+	first    bool
+	hasFirst bool
+	// alwaysPrompt makes the selection ask which device to use even if
+	// only one device was found.
+	alwaysPrompt bool
+	// expect is the number of devices the scan waits for. If it is
+	// positive, we listen until that many devices are found or the
+	// expectTimeout has passed, instead of for the scan timeout.
+	expect        int
+	expectTimeout time.Duration
+	// ipVersion is the IP version to listen for broadcasts on: auto, 4
+	// or 6. In auto mode both are used if the host supports them.
+	ipVersion string
+	// explainSelection makes the device selection print its reasoning on
+	// stderr.
+	explainSelection bool
+	// scheme is the URL scheme used to talk to the devices at the addresses
+	// given on the command line. If empty, the scheme of the address is
+	// used, which is http unless given otherwise. Devices that announce
+	// themselves are reached on the address they announce.
+	// insecure skips the verification of the certificates of devices that
+	// are reached over https.
+	scheme   string
+	insecure bool
+	// token is the bearer token given with --token. It is sent to the
+	// devices that are probed. Without it, the devices in known get the
+	// token stored for them, and no other device gets a token.
+	token string
+	known []Device
+}
+
+// explain prints a step of the device selection if it was asked to be
+// explained.
+func (o scanOptions) explain(format string, args ...interface{}) {
+	if o.explainSelection {
+		fmt.Fprintf(os.Stderr, format+"\n", args...)
+	}
+}
+
+const (
+	dedupByID      = "id"
+	dedupByAddress = "address"
+	dedupByName    = "name"
+)
+
+const (
+	sortByName    = "name"
+	sortByID      = "id"
+	sortByAddress = "address"
+)
+
+func defaultScanOptions() scanOptions {
+	// Without a seed file path we just listen for broadcasts, and without
+	// a cache path we always scan.
+	seedFile, _ := directory.GetSeedFilePath()
+	cacheFile, _ := directory.GetScanCachePath()
+	return scanOptions{
+		timeout:        scanTimeout,
+		connectTimeout: connectTimeout,
+		ports:          []uint{scanPort},
+		dedupBy:        dedupByID,
+		sortBy:         sortByName,
+		seedFile:       seedFile,
+		cacheFile:      cacheFile,
+		cacheTTL:       scanCacheTTL,
+		ipVersion:      ipVersionAuto,
+		concurrency:    scanRangeConcurrency,
+		bufferSize:     scanBufferSize,
+		retries:        identifyRetries,
+		retryDelay:     identifyRetryDelay,
+		identifyPath:   identifyPath,
+		identifyMethod: identifyMethod,
+	}
+}
+
+// deviceURL returns the base URL of the device at the given address, using
+// the scheme of the options.
+func (o scanOptions) deviceURL(address string) string {
+	return withScheme(deviceURL(address), o.scheme)
+}
+
+// udpNetworks returns the networks to listen for broadcasts on.
+func (o scanOptions) udpNetworks() []string {
+	switch o.ipVersion {
+	case ipVersion4:
+		return []string{"udp4"}
+	case ipVersion6:
+		return []string{"udp6"}
+	default:
+		return []string{"udp4", "udp6"}
+	}
+}
+
+// fromInterface returns true if the packet from the given source arrived
+// on the network interface of the options, or if no interface is given.
+// Link-local IPv6 sources carry the interface in their zone.
+func (o scanOptions) fromInterface(source net.Addr) bool {
+	if o.iface == nil {
+		return true
+	}
+	udp, ok := source.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	if udp.Zone != "" {
+		return udp.Zone == o.iface.Name
+	}
+	for _, network := range o.ifaceNetworks {
+		if network.Contains(udp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTrusted returns true if the packet from the given source
+// address should be accepted.
+func (o scanOptions) isTrusted(source net.Addr) bool {
+	if len(o.trusted) == 0 {
+		return true
+	}
+	udp, ok := source.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range o.trusted {
+		if network.Contains(udp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// deviceKey returns the key used to deduplicate devices during scans.
+func (o scanOptions) deviceKey(d Device) string {
+	switch o.dedupBy {
+	case dedupByAddress:
+		return d.Address
+	case dedupByName:
+		return d.Name
+	default:
+		return d.ID
+	}
+}
+
+// addDevice adds a scanned device to the devices found so far. If the
+// device was already found, its addresses are merged and the most recently
+// seen address is used.
+func (o scanOptions) addDevice(devices map[string]Device, d Device) {
+	key := o.deviceKey(d)
+	var addresses []string
+	if existing, ok := devices[key]; ok {
+		addresses = existing.Addresses
+	}
+	known := false
+	for _, address := range addresses {
+		if address == d.Address {
+			known = true
+			break
+		}
+	}
+	if !known {
+		addresses = append(addresses, d.Address)
+	}
+	d.Addresses = addresses
+	devices[key] = d
+}
+
+// findConflicts returns the device IDs that were reported from more than
+// one address. Depending on how devices are told apart, the addresses are
+// merged into one device or the ID is shared by several devices.
+func findConflicts(devices []Device) []DeviceConflict {
+	var ids []string
+	addresses := map[string][]string{}
+	for _, d := range devices {
+		if _, ok := addresses[d.ID]; !ok {
+			ids = append(ids, d.ID)
+		}
+		known := d.Addresses
+		if len(known) == 0 {
+			known = []string{d.Address}
+		}
+		for _, address := range known {
+			if !containsString(addresses[d.ID], address) {
+				addresses[d.ID] = append(addresses[d.ID], address)
+			}
+		}
+	}
+	sort.Strings(ids)
+
+	var res []DeviceConflict
+	for _, id := range ids {
+		if len(addresses[id]) > 1 {
+			sorted := append([]string(nil), addresses[id]...)
+			sort.Strings(sorted)
+			res = append(res, DeviceConflict{
+				ID:        id,
+				Addresses: sorted,
+			})
+		}
+	}
+	return res
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// sortDevices sorts the devices by name. Devices with the same name are
+// sorted by ID, so the order is always the same.
+func sortDevices(devices []Device) {
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].Name != devices[j].Name {
+			return devices[i].Name < devices[j].Name
+		}
+		return devices[i].ID < devices[j].ID
+	})
+}
+
+// sortDevicesBy orders the devices by the given field. The sort is stable,
+// so devices that compare equal keep their order.
+func sortDevicesBy(devices []Device, field string, reverse bool) {
+	compare := func(a, b Device) int {
+		switch field {
+		case sortByID:
+			return strings.Compare(a.ID, b.ID)
+		case sortByAddress:
+			return compareAddresses(a.Address, b.Address)
+		default:
+			return strings.Compare(a.Name, b.Name)
+		}
+	}
+	sort.SliceStable(devices, func(i, j int) bool {
+		if reverse {
+			return compare(devices[j], devices[i]) < 0
+		}
+		return compare(devices[i], devices[j]) < 0
+	})
+}
+
+// compareAddresses orders device addresses by their IP, so devices on the
+// same subnet end up next to each other. Addresses without an IP are
+// ordered after the others.
+func compareAddresses(a, b string) int {
+	ipA := parseIPAddress(strings.TrimPrefix(strings.TrimPrefix(a, schemeHTTPS+"://"), schemeHTTP+"://"))
+	ipB := parseIPAddress(strings.TrimPrefix(strings.TrimPrefix(b, schemeHTTPS+"://"), schemeHTTP+"://"))
+	switch {
+	case ipA != nil && ipB != nil:
+		if c := bytes.Compare(ipA.To16(), ipB.To16()); c != 0 {
+			return c
+		}
+	case ipA != nil:
+		return -1
+	case ipB != nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+type deviceSelect interface {
+	Match(d Device) bool
+	Address() string
+}
+
+type deviceIDSelect string
+
+func (s deviceIDSelect) Match(d Device) bool {
+	return string(s) == d.ID
+}
+
+// MatchPattern returns true if the ID of the device matches the selection
+// when it is used as a pattern.
+func (s deviceIDSelect) MatchPattern(d Device) bool {
+	return matchPattern(string(s), d.ID)
+}
+
+func (s deviceIDSelect) Address() string {
+	return ""
+}
+
+func (s deviceIDSelect) String() string {
+	return fmt.Sprintf("device with ID: '%s'", string(s))
+}
+
+type deviceNameSelect string
+
+func (s deviceNameSelect) Match(d Device) bool {
+	return string(s) == d.Name
+}
+
+// MatchPattern returns true if the name of the device matches the
+// selection when it is used as a pattern.
+func (s deviceNameSelect) MatchPattern(d Device) bool {
+	return matchPattern(string(s), d.Name)
+}
+
+func (s deviceNameSelect) Address() string {
+	return ""
+}
+
+func (s deviceNameSelect) String() string {
+	return fmt.Sprintf("device with name: '%s'", string(s))
+}
+
+// matchPattern matches a value against a glob pattern like 'lab-*'. A
+// pattern without any wildcards matches values that start with it.
+func matchPattern(pattern string, value string) bool {
+	if !isGlob(pattern) {
+		return strings.HasPrefix(value, pattern)
+	}
+	matched, err := path.Match(pattern, value)
+	return err == nil && matched
+}
+
+// isGlob returns true if the pattern has any wildcards.
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// deviceNamePatternSelect selects the devices whose name matches a glob
+// like 'sensor-*', or a regular expression if the selection is written as
+// '/sensor-[0-9]+/'. Unlike deviceNameSelect, it can match several
+// devices.
+type deviceNamePatternSelect struct {
+	pattern string
+	// re is the regular expression, or nil if the pattern is a glob.
+	re *regexp.Regexp
+}
+
+// parseNamePattern returns the selection for a name pattern. It returns
+// nil if the name isn't a pattern, so it should be matched exactly.
+func parseNamePattern(name string) (*deviceNamePatternSelect, error) {
+	if len(name) > 2 && strings.HasPrefix(name, "/") && strings.HasSuffix(name, "/") {
+		re, err := regexp.Compile(name[1 : len(name)-1])
+		if err != nil {
+			return nil, err
+		}
+		return &deviceNamePatternSelect{pattern: name[1 : len(name)-1], re: re}, nil
+	}
+	if isGlob(name) {
+		if _, err := path.Match(name, ""); err != nil {
+			return nil, err
+		}
+		return &deviceNamePatternSelect{pattern: name}, nil
+	}
+	return nil, nil
+}
+
+func (s *deviceNamePatternSelect) Match(d Device) bool {
+	if s.re != nil {
+		return s.re.MatchString(d.Name)
+	}
+	return deviceNameSelect(s.pattern).MatchPattern(d)
+}
+
+func (s *deviceNamePatternSelect) Address() string {
+	return ""
+}
+
+func (s *deviceNamePatternSelect) String() string {
+	if s.re != nil {
+		return fmt.Sprintf("device with a name matching the regular expression: '%s'", s.pattern)
+	}
+	return fmt.Sprintf("device with a name matching the glob: '%s'", s.pattern)
+}
+
+// devicePatternSelect selects the devices whose name or ID matches a
+// pattern.
+type devicePatternSelect string
+
+func (s devicePatternSelect) Match(d Device) bool {
+	return deviceNameSelect(s).MatchPattern(d) || deviceIDSelect(s).MatchPattern(d)
+}
+
+func (s devicePatternSelect) Address() string {
+	return ""
+}
+
+func (s devicePatternSelect) String() string {
+	return fmt.Sprintf("device with a name or ID matching: '%s'", string(s))
+}
+
+type deviceFingerprintSelect string
+
+func (s deviceFingerprintSelect) Match(d Device) bool {
+	return string(s) == d.Fingerprint()
+}
+
+func (s deviceFingerprintSelect) Address() string {
+	return ""
+}
+
+func (s deviceFingerprintSelect) String() string {
+	return fmt.Sprintf("device with fingerprint: '%s'", string(s))
+}
+
+type deviceAddressSelect string
+
+func (s deviceAddressSelect) Match(d Device) bool {
+	// The device address contains the scheme and a port number, so we
+	// compare the IPs to also match IPv6 addresses with a zone. The ports
+	// are only compared if the selection has one, as several devices can
+	// share an address behind a proxy.
+	ip := parseIPAddress(stripScheme(string(s)))
+	if ip == nil || !ip.Equal(parseIPAddress(stripScheme(d.Address))) {
+		return false
+	}
+	port := addressPort(string(s))
+	return port == "" || port == addressPort(d.Address)
+}
+
+func (s deviceAddressSelect) Address() string {
+	return string(s)
+}
+
+func (s deviceAddressSelect) String() string {
+	return fmt.Sprintf("device with address: '%s'", string(s))
+}
+
+type deviceWritableSelect struct{}
+
+func (s deviceWritableSelect) Match(d Device) bool {
+	return d.IsWritable()
+}
+
+func (s deviceWritableSelect) Address() string {
+	return ""
+}
+
+func (s deviceWritableSelect) String() string {
+	return "writable device"
+}
+
+// earthRadius is the mean radius of the Earth in meters.
+const earthRadius = 6371000.0
+
+type deviceNearSelect struct {
+	latitude  float64
+	longitude float64
+	radius    float64
+}
+
+func parseNearSelect(near string) (deviceNearSelect, error) {
+	parts := strings.Split(near, ",")
+	if len(parts) != 3 {
+		return deviceNearSelect{}, fmt.Errorf("--near must be given as 'latitude,longitude,meters', but was '%s'", near)
+	}
+	var values [3]float64
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return deviceNearSelect{}, fmt.Errorf("--near must be given as 'latitude,longitude,meters', but was '%s'", near)
+		}
+		values[i] = v
+	}
+	return deviceNearSelect{
+		latitude:  values[0],
+		longitude: values[1],
+		radius:    values[2],
+	}, nil
+}
+
+func (s deviceNearSelect) Match(d Device) bool {
+	if !d.HasLocation() {
+		return false
+	}
+	return distance(s.latitude, s.longitude, *d.Latitude, *d.Longitude) <= s.radius
+}
+
+func (s deviceNearSelect) Address() string {
+	return ""
+}
+
+func (s deviceNearSelect) String() string {
+	return fmt.Sprintf("device within %gm of %g,%g", s.radius, s.latitude, s.longitude)
+}
+
+// distance computes the great-circle distance in meters between two
+// coordinates using the haversine formula.
+func distance(lat1, lon1, lat2, lon2 float64) float64 {
+	toRadians := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRadians(lat2 - lat1)
+	dLon := toRadians(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRadians(lat1))*math.Cos(toRadians(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+func scanAndPickDevice(ctx context.Context, opts scanOptions, autoSelect deviceSelect, manualPick bool) (*Device, bool, error) {
+	if autoSelect != nil {
+		autoSelect = resolveAlias(opts.aliases, autoSelect)
+	}
+	device, autoSelected, err := pinnedDevice(ctx, opts, autoSelect)
+	if err != nil {
+		getLogger(ctx).Infof("The pinned device at '%s' didn't respond, scanning for devices instead: %s", opts.pinnedAddress, err)
+	}
+	if device == nil {
+		device, autoSelected, err = pickDevice(ctx, opts, autoSelect, manualPick)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	if opts.validateCmd != "" {
+		if err := validateDevice(ctx, opts.validateCmd, device); err != nil {
+			return nil, false, err
+		}
+	}
+	return device, autoSelected, nil
+}
+
+// pinnedDevice asks the device at the pinned address to identify itself,
+// so we don't have to scan. It returns nil if no device is pinned or if
+// the pinned device isn't the selected one or doesn't pass the filters.
+func pinnedDevice(ctx context.Context, opts scanOptions, autoSelect deviceSelect) (*Device, bool, error) {
+	if opts.pinnedAddress == "" {
+		return nil, false, nil
+	}
+	url := opts.deviceURL(opts.pinnedAddress)
+	ctx, cancel := context.WithTimeout(ctx, opts.identifyTimeout(ctx, url))
+	defer cancel()
+	device, err := identifyDeviceWithRetries(ctx, url, opts)
+	if err != nil {
+		return nil, false, err
+	}
+	if autoSelect != nil && !autoSelect.Match(*device) {
+		opts.explain("The pinned device '%s' isn't a %s, scanning for devices", device.Name, autoSelect)
+		return nil, false, nil
+	}
+	for _, f := range opts.filters {
+		if !f.Match(*device) {
+			opts.explain("The pinned device '%s' isn't a %s, scanning for devices", device.Name, f)
+			return nil, false, nil
+		}
+	}
+	opts.explain("Selected %s, it is the pinned device", device.Summary())
+	return device, true, nil
+}
+
+func pickDevice(ctx context.Context, opts scanOptions, autoSelect deviceSelect, manualPick bool) (*Device, bool, error) {
+	// A cache with fewer devices than expected is from a scan that
+	// stopped too early.
+	if devices, ok := readScanCache(opts); ok && len(devices) >= opts.expect {
+		opts.explain("Selecting from the %d devices found by a scan less than %s ago", len(devices), opts.cacheTTL)
+		device, autoSelected, err := selectDevice(ctx, prepareDevices(devices, opts), opts, autoSelect, manualPick)
+		if err != nil && err != errRescan && !errors.Is(err, ErrNoDevicesFound) {
+			return nil, false, err
+		}
+		if err == nil {
+			// Make sure the cached device is still there before we use it. A
+			// device that is gone mustn't make us wait longer than it takes
+			// to connect to it.
+			identifyOpts := opts
+			identifyOpts.insecure = device.Insecure
+			identifyCtx, cancel := context.WithTimeout(ctx, opts.identifyTimeout(ctx, device.Address))
+			identified, err := identifyOpts.identify(identifyCtx, device.Address)
+			cancel()
+			if err == nil && identified.ID == device.ID {
+				return device, autoSelected, nil
+			}
+			getLogger(ctx).Infof("The cached device '%s' didn't respond, scanning again", device.Name)
+		}
+		if err := invalidateScanCache(opts); err != nil {
+			getLogger(ctx).Warnf("Failed to update scan cache: %s", err)
+		}
+	}
+
+	for {
+		getLogger(ctx).Infof("Scanning ...")
+		devices, err := scanDevices(ctx, autoSelect, opts)
+		if err != nil {
+			return nil, false, err
+		}
+		device, autoSelected, err := selectDevice(ctx, devices, opts, autoSelect, manualPick)
+		if err != errRescan {
+			return device, autoSelected, err
+		}
+	}
+}
+
+// errRescan is returned by selectDevice when the user asks for another
+// scan.
+var errRescan = errors.New("rescan")
+
+const (
+	promptActionRescan  = "⟳ Rescan"
+	promptActionAddress = "✎ Enter address manually"
+)
+
+// promptEntry is an entry in the device prompt. Entries with an action
+// aren't devices, but let the user do something else.
+type promptEntry struct {
+	Device
+	Action string
+}
+
+// promptDeviceAddress asks the user for the address of a device and asks
+// the device at that address to identify itself.
+func promptDeviceAddress(ctx context.Context, opts scanOptions) (*Device, error) {
+	prompt := promptui.Prompt{
+		Label: "Address of the Jaguar device",
+		Validate: func(input string) error {
+			if strings.TrimSpace(input) == "" {
+				return fmt.Errorf("the address can't be empty")
+			}
+			return nil
+		},
+	}
+	address, err := prompt.Run()
+	if err != nil {
+		return nil, fmt.Errorf("you didn't enter an address")
+	}
+	url := opts.deviceURL(strings.TrimSpace(address))
+	ctx, cancel := context.WithTimeout(ctx, opts.identifyTimeout(ctx, url))
+	defer cancel()
+	device, err := identifyDeviceWithRetries(ctx, url, opts)
+	if err != nil {
+		return nil, fmt.Errorf("the device at '%s' didn't identify itself: %w", address, err)
+	}
+	return device, nil
+}
+
+// selectDevice picks the device to use from the found devices. Unless the
+// device is selected automatically, the user is asked which one to use.
+func selectDevice(ctx context.Context, devices []Device, opts scanOptions, autoSelect deviceSelect, manualPick bool) (*Device, bool, error) {
+	if len(devices) == 0 {
+		opts.explain("No devices were left to select from")
+		return nil, false, newScanError(ErrNoDevicesFound, "didn't find any Jaguar devices")
+	}
+	if autoSelect != nil {
+		opts.explain("Selecting the %s out of %d devices", autoSelect, len(devices))
+		var matches []Device
+		for _, d := range devices {
+			if autoSelect.Match(d) {
+				matches = append(matches, d)
+				continue
+			}
+			opts.explain("Skipped %s, it isn't a %s", d.Summary(), autoSelect)
+		}
+		pattern := false
+		if _, ok := autoSelect.(*deviceNamePatternSelect); ok {
+			pattern = true
+		}
+		if len(matches) > 1 && !opts.first && pattern && !manualPick {
+			// A pattern is meant to match a group of devices, so we ask
+			// which of them to use.
+			opts.explain("%d devices are a %s, asking which of them to use", len(matches), autoSelect)
+			devices = matches
+		} else if len(matches) > 1 && !opts.first {
+			// Picking one of them could mean using the wrong board.
+			var ids []string
+			for _, d := range matches {
+				ids = append(ids, d.ID)
+			}
+			opts.explain("%d devices are a %s", len(matches), autoSelect)
+			hint := "Select the device by ID"
+			if opts.hasFirst {
+				hint += " or use --first"
+			}
+			return nil, false, newScanError(ErrAmbiguousSelection, "found %d devices matching %s, with the IDs %s. %s", len(matches), autoSelect, strings.Join(ids, ", "), hint)
+		} else if len(matches) > 0 {
+			d := matches[0]
+			opts.explain("Selected %s, it is the first match", d.Summary())
+			return &d, true, nil
+		} else if manualPick {
+			opts.explain("None of the devices is a %s", autoSelect)
+			return nil, false, newScanError(ErrNoDevicesFound, "couldn't find %s", autoSelect)
+		} else {
+			opts.explain("None of the devices is a %s, asking which device to use", autoSelect)
+		}
+	} else {
+		opts.explain("No device selection was given, asking which of the %d devices to use", len(devices))
+	}
+
+	// If the scan was interrupted, there is nobody to ask.
+	if err := ctx.Err(); err != nil {
+		return nil, false, fmt.Errorf("the scan was interrupted: %w", err)
+	}
+
+	// There is no point in asking which device to use if there is only
+	// one. A selection that didn't match still gets the prompt, so we
+	// don't silently use another device than the one that was asked for.
+	if len(devices) == 1 && autoSelect == nil && !opts.alwaysPrompt {
+		d := devices[0]
+		opts.explain("Selected %s, it is the only device", d.Summary())
+		getLogger(ctx).Infof("Selected %s, the only device found", d.Summary())
+		return &d, false, nil
+	}
+
+	// Start the prompt at the last used device, or pick it right away if
+	// we were asked to.
+	cursor := 0
+	for i, d := range devices {
+		if opts.lastDeviceID != "" && d.ID == opts.lastDeviceID {
+			if opts.useLast {
+				opts.explain("Selected %s, it is the last used device", d.Summary())
+				return &d, true, nil
+			}
+			cursor = i
+			break
+		}
+	}
+
+	// The actions come before the devices.
+	entries := []promptEntry{
+		{Action: promptActionRescan},
+		{Action: promptActionAddress},
+	}
+	actions := len(entries)
+	for _, d := range devices {
+		d.Alias = aliasOf(opts.aliases, d.ID)
+		entries = append(entries, promptEntry{Device: d})
+	}
+
+	prompt := promptui.Select{
+		Label:     "Choose what Jaguar device you want to use",
+		Items:     entries,
+		CursorPos: actions + cursor,
+		Templates: &promptui.SelectTemplates{
+			Active:   `{{ "▸" | cyan }} {{ if .Action }}{{ .Action | cyan }}{{ else }}{{ .Summary | cyan }}{{ end }}`,
+			Inactive: `  {{ if .Action }}{{ .Action | faint }}{{ else }}{{ .Summary }}{{ end }}`,
+			Selected: `{{ if .Action }}{{ .Action }}{{ else }}{{ "✔" | green }} {{ .Summary }}{{ end }}`,
+			Details: `{{ if not .Action }}
+{{ "ID:" | faint }}	{{ .ID }}
+{{ "Chip:" | faint }}	{{ .Chip }}
+{{ "SDK:" | faint }}	{{ .SDKVersion }}{{ end }}`,
+		},
+		// The searcher only limits the entries shown; the index returned
+		// by the prompt is still the index in the list of entries. The
+		// actions are always shown.
+		Searcher: func(input string, index int) bool {
+			e := entries[index]
+			if e.Action != "" {
+				return true
+			}
+			input = strings.ToLower(strings.TrimSpace(input))
+			return strings.Contains(strings.ToLower(e.Name), input) || strings.Contains(strings.ToLower(e.ID), input) ||
+				strings.Contains(e.Alias, input)
+		},
+	}
+
+	i, _, err := prompt.Run()
+	if err != nil {
+		return nil, false, fmt.Errorf("you didn't select anything")
+	}
+
+	switch entries[i].Action {
+	case promptActionRescan:
+		return nil, false, errRescan
+	case promptActionAddress:
+		device, err := promptDeviceAddress(ctx, opts)
+		return device, false, err
+	}
+	res := entries[i].Device
+	return &res, false, nil
+}
+
+// awaitDevice scans repeatedly until a device with the given name is
+// found or the context is cancelled. It doesn't print anything on stdout.
+func awaitDevice(ctx context.Context, opts scanOptions, name string) (*Device, error) {
+	selection := deviceNameSelect(name)
+	for {
+		devices, err := scanDevices(ctx, selection, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range devices {
+			if selection.Match(d) {
+				return &d, nil
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("stopped waiting for %s: %w", selection, err)
+		}
+	}
+}
+
+// validateDevice runs the validation command for the given device. The
+// whole command is expanded as a template before it is split into
+// arguments, so the template actions may contain spaces. The command isn't
+// run by a shell.
+func validateDevice(ctx context.Context, validateCmd string, device *Device) error {
+	t, err := template.New("validate").Parse(validateCmd)
+	if err != nil {
+		return fmt.Errorf("failed to parse --validate-cmd: %w", err)
+	}
+	var expanded strings.Builder
+	if err := t.Execute(&expanded, device); err != nil {
+		return fmt.Errorf("failed to expand --validate-cmd: %w", err)
+	}
+	args := strings.Fields(expanded.String())
+	if len(args) == 0 {
+		return nil
+	}
+
+	// The output of the command is diagnostics, and must not end up in
+	// the output of jag, which scripts may parse.
+	var stderr bytes.Buffer
+	validate := exec.CommandContext(ctx, args[0], args[1:]...)
+	validate.Stdout = os.Stderr
+	validate.Stderr = &stderr
+	if err := validate.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("validation of '%s' failed: %s", device.Name, msg)
+		}
+		return fmt.Errorf("validation of '%s' failed: %w", device.Name, err)
+	}
+	return nil
+}
+
+func scan(ctx context.Context, ds deviceSelect, opts scanOptions) ([]Device, error) {
+	if ds != nil && ds.Address() != "" {
+		dev, err := identifyDeviceWithRetries(ctx, opts.deviceURL(ds.Address()), opts)
+		if err != nil {
+			return nil, newScanError(ErrDeviceUnreachable, "couldn't reach the device at %s: %w", ds.Address(), err)
+		}
+		return []Device{*dev}, nil
+	}
+
+	// The sweeps don't listen for broadcasts, but the report still has
+	// how long they took.
+	if opts.network != nil {
+		opts.report.begin()
+		defer opts.report.end()
+		return scanRange(ctx, opts.network, opts)
+	}
+	if opts.hostsFile != "" {
+		opts.report.begin()
+		defer opts.report.end()
+		return scanHosts(ctx, opts.hostsFile, opts)
+	}
+	if len(opts.addresses) > 0 {
+		opts.report.begin()
+		defer opts.report.end()
+		return scanAddressList(ctx, opts.addresses, opts), nil
+	}
+
+	// Probe the last-known addresses first. If we are looking for a
+	// specific device and it hasn't moved, we don't have to wait for the
+	// broadcasts. Otherwise the seeds are probed while we listen.
+	seeded := make(chan []Device, 1)
+	if opts.seedFile == "" {
+		seeded <- nil
+	} else {
+		seeds, err := readSeeds(opts.seedFile)
+		if err != nil {
+			getLogger(ctx).Warnf("Failed to read seed file: %s", err)
+		}
+		if ds == nil {
+			go func() { seeded <- probeSeeds(ctx, seeds, opts) }()
+		} else {
+			found := probeSeeds(ctx, seeds, opts)
+			for _, d := range found {
+				if ds.Match(d) && len(filterDevices([]Device{d}, opts.filters)) > 0 {
+					opts.explain("'%s' answered on its last-known address, skipping the broadcast scan", d.Name)
+					sortDevices(found)
+					return found, nil
+				}
+			}
+			seeded <- found
+		}
+	}
+
+	if isVerbose(ctx) && opts.report == nil {
+		opts.report = &scanReport{}
+	}
+	opts.report.begin()
+	// With --expect we stop listening as soon as enough devices have been
+	// found. The stream is drained until it closes.
+	listenCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	browsed := make(chan []Device, 1)
+	if opts.mdns {
+		go func() { browsed <- browseMDNS(listenCtx, opts) }()
+	} else {
+		browsed <- nil
+	}
+	stream, errs := scanStream(listenCtx, "", opts)
+	devices := map[string]Device{}
+	matching := 0
+	for d := range stream {
+		if _, ok := devices[opts.deviceKey(d)]; !ok && opts.expect > 0 && len(filterDevices([]Device{d}, opts.filters)) > 0 {
+			matching++
+			if matching == opts.expect {
+				opts.explain("Found the %d expected devices, stopping the scan", opts.expect)
+				cancel()
+			}
+		}
+		opts.addDevice(devices, d)
+	}
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+	if opts.report != nil {
+		opts.report.end()
+		opts.report.print(os.Stderr)
+	}
+
+	// Devices that didn't broadcast in time but answered on their
+	// last-known address or were found with mDNS are merged in by ID.
+	broadcasted := map[string]bool{}
+	for _, d := range devices {
+		broadcasted[d.ID] = true
+	}
+	for _, d := range <-browsed {
+		if !broadcasted[d.ID] {
+			opts.addDevice(devices, d)
+			broadcasted[d.ID] = true
+		}
+	}
+	for _, d := range <-seeded {
+		if !broadcasted[d.ID] {
+			opts.addDevice(devices, d)
+			broadcasted[d.ID] = true
+		}
+	}
+
+	var res []Device
+	for _, d := range devices {
 		res = append(res, d)
 	}
-	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	sortDevices(res)
+
+	if opts.seedFile != "" {
+		if err := writeSeeds(opts.seedFile, res); err != nil {
+			getLogger(ctx).Warnf("Failed to update seed file: %s", err)
+		}
+	}
+	if opts.cacheFile != "" {
+		if err := writeScanCache(opts, res); err != nil {
+			getLogger(ctx).Warnf("Failed to update scan cache: %s", err)
+		}
+	}
 	return res, nil
 }
 
+// ScanStream emits the devices as they are found until the context is
+// done. If addr is given, the device at that address is asked to identify
+// itself. Otherwise, the devices that announce themselves on the given UDP
+// port are emitted. Both channels are closed when the scan ends; the error
+// channel gets at most one error before that.
+func ScanStream(ctx context.Context, addr string, port uint) (<-chan Device, <-chan error) {
+	opts := defaultScanOptions()
+	opts.ports = []uint{port}
+	return scanStream(ctx, addr, opts)
+}
+
+func scanStream(ctx context.Context, addr string, opts scanOptions) (<-chan Device, <-chan error) {
+	devices := make(chan Device)
+	errs := make(chan error, 1)
+
+	if addr != "" {
+		go func() {
+			defer close(errs)
+			defer close(devices)
+			dev, err := identifyDeviceWithRetries(ctx, deviceURL(addr), opts)
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case devices <- *dev:
+			case <-ctx.Done():
+			}
+		}()
+		return devices, errs
+	}
+
+	if opts.allInterfaces {
+		return scanInterfaces(ctx, opts, devices, errs)
+	}
+
+	// Listen on all the networks and ports at the same time. If listening
+	// fails on one of them, we stop listening on the others.
+	ctx, cancel := context.WithCancel(ctx)
+	var mutex sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	for _, network := range opts.udpNetworks() {
+		for _, port := range opts.ports {
+			wg.Add(1)
+			go func(network string, port uint) {
+				defer wg.Done()
+				err := receive(ctx, network, port, opts, func(d Device) {
+					select {
+					case devices <- d:
+					case <-ctx.Done():
+					}
+				})
+				// In auto mode we don't require the host to support IPv6.
+				if err == nil || (opts.ipVersion == ipVersionAuto && network == "udp6") {
+					return
+				}
+				mutex.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mutex.Unlock()
+				cancel()
+			}(network, port)
+		}
+	}
+	go func() {
+		wg.Wait()
+		cancel()
+		if firstErr != nil {
+			errs <- firstErr
+		}
+		close(errs)
+		close(devices)
+	}()
+	return devices, errs
+}
+
+// scanInterfaces listens on the ports of the options with a socket per
+// IPv4 network interface and sends the devices found on any of them to
+// the devices channel. Unlike a single socket, a socket that fails only
+// stops the scan on its interface. The scan fails if it failed on all of
+// them.
+func scanInterfaces(ctx context.Context, opts scanOptions, devices chan Device, errs chan error) (<-chan Device, <-chan error) {
+	names, err := ipv4Interfaces()
+	if err == nil && len(names) == 0 {
+		err = fmt.Errorf("no network interface with an IPv4 address is up")
+	}
+	if err != nil {
+		errs <- err
+		close(errs)
+		close(devices)
+		return devices, errs
+	}
+
+	var mutex sync.Mutex
+	var firstErr error
+	failed := 0
+	listeners := 0
+	var wg sync.WaitGroup
+	for _, name := range names {
+		ifaceOpts := opts
+		ifaceOpts.iface, ifaceOpts.ifaceNetworks, err = interfaceNetworks(name)
+		if err != nil {
+			getLogger(ctx).Warnf("Skipped network interface '%s': %s", name, err)
+			continue
+		}
+		for _, port := range opts.ports {
+			listeners++
+			wg.Add(1)
+			go func(name string, port uint, opts scanOptions) {
+				defer wg.Done()
+				err := receive(ctx, "udp4", port, opts, func(d Device) {
+					select {
+					case devices <- d:
+					case <-ctx.Done():
+					}
+				})
+				if err == nil {
+					return
+				}
+				getLogger(ctx).Warnf("Stopped listening on network interface '%s' port %d: %s", name, port, err)
+				mutex.Lock()
+				failed++
+				if firstErr == nil {
+					firstErr = err
+				}
+				mutex.Unlock()
+			}(name, port, ifaceOpts)
+		}
+	}
+	go func() {
+		wg.Wait()
+		if listeners == 0 {
+			errs <- fmt.Errorf("no network interface to listen on")
+		} else if failed == listeners {
+			errs <- firstErr
+		}
+		close(errs)
+		close(devices)
+	}()
+	return devices, errs
+}
+
+// receive calls found for every device announcement on the given UDP
+// network until the context is done. It returns nil when the context
+// deadline is reached or the context is cancelled, for example because the
+// user interrupted the scan, so the devices found so far can be used.
+func receive(ctx context.Context, network string, port uint, opts scanOptions, found func(Device)) error {
+	pc, err := listenPacket(ctx, network, port, opts)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := pc.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+
+	if opts.solicit && network == "udp4" {
+		solicit(ctx, pc, port, opts)
+	}
+
+	// Closing the connection makes a blocked read return when the context
+	// is cancelled.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			pc.Close()
+		case <-done:
+		}
+	}()
+
+	// Parsing is slower than reading, so the packets are parsed by a pool
+	// of parsers. Otherwise packets are dropped when many devices
+	// broadcast at the same time. The parsers finish the packets that
+	// have been read before we return.
+	packets := make(chan udpPacket, scanPacketQueueSize)
+	var parsers sync.WaitGroup
+	for i := 0; i < scanParsers; i++ {
+		parsers.Add(1)
+		go func() {
+			defer parsers.Done()
+			for p := range packets {
+				handlePacket(p, opts, found)
+			}
+		}()
+	}
+	defer parsers.Wait()
+	defer close(packets)
+
+	// The buffer is reused for all reads. The packets are copied before
+	// they are handed to the parsers.
+	bufferSize := opts.bufferSize
+	if bufferSize <= 0 {
+		bufferSize = scanBufferSize
+	}
+	buf := make([]byte, bufferSize)
+	filled := 0
+	warned := false
+	// Devices broadcast their identity every second, so a truncated
+	// payload is only reported as a warning the first time per source.
+	truncated := map[string]bool{}
+looping:
+	for {
+		select {
+		case <-ctx.Done():
+			break looping
+		default:
+		}
+
+		n, source, err := pc.ReadFrom(buf)
+		if err != nil {
+			// Reads fail when the context is done, because of the deadline or
+			// because the connection was closed. Other errors are genuine.
+			if isTimeoutError(err) || ctx.Err() != nil {
+				break looping
+			}
+			return err
+		}
+
+		opts.report.received()
+
+		if !opts.fromInterface(source) {
+			continue
+		}
+
+		if !opts.isTrusted(source) {
+			if opts.includeErrors {
+				getLogger(ctx).Warnf("Dropped identify packet from untrusted source %s", source)
+			}
+			continue
+		}
+
+		// A read that fills the entire buffer has most likely been
+		// truncated, so parsing it would only give a confusing error. If
+		// that keeps happening, the devices send larger packets than we
+		// expect, so we grow the buffer.
+		if n == len(buf) && bufferSize < maxScanBufferSize {
+			if truncated[source.String()] {
+				getLogger(ctx).Debugf("Identify payload from %s truncated at %d bytes", source, n)
+			} else {
+				getLogger(ctx).Warnf("Identify payload from %s truncated at %d bytes, increase the buffer with --buffer-size", source, n)
+				truncated[source.String()] = true
+			}
+			filled++
+			if filled >= scanBufferFillLimit {
+				bufferSize *= 2
+				if bufferSize > maxScanBufferSize {
+					bufferSize = maxScanBufferSize
+				}
+				buf = make([]byte, bufferSize)
+				filled = 0
+				if !warned {
+					getLogger(ctx).Infof("Identify packets fill the scan buffer, increasing it to %d bytes", bufferSize)
+					warned = true
+				}
+			}
+			continue
+		}
+
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		select {
+		case packets <- udpPacket{data: data, source: source}:
+		case <-ctx.Done():
+			break looping
+		}
+	}
+	return nil
+}
+
+// packetSource opens the sockets that the device broadcasts are read
+// from. It is implemented by net.ListenConfig and can be replaced to feed
+// the scan with packets that don't come from the network.
+type packetSource interface {
+	ListenPacket(ctx context.Context, network string, address string) (net.PacketConn, error)
+}
+
+// packetSource returns the packet source of the options. By default the
+// sockets are opened on the host. With --all-interfaces there is a socket
+// per network interface on the same port, so the address must be
+// reusable. Broadcasts are then delivered to all the sockets and each
+// keeps those from its own interface. A socket for a network interface is
+// bound to it where the platform supports it.
+func (o scanOptions) packetSource() packetSource {
+	if o.packets != nil {
+		return o.packets
+	}
+	reuse := o.allInterfaces
+	iface := o.iface
+	return &net.ListenConfig{
+		Control: func(network string, address string, c syscall.RawConn) error {
+			if reuse {
+				if err := reuseAddress(network, address, c); err != nil {
+					return err
+				}
+			}
+			if iface != nil {
+				bindToDevice(c, iface.Name)
+			}
+			return nil
+		},
+	}
+}
+
+// listenPacket opens the socket to receive the broadcasts on the given
+// port.
+func listenPacket(ctx context.Context, network string, port uint, opts scanOptions) (net.PacketConn, error) {
+	return opts.packetSource().ListenPacket(ctx, network, fmt.Sprintf(":%d", port))
+}
+
+// solicitMessage asks the devices that receive it to identify themselves.
+var solicitMessage = []byte(`{"method":"jaguar.identify-request"}`)
+
+// solicit broadcasts an identify request from the socket we listen on. On
+// a network interface, it is sent to the broadcast address of each of its
+// IPv4 networks, so it goes out on that interface. Failing to send it
+// isn't fatal, as the devices still announce themselves.
+func solicit(ctx context.Context, pc net.PacketConn, port uint, opts scanOptions) {
+	var targets []net.IP
+	if opts.iface == nil {
+		targets = append(targets, net.IPv4bcast)
+	} else {
+		for _, network := range opts.ifaceNetworks {
+			if ip := broadcastAddress(network); ip != nil {
+				targets = append(targets, ip)
+			}
+		}
+	}
+	for _, ip := range targets {
+		addr := &net.UDPAddr{IP: ip, Port: int(port)}
+		if _, err := pc.WriteTo(solicitMessage, addr); err != nil {
+			getLogger(ctx).Warnf("Failed to ask the devices at %s to identify themselves: %s", addr, err)
+		} else {
+			getLogger(ctx).Debugf("Asked the devices at %s to identify themselves", addr)
+		}
+	}
+}
+
+// udpPacket is a packet that has been read, but not parsed yet.
+type udpPacket struct {
+	data   []byte
+	source net.Addr
+}
+
+// handlePacket parses a packet and passes the device to found if it is a
+// device announcement. It may be called from several goroutines at once.
+func handlePacket(p udpPacket, opts scanOptions, found func(Device)) {
+	// Our own identify request comes back to us when it is broadcast. It
+	// isn't from a device.
+	if opts.solicit && bytes.Equal(p.data, solicitMessage) {
+		return
+	}
+	dev, err := parseDevice(p.data)
+	if err != nil {
+		opts.report.malformed(p.source, p.data, err)
+		return
+	} else if dev == nil {
+		opts.report.ignored()
+		return
+	}
+	opts.report.announced()
+	if udp, ok := p.source.(*net.UDPAddr); ok {
+		dev.ReportedAddress = dev.Address
+		dev.SourceAddress = sourceURL(dev.Address, dev.Port, udp)
+		if !isRoutableAddress(dev.Address) {
+			dev.Address = dev.SourceAddress
+		}
+		dev.Address = withZone(dev.Address, udp)
+	}
+	// The scheme of the options is only for the addresses given on the
+	// command line. A device that announces itself is reached on the
+	// address it announced.
+	found(*dev)
+}
+
+// maxReportedPacketSize is how much of a malformed packet is reported.
+const maxReportedPacketSize = 256
+
+// scanReport collects the packets that weren't device announcements, so
+// misbehaving devices can be debugged, and counts all the packets of the
+// scan. A nil report collects nothing.
+type scanReport struct {
+	mutex             sync.Mutex
+	failures          []scanFailure
+	ignoredCount      int
+	receivedCount     int
+	announcementCount int
+	start             time.Time
+	duration          time.Duration
+}
+
+// ScanStats summarizes the packets received while listening for
+// broadcasts. Packets counts all of them, including those from sources
+// that weren't accepted, and Other counts the well-formed packets that
+// weren't device announcements.
+type ScanStats struct {
+	DurationMs    float64 `mapstructure:"durationMs" yaml:"durationMs" json:"durationMs"`
+	Packets       int     `mapstructure:"packets" yaml:"packets" json:"packets"`
+	Announcements int     `mapstructure:"announcements" yaml:"announcements" json:"announcements"`
+	Other         int     `mapstructure:"other" yaml:"other" json:"other"`
+	Malformed     int     `mapstructure:"malformed" yaml:"malformed" json:"malformed"`
+}
+
+// begin marks the start of listening.
+func (r *scanReport) begin() {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.start = time.Now()
+}
+
+// end marks the end of listening.
+func (r *scanReport) end() {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.duration = time.Since(r.start)
+}
+
+// received counts a packet that was read, before it is filtered or
+// parsed.
+func (r *scanReport) received() {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.receivedCount++
+}
+
+func (r *scanReport) announced() {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.announcementCount++
+}
+
+// stats returns the counters of the report.
+func (r *scanReport) stats() ScanStats {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return ScanStats{
+		DurationMs:    float64(r.duration.Microseconds()) / 1000,
+		Packets:       r.receivedCount,
+		Announcements: r.announcementCount,
+		Other:         r.ignoredCount,
+		Malformed:     len(r.failures),
+	}
+}
+
+type scanFailure struct {
+	source net.Addr
+	raw    []byte
+	err    error
+}
+
+func (r *scanReport) malformed(source net.Addr, raw []byte, err error) {
+	if r == nil {
+		return
+	}
+	if len(raw) > maxReportedPacketSize {
+		raw = raw[:maxReportedPacketSize]
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.failures = append(r.failures, scanFailure{
+		source: source,
+		raw:    append([]byte(nil), raw...),
+		err:    err,
+	})
+}
+
+// ignored counts a well-formed packet with a method other than
+// 'jaguar.identify'. These aren't errors.
+func (r *scanReport) ignored() {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.ignoredCount++
+}
+
+func (r *scanReport) print(w io.Writer) {
+	stats := r.stats()
+	fmt.Fprintf(w, "Scanned for %.1fms: %d packets, %d device announcements, %d other packets, %d malformed\n",
+		stats.DurationMs, stats.Packets, stats.Announcements, stats.Other, stats.Malformed)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.ignoredCount > 0 {
+		fmt.Fprintf(w, "Ignored %d packets that weren't device announcements\n", r.ignoredCount)
+	}
+	for _, f := range r.failures {
+		fmt.Fprintf(w, "Failed to parse identify from %s: %s\n  %q\n", f.source, f.err, f.raw)
+	}
+}
+
+// identifyClient is used for asking devices to identify themselves. It
+// doesn't keep connections alive, so concurrent scans don't share them,
+// and it gives up quickly on hosts that can't be reached.
+var identifyClient = newIdentifyClient(false)
+
+// insecureIdentifyClient is like identifyClient, but doesn't verify the
+// certificates of devices reached over https.
+var insecureIdentifyClient = newIdentifyClient(true)
+
+func newIdentifyClient(insecure bool) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:             deviceProxy,
+			DisableKeepAlives: true,
+			DialContext: (&net.Dialer{
+				Timeout: identifyDialTimeout,
+			}).DialContext,
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: insecure,
+			},
+		},
+	}
+}
+
+// identifyDeviceWithRetries asks the device at the given base URL to
+// identify itself. Requests that time out or are refused are retried with
+// an exponential backoff. Other errors, like non-OK responses, are
+// returned right away.
+func identifyDeviceWithRetries(ctx context.Context, url string, opts scanOptions) (*Device, error) {
+	delay := opts.retryDelay
+	for attempt := 0; ; attempt++ {
+		dev, err := opts.identify(ctx, url)
+		if err == nil || attempt >= opts.retries || !isRetryableError(err) {
+			return dev, err
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, err
+		}
+		delay *= 2
+	}
+}
+
+func isRetryableError(err error) bool {
+	return isTimeoutError(err) || errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// identifyDevice asks the device at its address to identify itself, with
+// its token and signed with its secret, like it is for other requests.
+func identifyDevice(ctx context.Context, d Device) (*Device, error) {
+	opts := scanOptions{
+		insecure: d.Insecure,
+		known:    []Device{d},
+	}
+	return opts.identify(ctx, d.Address)
+}
+
+// httpClient returns the HTTP client for the identify requests. If the
+// options have a transport, the requests are sent with it.
+func (o scanOptions) httpClient() *http.Client {
+	if o.transport != nil {
+		return &http.Client{
+			Transport: o.transport,
+		}
+	}
+	if o.insecure {
+		return insecureIdentifyClient
+	}
+	return identifyClient
+}
+
+// identify asks the device at the given base URL to identify itself, like
+// identifyDevice, using the client, certificate verification and token of
+// the options.
+func (o scanOptions) identify(ctx context.Context, url string) (*Device, error) {
+	path, method := o.identifyPath, o.identifyMethod
+	if path == "" {
+		path = identifyPath
+	}
+	if method == "" {
+		method = identifyMethod
+	}
+	req, err := http.NewRequestWithContext(ctx, method, joinURLPath(url, path), nil)
+	if err != nil {
+		return nil, err
+	}
+	// The token given with --token is sent to all devices. Otherwise, the
+	// known device at the address gets its token, and if it has a secret,
+	// the request is signed with it, as the device only identifies itself
+	// to callers that know its secret.
+	token := o.token
+	known := o.knownAt(url)
+	if token == "" && known != nil {
+		token = known.token
+	}
+	authorize(req, token)
+	var res *http.Response
+	if known != nil && known.secret != "" {
+		req.Header.Set(JaguarDeviceIDHeader, known.ID)
+		res, err = doSigned(o.httpClient(), req, known.secret, nil)
+	} else {
+		res, err = o.httpClient().Do(req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	buf, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, responseError(res, buf)
+	}
+	dev, err := parseDevice(buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse identify. reason %w", err)
+	} else if dev == nil {
+		return nil, fmt.Errorf("invalid identify response")
+	} else if dev.Address == "" {
+		return nil, fmt.Errorf("invalid payload of jaguar.identify: the field 'address' is missing or empty")
+	}
+	if strings.HasPrefix(url, schemeHTTPS+"://") {
+		// Devices don't know about the proxy that terminates TLS for
+		// them, so they report their plain address. Keep using the one
+		// we reached them on.
+		dev.Address = url
+		dev.Scheme = schemeHTTPS
+		dev.Insecure = o.insecure
+	}
+	// A stored token is only kept if the device is the one it belongs to.
+	if o.token != "" || (known != nil && known.ID == dev.ID) {
+		dev.token = token
+	}
+	return dev, nil
+}
+
+// identifyTimeout returns how long the device at the given base URL gets
+// to identify itself. It is the connect timeout, unless the known device
+// at the URL has a probe timeout in the device config.
+func (o scanOptions) identifyTimeout(ctx context.Context, url string) time.Duration {
+	if known := o.knownAt(url); known != nil {
+		return known.probeTimeoutFor(ctx, o.connectTimeout)
+	}
+	return o.connectTimeout
+}
+
+// addressesTimeout returns how long asking the addresses to identify
+// themselves takes at most. They are asked at the same time, so it is the
+// longest of their timeouts.
+func (o scanOptions) addressesTimeout(addresses []string) time.Duration {
+	timeout := o.connectTimeout
+	for _, address := range addresses {
+		if known := o.knownAt(o.deviceURL(address)); known != nil && known.probeTimeout > timeout {
+			timeout = known.probeTimeout
+		}
+	}
+	return timeout
+}
+
+// knownAt returns the known device at the given base URL, or nil if there
+// is none.
+func (o scanOptions) knownAt(url string) *Device {
+	for i := range o.known {
+		d := &o.known[i]
+		if d.Address == url || o.deviceURL(d.Address) == url {
+			return d
+		}
+	}
+	return nil
+}
+
 type udpMessage struct {
 	Method  string                 `json:"method"`
 	Payload map[string]interface{} `json:"payload"`
 }
 
-func parseDevice(bytes []byte) (*Device, error) {
-	var device Device
+// identifyPayload is the payload of a jaguar.identify message. It only has
+// the fields a device reports about itself, so a packet can't set the
+// fields of Device that are local, like Insecure, Scheme or Alias.
+type identifyPayload struct {
+	ID              string   `json:"id"`
+	Name            string   `json:"name"`
+	Chip            string   `json:"chip"`
+	Address         string   `json:"address"`
+	SDKVersion      string   `json:"sdkVersion"`
+	Port            int      `json:"port"`
+	FirmwareVersion string   `json:"firmwareVersion"`
+	WordSize        int      `json:"wordSize"`
+	Latitude        *float64 `json:"latitude"`
+	Longitude       *float64 `json:"longitude"`
+	Writable        *bool    `json:"writable"`
+}
 
-	var msg udpMessage
-	if err := ubjson.Unmarshal(bytes, &msg); err != nil {
-		if err := json.Unmarshal(bytes, &msg); err != nil {
-			return nil, fmt.Errorf("could not parse message: %s. Reason: %w", string(bytes), err)
+func (p identifyPayload) device() Device {
+	return Device{
+		ID:              p.ID,
+		Name:            p.Name,
+		Chip:            p.Chip,
+		Address:         p.Address,
+		SDKVersion:      p.SDKVersion,
+		Port:            p.Port,
+		FirmwareVersion: p.FirmwareVersion,
+		WordSize:        p.WordSize,
+		Latitude:        p.Latitude,
+		Longitude:       p.Longitude,
+		Writable:        p.Writable,
+	}
+}
 
+func parseDevice(data []byte) (*Device, error) {
+	var msg udpMessage
+	if err := ubjson.Unmarshal(data, &msg); err != nil {
+		// Some platforms hand us a datagram with trailing bytes, like
+		// padding or the start of the next datagram. Decoding a single
+		// value ignores what comes after it.
+		if err := json.NewDecoder(bytes.NewReader(data)).Decode(&msg); err != nil {
+			return nil, fmt.Errorf("could not parse message: %s. Reason: %w", string(data), err)
 		}
 	}
 
@@ -302,18 +3058,43 @@ func parseDevice(bytes []byte) (*Device, error) {
 	}
 
 	// We marshal the payload into JSON again, so we can use the reflection
-	// based support in encoding/json to fill in the fields in the device
-	// struct before returning it.
+	// based support in encoding/json to fill in the fields in the payload
+	// struct before returning the device.
 	payload, err := json.Marshal(msg.Payload)
 	if err != nil {
-		return nil, fmt.Errorf("failed to re-marshal jaguar.identify: %s. reason: %w", string(bytes), err)
+		return nil, fmt.Errorf("failed to re-marshal jaguar.identify: %s. reason: %w", string(data), err)
+	}
+	var identify identifyPayload
+	if err := json.Unmarshal(payload, &identify); err != nil {
+		return nil, fmt.Errorf("failed to parse payload of jaguar.identify: %s. reason: %w", string(data), err)
 	}
-	if err := json.Unmarshal(payload, &device); err != nil {
-		return nil, fmt.Errorf("failed to parse payload of jaguar.identify: %s. reason: %w", string(bytes), err)
+	device := identify.device()
+	if err := validateIdentify(device); err != nil {
+		return nil, fmt.Errorf("invalid payload of jaguar.identify: %w", err)
+	}
+	// A port of 0 means the device uses the default port.
+	if device.Port != 0 {
+		device.Address = withPort(device.Address, device.Port)
 	}
 	return &device, nil
 }
 
+// validateIdentify checks that a device sent the fields we need to tell it
+// apart from other devices. The address isn't checked here, because the
+// address of a broadcast can be used for devices that don't know their
+// own address.
+func validateIdentify(d Device) error {
+	switch {
+	case d.ID == "":
+		return fmt.Errorf("the field 'id' is missing or empty")
+	case d.Name == "":
+		return fmt.Errorf("the field 'name' is missing or empty")
+	case d.Port < 0 || d.Port > 65535:
+		return fmt.Errorf("the field 'port' is not a valid port: %d", d.Port)
+	}
+	return nil
+}
+
 func isTimeoutError(err error) bool {
 	e, ok := err.(net.Error)
 	return ok && e.Timeout()
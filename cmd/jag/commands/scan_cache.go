@@ -0,0 +1,105 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// scanCacheTTL is how long the results of a scan are reused when
+// selecting a device.
+const scanCacheTTL = 10 * time.Second
+
+// scanCacheEntry holds the devices found by the last scan on a set of
+// ports.
+type scanCacheEntry struct {
+	Time    time.Time `json:"time"`
+	Devices []Device  `json:"devices"`
+}
+
+// scanCacheKey returns the key of the cache entry for the options. Scans
+// on other ports, another network interface, from other trusted sources or
+// with another IP version find other devices, so they have their own
+// entries.
+func scanCacheKey(opts scanOptions) string {
+	var ports []string
+	for _, port := range opts.ports {
+		ports = append(ports, fmt.Sprint(port))
+	}
+	key := strings.Join(ports, ",")
+	if opts.iface != nil {
+		key += " interface=" + opts.iface.Name
+	}
+	if len(opts.trusted) > 0 {
+		var trusted []string
+		for _, network := range opts.trusted {
+			trusted = append(trusted, network.String())
+		}
+		sort.Strings(trusted)
+		key += " trust=" + strings.Join(trusted, ",")
+	}
+	if opts.ipVersion != "" && opts.ipVersion != ipVersionAuto {
+		key += " ip=" + opts.ipVersion
+	}
+	return key
+}
+
+func readScanCacheFile(path string) (map[string]scanCacheEntry, error) {
+	entries := map[string]scanCacheEntry{}
+	if err := readJSONMap(path, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// readScanCache returns the devices found by a scan on the same ports
+// within the cache TTL of the options. It returns false if there was no
+// such scan, or if the cache is disabled. Only broadcast scans are cached,
+// so scans of a range, of hosts or addresses, or of an imported inventory
+// don't use the cache.
+func readScanCache(opts scanOptions) ([]Device, bool) {
+	if opts.cacheFile == "" || opts.cacheTTL <= 0 || opts.network != nil || opts.hostsFile != "" || len(opts.addresses) > 0 || opts.importFile != "" {
+		return nil, false
+	}
+	entries, err := readScanCacheFile(opts.cacheFile)
+	if err != nil {
+		return nil, false
+	}
+	entry, ok := entries[scanCacheKey(opts)]
+	if !ok || time.Since(entry.Time) > opts.cacheTTL {
+		return nil, false
+	}
+	return entry.Devices, true
+}
+
+// writeScanCache stores the devices found by a scan on the ports of the
+// options.
+func writeScanCache(opts scanOptions, devices []Device) error {
+	entries, err := readScanCacheFile(opts.cacheFile)
+	if err != nil {
+		// A broken cache is replaced.
+		entries = map[string]scanCacheEntry{}
+	}
+	entries[scanCacheKey(opts)] = scanCacheEntry{
+		Time:    time.Now(),
+		Devices: devices,
+	}
+	return writeJSONMap(opts.cacheFile, entries)
+}
+
+// invalidateScanCache drops the cached devices for the ports of the
+// options, so the next selection scans again.
+func invalidateScanCache(opts scanOptions) error {
+	entries, err := readScanCacheFile(opts.cacheFile)
+	if err != nil {
+		return os.Remove(opts.cacheFile)
+	}
+	delete(entries, scanCacheKey(opts))
+	return writeJSONMap(opts.cacheFile, entries)
+}
@@ -0,0 +1,34 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"net"
+	"testing"
+)
+
+func TestScanCacheKey(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("192.168.1.0/24")
+	base := scanOptions{ports: []uint{scanPort}, ipVersion: ipVersionAuto}
+	tests := []struct {
+		name   string
+		change func(o *scanOptions)
+	}{
+		{"port", func(o *scanOptions) { o.ports = []uint{scanPort, 1991} }},
+		{"interface", func(o *scanOptions) { o.iface = &net.Interface{Name: "eth0"} }},
+		{"trusted source", func(o *scanOptions) { o.trusted = []*net.IPNet{trusted} }},
+		{"ip version", func(o *scanOptions) { o.ipVersion = ipVersion4 }},
+	}
+	keys := map[string]string{scanCacheKey(base): "default"}
+	for _, test := range tests {
+		opts := base
+		test.change(&opts)
+		key := scanCacheKey(opts)
+		if other, ok := keys[key]; ok {
+			t.Errorf("scans with another %s share the cache key %q with %s", test.name, key, other)
+		}
+		keys[key] = test.name
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ScanDiagnosis is the result of 'jag scan --diagnose'. It tells apart the
+// usual reasons for not finding devices: no usable network interface, a
+// port that can't be opened, broadcasts that don't arrive, and devices
+// that don't answer.
+type ScanDiagnosis struct {
+	Interfaces []InterfaceDiagnosis `mapstructure:"interfaces" yaml:"interfaces" json:"interfaces"`
+	Listeners  []ListenerDiagnosis  `mapstructure:"listeners" yaml:"listeners" json:"listeners"`
+	// Identify is the result of asking the given address to identify
+	// itself. It is only set if an address was given.
+	Identify *IdentifyDiagnosis `mapstructure:"identify" yaml:"identify,omitempty" json:"identify,omitempty"`
+}
+
+type InterfaceDiagnosis struct {
+	Name      string   `mapstructure:"name" yaml:"name" json:"name"`
+	Addresses []string `mapstructure:"addresses" yaml:"addresses" json:"addresses"`
+	Up        bool     `mapstructure:"up" yaml:"up" json:"up"`
+	Broadcast bool     `mapstructure:"broadcast" yaml:"broadcast" json:"broadcast"`
+	Loopback  bool     `mapstructure:"loopback" yaml:"loopback" json:"loopback"`
+}
+
+// ListenerDiagnosis describes what arrived on a UDP port while listening.
+// Packets counts everything, including packets that aren't from Jaguar.
+type ListenerDiagnosis struct {
+	Network       string   `mapstructure:"network" yaml:"network" json:"network"`
+	Port          uint     `mapstructure:"port" yaml:"port" json:"port"`
+	Opened        bool     `mapstructure:"opened" yaml:"opened" json:"opened"`
+	Error         string   `mapstructure:"error" yaml:"error,omitempty" json:"error,omitempty"`
+	Packets       int      `mapstructure:"packets" yaml:"packets" json:"packets"`
+	Announcements int      `mapstructure:"announcements" yaml:"announcements" json:"announcements"`
+	Malformed     int      `mapstructure:"malformed" yaml:"malformed" json:"malformed"`
+	Sources       []string `mapstructure:"sources" yaml:"sources,omitempty" json:"sources,omitempty"`
+}
+
+type IdentifyDiagnosis struct {
+	Address   string  `mapstructure:"address" yaml:"address" json:"address"`
+	OK        bool    `mapstructure:"ok" yaml:"ok" json:"ok"`
+	LatencyMs float64 `mapstructure:"latencyMs" yaml:"latencyMs,omitempty" json:"latencyMs,omitempty"`
+	Device    *Device `mapstructure:"device" yaml:"device,omitempty" json:"device,omitempty"`
+	Error     string  `mapstructure:"error" yaml:"error,omitempty" json:"error,omitempty"`
+}
+
+// diagnoseScan collects the information for a ScanDiagnosis. It listens
+// on the ports of the options for the duration of the scan timeout. If
+// address isn't empty, the device at the address is asked to identify
+// itself while listening.
+func diagnoseScan(ctx context.Context, address string, opts scanOptions) ScanDiagnosis {
+	var res ScanDiagnosis
+	res.Interfaces = diagnoseInterfaces()
+
+	ctx, cancel := context.WithTimeout(ctx, opts.timeout)
+	defer cancel()
+
+	for _, network := range opts.udpNetworks() {
+		for _, port := range opts.ports {
+			res.Listeners = append(res.Listeners, ListenerDiagnosis{
+				Network: network,
+				Port:    port,
+			})
+		}
+	}
+	var wg sync.WaitGroup
+	for i := range res.Listeners {
+		wg.Add(1)
+		go func(l *ListenerDiagnosis) {
+			defer wg.Done()
+			diagnoseListener(ctx, l, opts)
+		}(&res.Listeners[i])
+	}
+
+	if address != "" {
+		res.Identify = diagnoseIdentify(ctx, opts.deviceURL(address), opts)
+	}
+	wg.Wait()
+	return res
+}
+
+func diagnoseInterfaces() []InterfaceDiagnosis {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var res []InterfaceDiagnosis
+	for _, iface := range interfaces {
+		d := InterfaceDiagnosis{
+			Name:      iface.Name,
+			Addresses: []string{},
+			Up:        iface.Flags&net.FlagUp != 0,
+			Broadcast: iface.Flags&net.FlagBroadcast != 0,
+			Loopback:  iface.Flags&net.FlagLoopback != 0,
+		}
+		if addrs, err := iface.Addrs(); err == nil {
+			for _, addr := range addrs {
+				d.Addresses = append(d.Addresses, addr.String())
+			}
+		}
+		res = append(res, d)
+	}
+	return res
+}
+
+// diagnoseListener listens on the port of the listener until the context
+// is done and counts the packets that arrive.
+func diagnoseListener(ctx context.Context, l *ListenerDiagnosis, opts scanOptions) {
+	pc, err := listenPacket(ctx, l.Network, l.Port, opts)
+	if err != nil {
+		l.Error = err.Error()
+		return
+	}
+	defer pc.Close()
+	l.Opened = true
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := pc.SetDeadline(deadline); err != nil {
+			l.Error = err.Error()
+			return
+		}
+	}
+
+	sources := map[string]bool{}
+	buf := make([]byte, maxScanBufferSize)
+	for {
+		n, source, err := pc.ReadFrom(buf)
+		if err != nil {
+			if !isTimeoutError(err) && ctx.Err() == nil {
+				l.Error = err.Error()
+			}
+			break
+		}
+		l.Packets++
+		sources[source.String()] = true
+		dev, err := parseDevice(buf[:n])
+		if err != nil {
+			l.Malformed++
+		} else if dev != nil {
+			l.Announcements++
+		}
+	}
+	for source := range sources {
+		l.Sources = append(l.Sources, source)
+	}
+	sort.Strings(l.Sources)
+}
+
+func diagnoseIdentify(ctx context.Context, url string, opts scanOptions) *IdentifyDiagnosis {
+	res := &IdentifyDiagnosis{
+		Address: url,
+	}
+	start := time.Now()
+	dev, err := opts.identify(ctx, url)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.OK = true
+	res.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	res.Device = dev
+	return res
+}
+
+// printDiagnosis writes the diagnosis in the given output format. Formats
+// other than json and yaml give a human readable summary.
+func printDiagnosis(w io.Writer, d ScanDiagnosis, output string) error {
+	switch strings.ToLower(output) {
+	case "json":
+		return json.NewEncoder(w).Encode(d)
+	case "yaml":
+		return yaml.NewEncoder(w).Encode(d)
+	}
+
+	fmt.Fprintln(w, "Network interfaces:")
+	for _, iface := range d.Interfaces {
+		var flags []string
+		if iface.Up {
+			flags = append(flags, "up")
+		} else {
+			flags = append(flags, "down")
+		}
+		if iface.Broadcast {
+			flags = append(flags, "broadcast")
+		}
+		if iface.Loopback {
+			flags = append(flags, "loopback")
+		}
+		fmt.Fprintf(w, "  %s (%s): %s\n", iface.Name, strings.Join(flags, ", "), strings.Join(iface.Addresses, " "))
+	}
+
+	fmt.Fprintln(w, "Listeners:")
+	for _, l := range d.Listeners {
+		if !l.Opened {
+			fmt.Fprintf(w, "  %s port %d: couldn't open the port: %s\n", l.Network, l.Port, l.Error)
+			continue
+		}
+		fmt.Fprintf(w, "  %s port %d: %d packets, %d device announcements, %d malformed\n",
+			l.Network, l.Port, l.Packets, l.Announcements, l.Malformed)
+		for _, source := range l.Sources {
+			fmt.Fprintf(w, "    from %s\n", source)
+		}
+		if l.Error != "" {
+			fmt.Fprintf(w, "    failed while listening: %s\n", l.Error)
+		}
+	}
+
+	if d.Identify != nil {
+		if d.Identify.OK {
+			fmt.Fprintf(w, "Identify %s: '%s' answered in %.1fms\n", d.Identify.Address, d.Identify.Device.Name, d.Identify.LatencyMs)
+		} else {
+			fmt.Fprintf(w, "Identify %s: %s\n", d.Identify.Address, d.Identify.Error)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"fmt"
+	"io"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ScanPlan is the output of 'jag scan --dry-run'. It describes what the
+// scan would do with the given flags.
+type ScanPlan struct {
+	ScanParameters `mapstructure:",squash" yaml:",inline"`
+	// Interfaces are the network interfaces broadcasts are accepted on.
+	// 'any' means all of them.
+	Interfaces     []string `mapstructure:"interfaces" yaml:"interfaces"`
+	Networks       []string `mapstructure:"networks" yaml:"networks"`
+	ConnectTimeout string   `mapstructure:"connectTimeout" yaml:"connectTimeout"`
+	Solicit        bool     `mapstructure:"solicit" yaml:"solicit"`
+	Selection      string   `mapstructure:"selection,omitempty" yaml:"selection,omitempty"`
+	// Output is the format the devices are listed in, or empty if a device
+	// is selected.
+	Output string `mapstructure:"output,omitempty" yaml:"output,omitempty"`
+}
+
+// plan returns what a scan with the options would do. It doesn't touch the
+// network, apart from looking up the local interfaces.
+func (o scanOptions) plan(ds deviceSelect, try bool, output string) (ScanPlan, error) {
+	interfaces := []string{"any"}
+	if o.iface != nil {
+		interfaces = []string{o.iface.Name}
+	} else if o.allInterfaces {
+		names, err := ipv4Interfaces()
+		if err != nil {
+			return ScanPlan{}, err
+		}
+		interfaces = names
+	}
+	return ScanPlan{
+		ScanParameters: o.parameters(ds, try),
+		Interfaces:     interfaces,
+		Networks:       o.udpNetworks(),
+		ConnectTimeout: o.connectTimeout.String(),
+		Solicit:        o.solicit,
+		Selection:      describeSelection(ds),
+		Output:         output,
+	}, nil
+}
+
+// describeSelection returns a readable form of a device selection given
+// on the command line.
+func describeSelection(ds deviceSelect) string {
+	switch s := ds.(type) {
+	case nil:
+		return ""
+	case deviceIDSelect:
+		return fmt.Sprintf("id '%s'", string(s))
+	case deviceNameSelect:
+		return fmt.Sprintf("name '%s'", string(s))
+	case *deviceNamePatternSelect:
+		return fmt.Sprintf("name pattern '%s'", s.pattern)
+	case deviceFingerprintSelect:
+		return fmt.Sprintf("fingerprint '%s'", string(s))
+	case deviceAddressSelect:
+		return fmt.Sprintf("address '%s'", string(s))
+	}
+	return fmt.Sprint(ds)
+}
+
+func printScanPlan(w io.Writer, plan ScanPlan) error {
+	return yaml.NewEncoder(w).Encode(plan)
+}
@@ -0,0 +1,194 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	// scanRangeConcurrency is the default number of hosts that are probed
+	// at the same time when scanning a range.
+	scanRangeConcurrency = 32
+	// maxScanRangeBits limits the size of the ranges we scan to a /16 for
+	// IPv4 networks.
+	maxScanRangeBits = 16
+)
+
+// errNotAttempted is passed to the skipped callback of scanAddresses for
+// the hosts that weren't asked before the scan ended.
+var errNotAttempted = errors.New("the scan ended before it was asked")
+
+// rangeHosts returns the addresses of the hosts in the network. For IPv4
+// networks the network and broadcast addresses are skipped.
+func rangeHosts(network *net.IPNet) ([]net.IP, error) {
+	ones, bits := network.Mask.Size()
+	if bits-ones > maxScanRangeBits {
+		return nil, fmt.Errorf("the range %s is too large to scan, it can have at most %d host bits", network, maxScanRangeBits)
+	}
+
+	base := network.IP.Mask(network.Mask)
+	count := 1 << uint(bits-ones)
+	var res []net.IP
+	for i := 0; i < count; i++ {
+		if bits == 8*net.IPv4len && count > 2 && (i == 0 || i == count-1) {
+			continue
+		}
+		ip := make(net.IP, len(base))
+		copy(ip, base)
+		// Add the host number to the base address.
+		carry := i
+		for j := len(ip) - 1; j >= 0 && carry > 0; j-- {
+			sum := int(ip[j]) + carry&0xff
+			ip[j] = byte(sum)
+			carry = carry>>8 + sum>>8
+		}
+		res = append(res, ip)
+	}
+	return res, nil
+}
+
+// scanRange asks every host in the network to identify itself using a
+// bounded number of workers. Hosts that don't respond in time are skipped.
+func scanRange(ctx context.Context, network *net.IPNet, opts scanOptions) ([]Device, error) {
+	ips, err := rangeHosts(network)
+	if err != nil {
+		return nil, err
+	}
+	var hosts []string
+	for _, ip := range ips {
+		hosts = append(hosts, ip.String())
+	}
+	return scanAddresses(ctx, hosts, opts, nil), nil
+}
+
+// readHostsFile returns the host names and addresses in the file, one per
+// line. Empty lines and lines starting with '#' are skipped.
+func readHostsFile(path string) ([]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var hosts []string
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hosts = append(hosts, line)
+	}
+	return hosts, nil
+}
+
+// scanHosts asks every host in the hosts file to identify itself, like
+// scanRange does for the hosts in a network. Hosts that can't be resolved
+// or don't respond are skipped, which is reported with --verbose.
+func scanHosts(ctx context.Context, path string, opts scanOptions) ([]Device, error) {
+	hosts, err := readHostsFile(path)
+	if err != nil {
+		return nil, err
+	}
+	log := getLogger(ctx)
+	return scanAddresses(ctx, hosts, opts, func(host string, err error) {
+		log.Debugf("Skipped '%s': %s", host, err)
+	}), nil
+}
+
+// scanAddressList asks the devices at the given addresses to identify
+// themselves. A failure doesn't stop the others from being asked; the
+// failures and the addresses that weren't asked before the scan ended are
+// reported once the scan is done.
+func scanAddressList(ctx context.Context, addresses []string, opts scanOptions) []Device {
+	var mutex sync.Mutex
+	failures := map[string]error{}
+	devices := scanAddresses(ctx, addresses, opts, func(address string, err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		failures[address] = err
+	})
+	for _, address := range addresses {
+		if err, ok := failures[address]; ok {
+			if errors.Is(err, errNotAttempted) {
+				getLogger(ctx).Warnf("Skipped '%s': %s", address, err)
+			} else {
+				getLogger(ctx).Warnf("No device answered on '%s': %s", address, err)
+			}
+		}
+	}
+	return devices
+}
+
+// identifyHost asks the device at the host to identify itself within the
+// connect timeout, or the probe timeout of the known device at the host.
+func identifyHost(ctx context.Context, host string, opts scanOptions) (*Device, error) {
+	url := opts.deviceURL(host)
+	if timeout := opts.identifyTimeout(ctx, url); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return opts.identify(ctx, url)
+}
+
+// scanAddresses asks the devices at the given addresses to identify
+// themselves using a bounded number of workers. Each of them is given at
+// most the connect timeout to answer. The failures are passed
+// to skipped, if it isn't nil, and so are the hosts that weren't asked
+// before the context was done, with errNotAttempted.
+func scanAddresses(ctx context.Context, hosts []string, opts scanOptions, skipped func(host string, err error)) []Device {
+	var mutex sync.Mutex
+	devices := map[string]Device{}
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for host := range jobs {
+				dev, err := identifyHost(ctx, host, opts)
+				if err != nil {
+					if skipped != nil {
+						skipped(host, err)
+					}
+					continue
+				}
+				mutex.Lock()
+				opts.addDevice(devices, *dev)
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	fed := 0
+feeding:
+	for _, host := range hosts {
+		select {
+		case jobs <- host:
+			fed++
+		case <-ctx.Done():
+			break feeding
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if skipped != nil {
+		for _, host := range hosts[fed:] {
+			skipped(host, errNotAttempted)
+		}
+	}
+
+	var res []Device
+	for _, d := range devices {
+		res = append(res, d)
+	}
+	sortDevices(res)
+	return res
+}
@@ -0,0 +1,733 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakePackets is a packet source whose sockets read the given packets, as
+// if they were broadcast by devices, and then wait for their deadline.
+type fakePackets struct {
+	packets [][]byte
+	source  net.Addr
+}
+
+func (f *fakePackets) ListenPacket(ctx context.Context, network string, address string) (net.PacketConn, error) {
+	if network != "udp4" {
+		return nil, fmt.Errorf("network %s isn't supported", network)
+	}
+	return &fakePacketConn{
+		packets: f.packets,
+		source:  f.source,
+		closed:  make(chan struct{}),
+	}, nil
+}
+
+type fakePacketConn struct {
+	mutex    sync.Mutex
+	packets  [][]byte
+	source   net.Addr
+	deadline time.Time
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func (c *fakePacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.mutex.Lock()
+	if len(c.packets) > 0 {
+		packet := c.packets[0]
+		c.packets = c.packets[1:]
+		c.mutex.Unlock()
+		return copy(p, packet), c.source, nil
+	}
+	deadline := c.deadline
+	c.mutex.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timeout = time.After(time.Until(deadline))
+	}
+	select {
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *fakePacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return len(p), nil
+}
+
+func (c *fakePacketConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *fakePacketConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4zero, Port: scanPort}
+}
+
+func (c *fakePacketConn) SetDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *fakePacketConn) SetReadDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+
+func (c *fakePacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// roundTripFunc is a transport that answers the requests with a function
+// instead of sending them.
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// respond returns a transport that answers all requests with the given
+// status and body.
+func respond(status int, body string) roundTripFunc {
+	return func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+			StatusCode: status,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    req,
+		}, nil
+	}
+}
+
+// identifyPacket returns the broadcast of a device with the given ID and
+// name.
+func identifyPacket(id string, name string) []byte {
+	return []byte(fmt.Sprintf(`{"method":"jaguar.identify","payload":{"id":"%s","name":"%s","address":"http://192.168.1.10:9000","chip":"esp32","sdkVersion":"v2.0.0-alpha.74"}}`, id, name))
+}
+
+// testScanOptions returns the options for a scan that only uses the given
+// packet source and transport.
+func testScanOptions(packets packetSource, transport http.RoundTripper) scanOptions {
+	return scanOptions{
+		timeout:        100 * time.Millisecond,
+		connectTimeout: 100 * time.Millisecond,
+		ports:          []uint{scanPort},
+		ipVersion:      ipVersion4,
+		dedupBy:        dedupByID,
+		sortBy:         sortByName,
+		bufferSize:     scanBufferSize,
+		identifyPath:   identifyPath,
+		identifyMethod: identifyMethod,
+		packets:        packets,
+		transport:      transport,
+	}
+}
+
+func deviceNames(devices []Device) string {
+	var names []string
+	for _, d := range devices {
+		names = append(names, d.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestParseDevice(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    string
+		wantErr bool
+	}{
+		{"device", string(identifyPacket("1", "sensor")), "sensor", false},
+		{"other method", `{"method":"jaguar.other","payload":{}}`, "", false},
+		{"empty payload", `{"method":"jaguar.identify","payload":{}}`, "", true},
+		{"missing name", `{"method":"jaguar.identify","payload":{"id":"1"}}`, "", true},
+		{"not json", `jaguar`, "", true},
+		{"empty", ``, "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d, err := parseDevice([]byte(test.data))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseDevice() error = %v, want error %v", err, test.wantErr)
+			}
+			name := ""
+			if d != nil {
+				name = d.Name
+			}
+			if name != test.want {
+				t.Errorf("parseDevice() = %q, want %q", name, test.want)
+			}
+		})
+	}
+}
+
+func TestParseDeviceTrailingBytes(t *testing.T) {
+	packet := string(identifyPacket("1", "sensor"))
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"clean", packet},
+		{"trailing NULs", packet + "\x00\x00\x00\x00"},
+		{"concatenated", packet + string(identifyPacket("2", "gateway"))},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d, err := parseDevice([]byte(test.data))
+			if err != nil {
+				t.Fatalf("parseDevice() error = %v", err)
+			}
+			if d == nil || d.ID != "1" || d.Name != "sensor" {
+				t.Errorf("parseDevice() = %+v, want the first device", d)
+			}
+		})
+	}
+}
+
+func TestParseDeviceLocalFields(t *testing.T) {
+	data := `{"method":"jaguar.identify","payload":{"id":"1","name":"sensor","address":"http://192.168.1.10:9000",` +
+		`"wordSize":4,"writable":false,` +
+		`"insecure":true,"scheme":"https","alias":"hall","health":"unhealthy","addresses":["http://10.0.0.1:9000"]}}`
+	d, err := parseDevice([]byte(data))
+	if err != nil {
+		t.Fatalf("parseDevice() error = %v", err)
+	}
+	if d.ID != "1" || d.Name != "sensor" || d.WordSize != 4 || d.Writable == nil || *d.Writable {
+		t.Errorf("parseDevice() = %+v, want the reported fields", d)
+	}
+	if d.Insecure || d.Scheme != "" || d.Alias != "" || d.Health != "" || len(d.Addresses) != 0 {
+		t.Errorf("parseDevice() = %+v, the packet set local fields", d)
+	}
+}
+
+func TestScanBroadcasts(t *testing.T) {
+	source := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: scanPort}
+	tests := []struct {
+		name      string
+		packets   [][]byte
+		want      string
+		malformed int
+	}{
+		{"empty", nil, "", 0},
+		{"single", [][]byte{identifyPacket("1", "sensor")}, "sensor", 0},
+		{"duplicate", [][]byte{identifyPacket("1", "sensor"), identifyPacket("1", "sensor")}, "sensor", 0},
+		{"sorted", [][]byte{identifyPacket("2", "gateway"), identifyPacket("1", "sensor")}, "gateway,sensor", 0},
+		{"malformed", [][]byte{[]byte(`{"method":`), identifyPacket("1", "sensor")}, "sensor", 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := testScanOptions(&fakePackets{packets: test.packets, source: source}, nil)
+			opts.report = &scanReport{}
+			ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+			defer cancel()
+			devices, err := scan(ctx, nil, opts)
+			if err != nil {
+				t.Fatalf("scan() error = %v", err)
+			}
+			if got := deviceNames(devices); got != test.want {
+				t.Errorf("scan() = %q, want %q", got, test.want)
+			}
+			if got := opts.report.stats().Malformed; got != test.malformed {
+				t.Errorf("malformed packets = %d, want %d", got, test.malformed)
+			}
+		})
+	}
+}
+
+func TestScanAddress(t *testing.T) {
+	tests := []struct {
+		name      string
+		transport roundTripFunc
+		want      string
+		wantErr   string
+	}{
+		{"device", respond(http.StatusOK, string(identifyPacket("1", "sensor"))), "sensor", ""},
+		{"unauthorized", respond(http.StatusUnauthorized, ""), "", "requires authentication"},
+		{"error", respond(http.StatusInternalServerError, ""), "", "non-OK"},
+		{"malformed", respond(http.StatusOK, `{"method":`), "", "failed to parse identify"},
+		{"unreachable", func(req *http.Request) (*http.Response, error) {
+			return nil, errors.New("connection refused")
+		}, "", "couldn't reach the device"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := testScanOptions(&fakePackets{}, test.transport)
+			devices, err := scan(context.Background(), deviceAddressSelect("192.168.1.10:9000"), opts)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("scan() error = %v, want an error with %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("scan() error = %v", err)
+			}
+			if got := deviceNames(devices); got != test.want {
+				t.Errorf("scan() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestScanAddressListDuration(t *testing.T) {
+	transport := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		time.Sleep(10 * time.Millisecond)
+		return respond(http.StatusOK, string(identifyPacket("1", "sensor")))(req)
+	})
+	opts := testScanOptions(&fakePackets{}, transport)
+	opts.addresses = []string{"192.168.1.10:9000"}
+	opts.concurrency = 1
+	opts.report = &scanReport{}
+	if _, err := scan(context.Background(), nil, opts); err != nil {
+		t.Fatalf("scan() error = %v", err)
+	}
+	if got := opts.report.stats().DurationMs; got < 10 {
+		t.Errorf("DurationMs = %v, want at least 10", got)
+	}
+}
+
+func TestScanAddressesSkipped(t *testing.T) {
+	opts := testScanOptions(&fakePackets{}, respond(http.StatusOK, string(identifyPacket("1", "sensor"))))
+	opts.concurrency = 1
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	hosts := []string{"192.168.1.10", "192.168.1.11", "192.168.1.12"}
+	skipped := map[string]error{}
+	scanAddresses(ctx, hosts, opts, func(host string, err error) {
+		skipped[host] = err
+	})
+	for _, host := range hosts {
+		if skipped[host] == nil {
+			t.Errorf("%s wasn't reported as skipped", host)
+		}
+	}
+}
+
+func TestDeviceSelection(t *testing.T) {
+	devices := []Device{
+		{ID: "8bfa6a6c-7a40-4f8e-9a43-3b0e8c7f6a10", Name: "sensor-01", Address: "http://192.168.1.10:9000"},
+		{ID: "1d1a6f7e-3c2b-4a5d-8e9f-0a1b2c3d4e5f", Name: "sensor-02", Address: "http://192.168.1.11:9000"},
+		{ID: "5e0c9b8a-7f6e-4d3c-2b1a-0f9e8d7c6b5a", Name: "gateway", Address: "http://192.168.1.12:9000"},
+	}
+	tests := []struct {
+		selection string
+		want      string
+	}{
+		{"gateway", "gateway"},
+		{"sensor", ""},
+		{"8bfa6a6c-7a40-4f8e-9a43-3b0e8c7f6a10", "sensor-01"},
+		{"192.168.1.11", "sensor-02"},
+		{"192.168.1.11:9000", "sensor-02"},
+		{"192.168.1.11:9001", ""},
+		{"sensor-*", "sensor-01,sensor-02"},
+		{"/^sensor-0[2-9]$/", "sensor-02"},
+		{"unknown", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.selection, func(t *testing.T) {
+			selection := parseDeviceSelection(test.selection)
+			var matching []Device
+			for _, d := range devices {
+				if selection.Match(d) {
+					matching = append(matching, d)
+				}
+			}
+			if got := deviceNames(matching); got != test.want {
+				t.Errorf("%s matches %q, want %q", selection, got, test.want)
+			}
+		})
+	}
+}
+
+func TestSelectDeviceCount(t *testing.T) {
+	sensor := Device{ID: "8bfa6a6c-7a40-4f8e-9a43-3b0e8c7f6a10", Name: "sensor", Address: "http://192.168.1.10:9000"}
+	gateway := Device{ID: "5e0c9b8a-7f6e-4d3c-2b1a-0f9e8d7c6b5a", Name: "gateway", Address: "http://192.168.1.12:9000"}
+	tests := []struct {
+		name         string
+		devices      []Device
+		lastDeviceID string
+		alwaysPrompt bool
+		want         string
+		wantAuto     bool
+		wantErr      error
+	}{
+		{"zero", nil, "", false, "", false, ErrNoDevicesFound},
+		{"one", []Device{sensor}, "", false, "sensor", false, nil},
+		// Without the shortcut for a single device, the last used device
+		// is picked instead.
+		{"one always prompting", []Device{sensor}, sensor.ID, true, "sensor", true, nil},
+		{"many", []Device{sensor, gateway}, gateway.ID, false, "gateway", true, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := scanOptions{
+				lastDeviceID: test.lastDeviceID,
+				useLast:      test.lastDeviceID != "",
+				alwaysPrompt: test.alwaysPrompt,
+			}
+			d, auto, err := selectDevice(context.Background(), test.devices, opts, nil, false)
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("selectDevice() error = %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("selectDevice() error = %v", err)
+			}
+			if d.Name != test.want || auto != test.wantAuto {
+				t.Errorf("selectDevice() = %q, %v, want %q, %v", d.Name, auto, test.want, test.wantAuto)
+			}
+		})
+	}
+}
+
+func TestAmbiguousSelection(t *testing.T) {
+	devices := []Device{
+		{ID: "8bfa6a6c-7a40-4f8e-9a43-3b0e8c7f6a10", Name: "sensor", Address: "http://192.168.1.10:9000"},
+		{ID: "5e0c9b8a-7f6e-4d3c-2b1a-0f9e8d7c6b5a", Name: "sensor", Address: "http://192.168.1.12:9000"},
+	}
+	for _, hasFirst := range []bool{false, true} {
+		_, _, err := selectDevice(context.Background(), devices, scanOptions{hasFirst: hasFirst}, deviceNameSelect("sensor"), true)
+		if !errors.Is(err, ErrAmbiguousSelection) {
+			t.Fatalf("selectDevice() error = %v, want %v", err, ErrAmbiguousSelection)
+		}
+		if got := strings.Contains(err.Error(), "--first"); got != hasFirst {
+			t.Errorf("selectDevice() error = %v, suggesting --first should be %v", err, hasFirst)
+		}
+	}
+}
+
+func TestScanJSONShapes(t *testing.T) {
+	list := Devices{Devices: []Device{{ID: "1", Name: "sensor", Address: "http://192.168.1.10:9000"}}}
+	opts := scanOptions{timeout: 600 * time.Millisecond, ports: []uint{scanPort}}
+	tests := []struct {
+		name  string
+		value interface{}
+		want  []string
+	}{
+		{"list", list, []string{"devices"}},
+		{"envelope", ScanEnvelope{
+			Version:   "v1.9.0",
+			Timestamp: time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC),
+			Scan:      opts.parameters(nil, false),
+			Devices:   list,
+		}, []string{"devices", "scan", "timestamp", "version"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := json.Marshal(test.value)
+			if err != nil {
+				t.Fatalf("Marshal() error = %v", err)
+			}
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal(data, &fields); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			var keys []string
+			for key := range fields {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			if got, want := strings.Join(keys, ","), strings.Join(test.want, ","); got != want {
+				t.Errorf("fields = %s, want %s", got, want)
+			}
+			// The devices are listed the same way in both shapes.
+			var devices Devices
+			if err := json.Unmarshal(data, &devices); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			if got := deviceNames(devices.Devices); got != "sensor" {
+				t.Errorf("devices = %q, want %q", got, "sensor")
+			}
+		})
+	}
+}
+
+func TestScanParameters(t *testing.T) {
+	_, network, _ := net.ParseCIDR("192.168.1.0/24")
+	base := scanOptions{
+		timeout:        600 * time.Millisecond,
+		connectTimeout: 2 * time.Second,
+		expectTimeout:  10 * time.Second,
+	}
+	tests := []struct {
+		name        string
+		change      func(o *scanOptions)
+		selection   deviceSelect
+		try         bool
+		wantMethod  string
+		wantTimeout string
+	}{
+		{"broadcast", func(o *scanOptions) {}, nil, false, "broadcast", "600ms"},
+		{"expect", func(o *scanOptions) { o.expect = 2 }, nil, false, "broadcast", "10s"},
+		{"address", func(o *scanOptions) {}, deviceAddressSelect("192.168.1.10"), false, "address", "2s"},
+		{"addresses", func(o *scanOptions) { o.addresses = []string{"192.168.1.10", "192.168.1.11"} }, nil, false, "addresses", "2s"},
+		{"range", func(o *scanOptions) { o.network = network }, nil, false, "range", "0s"},
+		{"range with --timeout", func(o *scanOptions) { o.network, o.sweepTimeout = network, 5*time.Second }, nil, false, "range", "5s"},
+		{"hosts", func(o *scanOptions) { o.hostsFile = "hosts" }, nil, false, "hosts", "0s"},
+		{"import", func(o *scanOptions) { o.importFile = "devices.json" }, nil, false, "import", "0s"},
+		{"try", func(o *scanOptions) {}, nil, true, "try", "0s"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := base
+			test.change(&opts)
+			p := opts.parameters(test.selection, test.try)
+			if p.Method != test.wantMethod || p.Timeout != test.wantTimeout {
+				t.Errorf("parameters() = %s %s, want %s %s", p.Method, p.Timeout, test.wantMethod, test.wantTimeout)
+			}
+			if !test.try && opts.importFile == "" && p.Timeout != opts.scanTimeout(test.selection).String() {
+				t.Errorf("parameters() timeout %s isn't the timeout of the scan %s", p.Timeout, opts.scanTimeout(test.selection))
+			}
+		})
+	}
+}
+
+func BenchmarkParseDevice(b *testing.B) {
+	packet := identifyPacket("8bfa6a6c-7a40-4f8e-9a43-3b0e8c7f6a10", "sensor")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := parseDevice(packet); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkReceive measures how fast the broadcasts of many devices are
+// read and parsed.
+func BenchmarkReceive(b *testing.B) {
+	packets := make([][]byte, b.N)
+	for i := range packets {
+		packets[i] = identifyPacket(fmt.Sprintf("%d", i), fmt.Sprintf("sensor-%d", i))
+	}
+	source := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: scanPort}
+	opts := testScanOptions(&fakePackets{packets: packets, source: source}, nil)
+	opts.report = &scanReport{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var found int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	err := receive(ctx, "udp4", scanPort, opts, func(d Device) {
+		if atomic.AddInt64(&found, 1) == int64(b.N) {
+			cancel()
+		}
+	})
+	b.StopTimer()
+	if err != nil {
+		b.Fatal(err)
+	}
+	if found != int64(b.N) {
+		b.Fatalf("found %d devices, want %d", found, b.N)
+	}
+}
+
+func TestStreamDevices(t *testing.T) {
+	source := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: scanPort}
+	packets := [][]byte{identifyPacket("1", "sensor"), identifyPacket("2", "gateway"), identifyPacket("1", "sensor")}
+	opts := testScanOptions(&fakePackets{packets: packets, source: source}, nil)
+	opts.exportFile = filepath.Join(t.TempDir(), "devices.json")
+	opts.expect = 2
+
+	var buf bytes.Buffer
+	aliases := map[string]string{"hall": "2"}
+	if err := streamDevices(context.Background(), opts, aliases, newNDJSONEncoder(&buf)); err != nil {
+		t.Fatalf("streamDevices() error = %v", err)
+	}
+	var streamed []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var d Device
+		if err := json.Unmarshal([]byte(line), &d); err != nil {
+			t.Fatalf("line %q isn't a device: %v", line, err)
+		}
+		streamed = append(streamed, d.Name+"/"+d.Alias)
+	}
+	if got, want := strings.Join(streamed, ","), "sensor/,gateway/hall"; got != want {
+		t.Errorf("streamed %s, want %s", got, want)
+	}
+
+	exported, err := readInventory(context.Background(), opts.exportFile)
+	if err != nil {
+		t.Fatalf("readInventory() error = %v", err)
+	}
+	if got, want := deviceNames(exported), "gateway,sensor"; got != want {
+		t.Errorf("exported %s, want %s", got, want)
+	}
+}
+
+func TestStreamDevicesWithSeeds(t *testing.T) {
+	// The seed file defaults to the one in the config directory, so the
+	// devices of a scan with the default flags are streamed.
+	opts, err := parseScanOptions(ScanCmd(), nil)
+	if err != nil {
+		t.Fatalf("parseScanOptions() error = %v", err)
+	}
+	if !opts.streams() {
+		t.Errorf("streams() = false with the default flags")
+	}
+
+	seedFile := filepath.Join(t.TempDir(), "seeds.yaml")
+	if err := os.WriteFile(seedFile, []byte(`["192.168.1.20:9000"]`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	cmd := ScanCmd()
+	cmd.Flags().Set("seed-file", seedFile)
+	cmd.Flags().Set("timeout", "200ms")
+	if opts, err = parseScanOptions(cmd, nil); err != nil {
+		t.Fatalf("parseScanOptions() error = %v", err)
+	}
+	if !opts.streams() {
+		t.Fatalf("streams() = false with --seed-file")
+	}
+	source := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: scanPort}
+	opts.packets = &fakePackets{packets: [][]byte{identifyPacket("1", "sensor")}, source: source}
+	opts.transport = respond(http.StatusOK, string(identifyPacket("2", "gateway")))
+	opts.cacheFile = ""
+
+	var buf bytes.Buffer
+	if err := streamDevices(context.Background(), opts, nil, newNDJSONEncoder(&buf)); err != nil {
+		t.Fatalf("streamDevices() error = %v", err)
+	}
+	var streamed []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var d Device
+		if err := json.Unmarshal([]byte(line), &d); err != nil {
+			t.Fatalf("line %q isn't a device: %v", line, err)
+		}
+		streamed = append(streamed, d.Name)
+	}
+	sort.Strings(streamed)
+	if got, want := strings.Join(streamed, ","), "gateway,sensor"; got != want {
+		t.Errorf("streamed %s, want %s", got, want)
+	}
+}
+
+func TestScanScheme(t *testing.T) {
+	source := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: scanPort}
+
+	// Broadcasts are reached on the address they announce.
+	opts := testScanOptions(&fakePackets{packets: [][]byte{identifyPacket("1", "sensor")}, source: source}, nil)
+	opts.scheme = schemeHTTPS
+	ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+	defer cancel()
+	devices, err := scan(ctx, nil, opts)
+	if err != nil {
+		t.Fatalf("scan() error = %v", err)
+	}
+	if len(devices) != 1 || devices[0].Address != "http://192.168.1.10:9000" || devices[0].Scheme != "" {
+		t.Errorf("broadcast device = %+v, want the announced address", devices)
+	}
+
+	// Given addresses are reached with the scheme.
+	var requested string
+	opts = testScanOptions(&fakePackets{}, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		requested = req.URL.String()
+		return respond(http.StatusOK, string(identifyPacket("1", "sensor")))(req)
+	}))
+	opts.scheme = schemeHTTPS
+	devices, err = scan(context.Background(), deviceAddressSelect("proxy.example.com:443"), opts)
+	if err != nil {
+		t.Fatalf("scan() error = %v", err)
+	}
+	if !strings.HasPrefix(requested, "https://proxy.example.com:443/") {
+		t.Errorf("requested %s, want the https address", requested)
+	}
+	if len(devices) != 1 || devices[0].Address != "https://proxy.example.com:443" || devices[0].Scheme != schemeHTTPS {
+		t.Errorf("addressed device = %+v, want the https address", devices)
+	}
+}
+
+func TestSourceURL(t *testing.T) {
+	source := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: scanPort}
+	tests := []struct {
+		address string
+		port    int
+		want    string
+	}{
+		{"http://10.0.0.5:9000", 0, "http://192.168.1.10:9000"},
+		{"http://10.0.0.5:9100", 9200, "http://192.168.1.10:9100"},
+		{"", 0, "http://192.168.1.10:9000"},
+		{"", 9200, "http://192.168.1.10:9200"},
+	}
+	for _, test := range tests {
+		if got := sourceURL(test.address, test.port, source); got != test.want {
+			t.Errorf("sourceURL(%q, %d) = %s, want %s", test.address, test.port, got, test.want)
+		}
+	}
+}
+
+func TestIdentifyTimeout(t *testing.T) {
+	slow := Device{ID: "8bfa6a6c-7a40-4f8e-9a43-3b0e8c7f6a10", Name: "slow", Address: "http://192.168.1.10:9000", probeTimeout: 5 * time.Second}
+	opts := scanOptions{connectTimeout: 2 * time.Second, known: []Device{slow}}
+	ctx := context.Background()
+	if got := opts.identifyTimeout(ctx, "http://192.168.1.10:9000"); got != 5*time.Second {
+		t.Errorf("identifyTimeout() of the known device = %s, want its probe timeout", got)
+	}
+	if got := opts.identifyTimeout(ctx, "http://192.168.1.11:9000"); got != 2*time.Second {
+		t.Errorf("identifyTimeout() of an unknown device = %s, want the connect timeout", got)
+	}
+	if got := opts.scanTimeout(deviceAddressSelect("192.168.1.10")); got != 5*time.Second {
+		t.Errorf("scanTimeout() of the known device = %s, want its probe timeout", got)
+	}
+	opts.addresses = []string{"192.168.1.11", "192.168.1.10"}
+	if got := opts.scanTimeout(nil); got != 5*time.Second {
+		t.Errorf("scanTimeout() of the addresses = %s, want the longest timeout", got)
+	}
+}
+
+func TestPinnedDevice(t *testing.T) {
+	tests := []struct {
+		name    string
+		filters []deviceSelect
+		want    string
+	}{
+		{"no filters", nil, "sensor"},
+		{"matching filter", []deviceSelect{deviceNameSelect("sensor")}, "sensor"},
+		{"other filter", []deviceSelect{deviceNameSelect("gateway")}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := testScanOptions(&fakePackets{}, respond(http.StatusOK, string(identifyPacket("1", "sensor"))))
+			opts.pinnedAddress = "192.168.1.10:9000"
+			opts.filters = test.filters
+			d, _, err := pinnedDevice(context.Background(), opts, nil)
+			if err != nil {
+				t.Fatalf("pinnedDevice() error = %v", err)
+			}
+			got := ""
+			if d != nil {
+				got = d.Name
+			}
+			if got != test.want {
+				t.Errorf("pinnedDevice() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
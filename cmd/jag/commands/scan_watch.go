@@ -0,0 +1,131 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	// scanWatchTTL is how long a device may go without announcing itself
+	// before it is shown as offline.
+	scanWatchTTL = 10 * time.Second
+
+	deviceEventOnline  = "online"
+	deviceEventOffline = "offline"
+	deviceEventRemoved = "removed"
+)
+
+// DeviceEvent is emitted in watch mode when a device appears, goes
+// offline, or is removed after being offline for a while.
+type DeviceEvent struct {
+	Event  string    `mapstructure:"event" yaml:"event" json:"event"`
+	Time   time.Time `mapstructure:"time" yaml:"time" json:"time"`
+	Device Device    `mapstructure:"device" yaml:"device" json:"device"`
+}
+
+type watchedDevice struct {
+	device   Device
+	lastSeen time.Time
+	offline  bool
+}
+
+// watchDevices listens for device announcements until the context is
+// cancelled and calls emit whenever a device changes state. Devices that
+// haven't announced themselves within the TTL go offline, and are removed
+// once they have been silent for twice the TTL.
+func watchDevices(ctx context.Context, opts scanOptions, ttl time.Duration, emit func(DeviceEvent) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	announcements, errs := scanStream(ctx, "", opts)
+
+	ticker := time.NewTicker(ttl / 4)
+	defer ticker.Stop()
+
+	watched := map[string]*watchedDevice{}
+	for {
+		select {
+		case d, ok := <-announcements:
+			if !ok {
+				if err := <-errs; err != nil && ctx.Err() == nil {
+					return err
+				}
+				return nil
+			}
+			if len(filterDevices([]Device{d}, opts.filters)) == 0 {
+				continue
+			}
+			now := time.Now()
+			key := opts.deviceKey(d)
+			w, ok := watched[key]
+			if !ok {
+				w = &watchedDevice{}
+				watched[key] = w
+			}
+			w.device = d
+			w.lastSeen = now
+			if !ok || w.offline {
+				w.offline = false
+				if err := emit(DeviceEvent{Event: deviceEventOnline, Time: now, Device: d}); err != nil {
+					return err
+				}
+			}
+
+		case now := <-ticker.C:
+			for key, w := range watched {
+				silent := now.Sub(w.lastSeen)
+				if !w.offline && silent > ttl {
+					w.offline = true
+					if err := emit(DeviceEvent{Event: deviceEventOffline, Time: now, Device: w.device}); err != nil {
+						return err
+					}
+				} else if w.offline && silent > 2*ttl {
+					delete(watched, key)
+					if err := emit(DeviceEvent{Event: deviceEventRemoved, Time: now, Device: w.device}); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+}
+
+// runScanWatch prints the device events as they happen. In json mode
+// every event is printed as a single line of JSON.
+func runScanWatch(ctx context.Context, w io.Writer, opts scanOptions, ttl time.Duration, output string) error {
+	if output != "json" && output != "short" {
+		return fmt.Errorf("--output flag '%s' is not supported with '--watch'. Must be either json or short.", output)
+	}
+
+	out := bufio.NewWriter(w)
+	onShutdown(out.Flush)
+	encoder := json.NewEncoder(out)
+
+	return watchDevices(ctx, opts, ttl, func(event DeviceEvent) error {
+		if opts.webhook != "" {
+			runInBackground(func() {
+				if err := postWebhook(context.Background(), opts.webhook, opts.webhookSecret, event); err != nil {
+					fmt.Fprintln(os.Stderr, "Failed to post device event to webhook:", err)
+				}
+			})
+		}
+
+		if output == "json" {
+			if err := encoder.Encode(event); err != nil {
+				return err
+			}
+		} else {
+			fmt.Fprintf(out, "%-8s %s\n", event.Event, event.Device)
+		}
+		return out.Flush()
+	})
+}
@@ -0,0 +1,252 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/toitlang/jaguar/cmd/jag/directory"
+)
+
+// activeSDKVersion returns the SDK version selected with 'jag sdk use', or
+// the version Jaguar was built with if none is selected.
+func activeSDKVersion(info Info) string {
+	if version := directory.GetActiveSDKVersion(); version != "" {
+		return version
+	}
+	return info.SDKVersion
+}
+
+func SdkCmd(info Info) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "sdk",
+		Short: "Manage the downloaded versions of the Toit SDK",
+		Long: "Manage the downloaded versions of the Toit SDK.\n" +
+			"Besides the SDK from 'jag setup', other versions can be downloaded with\n" +
+			"their firmware and kept in the Jaguar cache directory. The version\n" +
+			"selected with 'jag sdk use' is used by all other commands, so you can\n" +
+			"switch between versions without downloading them again.\n\n" +
+			"The Jaguar assets are always those of this version of Jaguar, so\n" +
+			"flashing with another SDK version requires a matching version of Jaguar.",
+	}
+
+	cmd.AddCommand(
+		SdkListCmd(info),
+		SdkDownloadCmd(info),
+		SdkUseCmd(info),
+		SdkPruneCmd(info),
+	)
+	return cmd
+}
+
+// downloadedSDKVersions returns the SDK versions downloaded with
+// 'jag sdk download'.
+func downloadedSDKVersions() ([]string, error) {
+	versionsPath, err := directory.GetSDKVersionsCachePath()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(versionsPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			res = append(res, entry.Name())
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// isSDKDownloaded returns true if all of the SDK of the given version was
+// downloaded. The empty version is the SDK from 'jag setup'.
+func isSDKDownloaded(version string) bool {
+	sdkPath, err := directory.GetSDKCachePathFor(version)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(filepath.Join(sdkPath, "JAGUAR"))
+	return err == nil
+}
+
+func SdkListCmd(info Info) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "list",
+		Short:        "List the downloaded SDK versions",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			versions, err := downloadedSDKVersions()
+			if err != nil {
+				return err
+			}
+			active := activeSDKVersion(info)
+
+			type row struct {
+				version string
+				status  []string
+			}
+			var rows []row
+			if isSDKDownloaded("") {
+				rows = append(rows, row{info.SDKVersion, []string{"setup"}})
+			}
+			for _, version := range versions {
+				if version == info.SDKVersion && isSDKDownloaded("") {
+					continue
+				}
+				r := row{version: version}
+				if !isSDKDownloaded(version) {
+					r.status = append(r.status, "incomplete")
+				}
+				rows = append(rows, r)
+			}
+			if len(rows) == 0 {
+				fmt.Println("No SDKs, use 'jag setup' or 'jag sdk download' to download one")
+				return nil
+			}
+
+			versionLength := len("VERSION")
+			for _, r := range rows {
+				versionLength = max(versionLength, len(r.version))
+			}
+			fmt.Println(padded("VERSION", versionLength) + "STATUS")
+			for _, r := range rows {
+				if r.version == active {
+					r.status = append([]string{"active"}, r.status...)
+				}
+				fmt.Println(padded(r.version, versionLength) + strings.Join(r.status, ", "))
+			}
+			return nil
+		},
+	}
+	return cmd
+}
+
+func SdkDownloadCmd(info Info) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "download <version>",
+		Short: "Download a version of the SDK and its firmware",
+		Long: "Download a version of the Toit SDK and its firmware into the Jaguar\n" +
+			"cache directory. Use 'jag sdk use' to switch to it.",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			version, err := parseSDKVersion(args[0])
+			if err != nil {
+				return err
+			}
+			if version == info.SDKVersion {
+				return fmt.Errorf("SDK %s is the one Jaguar %s uses by default, download it with 'jag setup'", version, info.Version)
+			}
+			if err := installSDK(cmd.Context(), info, version); err != nil {
+				return err
+			}
+			fmt.Printf("Successfully downloaded Toit SDK %s, use 'jag sdk use %s' to switch to it.\n", version, version)
+			return nil
+		},
+	}
+	return cmd
+}
+
+func SdkUseCmd(info Info) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "use <version>",
+		Short: "Select the SDK version used by the other commands",
+		Long: "Select the SDK version used by the other commands. The version must\n" +
+			"have been downloaded with 'jag sdk download', unless it is the one from\n" +
+			"'jag setup', which switches back to the default.",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			version, err := parseSDKVersion(args[0])
+			if err != nil {
+				return err
+			}
+			cfg, err := directory.GetUserConfig()
+			if err != nil {
+				return err
+			}
+
+			if version == info.SDKVersion {
+				if err := unsetConfig(cfg, directory.SDKVersionCfgKey); err != nil {
+					return err
+				}
+				fmt.Printf("Using Toit SDK %s from 'jag setup'\n", version)
+				return nil
+			}
+
+			if !isSDKDownloaded(version) {
+				return fmt.Errorf("SDK %s hasn't been downloaded, use 'jag sdk download %s' first", version, version)
+			}
+			cfg.Set(directory.SDKVersionCfgKey, version)
+			if err := directory.WriteConfig(cfg); err != nil {
+				return err
+			}
+			fmt.Printf("Using Toit SDK %s\n", version)
+			return nil
+		},
+	}
+	return cmd
+}
+
+func SdkPruneCmd(info Info) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "prune",
+		Short:        "Remove the downloaded SDK versions that aren't in use",
+		Long:         "Remove the SDK versions downloaded with 'jag sdk download', except for the active one.",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			versions, err := downloadedSDKVersions()
+			if err != nil {
+				return err
+			}
+			versionsPath, err := directory.GetSDKVersionsCachePath()
+			if err != nil {
+				return err
+			}
+
+			active := directory.GetActiveSDKVersion()
+			removed := 0
+			for _, version := range versions {
+				if version == active {
+					continue
+				}
+				if err := os.RemoveAll(filepath.Join(versionsPath, version)); err != nil {
+					return err
+				}
+				fmt.Printf("Removed Toit SDK %s\n", version)
+				removed++
+			}
+			if removed == 0 {
+				fmt.Println("No unused SDK versions to remove")
+			}
+			return nil
+		},
+	}
+	return cmd
+}
+
+// parseSDKVersion checks that the SDK version looks like 'v2.0.0-alpha.74',
+// as it is used in the download URLs and as a directory name.
+func parseSDKVersion(version string) (string, error) {
+	if !strings.HasPrefix(version, "v") {
+		version = "v" + version
+	}
+	if strings.ContainsAny(version, "/\\ ") || len(version) < 2 {
+		return "", fmt.Errorf("'%s' is not an SDK version like v2.0.0-alpha.74", version)
+	}
+	return version, nil
+}
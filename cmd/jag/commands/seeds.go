@@ -0,0 +1,109 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// seedProbeTimeout is how long we wait for a seeded address to respond.
+const seedProbeTimeout = 300 * time.Millisecond
+
+// maxSeeds is the number of addresses kept in the seed file. The addresses
+// of the devices that were seen most recently are kept.
+const maxSeeds = 64
+
+// readSeeds returns the addresses stored in the seed file. A missing seed
+// file has no addresses.
+func readSeeds(path string) ([]string, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var seeds []string
+	if err := yaml.Unmarshal(b, &seeds); err != nil {
+		return nil, err
+	}
+	return seeds, nil
+}
+
+// writeSeeds adds the addresses of the given devices to the seed file. The
+// addresses that are already in the file are kept, so a scan that missed
+// some of the devices doesn't make us forget them. If there are no
+// addresses at all, the file isn't written.
+func writeSeeds(path string, devices []Device) error {
+	seen := map[string]bool{}
+	var seeds []string
+	for _, d := range devices {
+		if d.Address == "" || seen[d.Address] {
+			continue
+		}
+		seen[d.Address] = true
+		seeds = append(seeds, d.Address)
+	}
+	sort.Strings(seeds)
+
+	existing, err := readSeeds(path)
+	if err != nil {
+		// A broken seed file is replaced.
+		existing = nil
+	}
+	for _, seed := range existing {
+		if !seen[seed] {
+			seen[seed] = true
+			seeds = append(seeds, seed)
+		}
+	}
+	if len(seeds) == 0 {
+		return nil
+	}
+	if len(seeds) > maxSeeds {
+		seeds = seeds[:maxSeeds]
+	}
+
+	b, err := yaml.Marshal(seeds)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0666)
+}
+
+// probeSeeds asks all the seeded addresses to identify themselves in
+// parallel. Addresses that don't respond in time are skipped.
+func probeSeeds(ctx context.Context, seeds []string, opts scanOptions) []Device {
+	ctx, cancel := context.WithTimeout(ctx, seedProbeTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var res []Device
+	for _, seed := range seeds {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			dev, err := opts.identify(ctx, opts.deviceURL(address))
+			if err != nil {
+				return
+			}
+			mutex.Lock()
+			res = append(res, *dev)
+			mutex.Unlock()
+		}(seed)
+	}
+	wg.Wait()
+	return res
+}
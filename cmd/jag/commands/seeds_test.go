@@ -0,0 +1,47 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteSeeds(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seeds.yaml")
+
+	// An empty scan doesn't create the file.
+	if err := writeSeeds(path, nil); err != nil {
+		t.Fatalf("writeSeeds() error = %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("writeSeeds() without devices wrote the seed file")
+	}
+
+	steps := []struct {
+		devices []Device
+		want    string
+	}{
+		{[]Device{{Address: "http://192.168.1.11:9000"}, {Address: "http://192.168.1.10:9000"}}, "http://192.168.1.10:9000,http://192.168.1.11:9000"},
+		// A scan that finds fewer devices keeps the other addresses.
+		{[]Device{{Address: "http://192.168.1.12:9000"}}, "http://192.168.1.12:9000,http://192.168.1.10:9000,http://192.168.1.11:9000"},
+		// An empty scan keeps all of them.
+		{nil, "http://192.168.1.12:9000,http://192.168.1.10:9000,http://192.168.1.11:9000"},
+	}
+	for i, step := range steps {
+		if err := writeSeeds(path, step.devices); err != nil {
+			t.Fatalf("writeSeeds() error = %v", err)
+		}
+		seeds, err := readSeeds(path)
+		if err != nil {
+			t.Fatalf("readSeeds() error = %v", err)
+		}
+		if got := strings.Join(seeds, ","); got != step.want {
+			t.Errorf("step %d: seeds = %s, want %s", i, got, step.want)
+		}
+	}
+}
@@ -75,36 +75,14 @@ func SetupCmd(info Info) *cobra.Command {
 				return nil
 			}
 
-			sdkPath, err := directory.GetSDKCachePath()
-			if err != nil {
-				return err
-			}
-			downloaderPath := filepath.Join(sdkPath, "JAGUAR")
-			os.Remove(downloaderPath)
-
-			if err := downloadSdk(ctx, info.SDKVersion); err != nil {
-				return err
-			}
-
-			if err := downloadAssets(ctx, info.Version); err != nil {
-				return err
-			}
-
-			if err := downloadFirmwareAll(ctx, info.SDKVersion); err != nil {
-				return err
-			}
-
-			downloaderBytes, err := json.Marshal(&info)
-			if err != nil {
-				return err
-			}
-
-			if err := os.WriteFile(downloaderPath, downloaderBytes, 0666); err != nil {
+			if err := installSDK(ctx, info, ""); err != nil {
 				return err
 			}
 
 			fmt.Printf("Successfully setup Jaguar %s with Toit SDK %s.\n", info.Version, info.SDKVersion)
-
+			if version := directory.GetActiveSDKVersion(); version != "" {
+				fmt.Printf("Note that Toit SDK %s is selected with 'jag sdk use'.\n", version)
+			}
 			return nil
 		},
 	}
@@ -132,12 +110,51 @@ func SetupSdkCmd(info Info) *cobra.Command {
 	return cmd
 }
 
-func downloadAssets(ctx context.Context, version string) error {
-	assetsPath, err := directory.GetAssetsCachePath()
+// installSDK downloads the Toit SDK, the Jaguar assets and the firmware
+// envelopes for the SDK version. The empty version is the SDK version
+// Jaguar was built with, which is installed where 'jag setup' puts it.
+// Other versions are installed next to it, for 'jag sdk use'.
+func installSDK(ctx context.Context, info Info, version string) error {
+	sdkVersion := version
+	if sdkVersion == "" {
+		sdkVersion = info.SDKVersion
+	}
+	sdkPath, err := directory.GetSDKCachePathFor(version)
+	if err != nil {
+		return err
+	}
+	assetsPath, err := directory.GetAssetsCachePathFor(version)
 	if err != nil {
 		return err
 	}
 
+	// The downloader info marks the SDK as complete, so it is removed
+	// until everything is in place.
+	downloaderPath := filepath.Join(sdkPath, "JAGUAR")
+	os.Remove(downloaderPath)
+
+	if err := downloadSdkTo(ctx, sdkVersion, sdkPath); err != nil {
+		return err
+	}
+
+	if err := downloadAssets(ctx, info.Version, assetsPath); err != nil {
+		return err
+	}
+
+	if err := downloadFirmwareAll(ctx, sdkVersion, assetsPath); err != nil {
+		return err
+	}
+
+	downloaderInfo := info
+	downloaderInfo.SDKVersion = sdkVersion
+	downloaderBytes, err := json.Marshal(&downloaderInfo)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(downloaderPath, downloaderBytes, 0666)
+}
+
+func downloadAssets(ctx context.Context, version string, assetsPath string) error {
 	assetsURL := getAssetsURL(version)
 	fmt.Printf("Downloading Jaguar assets from %s ...\n", assetsURL)
 	bundle, err := download(ctx, assetsURL)
@@ -168,22 +185,17 @@ func downloadAssets(ctx context.Context, version string) error {
 	return nil
 }
 
-func downloadFirmwareAll(ctx context.Context, version string) error {
+func downloadFirmwareAll(ctx context.Context, version string, assetsPath string) error {
 	models := directory.GetFirmwareModels()
 	for _, model := range models {
-		if err := downloadFirmware(ctx, version, model); err != nil {
+		if err := downloadFirmware(ctx, version, model, assetsPath); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func downloadFirmware(ctx context.Context, version string, model string) error {
-	assetsPath, err := directory.GetAssetsCachePath()
-	if err != nil {
-		return err
-	}
-
+func downloadFirmware(ctx context.Context, version string, model string, assetsPath string) error {
 	firmwareURL := getFirmwareURL(version, model)
 	fmt.Printf("Downloading %s firmware from %s ...\n", model, firmwareURL)
 	bundle, err := download(ctx, firmwareURL)
@@ -218,14 +230,6 @@ func downloadFirmware(ctx context.Context, version string, model string) error {
 	return nil
 }
 
-func downloadSdk(ctx context.Context, version string) error {
-	sdkPath, err := directory.GetSDKCachePath()
-	if err != nil {
-		return err
-	}
-	return downloadSdkTo(ctx, version, sdkPath)
-}
-
 func downloadSdkTo(ctx context.Context, version string, sdkPath string) error {
 	sdkURL, err := getToitSDKURL(version)
 	if err != nil {
@@ -0,0 +1,80 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The background work and the buffered writers that must be taken care of
+// before Jaguar exits, so we don't lose events when interrupted.
+var background struct {
+	sync.Mutex
+	wg       sync.WaitGroup
+	flushers []func() error
+	// closing is set once Shutdown waits for the work, after which no
+	// more work may be added to the wait group.
+	closing bool
+}
+
+// runInBackground runs fn in a new goroutine and makes Shutdown wait for
+// it to complete. Work that is started after Shutdown began isn't run, as
+// Jaguar is about to exit.
+func runInBackground(fn func()) {
+	background.Lock()
+	defer background.Unlock()
+	if background.closing {
+		return
+	}
+	background.wg.Add(1)
+	go func() {
+		defer background.wg.Done()
+		fn()
+	}()
+}
+
+// onShutdown registers a function that flushes buffered output when
+// Jaguar shuts down.
+func onShutdown(flush func() error) {
+	background.Lock()
+	defer background.Unlock()
+	background.flushers = append(background.flushers, flush)
+}
+
+// Shutdown waits for the background work to complete, but no longer than
+// the grace period, and then flushes all registered writers. It returns an
+// error if the work didn't complete or the output couldn't be flushed. It
+// is safe to call Shutdown more than once; the writers are only flushed
+// once.
+func Shutdown(grace time.Duration) error {
+	background.Lock()
+	background.closing = true
+	background.Unlock()
+
+	var err error
+	done := make(chan struct{})
+	go func() {
+		background.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(grace):
+		err = fmt.Errorf("timed out waiting for background work to complete")
+	}
+
+	background.Lock()
+	flushers := background.flushers
+	background.flushers = nil
+	background.Unlock()
+	for _, flush := range flushers {
+		if flushErr := flush(); flushErr != nil && err == nil {
+			err = fmt.Errorf("failed to flush output: %w", flushErr)
+		}
+	}
+	return err
+}
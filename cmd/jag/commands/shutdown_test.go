@@ -0,0 +1,39 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	defer func() {
+		background.Lock()
+		background.closing = false
+		background.Unlock()
+	}()
+
+	ran := make(chan struct{})
+	runInBackground(func() { close(ran) })
+	flushErr := errors.New("disk full")
+	onShutdown(func() error { return flushErr })
+	if err := Shutdown(time.Second); !errors.Is(err, flushErr) {
+		t.Errorf("Shutdown() error = %v, want %v", err, flushErr)
+	}
+	select {
+	case <-ran:
+	default:
+		t.Errorf("Shutdown() returned before the background work was done")
+	}
+
+	// Work started after the shutdown isn't run, and the writers are only
+	// flushed once.
+	runInBackground(func() { t.Errorf("work started after the shutdown was run") })
+	if err := Shutdown(time.Second); err != nil {
+		t.Errorf("second Shutdown() error = %v", err)
+	}
+}
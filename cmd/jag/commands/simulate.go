@@ -6,6 +6,7 @@ package commands
 
 import (
 	"bufio"
+	"fmt"
 	"io"
 	"os"
 	"strconv"
@@ -20,7 +21,10 @@ func SimulateCmd() *cobra.Command {
 		Use:   "simulate",
 		Short: "Start a simulated Jaguar device on your machine",
 		Long: "Start a simulated Jaguar device on your host machine. Useful for testing\n" +
-			"and for experimenting with the Jaguar-based workflows.",
+			"and for experimenting with the Jaguar-based workflows.\n" +
+			"The simulator announces itself and serves requests like a real device, so\n" +
+			"'jag scan', 'jag run' and 'jag container' work with it. In CI, give it a\n" +
+			"fixed '--port', '--name' and '--id' and select it with 'jag scan localhost:<port>'.",
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx := cmd.Context()
@@ -31,6 +35,16 @@ func SimulateCmd() *cobra.Command {
 			}
 
 			id := uuid.New()
+			if cmd.Flags().Changed("id") {
+				idFlag, err := cmd.Flags().GetString("id")
+				if err != nil {
+					return err
+				}
+				if id, err = uuid.Parse(idFlag); err != nil {
+					return fmt.Errorf("--id must be a UUID: %w", err)
+				}
+			}
+
 			var name string
 			if cmd.Flags().Changed("name") {
 				name, err = cmd.Flags().GetString("name")
@@ -65,10 +79,12 @@ func SimulateCmd() *cobra.Command {
 
 			// Goroutine that gets data from the pipe and converts it into
 			// lines.
+			decoded := make(chan struct{})
 			go func() {
+				defer close(decoded)
 				scanner := bufio.NewScanner(outReader)
 
-				decoder := Decoder{scanner, cmd}
+				decoder := Decoder{scanner, cmd, "esp32"}
 
 				decoder.decode(pretty, plain)
 			}()
@@ -76,12 +92,18 @@ func SimulateCmd() *cobra.Command {
 			simCmd := sdk.ToitRun(ctx, snapshot, strconv.Itoa(int(port)), id.String(), name)
 			simCmd.Stderr = os.Stderr
 			simCmd.Stdout = outWriter
-			return simCmd.Run()
+			err = simCmd.Run()
+			// Let the decoder print the last of the output before exiting,
+			// like the reason the simulator stopped.
+			outWriter.Close()
+			<-decoded
+			return err
 		},
 	}
 
 	cmd.Flags().UintP("port", "p", 0, "port to run the simulator on")
 	cmd.Flags().String("name", "", "name for the simulator, if not set a name will be auto generated")
+	cmd.Flags().String("id", "", "ID for the simulator, if not set a random ID is used")
 	cmd.Flags().BoolP("force-pretty", "r", false, "force output to use terminal graphics")
 	cmd.Flags().BoolP("force-plain", "l", false, "force output to use plain ASCII text")
 
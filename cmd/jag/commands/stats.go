@@ -0,0 +1,219 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/toitlang/jaguar/cmd/jag/directory"
+	"golang.org/x/term"
+)
+
+const (
+	statsInterval = 2 * time.Second
+	// clearScreen moves the cursor home and clears the terminal.
+	clearScreen = "\033[H\033[2J"
+)
+
+// DeviceMetrics is the health and resource usage a device reports on its
+// /metrics endpoint, see src/metrics.toit.
+type DeviceMetrics struct {
+	UptimeSeconds          int `mapstructure:"uptimeSeconds" yaml:"uptimeSeconds" json:"uptimeSeconds"`
+	SystemFreeMemory       int `mapstructure:"systemFreeMemory" yaml:"systemFreeMemory" json:"systemFreeMemory"`
+	SystemLargestFreeBlock int `mapstructure:"systemLargestFreeBlock" yaml:"systemLargestFreeBlock" json:"systemLargestFreeBlock"`
+	JaguarAllocatedMemory  int `mapstructure:"jaguarAllocatedMemory" yaml:"jaguarAllocatedMemory" json:"jaguarAllocatedMemory"`
+	JaguarReservedMemory   int `mapstructure:"jaguarReservedMemory" yaml:"jaguarReservedMemory" json:"jaguarReservedMemory"`
+	// FlashFree is the unallocated space in the flash registry in bytes. It
+	// is nil if the device can't read the registry.
+	FlashFree *int `mapstructure:"flashFree" yaml:"flashFree,omitempty" json:"flashFree,omitempty"`
+	// WifiRSSI is the signal strength of the WiFi network in dBm. It is nil
+	// if the device doesn't know it.
+	WifiRSSI   *int               `mapstructure:"wifiRssi" yaml:"wifiRssi,omitempty" json:"wifiRssi,omitempty"`
+	Containers []RunningContainer `mapstructure:"containers" yaml:"containers" json:"containers"`
+}
+
+// RunningContainer is a container started by Jaguar that is still running.
+// Programs started by 'jag run' have no name.
+type RunningContainer struct {
+	ID            string `mapstructure:"id" yaml:"id" json:"id"`
+	Name          string `mapstructure:"name" yaml:"name" json:"name"`
+	UptimeSeconds int    `mapstructure:"uptimeSeconds" yaml:"uptimeSeconds" json:"uptimeSeconds"`
+}
+
+// statsResult is the result of 'jag stats' printed with --output.
+type statsResult struct {
+	commandStatus `yaml:",inline"`
+	Device        *deviceResult  `mapstructure:"device" yaml:"device,omitempty" json:"device,omitempty"`
+	Time          string         `mapstructure:"time" yaml:"time,omitempty" json:"time,omitempty"`
+	Metrics       *DeviceMetrics `mapstructure:"metrics" yaml:"metrics,omitempty" json:"metrics,omitempty"`
+}
+
+func StatsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "stats [device]",
+		Short: "Show the health and resource usage of a Jaguar device",
+		Long: "Show the health and resource usage of a Jaguar device: its uptime, free\n" +
+			"memory and flash, the memory used by Jaguar, the WiFi signal strength and\n" +
+			"the running containers.\n" +
+			"With '--watch', the stats are refreshed until you press Ctrl-C. With\n" +
+			"'--output json', they are printed as a JSON object per line, so monitoring\n" +
+			"scripts can follow them.",
+		Args:         cobra.MaximumNArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			out, err := parseCommandOutput(cmd)
+			if err != nil {
+				return err
+			}
+
+			cfg, err := directory.GetDeviceConfig()
+			if err != nil {
+				return err
+			}
+
+			deviceSelect, err := parseDeviceFlag(cmd)
+			if err != nil {
+				return err
+			}
+			if len(args) == 1 {
+				if deviceSelect != nil {
+					return fmt.Errorf("a device argument and --device are exclusive")
+				}
+				deviceSelect = parseDeviceSelection(args[0])
+			}
+
+			watch, err := cmd.Flags().GetBool("watch")
+			if err != nil {
+				return err
+			}
+			if watch && out.format == "yaml" {
+				return fmt.Errorf("--watch only supports json and short output")
+			}
+
+			interval, err := cmd.Flags().GetDuration("interval")
+			if err != nil {
+				return err
+			}
+
+			timeout, err := cmd.Flags().GetDuration("timeout")
+			if err != nil {
+				return err
+			}
+
+			ctx := cmd.Context()
+			sdk, err := GetSDK(ctx)
+			if err != nil {
+				return err
+			}
+
+			device, err := GetDevice(ctx, cfg, sdk, true, deviceSelect)
+			if err != nil {
+				return out.print(&statsResult{}, err)
+			}
+
+			for {
+				result := &statsResult{Device: newDeviceResult(device)}
+				metricsCtx, cancel := context.WithTimeout(ctx, device.probeTimeoutFor(ctx, timeout))
+				result.Metrics, err = device.Metrics(metricsCtx, sdk)
+				cancel()
+				if ctx.Err() != nil {
+					return nil
+				}
+				result.Time = time.Now().Format(time.RFC3339)
+				if err != nil {
+					err = fmt.Errorf("couldn't get the stats of '%s': %w", device.Name, err)
+				}
+
+				if !watch {
+					if err == nil && !out.structured() {
+						printStats(out.stdout, device, result.Metrics)
+					}
+					return out.print(result, err)
+				}
+
+				// Failing to get the stats, for instance because the device
+				// restarts, isn't fatal while watching.
+				if out.structured() {
+					out.print(result, err)
+				} else {
+					if term.IsTerminal(int(os.Stdout.Fd())) {
+						fmt.Fprint(out.stdout, clearScreen)
+					}
+					fmt.Fprintf(out.stdout, "Every %s, press Ctrl-C to stop\t%s\n\n", interval, result.Time)
+					if err != nil {
+						fmt.Fprintln(out.stdout, err)
+					} else {
+						printStats(out.stdout, device, result.Metrics)
+					}
+				}
+
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-time.After(interval):
+				}
+			}
+		},
+	}
+
+	cmd.Flags().StringP("device", "d", "", "use device with a given name, id, or address")
+	cmd.Flags().BoolP("watch", "w", false, "refresh the stats until interrupted")
+	cmd.Flags().Duration("interval", statsInterval, "how often to refresh the stats with --watch")
+	cmd.Flags().DurationP("timeout", "t", connectTimeout, "how long to wait for the device to report its stats")
+	addOutputFlag(cmd)
+	return cmd
+}
+
+func printStats(w io.Writer, device *Device, m *DeviceMetrics) {
+	fmt.Fprintf(w, "Device:       %s\n", device.Summary())
+	fmt.Fprintf(w, "Uptime:       %s\n", time.Duration(m.UptimeSeconds)*time.Second)
+	fmt.Fprintf(w, "Free memory:  %s (largest block %s)\n", formatKB(m.SystemFreeMemory), formatKB(m.SystemLargestFreeBlock))
+	fmt.Fprintf(w, "Jaguar heap:  %s allocated, %s reserved\n", formatKB(m.JaguarAllocatedMemory), formatKB(m.JaguarReservedMemory))
+	if m.FlashFree != nil {
+		fmt.Fprintf(w, "Free flash:   %s\n", formatKB(*m.FlashFree))
+	} else {
+		fmt.Fprintln(w, "Free flash:   unknown")
+	}
+	if m.WifiRSSI != nil {
+		fmt.Fprintf(w, "WiFi RSSI:    %d dBm\n", *m.WifiRSSI)
+	} else {
+		fmt.Fprintln(w, "WiFi RSSI:    unknown")
+	}
+	fmt.Fprintf(w, "Containers:   %d running\n", len(m.Containers))
+	if len(m.Containers) == 0 {
+		return
+	}
+
+	nameLength := len("NAME")
+	idLength := len("IMAGE")
+	for _, c := range m.Containers {
+		nameLength = max(nameLength, len(containerLabel(c)))
+		idLength = max(idLength, len(c.ID))
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "  "+padded("NAME", nameLength)+padded("IMAGE", idLength)+"UPTIME")
+	for _, c := range m.Containers {
+		uptime := time.Duration(c.UptimeSeconds) * time.Second
+		fmt.Fprintln(w, "  "+padded(containerLabel(c), nameLength)+padded(c.ID, idLength)+uptime.String())
+	}
+}
+
+// containerLabel returns the name of the container, or '(program)' for
+// programs started by 'jag run'.
+func containerLabel(c RunningContainer) string {
+	if c.Name == "" {
+		return "(program)"
+	}
+	return c.Name
+}
+
+func formatKB(bytes int) string {
+	return fmt.Sprintf("%.1f KB", float64(bytes)/1024)
+}
@@ -9,20 +9,27 @@ import (
 	"bufio"
 	"compress/gzip"
 	"context"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
+	"text/template"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
 	"github.com/toitlang/jaguar/cmd/jag/directory"
 	"github.com/xtgo/uuid"
 	"golang.org/x/term"
@@ -53,6 +60,7 @@ func GetSDK(ctx context.Context) (*SDK, error) {
 		Version: version,
 	}
 	info := GetInfo(ctx)
+	info.SDKVersion = activeSDKVersion(info)
 	// If we're running a development build, we skip the SDK version checks
 	// if the SDK is pulled in through the JAG_TOIT_REPO_PATH environment
 	// variable. This make it much easier to work with. For release builds,
@@ -220,7 +228,7 @@ func (s *SDK) Compile(ctx context.Context, snapshot string, entrypoint string, o
 		buildSnap = s.ToitCompile(ctx, "-w", snapshot, entrypoint)
 	}
 	buildSnap.Stderr = os.Stderr
-	buildSnap.Stdout = os.Stdout
+	buildSnap.Stdout = getStdout(ctx)
 	if err := buildSnap.Run(); err != nil {
 		return err
 	}
@@ -250,7 +258,7 @@ func (s *SDK) Build(ctx context.Context, device *Device, snapshotPath string, as
 	}
 	buildImage := s.SnapshotToImage(ctx, arguments...)
 	buildImage.Stderr = os.Stderr
-	buildImage.Stdout = os.Stdout
+	buildImage.Stdout = getStdout(ctx)
 	if err := buildImage.Run(); err != nil {
 		return nil, err
 	}
@@ -397,7 +405,49 @@ func parseDefineFlags(cmd *cobra.Command, flagName string) (map[string]interface
 	return definesMap, nil
 }
 
-func parseOutputFlag(cmd *cobra.Command) (encoder, error) {
+// applyProjectConfig uses the project config (jaguar.yaml) to provide
+// defaults for the flags that weren't given on the command line. The flags
+// for a command are found under the command path, so the timeout used by
+// 'jag scan' is set through 'scan.timeout' and the port used by
+// 'jag container list' through 'container.list.port'.
+//
+// Explicitly given flags take precedence over the project config, which
+// takes precedence over the settings in the user and device configs.
+func applyProjectConfig(cmd *cobra.Command) error {
+	cfg, err := directory.GetProjectConfig()
+	if err != nil {
+		return err
+	}
+
+	prefix := strings.Join(strings.Fields(cmd.CommandPath())[1:], ".")
+	if prefix == "" {
+		return nil
+	}
+
+	var result error
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		key := prefix + "." + f.Name
+		if result != nil || f.Changed || !cfg.IsSet(key) {
+			return
+		}
+		values, ok := cfg.Get(key).([]interface{})
+		if !ok {
+			values = []interface{}{cfg.Get(key)}
+		}
+		for _, value := range values {
+			if err := cmd.Flags().Set(f.Name, fmt.Sprint(value)); err != nil {
+				result = fmt.Errorf("invalid value for '%s' in %s: %w", key, cfg.ConfigFileUsed(), err)
+				return
+			}
+		}
+	})
+	return result
+}
+
+// parseOutputFlag returns the encoder selected by the --output flag. If the
+// flag isn't given, the output format is taken from the key in the config.
+// The config may be nil.
+func parseOutputFlag(cmd *cobra.Command, cfg *viper.Viper, key string) (encoder, error) {
 	list, err := cmd.Flags().GetBool("list")
 	if err != nil {
 		return nil, err
@@ -405,21 +455,129 @@ func parseOutputFlag(cmd *cobra.Command) (encoder, error) {
 	if !list {
 		return nil, nil
 	}
-	output, err := cmd.Flags().GetString("output")
+	output, err := stringFlagOrConfig(cmd, "output", cfg, key)
 	if err != nil {
 		return nil, err
 	}
 
-	switch strings.ToLower(output) {
+	// The output goes to the writer of the command, which is stdout
+	// unless it is redirected.
+	return newOutputEncoder(cmd.OutOrStdout(), output)
+}
+
+// The output formats of the results of the commands and of the device
+// lists.
+var (
+	resultOutputFormats = []string{"json", "yaml", "short"}
+	deviceOutputFormats = []string{"json", "yaml", "ndjson", "geojson", "canonical", "terraform", "csv", "short"}
+)
+
+// parseOutputFormat returns the output format in lower case, or an error if
+// it isn't one of the formats.
+func parseOutputFormat(output string, formats []string) (string, error) {
+	output = strings.ToLower(output)
+	for _, f := range formats {
+		if output == f {
+			return output, nil
+		}
+	}
+	last := len(formats) - 1
+	return "", fmt.Errorf("'%s' was not recognized. Must be either %s or %s.", output, strings.Join(formats[:last], ", "), formats[last])
+}
+
+// parseOutputFormatFlag returns the format given with the --output flag.
+func parseOutputFormatFlag(cmd *cobra.Command, formats []string) (string, error) {
+	output, err := cmd.Flags().GetString("output")
+	if err != nil {
+		return "", err
+	}
+	output, err = parseOutputFormat(output, formats)
+	if err != nil {
+		return "", fmt.Errorf("--output flag %w", err)
+	}
+	return output, nil
+}
+
+// newOutputEncoder returns the encoder for the given output format that
+// writes to w.
+func newOutputEncoder(w io.Writer, output string) (encoder, error) {
+	output, err := parseOutputFormat(output, deviceOutputFormats)
+	if err != nil {
+		return nil, fmt.Errorf("--output flag %w", err)
+	}
+	switch output {
 	case "json":
-		return json.NewEncoder(os.Stdout), nil
+		return json.NewEncoder(w), nil
 	case "yaml":
-		return yaml.NewEncoder(os.Stdout), nil
+		return yaml.NewEncoder(w), nil
 	case "short":
-		return newShortEncoder(os.Stdout), nil
+		return newShortEncoder(w), nil
+	case "geojson":
+		return newGeoJSONEncoder(w), nil
+	case "canonical":
+		return newCanonicalEncoder(w), nil
+	case "terraform":
+		return newTerraformEncoder(w), nil
+	case "csv":
+		return newCSVEncoder(w), nil
 	default:
-		return nil, fmt.Errorf("--output flag '%s' was not recognized. Must be either json, yaml or short.", output)
+		return newNDJSONEncoder(w), nil
+	}
+}
+
+// outputFile is the writer for --output-file. The file is created when
+// the output is first written, so flags that turn out to be invalid don't
+// leave an empty or truncated file behind.
+type outputFile struct {
+	path string
+	f    *os.File
+}
+
+func (o *outputFile) Write(p []byte) (int, error) {
+	if o.f == nil {
+		f, err := os.Create(o.path)
+		if err != nil {
+			return 0, err
+		}
+		o.f = f
+	}
+	return o.f.Write(p)
+}
+
+// close closes the file. If nothing was written, the file is only created
+// if the command succeeded, so an empty result still replaces the file.
+func (o *outputFile) close(succeeded bool) error {
+	if o.f == nil {
+		if !succeeded {
+			return nil
+		}
+		if _, err := o.Write(nil); err != nil {
+			return err
+		}
+	}
+	return o.f.Close()
+}
+
+// stringFlagOrConfig returns the value of the flag if it is given on the
+// command line. Otherwise the value of the key in the config is used, or
+// the default of the flag if the key isn't set.
+func stringFlagOrConfig(cmd *cobra.Command, name string, cfg *viper.Viper, key string) (string, error) {
+	if !cmd.Flags().Changed(name) && cfg != nil && cfg.IsSet(key) {
+		return cfg.GetString(key), nil
+	}
+	return cmd.Flags().GetString(name)
+}
+
+// durationFlagOrConfig is like stringFlagOrConfig for duration flags.
+func durationFlagOrConfig(cmd *cobra.Command, name string, cfg *viper.Viper, key string) (time.Duration, error) {
+	if !cmd.Flags().Changed(name) && cfg != nil && cfg.IsSet(key) {
+		d, err := time.ParseDuration(cfg.GetString(key))
+		if err != nil {
+			return 0, fmt.Errorf("cannot parse %s ('%s') as a duration", key, cfg.GetString(key))
+		}
+		return d, nil
 	}
+	return cmd.Flags().GetDuration(name)
 }
 
 func parseDeviceFlag(cmd *cobra.Command) (deviceSelect, error) {
@@ -431,6 +589,9 @@ func parseDeviceFlag(cmd *cobra.Command) (deviceSelect, error) {
 	if err != nil {
 		return nil, err
 	}
+	if _, err := parseNamePattern(d); err != nil {
+		return nil, fmt.Errorf("--device '%s' is not a valid pattern: %w", d, err)
+	}
 	return parseDeviceSelection(d), nil
 }
 
@@ -438,9 +599,13 @@ func parseDeviceSelection(d string) deviceSelect {
 	if _, err := uuid.Parse(d); err == nil {
 		return deviceIDSelect(d)
 	}
-	if ip := net.ParseIP(d); ip != nil {
+	if ip := parseIPAddress(d); ip != nil {
 		return deviceAddressSelect(d)
 	}
+	// Names that aren't valid patterns are matched exactly.
+	if pattern, err := parseNamePattern(d); err == nil && pattern != nil {
+		return pattern
+	}
 	return deviceNameSelect(d)
 }
 
@@ -462,7 +627,16 @@ type Short interface {
 	Short() string
 }
 
+// Columns is implemented by values that show more than one column
+// per element in the short output.
+type Columns interface {
+	Columns() [][]string
+}
+
 func (s *shortEncoder) Encode(v interface{}) error {
+	if cs, ok := v.(Columns); ok {
+		return s.encodeColumns(cs.Columns())
+	}
 	es, ok := v.(Elements)
 	if !ok {
 		return fmt.Errorf("value type %T was not compatible with the Elements interface", v)
@@ -473,6 +647,393 @@ func (s *shortEncoder) Encode(v interface{}) error {
 	return nil
 }
 
+// encodeColumns prints the rows with the columns aligned. The last column
+// isn't padded.
+func (s *shortEncoder) encodeColumns(rows [][]string) error {
+	var lengths []int
+	for _, row := range rows {
+		for i, cell := range row {
+			if i == len(lengths) {
+				lengths = append(lengths, 0)
+			}
+			lengths[i] = max(lengths[i], len(cell))
+		}
+	}
+	for _, row := range rows {
+		line := ""
+		for i, cell := range row {
+			if i == len(row)-1 {
+				line += cell
+			} else {
+				line += padded(cell, lengths[i])
+			}
+		}
+		if _, err := fmt.Fprintln(s.w, strings.TrimRight(line, " ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// geoJSONEncoder encodes devices as a GeoJSON FeatureCollection with
+// one point feature per device. Devices that don't report their
+// location get a null geometry.
+type geoJSONEncoder struct {
+	w io.Writer
+}
+
+func newGeoJSONEncoder(w io.Writer) *geoJSONEncoder {
+	return &geoJSONEncoder{
+		w: w,
+	}
+}
+
+type geoJSONGeometry struct {
+	Type        string    `json:"type"`
+	Coordinates []float64 `json:"coordinates"`
+}
+
+type geoJSONFeature struct {
+	Type       string           `json:"type"`
+	Geometry   *geoJSONGeometry `json:"geometry"`
+	Properties Device           `json:"properties"`
+}
+
+type geoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+func (g *geoJSONEncoder) Encode(v interface{}) error {
+	devices, ok := v.(Devices)
+	if !ok {
+		return fmt.Errorf("value type %T can't be encoded as GeoJSON", v)
+	}
+	collection := geoJSONFeatureCollection{
+		Type:     "FeatureCollection",
+		Features: []geoJSONFeature{},
+	}
+	for _, d := range devices.Devices {
+		feature := geoJSONFeature{
+			Type:       "Feature",
+			Properties: d,
+		}
+		if d.HasLocation() {
+			// GeoJSON positions are given as longitude first.
+			feature.Geometry = &geoJSONGeometry{
+				Type:        "Point",
+				Coordinates: []float64{*d.Longitude, *d.Latitude},
+			}
+		}
+		collection.Features = append(collection.Features, feature)
+	}
+	return json.NewEncoder(g.w).Encode(collection)
+}
+
+// templateEncoder runs every device through a template and ends it with a
+// newline.
+type templateEncoder struct {
+	w    io.Writer
+	tmpl *template.Template
+}
+
+func newTemplateEncoder(w io.Writer, tmpl *template.Template) *templateEncoder {
+	return &templateEncoder{
+		w:    w,
+		tmpl: tmpl,
+	}
+}
+
+func (t *templateEncoder) Encode(v interface{}) error {
+	devices, ok := v.(Devices)
+	if !ok {
+		return fmt.Errorf("value type %T can't be encoded with a template", v)
+	}
+	for _, d := range devices.Devices {
+		if err := t.tmpl.Execute(t.w, d); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(t.w, "\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ndjsonEncoder encodes devices as newline-delimited JSON, with one device
+// per line. Other values are encoded on a single line.
+type ndjsonEncoder struct {
+	enc *json.Encoder
+}
+
+func newNDJSONEncoder(w io.Writer) *ndjsonEncoder {
+	return &ndjsonEncoder{
+		enc: json.NewEncoder(w),
+	}
+}
+
+func (n *ndjsonEncoder) Encode(v interface{}) error {
+	devices, ok := v.(Devices)
+	if !ok {
+		return n.enc.Encode(v)
+	}
+	for _, d := range devices.Devices {
+		if err := n.enc.Encode(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// csvEncoder encodes devices as CSV with a header row followed by one row
+// per device. The header is written even if there are no devices.
+type csvEncoder struct {
+	w io.Writer
+}
+
+func newCSVEncoder(w io.Writer) *csvEncoder {
+	return &csvEncoder{
+		w: w,
+	}
+}
+
+var csvDeviceHeader = []string{"id", "name", "chip", "address", "sdkVersion", "firmwareVersion", "wordSize", "latitude", "longitude", "writable"}
+
+func (c *csvEncoder) Encode(v interface{}) error {
+	devices, ok := v.(Devices)
+	if !ok {
+		return fmt.Errorf("value type %T can't be encoded as CSV", v)
+	}
+	optionalFloat := func(f *float64) string {
+		if f == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*f, 'f', -1, 64)
+	}
+	w := csv.NewWriter(c.w)
+	if err := w.Write(csvDeviceHeader); err != nil {
+		return err
+	}
+	for _, d := range devices.Devices {
+		row := []string{
+			d.ID,
+			d.Name,
+			d.Chip,
+			d.Address,
+			d.SDKVersion,
+			d.FirmwareVersion,
+			strconv.Itoa(d.WordSize),
+			optionalFloat(d.Latitude),
+			optionalFloat(d.Longitude),
+			strconv.FormatBool(d.IsWritable()),
+		}
+		if err := w.Write(row); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// terraformEncoder encodes devices as Terraform resource blocks, so a
+// scan can seed a device inventory. The resource names are derived from
+// the device names and made unique.
+type terraformEncoder struct {
+	w io.Writer
+}
+
+func newTerraformEncoder(w io.Writer) *terraformEncoder {
+	return &terraformEncoder{
+		w: w,
+	}
+}
+
+const terraformResourceType = "jaguar_device"
+
+func (t *terraformEncoder) Encode(v interface{}) error {
+	devices, ok := v.(Devices)
+	if !ok {
+		return fmt.Errorf("value type %T can't be encoded as Terraform resources", v)
+	}
+	used := map[string]bool{}
+	for i, d := range devices.Devices {
+		// The resources are keyed by the ID of the device, so renaming a
+		// device doesn't replace its resource. Devices that share an ID
+		// get a suffix.
+		name := terraformIdentifier("device_" + d.ID)
+		unique := name
+		for n := 2; used[unique]; n++ {
+			unique = fmt.Sprintf("%s_%d", name, n)
+		}
+		used[unique] = true
+
+		if i > 0 {
+			fmt.Fprintln(t.w)
+		}
+		fmt.Fprintf(t.w, "resource \"%s\" \"%s\" {\n", terraformResourceType, unique)
+		fmt.Fprintf(t.w, "  id      = %s\n", hclString(d.ID))
+		fmt.Fprintf(t.w, "  name    = %s\n", hclString(d.Name))
+		fmt.Fprintf(t.w, "  address = %s\n", hclString(d.Address))
+		fmt.Fprintf(t.w, "  chip    = %s\n", hclString(d.Chip))
+		if _, err := fmt.Fprintln(t.w, "}"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// terraformIdentifier turns a string into a valid HCL identifier.
+// Identifiers may contain letters, digits, underscores and dashes, and
+// must start with a letter or an underscore.
+func terraformIdentifier(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if r < 0x80 && (r == '_' || r == '-' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')) {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('_')
+		}
+	}
+	res := b.String()
+	if res == "" || !(res[0] == '_' || (res[0] >= 'a' && res[0] <= 'z') || (res[0] >= 'A' && res[0] <= 'Z')) {
+		res = "device_" + res
+	}
+	return res
+}
+
+// hclString quotes a string for HCL. Template sequences are escaped, so
+// the value is used literally.
+func hclString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i, r := range s {
+		switch {
+		case r == '"':
+			b.WriteString("\\\"")
+		case r == '\\':
+			b.WriteString("\\\\")
+		case r == '\n':
+			b.WriteString("\\n")
+		case r == '\r':
+			b.WriteString("\\r")
+		case r == '\t':
+			b.WriteString("\\t")
+		case (r == '$' || r == '%') && i+1 < len(s) && s[i+1] == '{':
+			b.WriteRune(r)
+			b.WriteRune(r)
+		case r < 0x20:
+			fmt.Fprintf(&b, "\\u%04x", r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// canonicalVolatileFields are the fields that change from run to run and
+// are dropped from the canonical output.
+var canonicalVolatileFields = map[string]bool{
+	"latencyMs": true,
+	"error":     true,
+}
+
+// canonicalEncoder encodes values as stable JSON that can be compared to
+// golden files: object keys are sorted, volatile fields are dropped,
+// lists of objects with an ID are sorted by ID, and addresses are
+// normalized to 'http://<host>:<port>'.
+type canonicalEncoder struct {
+	w io.Writer
+}
+
+func newCanonicalEncoder(w io.Writer) *canonicalEncoder {
+	return &canonicalEncoder{
+		w: w,
+	}
+}
+
+func (c *canonicalEncoder) Encode(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var generic interface{}
+	if err := json.Unmarshal(b, &generic); err != nil {
+		return err
+	}
+	// Maps are encoded with sorted keys.
+	b, err = json.MarshalIndent(canonicalize(generic), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(c.w, string(b))
+	return err
+}
+
+func canonicalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		res := map[string]interface{}{}
+		for key, value := range v {
+			if canonicalVolatileFields[key] {
+				continue
+			}
+			if address, ok := value.(string); ok && key == "address" {
+				res[key] = canonicalAddress(address)
+			} else if addresses, ok := value.([]interface{}); ok && key == "addresses" {
+				normalized := []string{}
+				for _, a := range addresses {
+					if address, ok := a.(string); ok {
+						normalized = append(normalized, canonicalAddress(address))
+					}
+				}
+				sort.Strings(normalized)
+				res[key] = normalized
+			} else {
+				res[key] = canonicalize(value)
+			}
+		}
+		return res
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, e := range v {
+			res[i] = canonicalize(e)
+		}
+		sort.SliceStable(res, func(i, j int) bool {
+			return canonicalID(res[i]) < canonicalID(res[j])
+		})
+		return res
+	default:
+		return v
+	}
+}
+
+func canonicalID(v interface{}) string {
+	if m, ok := v.(map[string]interface{}); ok {
+		if id, ok := m["id"].(string); ok {
+			return id
+		}
+	}
+	return ""
+}
+
+// canonicalAddress normalizes a device address to 'http://<host>:<port>'
+// with a lowercase host and an explicit port.
+func canonicalAddress(address string) string {
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil || u.Host == "" {
+		return address
+	}
+	port := u.Port()
+	if port == "" {
+		port = fmt.Sprint(scanHttpPort)
+	}
+	return strings.ToLower(u.Scheme) + "://" + net.JoinHostPort(strings.ToLower(u.Hostname()), port)
+}
+
 func getWifiCredentials(cmd *cobra.Command) (string, string, error) {
 	var wifiSSID string
 	var err error
@@ -530,6 +1091,24 @@ func getWifiCredentials(cmd *cobra.Command) (string, string, error) {
 	return wifiSSID, wifiPassword, nil
 }
 
+// openBrowser opens the URL in the default browser. It fails without
+// trying if there is no graphical environment to open a browser in.
+func openBrowser(url string) error {
+	var open *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		open = exec.Command("open", url)
+	case "windows":
+		open = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		if os.Getenv("DISPLAY") == "" && os.Getenv("WAYLAND_DISPLAY") == "" {
+			return fmt.Errorf("no graphical environment available")
+		}
+		open = exec.Command("xdg-open", url)
+	}
+	return open.Start()
+}
+
 // isLikelyRunningOnBuildbot returns true if the current process is running on a buildbot.
 // It uses some heuristics to determine this, and may not be 100% accurate.
 func isLikelyRunningOnBuildbot() bool {
@@ -546,3 +1125,28 @@ func isLikelyRunningOnBuildbot() bool {
 	}
 	return false
 }
+
+// readJSONMap reads the JSON object in the file at path into the map that
+// entries points to. A missing file leaves the map as it is.
+func readJSONMap(path string, entries interface{}) error {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, entries)
+}
+
+// writeJSONMap writes the map as a JSON object to the file at path. The
+// directory of the file is created if it doesn't exist.
+func writeJSONMap(path string, entries interface{}) error {
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0666)
+}
@@ -0,0 +1,133 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOutputEncoderWriter(t *testing.T) {
+	devices := Devices{Devices: []Device{
+		{ID: "8bfa6a6c-7a40-4f8e-9a43-3b0e8c7f6a10", Name: "sensor", Address: "http://192.168.1.10:9000"},
+	}}
+	for _, output := range []string{"json", "yaml", "ndjson", "csv", "geojson", "canonical", "terraform", "short", "JSON"} {
+		t.Run(output, func(t *testing.T) {
+			var buf bytes.Buffer
+			enc, err := newOutputEncoder(&buf, output)
+			if err != nil {
+				t.Fatalf("newOutputEncoder() error = %v", err)
+			}
+			if err := enc.Encode(devices); err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+			if !strings.Contains(buf.String(), "sensor") {
+				t.Errorf("output = %q, want the device in the writer", buf.String())
+			}
+		})
+	}
+	if _, err := newOutputEncoder(&bytes.Buffer{}, "xml"); err == nil {
+		t.Errorf("newOutputEncoder() with an unknown format didn't fail")
+	}
+}
+
+func TestParseOutputFormat(t *testing.T) {
+	if got, err := parseOutputFormat("YAML", resultOutputFormats); err != nil || got != "yaml" {
+		t.Errorf("parseOutputFormat(YAML) = %q, %v, want yaml", got, err)
+	}
+	_, err := parseOutputFormat("csv", resultOutputFormats)
+	want := "'csv' was not recognized. Must be either json, yaml or short."
+	if err == nil || err.Error() != want {
+		t.Errorf("parseOutputFormat(csv) error = %v, want %q", err, want)
+	}
+	if _, err := parseOutputFormat("csv", deviceOutputFormats); err != nil {
+		t.Errorf("parseOutputFormat(csv) error = %v, want a device output format", err)
+	}
+}
+
+func TestOutputFile(t *testing.T) {
+	tests := []struct {
+		name      string
+		write     string
+		succeeded bool
+		want      string
+		exists    bool
+	}{
+		{"written", "sensor\n", true, "sensor\n", true},
+		{"empty result", "", true, "", true},
+		{"failed", "", false, "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "devices.txt")
+			out := &outputFile{path: path}
+			if test.write != "" {
+				if _, err := out.Write([]byte(test.write)); err != nil {
+					t.Fatalf("Write() error = %v", err)
+				}
+			}
+			if err := out.close(test.succeeded); err != nil {
+				t.Fatalf("close() error = %v", err)
+			}
+			data, err := os.ReadFile(path)
+			if !test.exists {
+				if !os.IsNotExist(err) {
+					t.Fatalf("the file exists after a failure: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReadFile() error = %v", err)
+			}
+			if string(data) != test.want {
+				t.Errorf("file = %q, want %q", data, test.want)
+			}
+		})
+	}
+}
+
+func TestTerraformEncoder(t *testing.T) {
+	devices := Devices{Devices: []Device{
+		{ID: "8bfa6a6c-7a40-4f8e-9a43-3b0e8c7f6a10", Name: "sensor", Address: "http://192.168.1.10:9000"},
+		{ID: "8bfa6a6c-7a40-4f8e-9a43-3b0e8c7f6a10", Name: "sensor.old", Address: "http://192.168.1.11:9000"},
+		{ID: "5e0c9b8a-7f6e-4d3c-2b1a-0f9e8d7c6b5a", Name: "sensor", Address: "http://192.168.1.12:9000"},
+	}}
+	var buf bytes.Buffer
+	if err := newTerraformEncoder(&buf).Encode(devices); err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	for _, want := range []string{
+		`resource "jaguar_device" "device_8bfa6a6c-7a40-4f8e-9a43-3b0e8c7f6a10" {`,
+		`resource "jaguar_device" "device_8bfa6a6c-7a40-4f8e-9a43-3b0e8c7f6a10_2" {`,
+		`resource "jaguar_device" "device_5e0c9b8a-7f6e-4d3c-2b1a-0f9e8d7c6b5a" {`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("output = %s, want %s", buf.String(), want)
+		}
+	}
+}
+
+func TestJSONMap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache", "health.json")
+	entries := map[string]deviceHealth{}
+	if err := readJSONMap(path, &entries); err != nil || len(entries) != 0 {
+		t.Fatalf("readJSONMap() of a missing file = %v, %v, want an empty map", entries, err)
+	}
+	if err := writeJSONMap(path, map[string]deviceHealth{"1": {Failures: 2}}); err != nil {
+		t.Fatalf("writeJSONMap() error = %v", err)
+	}
+	if err := readJSONMap(path, &entries); err != nil || entries["1"].Failures != 2 {
+		t.Errorf("readJSONMap() = %v, %v, want the written map", entries, err)
+	}
+	if err := os.WriteFile(path, []byte("{"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := readJSONMap(path, &map[string]deviceHealth{}); err == nil {
+		t.Errorf("readJSONMap() of a broken file didn't fail")
+	}
+}
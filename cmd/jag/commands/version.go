@@ -23,7 +23,7 @@ func VersionCmd(info Info, isReleaseBuild bool) *cobra.Command {
 
 			if isReleaseBuild {
 				version = info.Version
-				sdkVersion = info.SDKVersion
+				sdkVersion = activeSDKVersion(info)
 			} else {
 				ctx := cmd.Context()
 				sdk, _ := GetSDK(ctx)
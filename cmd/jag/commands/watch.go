@@ -121,7 +121,19 @@ func (w *watcher) Errors() chan error {
 	return w.watcher.Errors
 }
 
+// Forget drops a path that is no longer watched, because the file was
+// removed or renamed. Editors that save by replacing the file do that, and
+// the next call to Watch adds the new file again.
+func (w *watcher) Forget(path string) {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+	w.watcher.Remove(path)
+	delete(w.paths, path)
+}
+
 func (w *watcher) CountPaths() int {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
 	return len(w.paths)
 }
 
@@ -132,23 +144,24 @@ func (w *watcher) Watch(paths ...string) (err error) {
 		}
 	}
 
+	// Forget is called from the event loop, so the paths are only used
+	// while holding the lock.
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+
 	candidates := map[string]struct{}{}
 	for _, p := range paths {
 		if _, ok := w.paths[p]; !ok {
-			w.Mutex.Lock()
 			w.watcher.Add(p)
 			w.paths[p] = struct{}{}
-			w.Mutex.Unlock()
 		}
 		candidates[p] = struct{}{}
 	}
 
 	for p := range w.paths {
 		if _, ok := candidates[p]; !ok {
-			w.Mutex.Lock()
 			w.watcher.Remove(p)
 			delete(w.paths, p)
-			w.Mutex.Unlock()
 		}
 	}
 	return nil
@@ -230,14 +243,17 @@ func onWatchChanges(
 				if !ok {
 					return
 				}
-				if event.Op&fsnotify.Write == fsnotify.Write {
+				if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+					watcher.Forget(event.Name)
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0 {
 					if !fired {
 						fmt.Printf("File modified '%s'\n", event.Name)
 						previousCancel()
 						var innerCtx context.Context
 						innerCtx, previousCancel = context.WithCancel(ctx)
 						go updateWatcher(innerCtx)
-						go runOnDevice(innerCtx)
+						runInBackground(func() { runOnDevice(innerCtx) })
 						fired = true
 						ticker.Reset(ticketDuration)
 					}
@@ -0,0 +1,84 @@
+// Copyright (C) 2023 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	// JaguarSignatureHeader holds the hex encoded HMAC-SHA256 of the
+	// webhook request body, keyed with the webhook secret.
+	JaguarSignatureHeader = "X-Jaguar-Signature"
+
+	webhookAttempts     = 4
+	webhookInitialDelay = 250 * time.Millisecond
+	webhookTimeout      = 5 * time.Second
+)
+
+// postWebhook posts the payload as JSON to the given URL. Failed attempts
+// are retried with an exponential backoff. If a secret is given, the request
+// is signed so the receiver can verify it came from us.
+func postWebhook(ctx context.Context, url string, secret string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	var signature string
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		signature = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	delay := webhookInitialDelay
+	for attempt := 1; ; attempt++ {
+		err = postWebhookOnce(ctx, url, signature, body)
+		if err == nil || attempt == webhookAttempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func postWebhookOnce(ctx context.Context, url string, signature string, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "jaguar-cli")
+	if signature != "" {
+		req.Header.Set(JaguarSignatureHeader, signature)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	io.ReadAll(res.Body) // Avoid closing connection prematurely.
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("got non-OK from webhook: %s", res.Status)
+	}
+	return nil
+}
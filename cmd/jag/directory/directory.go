@@ -19,7 +19,15 @@ const (
 	UserConfigPathEnv    = "JAG_USER_CONFIG_PATH"
 	DeviceConfigPathEnv  = "JAG_DEVICE_CONFIG_PATH"
 	SnapshotCachePathEnv = "JAG_SNAPSHOT_CACHE_PATH"
+	// ScanCachePathEnv and DeviceHealthPathEnv if set, will store the
+	// results of the recent scans and the health of the devices at those
+	// paths.
+	ScanCachePathEnv    = "JAG_SCAN_CACHE_PATH"
+	DeviceHealthPathEnv = "JAG_DEVICE_HEALTH_PATH"
+	// ProjectConfigPathEnv if set, will load the project config from that path.
+	ProjectConfigPathEnv = "JAG_PROJECT_CONFIG_PATH"
 	configFile           = ".jaguar"
+	projectConfigFile    = "jaguar.yaml"
 
 	// ToitPathEnv: Path to the Toit SDK build.
 	ToitRepoPathEnv = "JAG_TOIT_REPO_PATH"
@@ -27,6 +35,10 @@ const (
 	WifiSSIDEnv = "JAG_WIFI_SSID"
 	// WifiPasswordEnv if set will use this wifi password.
 	WifiPasswordEnv = "JAG_WIFI_PASSWORD"
+
+	// SDKVersionCfgKey is the user config key of the SDK version selected
+	// with 'jag sdk use'. If it isn't set, the SDK from 'jag setup' is used.
+	SDKVersionCfgKey = "sdk.version"
 )
 
 // Hackishly set by main.go.
@@ -66,6 +78,65 @@ func GetDeviceConfigPath() (string, error) {
 	return filepath.Join(homedir, ".config", "jaguar", "device.yaml"), nil
 }
 
+// GetSeedFilePath returns the path of the seed file with the last-known
+// device addresses.
+func GetSeedFilePath() (string, error) {
+	homedir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homedir, ".config", "jaguar", "seeds.yaml"), nil
+}
+
+// GetScanCachePath returns the path of the file with the results of the
+// recent scans.
+func GetScanCachePath() (string, error) {
+	return getCacheFilePath(ScanCachePathEnv, "scan-cache.json")
+}
+
+// GetDeviceHealthPath returns the path of the file with the recent
+// connection failures of the devices.
+func GetDeviceHealthPath() (string, error) {
+	return getCacheFilePath(DeviceHealthPathEnv, "device-health.json")
+}
+
+// getCacheFilePath returns the path given with the environment variable, or
+// the path of the file with the given name in the Jaguar cache directory.
+func getCacheFilePath(env string, name string) (string, error) {
+	if path, ok := os.LookupEnv(env); ok {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".cache", "jaguar", name), nil
+}
+
+// GetProjectConfigPath finds the project config by walking up from the
+// current working directory. It returns false if there is no project config.
+func GetProjectConfigPath() (string, bool, error) {
+	if path, ok := os.LookupEnv(ProjectConfigPathEnv); ok {
+		return path, true, nil
+	}
+
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", false, err
+	}
+	for {
+		path := filepath.Join(dir, projectConfigFile)
+		if stat, err := os.Stat(path); err == nil && !stat.IsDir() {
+			return path, true, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false, nil
+		}
+		dir = parent
+	}
+}
+
 func GetSnapshotsCachePath() (string, error) {
 	path, ok := os.LookupEnv(SnapshotCachePathEnv)
 	if ok {
@@ -80,6 +151,19 @@ func GetSnapshotsCachePath() (string, error) {
 	return ensureDirectory(filepath.Join(home, ".cache", "jaguar", "snapshots"), nil)
 }
 
+// GetFirmwareBaselinesCachePath returns the directory with the firmware
+// last installed on each device by 'jag firmware update'. They are the
+// baselines for the next update by patch.
+func GetFirmwareBaselinesCachePath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	// The firmware of a device contains its WiFi password and its
+	// secret, so only the user can read it.
+	return ensurePrivateDirectory(filepath.Join(home, ".cache", "jaguar", "firmware"), nil)
+}
+
 func getRepoPath() (string, bool) {
 	if IsReleaseBuild {
 		return "", false
@@ -97,12 +181,56 @@ func GetSDKPath() (string, error) {
 		return "", err
 	}
 	if stat, err := os.Stat(sdkCachePath); err != nil || !stat.IsDir() {
-		return "", fmt.Errorf("the path '%s' did not hold the SDK.\nYou must setup the SDK using 'jag setup'", sdkCachePath)
+		return "", fmt.Errorf("the path '%s' did not hold the SDK.\nYou must setup the SDK using %s", sdkCachePath, setupCommand())
 	}
 	return sdkCachePath, nil
 }
 
+// GetActiveSDKVersion returns the SDK version selected with 'jag sdk use',
+// or the empty string if the SDK from 'jag setup' is used.
+func GetActiveSDKVersion() string {
+	cfg, err := GetUserConfig()
+	if err != nil {
+		return ""
+	}
+	return cfg.GetString(SDKVersionCfgKey)
+}
+
+// setupCommand returns the command that downloads the active SDK version,
+// for the errors about missing files.
+func setupCommand() string {
+	if version := GetActiveSDKVersion(); version != "" {
+		return fmt.Sprintf("'jag sdk download %s'", version)
+	}
+	return "'jag setup'"
+}
+
+// GetSDKVersionsCachePath returns the directory with the SDK versions
+// downloaded by 'jag sdk download', each in its own subdirectory.
+func GetSDKVersionsCachePath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".cache", "jaguar", "sdks"), nil
+}
+
+// GetSDKCachePath returns the path of the SDK of the active SDK version.
 func GetSDKCachePath() (string, error) {
+	return GetSDKCachePathFor(GetActiveSDKVersion())
+}
+
+// GetSDKCachePathFor returns the path of the SDK of the given version, as
+// downloaded by 'jag sdk download'. The empty version is the SDK from
+// 'jag setup'.
+func GetSDKCachePathFor(version string) (string, error) {
+	if version != "" {
+		versions, err := GetSDKVersionsCachePath()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(versions, version, "sdk"), nil
+	}
 	home, err := os.UserHomeDir()
 	if err != nil {
 		return "", err
@@ -110,7 +238,23 @@ func GetSDKCachePath() (string, error) {
 	return filepath.Join(home, ".cache", "jaguar", "sdk"), nil
 }
 
+// GetAssetsCachePath returns the path of the Jaguar assets and firmware
+// envelopes of the active SDK version.
 func GetAssetsCachePath() (string, error) {
+	return GetAssetsCachePathFor(GetActiveSDKVersion())
+}
+
+// GetAssetsCachePathFor returns the path of the Jaguar assets and firmware
+// envelopes for the given SDK version. Like for GetSDKCachePathFor, the
+// empty version is the one from 'jag setup'.
+func GetAssetsCachePathFor(version string) (string, error) {
+	if version != "" {
+		versions, err := GetSDKVersionsCachePath()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(versions, version, "assets"), nil
+	}
 	home, err := os.UserHomeDir()
 	if err != nil {
 		return "", err
@@ -136,7 +280,7 @@ func GetAssetsPath() (string, error) {
 		return "", err
 	}
 	if stat, err := os.Stat(assetsPath); err != nil || !stat.IsDir() {
-		return "", fmt.Errorf("the path '%s' does not hold the Jaguar assets.\nYou must setup the assets using 'jag setup'", assetsPath)
+		return "", fmt.Errorf("the path '%s' does not hold the Jaguar assets.\nYou must setup the assets using %s", assetsPath, setupCommand())
 	}
 	return assetsPath, nil
 }
@@ -149,7 +293,7 @@ func getAssetPath(name string) (string, error) {
 
 	path := filepath.Join(assetsPath, name)
 	if stat, err := os.Stat(path); err != nil || stat.IsDir() {
-		return "", fmt.Errorf("the path '%s' does not hold the asset '%s'.\nYou must setup the Jaguar assets using 'jag setup'", assetsPath, name)
+		return "", fmt.Errorf("the path '%s' does not hold the asset '%s'.\nYou must setup the Jaguar assets using %s", assetsPath, name, setupCommand())
 	}
 	return path, nil
 }
@@ -183,7 +327,7 @@ func GetEsptoolPath() (string, error) {
 	esptoolPath := filepath.Join(sdkCachePath, "tools", Executable("esptool"))
 
 	if stat, err := os.Stat(esptoolPath); err != nil || stat.IsDir() {
-		return "", fmt.Errorf("the path '%s' did not hold the esptool.\nYou must setup the SDK using 'jag setup'", esptoolPath)
+		return "", fmt.Errorf("the path '%s' did not hold the esptool.\nYou must setup the SDK using %s", esptoolPath, setupCommand())
 	}
 	return esptoolPath, nil
 }
@@ -195,6 +339,18 @@ func ensureDirectory(dir string, err error) (string, error) {
 	return dir, os.MkdirAll(dir, 0755)
 }
 
+// ensurePrivateDirectory is like ensureDirectory, but the directory can
+// only be accessed by the user, also if it already existed.
+func ensurePrivateDirectory(dir string, err error) (string, error) {
+	if err != nil {
+		return dir, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return dir, err
+	}
+	return dir, os.Chmod(dir, 0700)
+}
+
 func GetUserConfig() (*viper.Viper, error) {
 	path, err := GetUserConfigPath()
 	if err != nil {
@@ -229,6 +385,26 @@ func GetDeviceConfig() (*viper.Viper, error) {
 	return cfg, nil
 }
 
+// GetProjectConfig returns the project config. If there is no project
+// config, the returned config is empty.
+func GetProjectConfig() (*viper.Viper, error) {
+	path, ok, err := GetProjectConfigPath()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get project config path: %w", err)
+	}
+
+	cfg := viper.New()
+	cfg.SetConfigType("yaml")
+	if !ok {
+		return cfg, nil
+	}
+	cfg.SetConfigFile(path)
+	if err := cfg.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("failed to read project config: %w", err)
+	}
+	return cfg, nil
+}
+
 func WriteConfig(cfg *viper.Viper) error {
 	file := cfg.ConfigFileUsed()
 	dir := filepath.Dir(file)
@@ -6,8 +6,14 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/spf13/cobra"
 	"github.com/toitlang/jaguar/cmd/jag/commands"
 	"github.com/toitlang/jaguar/cmd/jag/directory"
 )
@@ -20,6 +26,10 @@ var (
 var buildDate = "unknown"
 var buildMode = "development"
 
+// shutdownGracePeriod is how long we wait for commands to finish their
+// work and flush their output after being interrupted.
+const shutdownGracePeriod = 3 * time.Second
+
 func main() {
 	isReleaseBuild := buildMode == "release"
 	directory.IsReleaseBuild = isReleaseBuild
@@ -29,13 +39,56 @@ func main() {
 		Version:    version,
 		SDKVersion: sdkVersion,
 	}
-	ctx := commands.SetInfo(context.Background(), info)
+	ctx, cancel := context.WithCancel(commands.SetInfo(context.Background(), info))
+	defer cancel()
+
 	cmd := commands.JagCmd(info, isReleaseBuild)
-	if err := cmd.ExecuteContext(ctx); err != nil {
+	grace := shutdownGracePeriod
+	err := executeInterruptibly(ctx, cancel, cmd)
+	if errors.Is(err, errInterrupted) {
+		// The grace period is used up.
+		grace = 0
+	}
+	if shutdownErr := commands.Shutdown(grace); shutdownErr != nil {
+		fmt.Fprintln(os.Stderr, "Error:", shutdownErr)
+	}
+	if err != nil {
 		// The 'jag' command needs to have its "post run" function called
 		// even when we exit with an error. The cobra framework doesn't
 		// automatically call this, so we do it manually.
 		cmd.PersistentPostRun(cmd, cmd.Flags().Args())
-		os.Exit(1)
+		os.Exit(commands.ExitCode(err))
+	}
+}
+
+// errInterrupted is returned when the command doesn't stop after being
+// interrupted.
+var errInterrupted = errors.New("interrupted")
+
+// executeInterruptibly runs the command and cancels its context when we
+// are interrupted, so it gets a chance to stop gracefully. If the command
+// doesn't stop within the grace period, or if we are interrupted again,
+// errInterrupted is returned without waiting for the command any longer.
+func executeInterruptibly(ctx context.Context, cancel context.CancelFunc, cmd *cobra.Command) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.ExecuteContext(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-signals:
+		cancel()
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-signals:
+	case <-time.After(shutdownGracePeriod):
 	}
+	return errInterrupted
 }